@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// a single line input for the program's arguments. onDone is called with the
+// line, or ok false if the dialog was cancelled.
+func newArgsDialog(initial string, onDone func(line string, ok bool)) tview.Primitive {
+	input := tview.NewInputField().
+		SetLabel("Arguments: ").
+		SetText(initial)
+
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			onDone(input.GetText(), true)
+		} else if key == tcell.KeyEscape {
+			onDone("", false)
+		}
+	})
+
+	input.SetBorder(true).
+		SetTitle("Program arguments (argc/argv), applied on the next run")
+
+	// centre the dialog over the main layout
+	return tview.NewGrid().
+		SetColumns(0, 70, 0).
+		SetRows(0, 3, 0).
+		AddItem(input, 1, 1, 1, 1, 0, 0, true)
+}
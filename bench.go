@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// decodes and runs file over and over without the interface and prints how
+// fast it went, for "riscv_interpreter bench". Ctrl-C stops early and reports
+// the runs so far.
+func runBench(file string, config riscv.BenchmarkConfig, out io.Writer) error {
+	if file == "" {
+		return fmt.Errorf("bench needs a --file to run")
+	}
+
+	source, err := loadSource(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := riscv.Benchmark(ctx, source, config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, result)
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// writes the coverage of every hart to path, for --coverage
+func saveCoverage(machine *riscv.Machine, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := machine.Coverage().WriteJSON(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
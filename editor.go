@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// the instructions text area with the line about to execute highlighted and
+// lines that never ran dimmed. Lines don't wrap, so each source line is one
+// row.
+type sourceEditor struct {
+	*tview.TextArea
+	currentLine int // 1-based, 0 for none
+	// lines with instructions and whether they ran, nil to dim nothing
+	coverage map[int]bool
+}
+
+func newSourceEditor() *sourceEditor {
+	editor := &sourceEditor{TextArea: tview.NewTextArea()}
+	editor.SetWrap(false)
+	return editor
+}
+
+// highlights a line, 0 for none. A line that changed is scrolled into view,
+// so stepping follows the program without typing fighting the scroll.
+func (editor *sourceEditor) setCurrentLine(line int) {
+	if line == editor.currentLine {
+		return
+	}
+	editor.currentLine = line
+	if line == 0 {
+		return
+	}
+
+	_, _, _, height := editor.GetInnerRect()
+	row, column := editor.GetOffset()
+	if line-1 < row || line-1 >= row+height {
+		editor.SetOffset(max(line-1-height/2, 0), column)
+	}
+}
+
+func (editor *sourceEditor) setCoverage(coverage map[int]bool) {
+	editor.coverage = coverage
+}
+
+func (editor *sourceEditor) Draw(screen tcell.Screen) {
+	editor.TextArea.Draw(screen)
+	if editor.GetText() == "" {
+		return
+	}
+
+	x, y, width, height := editor.GetInnerRect()
+	row, _ := editor.GetOffset()
+	for screenY := y; screenY < y+height; screenY++ {
+		if ran, ok := editor.coverage[screenY-y+row+1]; !ok || ran {
+			continue
+		}
+		for screenX := x; screenX < x+width; screenX++ {
+			mainc, combc, style, _ := screen.GetContent(screenX, screenY)
+			screen.SetContent(screenX, screenY, mainc, combc, style.Foreground(tcell.ColorGray))
+		}
+	}
+
+	if editor.currentLine == 0 {
+		return
+	}
+	screenY := y + editor.currentLine - 1 - row
+	if screenY < y || screenY >= y+height {
+		return
+	}
+	for screenX := x; screenX < x+width; screenX++ {
+		mainc, combc, style, _ := screen.GetContent(screenX, screenY)
+		screen.SetContent(screenX, screenY, mainc, combc, style.Background(tcell.ColorDarkGreen))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const maxRecentFiles = 10
+
+func recentFilesPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "riscv_interpreter", "recent"), nil
+}
+
+func loadRecentFiles() []string {
+	path, err := recentFilesPath()
+	if err != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var recent []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			recent = append(recent, line)
+		}
+	}
+
+	return recent
+}
+
+// moves the file to the front of the recent list, best effort
+func rememberRecentFile(file string) {
+	if absolute, err := filepath.Abs(file); err == nil {
+		file = absolute
+	}
+
+	recent := slices.DeleteFunc(loadRecentFiles(), func(existing string) bool {
+		return existing == file
+	})
+	recent = append([]string{file}, recent...)
+	if len(recent) > maxRecentFiles {
+		recent = recent[:maxRecentFiles]
+	}
+
+	path, err := recentFilesPath()
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+
+	os.WriteFile(path, []byte(strings.Join(recent, "\n")+"\n"), 0o644)
+}
+
+// source is read and written verbatim so comments and blank lines round-trip
+func loadSource(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func saveSource(file string, source string) error {
+	return os.WriteFile(file, []byte(source), 0o644)
+}
+
+// path input with the recent files listed underneath. onDone is called with the
+// chosen path, or an empty path if the dialog was cancelled.
+func newFileDialog(app *tview.Application, title string, initial string, recent []string, onDone func(path string)) tview.Primitive {
+	input := tview.NewInputField().
+		SetLabel("Path: ").
+		SetText(initial)
+
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			onDone(strings.TrimSpace(input.GetText()))
+		} else if key == tcell.KeyEscape {
+			onDone("")
+		}
+	})
+
+	recentList := tview.NewList().
+		ShowSecondaryText(false)
+
+	for _, file := range recent {
+		recentList.AddItem(file, "", 0, func() {
+			onDone(file)
+		})
+	}
+
+	recentList.SetDoneFunc(func() {
+		onDone("")
+	})
+
+	recentList.SetBorder(true).
+		SetTitle("Recent (Tab)")
+
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyTab && recentList.GetItemCount() > 0 {
+			app.SetFocus(recentList)
+			return nil
+		}
+		return event
+	})
+
+	recentList.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyTab {
+			app.SetFocus(input)
+			return nil
+		}
+		return event
+	})
+
+	layout := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(input, 1, 0, true).
+		AddItem(recentList, 0, 1, false)
+
+	layout.SetBorder(true).
+		SetTitle(title)
+
+	// centre the dialog over the main layout
+	return tview.NewGrid().
+		SetColumns(0, 70, 0).
+		SetRows(0, 16, 0).
+		AddItem(layout, 1, 1, 1, 1, 0, 0, true)
+}
@@ -1,8 +1,9 @@
-module riscv_interpreter
+module github.com/ckashino/riscv_interpreter
 
 go 1.24.1
 
 require (
+	github.com/ckashino/riscv_interpreter/riscv v0.0.0
 	github.com/gdamore/tcell/v2 v2.7.1
 	github.com/rivo/tview v0.0.0-20241227133733-17b7edb88c57
 )
@@ -16,3 +17,7 @@ require (
 	golang.org/x/term v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
+
+// the interpreter core is its own module so it can be used without the
+// interface's dependencies
+replace github.com/ckashino/riscv_interpreter/riscv => ./riscv
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// runs file to the end without the interface and prints its check and
+// assertion results, for grading. What the program writes goes to console and
+// stderr.
+func runGrade(machine *riscv.Machine, file string, out, console, stderr io.Writer) (bool, error) {
+	if file == "" {
+		return false, fmt.Errorf("--grade needs a --file to run")
+	}
+
+	source, err := loadSource(file)
+	if err != nil {
+		return false, err
+	}
+
+	if _, _, err := machine.MapStandardDevices(); err != nil {
+		return false, err
+	}
+	attachProgramOutput(machine, console, stderr)
+
+	if seed, ok := machine.Harts[0].RandomSeed(); ok {
+		fmt.Fprintf(out, "random init seed %d\n", seed)
+	}
+
+	steps := exectute(context.Background(), machine, strings.Split(source, "\n"))
+
+	passed := true
+	for i, hart := range machine.Harts {
+		prefix := ""
+		if len(machine.Harts) > 1 {
+			prefix = fmt.Sprintf("hart %d: ", i)
+		}
+
+		for _, diagnostic := range hart.Diagnostics() {
+			fmt.Fprintf(out, "%s%s\n", prefix, diagnostic)
+			passed = false
+		}
+		for _, warning := range hart.StrictWarnings() {
+			fmt.Fprintf(out, "%swarning: %s\n", prefix, warning)
+		}
+		if err := hart.Err(); err != nil {
+			fmt.Fprintf(out, "%sstopped: %s\n", prefix, err)
+			passed = false
+		}
+		if code, ended := hart.ExitCode(); ended {
+			fmt.Fprintf(out, "%sexited with code %d (%s)\n", prefix, code, hart.Termination())
+		}
+		for _, result := range hart.CheckResults() {
+			fmt.Fprintf(out, "%s%s\n", prefix, result)
+			passed = passed && result.Passed()
+		}
+		for _, result := range hart.AssertionResults() {
+			fmt.Fprintf(out, "%s%s\n", prefix, result)
+			passed = passed && result.Passed()
+		}
+	}
+
+	fmt.Fprintf(out, "%d instructions\n", steps)
+	return passed, nil
+}
+
+// the console and stderr streams of every hart. The UART only writes to the
+// first hart's console.
+func attachProgramOutput(machine *riscv.Machine, console, stderr io.Writer) {
+	for _, hart := range machine.Harts {
+		hart.AttachSink(riscv.StreamConsole, console)
+		hart.AttachSink(riscv.StreamStderr, stderr)
+	}
+}
+
+// the status to exit with once the program passed grading: what it gave the
+// exit system call, truncated to a byte as a shell sees it, or 0. Programs
+// often leave a result in a0 when they return, so that isn't used.
+func programExitStatus(machine *riscv.Machine) int {
+	hart := machine.Harts[0]
+	code, ended := hart.ExitCode()
+	if !ended || hart.Termination() != riscv.TerminationExit {
+		return 0
+	}
+	return int(uint8(code))
+}
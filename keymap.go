@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// something the interface does from a key or the command palette
+type action struct {
+	name        string   // as it is bound in the keymap file
+	label       string   // in the controls bar, empty to leave it out
+	description string   // in the command palette
+	keys        []string // bound by default
+}
+
+var actions = []action{
+	{"step", "Step", "Step one instruction", []string{"Ctrl-N", "F10"}},
+	{"run", "Run/stop", "Run the program, or stop the run going on", []string{"Ctrl-R", "F5"}},
+	{"run-to-cursor", "Run to cursor", "Run until the line the cursor is on", []string{"Ctrl-G"}},
+	{"reset", "Reset", "Put every hart back at the entry point to run the program again", []string{"Alt-R"}},
+	{"watch", "Watch", "Go to the watch prompt", []string{"Ctrl-W"}},
+	{"debugger", "Debugger", "Go to the debugger prompt", []string{"Alt-D"}},
+	{"open", "Open", "Open a file", []string{"Ctrl-O"}},
+	{"save", "Save", "Save the file", []string{"Ctrl-S"}},
+	{"pipeline", "Pipeline", "Show or hide the pipeline model", []string{"Ctrl-P"}},
+	{"csrs", "CSRs", "Switch between registers and CSRs", []string{"Ctrl-T"}},
+	{"memory-view", "Memory view", "Switch between the registers and the memory view", []string{"Alt-M"}},
+	{"clear-memory-history", "", "Clear the loads and stores in the memory summary", nil},
+	{"coverage", "", "Dim the lines that haven't run, or stop dimming them", []string{"Alt-V"}},
+	{"clear-coverage", "", "Forget which lines have run", nil},
+	{"format", "Format", "Cycle values between decimal, hex, binary and unsigned", []string{"Alt-F"}},
+	{"next-hart", "Hart", "Show the next hart", []string{"Alt-H"}},
+	{"arguments", "Arguments", "Change the program's arguments", []string{"Alt-A"}},
+	{"back", "Back", "Go back to where the cursor was", []string{"Alt-Left"}},
+	{"forward", "Forward", "Go forward again", []string{"Alt-Right"}},
+	{"macro-record", "Macro record", "Start recording a macro", []string{"F3"}},
+	{"macro-play", "Macro stop/play", "Stop recording the macro, or play it", []string{"F4"}},
+	{"toggle-side", "", "Show or hide the memory summary, call stack and watches", nil},
+	{"toggle-bottom", "", "Show or hide the diagnostics, console and watches", nil},
+	{"toggle-controls", "", "Show or hide this bar of keys", nil},
+	{"palette", "Commands", "Search every command", []string{"F1"}},
+}
+
+func findAction(name string) (action, bool) {
+	index := slices.IndexFunc(actions, func(action action) bool { return action.name == name })
+	if index < 0 {
+		return action{}, false
+	}
+	return actions[index], true
+}
+
+// which action each key runs, by the key's name
+type keymap map[string]string
+
+func defaultKeymap() keymap {
+	keys := keymap{}
+	for _, action := range actions {
+		for _, key := range action.keys {
+			keys[key] = action.name
+		}
+	}
+	return keys
+}
+
+// binds the keys to the action instead of the keys it had. A key bound to
+// another action moves to this one.
+func (keys keymap) bind(name string, keyNames []string) error {
+	if _, ok := findAction(name); !ok {
+		return fmt.Errorf("unknown action: %s", name)
+	}
+
+	var parsed []string
+	for _, keyName := range keyNames {
+		key, err := parseKey(keyName)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, key)
+	}
+
+	for key, bound := range keys {
+		if bound == name {
+			delete(keys, key)
+		}
+	}
+	for _, key := range parsed {
+		keys[key] = name
+	}
+	return nil
+}
+
+// the keys bound to an action, sorted
+func (keys keymap) keysFor(name string) []string {
+	var bound []string
+	for key, action := range keys {
+		if action == name {
+			bound = append(bound, key)
+		}
+	}
+	slices.Sort(bound)
+	return bound
+}
+
+func (keys keymap) lookup(event *tcell.EventKey) (string, bool) {
+	name, ok := keys[keyName(event)]
+	return name, ok
+}
+
+// how to run an action, for messages: its first key, or its name in the
+// palette when it has none
+func (keys keymap) hint(name string) string {
+	if bound := keys.keysFor(name); len(bound) > 0 {
+		return bound[0]
+	}
+	if palette := keys.keysFor("palette"); len(palette) > 0 {
+		return fmt.Sprintf("%q from %s", name, palette[0])
+	}
+	return fmt.Sprintf("%q (unbound)", name)
+}
+
+// "Step: Ctrl-N, F10   Run/stop: Ctrl-R, F5 ..." for the controls bar
+func (keys keymap) controls() string {
+	var parts []string
+	for _, action := range actions {
+		if bound := keys.keysFor(action.name); action.label != "" && len(bound) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", action.label, strings.Join(bound, ", ")))
+		}
+	}
+	return strings.Join(parts, "\t")
+}
+
+// the name a key is bound by, e.g. "Ctrl-R", "Alt-M", "F3" or "Alt-Left"
+func keyName(event *tcell.EventKey) string {
+	modifiers := event.Modifiers()
+	if event.Key() == tcell.KeyRune {
+		return withModifiers(string(unicode.ToUpper(event.Rune())), modifiers&tcell.ModAlt != 0, false, false)
+	}
+	return withModifiers(tcell.KeyNames[event.Key()], modifiers&tcell.ModAlt != 0, modifiers&tcell.ModCtrl != 0, modifiers&tcell.ModShift != 0)
+}
+
+// e.g. "Alt-Ctrl-Shift-Left". Control keys are named "Ctrl-R" already.
+func withModifiers(name string, alt, ctrl, shift bool) string {
+	if shift {
+		name = "Shift-" + name
+	}
+	if ctrl && !strings.HasPrefix(name, "Ctrl-") {
+		name = "Ctrl-" + name
+	}
+	if alt {
+		name = "Alt-" + name
+	}
+	return name
+}
+
+// the name of a key written as e.g. "ctrl-r", "C-r", "alt+m", "M-m" or "f5"
+func parseKey(text string) (string, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '-' || r == '+' })
+	if len(fields) == 0 {
+		return "", fmt.Errorf("invalid key: %q", text)
+	}
+
+	var alt, ctrl, shift bool
+	for _, modifier := range fields[:len(fields)-1] {
+		switch strings.ToLower(modifier) {
+		case "alt", "meta", "m":
+			alt = true
+		case "ctrl", "c":
+			ctrl = true
+		case "shift", "s":
+			shift = true
+		default:
+			return "", fmt.Errorf("invalid key: %q", text)
+		}
+	}
+
+	key := fields[len(fields)-1]
+	var name string
+	switch {
+	case utf8.RuneCountInString(key) == 1 && shift:
+		return "", fmt.Errorf("invalid key: %q, shifted letters can't be told apart", text)
+	case utf8.RuneCountInString(key) == 1 && ctrl:
+		name, ctrl = "Ctrl-"+strings.ToUpper(key), false
+	case utf8.RuneCountInString(key) == 1 && !alt:
+		return "", fmt.Errorf("%s would be typed into the editor, bind it with Alt or Ctrl", text)
+	case utf8.RuneCountInString(key) == 1:
+		return withModifiers(strings.ToUpper(key), alt, false, false), nil
+	case ctrl && namedKey("Ctrl-"+key) != "":
+		name, ctrl = namedKey("Ctrl-"+key), false
+	default:
+		name = namedKey(key)
+	}
+	if namedKey(name) == "" {
+		return "", fmt.Errorf("invalid key: %q", text)
+	}
+
+	return withModifiers(name, alt, ctrl, shift), nil
+}
+
+// tcell's name for a key, matched without case, or "" if it has none
+func namedKey(name string) string {
+	for _, known := range tcell.KeyNames {
+		if strings.EqualFold(known, name) {
+			return known
+		}
+	}
+	return ""
+}
+
+func keymapPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "riscv_interpreter", "keys"), nil
+}
+
+// the default keymap with the bindings in path applied, one "action key..."
+// per line. An action listed without keys is unbound. A missing file leaves
+// the defaults.
+func loadKeymap(path string) (keymap, error) {
+	keys := defaultKeymap()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(stripKeymapComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if err := keys.bind(fields[0], fields[1:]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+func stripKeymapComment(line string) string {
+	line, _, _ = strings.Cut(line, "#")
+	return line
+}
+
+// writes every action with its keys, so the file lists everything that can
+// be bound
+func saveKeymap(path string, keys keymap) error {
+	var builder strings.Builder
+	builder.WriteString("# action key...\n")
+	for _, action := range actions {
+		fmt.Fprintf(&builder, "%-22s %s\n", action.name, strings.Join(keys.keysFor(action.name), " "))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(builder.String()), 0o644)
+}
+
+// "bind <action> [key...]" changes an action's keys and saves the keymap.
+// Returns what to tell the user.
+func parseBindCommand(command string, keys keymap, path string) (string, bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || fields[0] != "bind" {
+		return "", false
+	}
+	if len(fields) < 2 {
+		return "usage: bind <action> [key...]", true
+	}
+
+	if err := keys.bind(fields[1], fields[2:]); err != nil {
+		return err.Error(), true
+	}
+	if err := saveKeymap(path, keys); err != nil {
+		return err.Error(), true
+	}
+	if len(fields) == 2 {
+		return fmt.Sprintf("%s unbound", fields[1]), true
+	}
+	return fmt.Sprintf("%s bound to %s", fields[1], strings.Join(keys.keysFor(fields[1]), ", ")), true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestParseKey(t *testing.T) {
+	cases := map[string]string{
+		"ctrl-r":         "Ctrl-R",
+		"C-r":            "Ctrl-R",
+		"alt+m":          "Alt-M",
+		"M-m":            "Alt-M",
+		"f5":             "F5",
+		"alt-left":       "Alt-Left",
+		"ctrl-shift-end": "Ctrl-Shift-End",
+		"Enter":          "Enter",
+	}
+	for text, expected := range cases {
+		if name, err := parseKey(text); err != nil || name != expected {
+			t.Errorf("Parse key %q fail. actual %q %v", text, name, err)
+		}
+	}
+
+	for _, text := range []string{"", "-", "hyper-x", "shift-a", "r", "alt-nokey"} {
+		if name, err := parseKey(text); err == nil {
+			t.Errorf("Parse bad key %q fail. actual %q", text, name)
+		}
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	cases := []struct {
+		event    *tcell.EventKey
+		expected string
+	}{
+		{tcell.NewEventKey(tcell.KeyCtrlR, 0, tcell.ModCtrl), "Ctrl-R"},
+		{tcell.NewEventKey(tcell.KeyRune, 'm', tcell.ModAlt), "Alt-M"},
+		{tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModAlt), "Alt-Left"},
+		{tcell.NewEventKey(tcell.KeyF5, 0, tcell.ModNone), "F5"},
+	}
+	for _, c := range cases {
+		name := keyName(c.event)
+		if name != c.expected {
+			t.Errorf("Key name fail. actual %q expected %q", name, c.expected)
+		}
+		// the names the keymap file uses are the names keys get
+		if parsed, err := parseKey(name); err != nil || parsed != name {
+			t.Errorf("Key name round trip %q fail. actual %q %v", name, parsed, err)
+		}
+	}
+}
+
+func TestKeymapBind(t *testing.T) {
+	keys := defaultKeymap()
+
+	// no key is bound to two actions by default
+	for _, action := range actions {
+		for _, key := range action.keys {
+			if keys[key] != action.name {
+				t.Errorf("Default key %s fail. actual %s expected %s", key, keys[key], action.name)
+			}
+		}
+	}
+
+	if name, ok := keys.lookup(tcell.NewEventKey(tcell.KeyF10, 0, tcell.ModNone)); !ok || name != "step" {
+		t.Errorf("Keymap lookup fail. actual %q %v", name, ok)
+	}
+
+	if err := keys.bind("step", []string{"f6"}); err != nil || !slices.Equal(keys.keysFor("step"), []string{"F6"}) {
+		t.Errorf("Keymap bind fail. actual %v %v", keys.keysFor("step"), err)
+	}
+	if _, ok := keys["Ctrl-N"]; ok {
+		t.Error("Keymap rebind fail, Ctrl-N still bound")
+	}
+
+	// a key bound to another action moves to it
+	if err := keys.bind("run", []string{"F6", "F6"}); err != nil || len(keys.keysFor("step")) != 0 || !slices.Equal(keys.keysFor("run"), []string{"F6"}) {
+		t.Errorf("Keymap duplicate bind fail. actual %v %v %v", keys.keysFor("step"), keys.keysFor("run"), err)
+	}
+
+	before := maps.Clone(keys)
+	if err := keys.bind("nope", []string{"F7"}); err == nil || err.Error() != "unknown action: nope" {
+		t.Errorf("Keymap unknown action fail. actual %v", err)
+	}
+	if err := keys.bind("run", []string{"F7", "hyper-x"}); err == nil || !maps.Equal(keys, before) {
+		t.Errorf("Keymap unknown key fail. actual %v %v", keys.keysFor("run"), err)
+	}
+
+	if hint := keys.hint("step"); hint != `"step" from F1` {
+		t.Errorf("Keymap hint fail. actual %s", hint)
+	}
+}
+
+func TestLoadKeymap(t *testing.T) {
+	dir := t.TempDir()
+
+	keys, err := loadKeymap(filepath.Join(dir, "missing"))
+	if err != nil || !maps.Equal(keys, defaultKeymap()) {
+		t.Errorf("Load missing keymap fail. actual %v", err)
+	}
+
+	path := filepath.Join(dir, "keys")
+	os.WriteFile(path, []byte("# my keys\nstep f6 ctrl-n # both\n\ncoverage\n"), 0o644)
+	keys, err = loadKeymap(path)
+	if err != nil || !slices.Equal(keys.keysFor("step"), []string{"Ctrl-N", "F6"}) || len(keys.keysFor("coverage")) != 0 {
+		t.Errorf("Load keymap fail. actual %v %v %v", keys.keysFor("step"), keys.keysFor("coverage"), err)
+	}
+
+	// saving writes every action, so loading it back gives the same keymap
+	if err := saveKeymap(path, keys); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := loadKeymap(path); err != nil || !maps.Equal(loaded, keys) {
+		t.Errorf("Save keymap fail. actual %v", err)
+	}
+
+	os.WriteFile(path, []byte("step f6\nfly alt-f\n"), 0o644)
+	if _, err := loadKeymap(path); err == nil || err.Error() != path+":2: unknown action: fly" {
+		t.Errorf("Load bad keymap fail. actual %v", err)
+	}
+}
+
+func TestParseBindCommand(t *testing.T) {
+	keys := defaultKeymap()
+	path := filepath.Join(t.TempDir(), "riscv_interpreter", "keys")
+
+	cases := []struct {
+		command  string
+		expected string
+	}{
+		{"bind", "usage: bind <action> [key...]"},
+		{"bind step f6 alt-n", "step bound to Alt-N, F6"},
+		{"bind coverage", "coverage unbound"},
+		{"bind fly alt-f", "unknown action: fly"},
+		{"bind step n", "n would be typed into the editor, bind it with Alt or Ctrl"},
+	}
+	for _, c := range cases {
+		if message, ok := parseBindCommand(c.command, keys, path); !ok || message != c.expected {
+			t.Errorf("Bind command %q fail. actual %q", c.command, message)
+		}
+	}
+
+	if _, ok := parseBindCommand("step", keys, path); ok {
+		t.Error("Bind command other fail")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "step                   Alt-N F6\n") {
+		t.Errorf("Bind command save fail. actual %q %v", data, err)
+	}
+}
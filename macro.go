@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// recorded keystrokes, e.g. step, inspect a watch, step, so repetitive
+// stepping through long loops can be replayed with one key
+type keyMacro struct {
+	recording bool
+	replaying bool
+	keys      []*tcell.EventKey
+}
+
+func (macro *keyMacro) start() {
+	macro.recording = true
+	macro.keys = nil
+}
+
+func (macro *keyMacro) stop() {
+	macro.recording = false
+}
+
+func (macro *keyMacro) record(event *tcell.EventKey) {
+	if macro.recording {
+		macro.keys = append(macro.keys, event)
+	}
+}
+
+// replays the macro up to times passes, stopping early once stopped reports
+// the program needs attention. returns the number of passes made
+func (macro *keyMacro) replay(times int, dispatch func(*tcell.EventKey), stopped func() bool) int {
+	// a macro that replays itself would never finish
+	if macro.recording || macro.replaying || len(macro.keys) == 0 {
+		return 0
+	}
+
+	macro.replaying = true
+	defer func() { macro.replaying = false }()
+
+	passes := 0
+	for passes < times && !stopped() {
+		for _, event := range macro.keys {
+			dispatch(event)
+		}
+		passes++
+	}
+	return passes
+}
+
+// "macro <n>" replays the macro n times
+func parseMacroCommand(command string) (int, bool) {
+	timesStr, found := strings.CutPrefix(strings.TrimSpace(command), "macro ")
+	if !found {
+		return 0, false
+	}
+
+	times, err := strconv.Atoi(strings.TrimSpace(timesStr))
+	if err != nil || times < 1 {
+		return 0, false
+	}
+	return times, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestParseMacroCommand(t *testing.T) {
+	cases := map[string]int{
+		"macro 3":      3,
+		"  macro 12  ": 12,
+		"macro  1":     1,
+	}
+	for command, expected := range cases {
+		if times, ok := parseMacroCommand(command); !ok || times != expected {
+			t.Errorf("Macro command %q fail. actual %d %v", command, times, ok)
+		}
+	}
+
+	for _, command := range []string{"macro", "macro 0", "macro -2", "macro x", "macros 3", "step"} {
+		if times, ok := parseMacroCommand(command); ok {
+			t.Errorf("Macro bad command %q fail. actual %d", command, times)
+		}
+	}
+}
+
+func TestKeyMacro(t *testing.T) {
+	step := tcell.NewEventKey(tcell.KeyCtrlN, 0, tcell.ModCtrl)
+	watch := tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModCtrl)
+
+	var macro keyMacro
+	macro.record(step)
+	if len(macro.keys) != 0 {
+		t.Errorf("Macro record while stopped fail. actual %d keys", len(macro.keys))
+	}
+
+	macro.start()
+	macro.record(step)
+	macro.record(watch)
+
+	var dispatched []string
+	dispatch := func(event *tcell.EventKey) { dispatched = append(dispatched, keyName(event)) }
+	never := func() bool { return false }
+
+	// replaying while recording would record the replay
+	if passes := macro.replay(2, dispatch, never); passes != 0 || len(dispatched) != 0 {
+		t.Errorf("Macro replay while recording fail. actual %d", passes)
+	}
+
+	macro.stop()
+	if passes := macro.replay(2, dispatch, never); passes != 2 || len(dispatched) != 4 || dispatched[2] != "Ctrl-N" || dispatched[3] != "Ctrl-W" {
+		t.Errorf("Macro replay fail. actual %d %v", passes, dispatched)
+	}
+
+	// a breakpoint or the end of the program stops the passes early
+	dispatched = nil
+	if passes := macro.replay(5, dispatch, func() bool { return len(dispatched) >= 6 }); passes != 3 {
+		t.Errorf("Macro replay stop fail. actual %d", passes)
+	}
+
+	// a macro that plays itself doesn't recurse
+	nested := -1
+	macro.replay(1, func(*tcell.EventKey) { nested = macro.replay(1, dispatch, never) }, never)
+	if nested != 0 || macro.replaying {
+		t.Errorf("Macro nested replay fail. actual %d %v", nested, macro.replaying)
+	}
+
+	macro.start()
+	macro.stop()
+	if passes := macro.replay(1, dispatch, never); passes != 0 {
+		t.Errorf("Macro empty replay fail. actual %d", passes)
+	}
+}
@@ -1,107 +1,809 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"riscv_interpreter/riscv"
+	"io"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ckashino/riscv_interpreter/riscv"
+	"github.com/ckashino/riscv_interpreter/riscv/debug"
+	"github.com/ckashino/riscv_interpreter/riscv/format"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-var registerToABI = map[int]string{
-	0:  "zero",
-	1:  "ra",
-	2:  "sp",
-	3:  "gp",
-	4:  "tp",
-	5:  "t0",
-	6:  "t1",
-	7:  "t2",
-	8:  "fp",
-	9:  "s1",
-	10: "a0",
-	11: "a1",
-	12: "a2",
-	13: "a3",
-	14: "a4",
-	15: "a5",
-	16: "a6",
-	17: "a7",
-	18: "s2",
-	19: "s3",
-	20: "s4",
-	21: "s5",
-	22: "s6",
-	23: "s7",
-	24: "s8",
-	25: "s9",
-	26: "s10",
-	27: "s11",
-	28: "t3",
-	29: "t4",
-	30: "t5",
-	31: "t6",
-}
-
-func updateRegisterText(cpu *riscv.CPU, registerText *tview.TextView) {
+// how many writes to each register the history page shows
+const registerHistoryDepth = 16
+
+// registers that differ from previous are highlighted
+func updateRegisterText(cpu *riscv.CPU, registerText *tview.TextView, showCSRs bool, previous [32]int32, mode format.Mode) {
 	var builder strings.Builder
-	for i, reg := range cpu.Registers {
-		builder.WriteString(fmt.Sprintf("x%d (%s): %d\n", i, registerToABI[i], reg))
+
+	if showCSRs {
+		for _, csr := range riscv.CSRList {
+			builder.WriteString(fmt.Sprintf("%s (0x%03x): %s\n", csr.Name, csr.Address, format.Word(cpu.ReadCSR(csr.Address), mode)))
+		}
+
+		registerText.SetText(builder.String())
+		return
+	}
+
+	state := cpu.GetState()
+	names := cpu.Arch.RegisterNames()
+	for i, reg := range state.Registers {
+		if reg != previous[i] {
+			builder.WriteString(fmt.Sprintf("[yellow]x%d (%s): %s[-]\n", i, names[i], format.Word(reg, mode)))
+		} else {
+			builder.WriteString(fmt.Sprintf("x%d (%s): %s\n", i, names[i], format.Word(reg, mode)))
+		}
 	}
 
-	builder.WriteString(fmt.Sprintf("\nPC: %d", cpu.PC))
+	builder.WriteString(fmt.Sprintf("\nPC: %s", format.Word(int32(state.PC), mode)))
 
 	registerText.SetText(builder.String())
 }
 
-func updateMemHist(cpu *riscv.CPU, memoryText *tview.TextView) {
+func updateRegisterHistory(cpu *riscv.CPU, register int, historyText *tview.TextView, mode format.Mode) {
+	historyText.SetTitle(fmt.Sprintf("History of x%d (%s)", register, cpu.Arch.RegisterNames()[register]))
+
+	var builder strings.Builder
+	for _, change := range cpu.RegisterHistory(register) {
+		source := change.Instruction
+		if source == "" {
+			source = "(set)"
+		}
+		builder.WriteString(fmt.Sprintf("0x%04x %-24s %s -> %s\n", change.PC, tview.Escape(source), format.Word(change.Old, mode), format.Word(change.New, mode)))
+	}
+
+	historyText.SetText(builder.String())
+}
+
+// address, size and source of every instruction, so compressed instructions
+// stand out
+func updateListing(cpu *riscv.CPU, listingText *tview.TextView) {
+	var builder strings.Builder
+	for _, entry := range cpu.Listing() {
+		builder.WriteString(fmt.Sprintf("0x%04x %d %4d  %s\n", entry.Address, entry.Size, entry.Line, tview.Escape(entry.Source)))
+	}
+	listingText.SetText(builder.String())
+}
+
+// every label with its address, kind, definition and uses
+func updateSymbols(cpu *riscv.CPU, symbolsText *tview.TextView) {
+	var builder strings.Builder
+	for _, symbol := range cpu.Symbols() {
+		uses := make([]string, len(symbol.References))
+		for i, line := range symbol.References {
+			uses[i] = strconv.Itoa(line)
+		}
+		builder.WriteString(fmt.Sprintf("%-16s 0x%04x %s %4d  %s\n", tview.Escape(symbol.Name), symbol.Address, symbol.Kind, symbol.Line, strings.Join(uses, ", ")))
+	}
+	symbolsText.SetText(builder.String())
+}
+
+// "history <register>" shows the last values written to a register
+func parseHistoryCommand(cpu *riscv.CPU, command string) (int, bool) {
+	name, found := strings.CutPrefix(strings.TrimSpace(command), "history ")
+	if !found {
+		return 0, false
+	}
+	return cpu.Arch.RegisterNumber(strings.TrimSpace(name))
+}
+
+// collects the lines written to it, newest first
+func updateMemHist(cpu *riscv.CPU, view memHistoryView, memoryText *tview.TextView) {
 	var builder strings.Builder
-	for _, operation := range cpu.MemoryHistory {
-		builder.WriteString(operation)
+
+	if cache := cpu.Cache(); cache != nil {
+		cfg := cache.Config
+		builder.WriteString(fmt.Sprintf("Cache %dB %d-way %dB blocks %s\n", cfg.Size, cfg.Associativity, cfg.BlockSize, cfg.WritePolicy))
+		builder.WriteString(cache.Stats.String())
+		builder.WriteString("\n\n")
+	}
+
+	regions := cpu.MemoryRegions()
+	for _, region := range regions {
+		builder.WriteString(fmt.Sprintf("[gray]%-5s[-] 0x%04x-0x%04x\n", region.Name, region.Start, region.End))
+	}
+	if len(regions) > 0 {
+		builder.WriteString("\n")
+	}
+
+	dataSymbols := cpu.DataSymbols()
+	for _, symbol := range dataSymbols {
+		builder.WriteString(fmt.Sprintf("[gray]0x%04x[-] %s\n", symbol.Address, tview.Escape(symbol.Describe())))
+	}
+	if len(dataSymbols) > 0 {
+		builder.WriteString("\n")
+	}
+
+	bookmarks := cpu.Bookmarks()
+	for _, bookmark := range bookmarks {
+		builder.WriteString(fmt.Sprintf("[%s]%s[-]: %d-%d\n", bookmark.Color, tview.Escape(bookmark.Name), bookmark.Start, bookmark.End))
+	}
+	if len(bookmarks) > 0 {
+		builder.WriteString("\n")
+	}
+
+	results := cpu.CheckResults()
+	for _, result := range results {
+		color := "green"
+		if !result.Passed() {
+			color = "red"
+		}
+		builder.WriteString(fmt.Sprintf("[%s]%s[-]\n", color, tview.Escape(result.String())))
+	}
+	assertions := cpu.AssertionResults()
+	for _, result := range assertions {
+		color := "green"
+		if !result.Passed() {
+			color = "red"
+		}
+		builder.WriteString(fmt.Sprintf("[%s]%s[-]\n", color, tview.Escape(result.String())))
+	}
+	if len(results) > 0 || len(assertions) > 0 {
+		builder.WriteString("\n")
+	}
+
+	if heading := view.String(); heading != "" {
+		builder.WriteString(fmt.Sprintf("[gray]%s[-]\n", tview.Escape(heading)))
+	}
+	for _, op := range view.ops(cpu) {
+		builder.WriteString(tview.Escape(cpu.DescribeMemOp(op)))
 		builder.WriteString("\n")
 	}
+	if dropped := cpu.MemoryHistoryDropped(); dropped > 0 {
+		builder.WriteString(fmt.Sprintf("[gray]%d older loads and stores dropped, keep more with --memory-history[-]\n", dropped))
+	}
 
 	memoryText.SetText(builder.String())
 }
 
-func exectute(cpu *riscv.CPU, instrs []string) {
-	cpu.LoadInstructions(instrs)
-	cpu.RunProgram()
+func updateCallStack(cpu *riscv.CPU, callStackText *tview.TextView) {
+	var builder strings.Builder
+	for _, frame := range cpu.CallStack() {
+		builder.WriteString(frame.String())
+		builder.WriteString("\n")
+	}
+
+	callStackText.SetText(builder.String())
+}
+
+func updateDiagnostics(cpu *riscv.CPU, diagnosticsText *tview.TextView, keys keymap) {
+	var builder strings.Builder
+	builder.WriteString(cpu.Stats().String())
+	builder.WriteString("\n")
+
+	if err := cpu.Err(); err == riscv.ErrStepLimit || err == riscv.ErrCanceled {
+		builder.WriteString(fmt.Sprintf("%s, continue with %s\n", err, keys.hint("run")))
+	} else if err != nil {
+		builder.WriteString(fmt.Sprintf("runtime error: %s\n", err))
+	}
+
+	if cpu.AtBreakpoint() {
+		builder.WriteString(fmt.Sprintf("stopped at ebreak, step with %s or continue with %s\n", keys.hint("step"), keys.hint("run")))
+	}
+	if cpu.PausedAtBreakpoint() {
+		builder.WriteString(fmt.Sprintf("paused at a breakpoint, step with %s or continue with %s\n", keys.hint("step"), keys.hint("run")))
+	}
+
+	if code, ended := cpu.ExitCode(); ended {
+		builder.WriteString(fmt.Sprintf("exited with code %d (%s), reset with %s to run it again\n", code, cpu.Termination(), keys.hint("reset")))
+	}
+
+	if coverage := cpu.Coverage(); coverage.Executed > 0 {
+		builder.WriteString(fmt.Sprintf("coverage: %d of %d instructions run, %d of %d branches both ways\n",
+			coverage.Executed, coverage.Instructions, coverage.BothWays, coverage.Branches))
+	}
+
+	if seed, ok := cpu.RandomSeed(); ok {
+		builder.WriteString(fmt.Sprintf("registers and memory started random, rerun with --init-seed %d\n", seed))
+	}
+
+	for _, diagnostic := range cpu.Diagnostics() {
+		builder.WriteString(diagnostic.String())
+		builder.WriteString("\n")
+	}
+
+	for _, warning := range cpu.StrictWarnings() {
+		builder.WriteString(fmt.Sprintf("warning: %s\n", warning))
+	}
+
+	if stack := cpu.StackReport(); stack.Top != 0 {
+		builder.WriteString(stack.String())
+		builder.WriteString("\n")
+		for _, warning := range stack.Warnings {
+			builder.WriteString(fmt.Sprintf("warning: %s\n", warning))
+		}
+	}
+
+	diagnosticsText.SetText(builder.String())
+}
+
+func updateWatches(cpu *riscv.CPU, watchText *tview.TextView, message string) {
+	var builder strings.Builder
+	for _, watch := range cpu.Watches() {
+		builder.WriteString(fmt.Sprintf("%d: %s\n", watch.ID, watch.Expression))
+	}
+
+	for _, hit := range cpu.WatchHits() {
+		builder.WriteString(hit.String())
+		builder.WriteString("\n")
+	}
+
+	if message != "" {
+		builder.WriteString(message)
+	}
+
+	watchText.SetText(builder.String())
+}
+
+type memoryView struct {
+	region      string
+	disassemble bool
 }
 
-func step(cpu *riscv.CPU, instrs []string) {
-	cpu.LoadInstructions(instrs)
-	if !(cpu.Done) {
-		cpu.RunNextInstruction()
+// "x <region>" shows a region as hex and "dis <region>" as instructions
+func parseMemoryView(command string) (memoryView, bool) {
+	fields := strings.Fields(command)
+	if len(fields) != 2 {
+		return memoryView{}, false
+	}
+
+	switch fields[0] {
+	case "x":
+		return memoryView{region: fields[1]}, true
+	case "dis":
+		return memoryView{region: fields[1], disassemble: true}, true
 	}
+	return memoryView{}, false
+}
+
+func updateMemoryView(cpu *riscv.CPU, view memoryView, memoryViewText *tview.TextView, mode format.Mode) {
+	if view.region == "" {
+		memoryViewText.SetText("")
+		return
+	}
+
+	start, end, err := cpu.ResolveRange(view.region)
+	var lines []string
+	if err == nil {
+		if view.disassemble {
+			lines, err = cpu.DisassembleRange(start, end)
+		} else {
+			lines, err = cpu.Dump(start, end, mode)
+		}
+	}
+	if err != nil {
+		memoryViewText.SetText(err.Error())
+		return
+	}
+
+	memoryViewText.SetText(strings.Join(lines, "\n"))
+}
+
+// "<expression>" adds a watch and "delete <id>" removes one
+func watchCommand(cpu *riscv.CPU, command string) string {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return ""
+	}
+
+	if idStr, found := strings.CutPrefix(command, "delete "); found {
+		id, err := strconv.Atoi(strings.TrimSpace(idStr))
+		if err != nil {
+			return fmt.Sprintf("invalid watch id: %s", idStr)
+		}
+		if err := cpu.RemoveWatch(id); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	if _, err := cpu.AddWatch(command); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// the debugger command that does the same as a watchCommand
+func watchDebugCommand(command string) string {
+	command = strings.TrimSpace(command)
+	if id, found := strings.CutPrefix(command, "delete "); found {
+		return "unwatch " + strings.TrimSpace(id)
+	}
+	if command == "" {
+		return ""
+	}
+	return "watch " + command
+}
+
+func updatePipeline(cpu *riscv.CPU, pipelineText *tview.TextView) {
+	pipeline := cpu.Pipeline()
+	if pipeline == nil {
+		pipelineText.SetText("")
+		return
+	}
+
+	var builder strings.Builder
+
+	cycle := pipeline.Cycle()
+	builder.WriteString(fmt.Sprintf("Cycle %d\n", cycle))
+	for stage, entry := range pipeline.Occupancy(cycle) {
+		text := "-"
+		if entry != nil {
+			text = entry.Text
+		}
+		builder.WriteString(fmt.Sprintf("%-4s %s\n", riscv.StageNames[stage], text))
+	}
+
+	builder.WriteString("\n")
+	builder.WriteString(pipeline.Diagram(8))
+
+	builder.WriteString(fmt.Sprintf("\n%d instructions, %d cycles, CPI %.2f\n", pipeline.Instructions, pipeline.Cycles(), pipeline.CPI()))
+	builder.WriteString(fmt.Sprintf("%d stalls, %d flushes\n\n", pipeline.Stalls, pipeline.Flushes))
+
+	if predictor := cpu.BranchPredictor(); predictor != nil {
+		builder.WriteString(predictor.String())
+		builder.WriteString("\n")
+	}
+
+	for i := len(pipeline.Hazards) - 1; i >= 0; i-- {
+		builder.WriteString(pipeline.Hazards[i].String())
+		builder.WriteString("\n")
+	}
+
+	pipelineText.SetText(builder.String())
+}
+
+func exectute(ctx context.Context, machine *riscv.Machine, instrs []string) uint64 {
+	machine.LoadInstructions(instrs)
+	if len(machine.Harts) == 1 {
+		// a lone hart keeps the cpu's own run semantics, sandbox limits included
+		return machine.Harts[0].RunContext(ctx)
+	}
+	return machine.RunContext(ctx)
+}
+
+// runs until the pc gets to the first instruction on or after a line
+func runUntilLine(ctx context.Context, machine *riscv.Machine, instrs []string, line int) (uint64, error) {
+	machine.LoadInstructions(instrs)
+	address, ok := instructionFrom(machine.Harts[0], line, len(instrs))
+	if !ok {
+		return 0, fmt.Errorf("no instruction on or after line %d", line)
+	}
+	if len(machine.Harts) == 1 {
+		return machine.Harts[0].RunUntilContext(ctx, address)
+	}
+	return machine.RunUntilContext(ctx, address)
+}
+
+func step(machine *riscv.Machine, instrs []string) {
+	machine.LoadInstructions(instrs)
+	machine.Step()
 }
 
 func main() {
-	cpu := riscv.NewCPU(1024 * 10)
+	file := flag.String("file", "", "assembly file to open on startup")
+	cacheEnabled := flag.Bool("cache", false, "simulate a data cache")
+	cacheSize := flag.Uint("cache-size", uint(riscv.DefaultCacheConfig.Size), "data cache size in bytes")
+	cacheAssoc := flag.Uint("cache-assoc", uint(riscv.DefaultCacheConfig.Associativity), "data cache associativity")
+	cacheBlock := flag.Uint("cache-block", uint(riscv.DefaultCacheConfig.BlockSize), "data cache block size in bytes")
+	cachePolicy := flag.String("cache-policy", "wb", "data cache write policy (wb or wt)")
+	cachePenalty := flag.Int("cache-miss-penalty", riscv.DefaultCacheConfig.MissPenalty, "data cache miss penalty in cycles")
+	predictorName := flag.String("predictor", "", "simulate a branch predictor (static, 1-bit, 2-bit or gshare)")
+	predictorEntries := flag.Uint("predictor-entries", riscv.DefaultPredictorEntries, "branch predictor table entries")
+	sandboxed := flag.Bool("sandbox", false, "limit steps and source size and disable host file checks")
+	hartCount := flag.Int("harts", 1, "number of harts sharing memory")
+	schedule := flag.String("schedule", "rr", "how harts are interleaved (rr or random)")
+	seed := flag.Int64("seed", 1, "seed for the random schedule")
+	traceFile := flag.String("trace", "", "write every executed instruction to this file")
+	traceFormat := flag.String("trace-format", "json", "trace file format (json, csv or spike)")
+	maxSteps := flag.Uint64("max-steps", 10_000_000, "instructions per run before it stops, 0 for no limit")
+	programArgs := flag.String("args", "", "arguments passed to the program in a0 (argc) and a1 (argv), quoted like a shell")
+	memoryMap := flag.String("memory-map", "", "lay memory out in text, data, heap and stack segments and fault outside them: default, or e.g. text=0x400,stack-size=4096")
+	randomInit := flag.Bool("random-init", false, "start registers and memory out as random garbage instead of zeros")
+	initSeed := flag.Int64("init-seed", 0, "seed for --random-init, 0 picks one and shows it")
+	bigEndian := flag.Bool("big-endian", false, "store data in memory most significant byte first")
+	allowMisaligned := flag.Bool("allow-misaligned", false, "let loads and stores at misaligned addresses work instead of raising an exception")
+	memoryHistory := flag.Int("memory-history", riscv.DefaultMemoryHistoryDepth, "loads and stores to remember for the memory summary")
+	strict := flag.Bool("strict", false, "warn when a program relies on the interpreter behaving differently from hardware")
+	grade := flag.Bool("grade", false, "run the --file program without the interface, report its checks and assertions and exit 1 if any fail")
+	repl := flag.Bool("repl", false, "read debugger commands from stdin instead of starting the interface")
+	coverageFile := flag.String("coverage", "", "write which instructions ran and which branches went both ways to this file as JSON on exit")
+	recordFile := flag.String("record", "", "record the session of the interface or --repl to this file")
+	replayFile := flag.String("replay", "", "replay a recorded session without the interface, print it as an annotated transcript and exit 1 if anything went differently")
+	stdinFile := flag.String("stdin", "", "file the program reads with the read system call")
+	stdoutFile := flag.String("stdout", "", "file the program's output goes to, keeping it apart from --grade and --repl output")
+	keysFile := flag.String("keys", "", "key bindings file, by default keys in the user config directory")
+	displayFormat := flag.String("format", "decimal", "how register and memory values are shown (decimal, hex, binary or unsigned)")
+	port := flag.Int("port", 8080, "port serve listens on")
+	allowOrigin := flag.String("allow-origin", "", "origin of a web page allowed to call serve's API, * for any")
+	iterations := flag.Int("iterations", 0, "runs of the program bench times, at least one")
+	benchTime := flag.Duration("bench-time", time.Second, "how long bench keeps running the program, after --iterations runs")
+
+	// "riscv_interpreter serve [flags]" serves a JSON-RPC API instead of
+	// starting the interface, with the machine the other flags set up.
+	// "riscv_interpreter bench [flags]" times the --file program instead.
+	serve := len(os.Args) > 1 && os.Args[1] == "serve"
+	bench := len(os.Args) > 1 && os.Args[1] == "bench"
+	if serve || bench {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	// set instead of calling os.Exit so deferred flushes still run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	if *hartCount < 1 {
+		fmt.Fprintln(os.Stderr, "--harts must be at least 1")
+		os.Exit(2)
+	}
+
+	displayMode, err := format.ParseMode(*displayFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var scheduler riscv.Scheduler
+	switch *schedule {
+	case "rr":
+		scheduler = &riscv.RoundRobin{}
+	case "random":
+		scheduler = riscv.NewRandomScheduler(*seed)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown schedule %s, expected rr or random\n", *schedule)
+		os.Exit(2)
+	}
+
+	var cacheConfig *riscv.CacheConfig
+	if *cacheEnabled {
+		policy, err := riscv.ParseWritePolicy(*cachePolicy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		cfg := riscv.DefaultCacheConfig
+		cfg.Size = uint32(*cacheSize)
+		cfg.Associativity = uint32(*cacheAssoc)
+		cfg.BlockSize = uint32(*cacheBlock)
+		cfg.WritePolicy = policy
+		cfg.MissPenalty = *cachePenalty
+		cacheConfig = &cfg
+	}
+
+	// every hart gets the same garbage so one seed reproduces a run
+	options := riscv.Options{
+		MemorySize:      riscv.DefaultMemorySize,
+		RandomInit:      *randomInit,
+		Seed:            *initSeed,
+		BigEndian:       *bigEndian,
+		AllowMisaligned: *allowMisaligned,
+	}
+	if options.RandomInit && options.Seed == 0 {
+		options.Seed = time.Now().UnixNano()
+	}
+
+	// on a bare cpu, so caches, predictors and extra harts don't count
+	if bench {
+		config := riscv.BenchmarkConfig{Options: options, Iterations: *iterations, Duration: *benchTime, MaxSteps: *maxSteps}
+		if err := runBench(*file, config, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+		}
+		return
+	}
+
+	var harts []*riscv.CPU
+	for range *hartCount {
+		hart := riscv.NewCPUWithOptions(options)
+		if *sandboxed {
+			var err error
+			hart, err = riscv.NewSandboxedCPUWithOptions(riscv.SafeSandbox, options)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+
+		if cacheConfig != nil {
+			if _, err := hart.AttachCache(*cacheConfig); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+
+		if *predictorName != "" {
+			predictor, err := riscv.ParsePredictor(*predictorName, uint32(*predictorEntries))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			hart.AttachPredictor(predictor)
+		}
+
+		hart.SetStepBudget(*maxSteps)
+		hart.SetStrict(*strict)
+		hart.KeepRegisterHistory(registerHistoryDepth)
+		hart.SetMemoryHistoryDepth(*memoryHistory)
+		harts = append(harts, &hart)
+	}
+
+	machine := riscv.NewMachine(harts, scheduler)
+	machine.StepBudget = *maxSteps
+
+	if *memoryMap != "" {
+		layout, err := riscv.ParseMemoryMap(*memoryMap, harts[0].MemorySize)
+		if err == nil {
+			err = machine.SetMemoryMap(layout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *programArgs != "" {
+		args, err := riscv.SplitArgs(*programArgs)
+		if err == nil {
+			err = machine.SetArgs(args)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *stdinFile != "" {
+		file, err := os.Open(*stdinFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer file.Close()
+		machine.SetStdin(bufio.NewReader(file))
+	}
+
+	// without --stdout the program's output is mixed in with ours
+	var programOutput io.Writer = os.Stdout
+	if *stdoutFile != "" {
+		file, err := os.Create(*stdoutFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		output := bufio.NewWriter(file)
+		programOutput = output
+
+		defer func() {
+			if err := output.Flush(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			file.Close()
+		}()
+	}
 
-	instructions := tview.NewTextArea()
+	if *traceFile != "" {
+		kind, err := riscv.ParseTraceFormat(*traceFormat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		file, err := os.Create(*traceFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		trace := bufio.NewWriter(file)
+		machine.EnableTrace(trace, kind)
+
+		defer func() {
+			if err := machine.DisableTrace(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if err := trace.Flush(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			file.Close()
+		}()
+	}
+
+	if *coverageFile != "" {
+		defer func() {
+			if err := saveCoverage(machine, *coverageFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				exitCode = 1
+			}
+		}()
+	}
+
+	if *grade {
+		passed, err := runGrade(machine, *file, os.Stdout, programOutput, os.Stderr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		exitCode = programExitStatus(machine)
+		if !passed {
+			exitCode = 1
+		}
+		return
+	}
+
+	if *replayFile != "" {
+		same, err := runReplay(machine, *replayFile, os.Stdout, programOutput, os.Stderr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if !same {
+			exitCode = 1
+		}
+		return
+	}
+
+	if serve {
+		if err := runServe(machine, *file, *port, *allowOrigin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+		}
+		return
+	}
+
+	if *repl {
+		if err := runREPL(machine, *file, os.Stdin, os.Stdout, programOutput, os.Stderr, *recordFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	selectedHart := 0
+	cpu := machine.Harts[selectedHart]
+
+	instructions := newSourceEditor()
 	instructions.SetPlaceholder("Enter Instructions Here...")
 
 	instructions.SetTitle("Instructions").
 		SetBorder(true)
 
-	registerInfo := tview.NewTextView()
+	registerInfo := tview.NewTextView().
+		SetDynamicColors(true)
 
 	registerInfo.SetBorder(true).
 		SetTitle("Registers")
 
-	memoryInfo := tview.NewTextView()
+	pipelineInfo := tview.NewTextView().
+		SetWrap(false)
+
+	pipelineInfo.SetBorder(true).
+		SetTitle("Pipeline")
+
+	memoryViewInfo := tview.NewTextView().
+		SetWrap(false)
+
+	memoryViewInfo.SetBorder(true).
+		SetTitle("Memory")
+
+	registerHistoryInfo := tview.NewTextView().
+		SetWrap(false)
+
+	registerHistoryInfo.SetBorder(true)
+
+	listingInfo := tview.NewTextView().
+		SetWrap(false)
+
+	listingInfo.SetBorder(true).
+		SetTitle("Listing (address, size, line)")
+
+	symbolsInfo := tview.NewTextView().
+		SetWrap(false)
+
+	symbolsInfo.SetBorder(true).
+		SetTitle("Symbols (name, address, kind, line, used on)")
+
+	diffInfo := tview.NewTextView().
+		SetWrap(false)
+
+	diffInfo.SetBorder(true).
+		SetTitle("Run Diff (before -> after)")
+
+	debugLog := tview.NewTextView().
+		SetWrap(false)
+
+	debugLog.SetBorder(true).
+		SetTitle("Debugger")
+
+	middlePages := tview.NewPages().
+		AddPage("registers", registerInfo, true, true).
+		AddPage("pipeline", pipelineInfo, true, false).
+		AddPage("memory", memoryViewInfo, true, false).
+		AddPage("history", registerHistoryInfo, true, false).
+		AddPage("listing", listingInfo, true, false).
+		AddPage("symbols", symbolsInfo, true, false).
+		AddPage("diff", diffInfo, true, false).
+		AddPage("debugger", debugLog, true, false)
+
+	memoryInfo := tview.NewTextView().
+		SetDynamicColors(true)
 
 	memoryInfo.SetBorder(true).
 		SetTitle("Memory Summary")
 
-	currInstr := tview.NewTextView()
-	currInstr.SetBorder(true)
+	callStackInfo := tview.NewTextView()
+
+	callStackInfo.SetBorder(true).
+		SetTitle("Call Stack")
+
+	diagnosticsInfo := tview.NewTextView()
+
+	diagnosticsInfo.SetBorder(true).
+		SetTitle("Diagnostics")
 
-	grid := tview.NewGrid().
-		SetRows(3, 0, 3).
-		SetColumns(-1, -1, -1)
+	watchInfo := tview.NewTextView()
+
+	watchInfo.SetBorder(true).
+		SetTitle("Watches")
+
+	consoleInfo := tview.NewTextView()
+
+	consoleInfo.SetBorder(true).
+		SetTitle(fmt.Sprintf("Console (uart at %#x)", riscv.UARTBase))
+
+	uart, _, err := machine.MapStandardDevices()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	console := io.Writer(consoleInfo)
+	if *stdoutFile != "" {
+		console = io.MultiWriter(consoleInfo, programOutput)
+	}
+	attachProgramOutput(machine, console, consoleInfo)
+
+	memHistView := memHistoryView{}
+	runs := runDiff{}
+
+	watchInput := tview.NewInputField().
+		SetLabel("watch> ").
+		SetPlaceholder("x10, output, 0x100-0x110, delete <id>, x <region>, dis <region>, goto <label|line|*address>, uses <label>, symbols, mem [loads|stores] [range], mem find <text>, mem export <file>, history <reg>, listing, diff base, diff, input <text>, macro <n> or bind <action> <key...>")
+
+	watchInput.SetBorder(true)
+
+	debugInput := tview.NewInputField().
+		SetLabel("(rv) ").
+		SetPlaceholder("p x10, x/8w 0x100, b main, u done, si, c, set x5=42, set *0x100=7, info b or help. Esc to leave")
+
+	debugInput.SetBorder(true)
+
+	keysPath := *keysFile
+	if keysPath == "" {
+		if keysPath, err = keymapPath(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	keys, err := loadKeymap(keysPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	grid := tview.NewGrid()
 
 	title := tview.NewTextView().
 		SetTextAlign(tview.AlignCenter)
@@ -109,41 +811,654 @@ func main() {
 	title.SetText("Risc-V Interpreter").SetBorder(true)
 
 	controls := tview.NewTextView()
-	controls.SetText("(N)ext step: C-n	(R)un/(R)estart: C-r").SetBorder(true)
+	controls.SetText(keys.controls()).SetBorder(true)
 	controls.SetTextAlign(tview.AlignCenter)
 
-	grid.AddItem(title, 0, 0, 1, 3, 0, 0, false).
-		AddItem(instructions, 1, 0, 1, 1, 0, 0, true).
-		AddItem(registerInfo, 1, 1, 1, 1, 0, 0, false).
-		AddItem(memoryInfo, 1, 2, 1, 1, 0, 0, false).
-		AddItem(currInstr, 2, 0, 1, 1, 0, 0, false).
-		AddItem(controls, 2, 1, 1, 2, 0, 0, false)
+	// panes that can be hidden to make room
+	showSide, showBottom, showControls := true, true, true
+
+	layoutGrid := func() {
+		grid.Clear()
+		rows := []int{3, 0, 0}
+		columns := []int{-1, -1}
+		if showSide {
+			columns = append(columns, -1)
+		}
+
+		grid.AddItem(title, 0, 0, 1, len(columns), 0, 0, false).
+			AddItem(instructions, 1, 0, 2, 1, 0, 0, true).
+			AddItem(middlePages, 1, 1, 2, 1, 0, 0, false)
+		if showSide {
+			grid.AddItem(memoryInfo, 1, 2, 1, 1, 0, 0, false).
+				AddItem(callStackInfo, 2, 2, 1, 1, 0, 0, false)
+		}
+		if showBottom {
+			grid.AddItem(diagnosticsInfo, len(rows), 0, 1, 1, 0, 0, false).
+				AddItem(consoleInfo, len(rows), 1, 1, 1, 0, 0, false)
+			if showSide {
+				grid.AddItem(watchInfo, len(rows), 2, 1, 1, 0, 0, false)
+			}
+			rows = append(rows, 6)
+		}
+		if showControls {
+			grid.AddItem(controls, len(rows), 0, 1, len(columns), 0, 0, false)
+			rows = append(rows, 3)
+		}
+		grid.AddItem(watchInput, len(rows), 0, 1, len(columns), 0, 0, false).
+			AddItem(debugInput, len(rows)+1, 0, 1, len(columns), 0, 0, false)
+		rows = append(rows, 3, 3)
+
+		grid.SetRows(rows...).SetColumns(columns...)
+	}
+	layoutGrid()
 
 	app := tview.NewApplication()
+	showCSRs := false
+	showCoverage := true
+	historyRegister := 0
 
-	updateRegisterText(&cpu, registerInfo)
+	// register values before the last step or run, so changes stand out
+	previousRegisters := make([][32]int32, len(machine.Harts))
+	rememberRegisters := func() {
+		for i, hart := range machine.Harts {
+			previousRegisters[i] = hart.GetState().Registers
+		}
+	}
+	rememberRegisters()
+	memView := memoryView{}
+	pages := tview.NewPages().
+		AddPage("main", grid, true, true)
 
-	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		if event.Key() == tcell.KeyCtrlR {
-			tokens := strings.Split(instructions.GetText(), "\n")
-			exectute(&cpu, tokens)
-			updateRegisterText(&cpu, registerInfo)
-			updateMemHist(&cpu, memoryInfo)
+	currentFile := ""
+	status := func(message string) {
+		instructions.SetTitle(message)
+	}
+
+	openFile := func(path string) {
+		source, err := loadSource(path)
+		if err != nil {
+			status(fmt.Sprintf("Instructions - %s", err))
+			return
+		}
+
+		currentFile = path
+		instructions.SetText(source, false)
+		rememberRecentFile(path)
+		status(fmt.Sprintf("Instructions - %s", path))
+	}
+
+	saveFile := func(path string) {
+		if err := saveSource(path, instructions.GetText()); err != nil {
+			status(fmt.Sprintf("Instructions - %s", err))
+			return
+		}
+
+		currentFile = path
+		rememberRecentFile(path)
+		status(fmt.Sprintf("Instructions - %s (saved)", path))
+	}
+
+	showFileDialog := func(title string, onDone func(path string)) {
+		dialog := newFileDialog(app, title, currentFile, loadRecentFiles(), func(path string) {
+			pages.RemovePage("file")
+			app.SetFocus(instructions)
+			if path != "" {
+				onDone(path)
+			}
+		})
+		pages.AddPage("file", dialog, true, true)
+	}
+
+	debugger := debug.New(machine)
+	debugger.UART = uart
+	if *recordFile != "" {
+		debugger.Record()
+	}
+
+	// keys that run the program, and changes to the watches, arguments and
+	// input, are recorded as the debugger command that does the same, after
+	// the program as it is in the editor
+	recordKey := func(command func() string) {
+		if *recordFile == "" {
+			return
+		}
+		debugger.Load(currentFile, instructions.GetText())
+		debugger.Hart = selectedHart
+		if line := command(); line != "" {
+			debugger.AddToSession(line)
+		}
+	}
+
+	showArgsDialog := func() {
+		dialog := newArgsDialog(riscv.JoinArgs(cpu.Args()), func(line string, ok bool) {
+			pages.RemovePage("args")
+			app.SetFocus(instructions)
+			if !ok {
+				return
+			}
+
+			args, err := riscv.SplitArgs(line)
+			if err == nil {
+				err = machine.SetArgs(args)
+			}
+			if err != nil {
+				status(fmt.Sprintf("Instructions - %s", err))
+				return
+			}
+			recordKey(func() string { return "args " + riscv.JoinArgs(args) })
+			status(fmt.Sprintf("Instructions - %d arguments, applied on the next run", len(args)))
+		})
+		pages.AddPage("args", dialog, true, true)
+	}
+
+	history := navHistory{}
+
+	cursorLine := func() int {
+		_, start, _ := instructions.GetSelection()
+		return strings.Count(instructions.GetText()[:start], "\n") + 1
+	}
+
+	showLocation := func(loc location) {
+		offset := 0
+		for i, line := range strings.SplitAfter(instructions.GetText(), "\n") {
+			if i == loc.line-1 {
+				break
+			}
+			offset += len(line)
+		}
+		instructions.Select(offset, offset)
+		status(fmt.Sprintf("Instructions - %s", loc))
+	}
+
+	navigate := func(to location) {
+		history.visit(location{line: cursorLine(), reason: "cursor"}, to)
+		showLocation(to)
+	}
+
+	updateRegisterTitle := func() {
+		title := "Registers"
+		if showCSRs {
+			title = "CSRs"
+		}
+		if displayMode != format.Decimal {
+			title = fmt.Sprintf("%s (%s)", title, displayMode)
+		}
+		if len(machine.Harts) > 1 {
+			title = fmt.Sprintf("%s - hart %d of %d", title, selectedHart, len(machine.Harts))
+			if machine.LastHart >= 0 {
+				title += fmt.Sprintf(", hart %d ran last", machine.LastHart)
+			}
+		}
+		registerInfo.SetTitle(title)
+	}
+
+	selectHart := func(hart int) {
+		selectedHart = hart
+		cpu = machine.Harts[hart]
+	}
+
+	// dims the lines no hart has run, once any have run
+	updateCoverage := func() {
+		coverage := machine.Coverage()
+		if !showCoverage || coverage.Executed == 0 {
+			instructions.setCoverage(nil)
+			return
+		}
+		instructions.setCoverage(coverage.Lines())
+	}
+
+	refresh := func() {
+		updateRegisterTitle()
+		updateCoverage()
+		updateRegisterText(cpu, registerInfo, showCSRs, previousRegisters[selectedHart], displayMode)
+		updateMemHist(cpu, memHistView, memoryInfo)
+		updateCallStack(cpu, callStackInfo)
+		updateWatches(cpu, watchInfo, "")
+		updatePipeline(cpu, pipelineInfo)
+		updateMemoryView(cpu, memView, memoryViewInfo, displayMode)
+		updateRegisterHistory(cpu, historyRegister, registerHistoryInfo, displayMode)
+		updateListing(cpu, listingInfo)
+		updateSymbols(cpu, symbolsInfo)
+		updateDiagnostics(cpu, diagnosticsInfo, keys)
+	}
+
+	updateRegisterTitle()
+	updateRegisterText(cpu, registerInfo, showCSRs, previousRegisters[selectedHart], displayMode)
+
+	// highlights the line the selected hart runs next
+	updateCurrInstr := func() {
+		line, _ := cpu.CurrentLine()
+		instructions.setCurrentLine(line)
+	}
+
+	instructions.SetChangedFunc(func() {
+		machine.LoadInstructions(strings.Split(instructions.GetText(), "\n"))
+		updateDiagnostics(cpu, diagnosticsInfo, keys)
+		updateCoverage()
+		updateCurrInstr()
+	})
+
+	if *file != "" {
+		openFile(*file)
+	}
+
+	macro := keyMacro{}
+
+	// set while a run is going on its own goroutine. Nothing else may touch
+	// the harts until it finishes
+	var cancelRun context.CancelFunc
+	var runDone chan struct{}
+
+	finishRun := func(steps uint64) {
+		// show the hart that stopped the run
+		if machine.LastHart >= 0 {
+			if _, stopped := stopLocation(machine.Harts[machine.LastHart]); stopped {
+				selectHart(machine.LastHart)
+			}
+		}
+		refresh()
+		updateCurrInstr()
+
+		stop := cpu.GetState().Stop
+		code, ended := cpu.ExitCode()
+		switch {
+		case stop == riscv.StopStepLimit || stop == riscv.StopCanceled:
+			title.SetText(fmt.Sprintf("Risc-V Interpreter - stopped after %d instructions", steps))
+		case ended:
+			title.SetText(fmt.Sprintf("Risc-V Interpreter - exited with code %d after %d instructions", code, steps))
+		default:
+			title.SetText("Risc-V Interpreter")
 		}
 
-		if event.Key() == tcell.KeyCtrlN {
-			tokens := strings.Split(strings.TrimSpace(instructions.GetText()), "\n")
-			step(&cpu, tokens)
-			updateRegisterText(&cpu, registerInfo)
-			updateMemHist(&cpu, memoryInfo)
+		if loc, ok := stopLocation(cpu); ok {
+			navigate(loc)
 		}
+	}
 
-		currInstr.SetText(cpu.GetCurrInstr())
+	// runs on its own goroutine, or straight away while a macro replays
+	// since replays need the result before the next key
+	startRun := func(run func(ctx context.Context) uint64) {
+		atStart := cpu.GetState().PC == cpu.EntryAddress()
+		if cpu.Pipeline() != nil && atStart {
+			cpu.Pipeline().Reset()
+		}
+		if cpu.Cache() != nil && atStart {
+			cpu.Cache().Reset()
+		}
+		if cpu.BranchPredictor() != nil && atStart {
+			cpu.BranchPredictor().Reset()
+		}
+		rememberRegisters()
 
+		if macro.replaying {
+			finishRun(run(context.Background()))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelRun, runDone = cancel, make(chan struct{})
+		title.SetText(fmt.Sprintf("Risc-V Interpreter - running, %s to stop", keys.hint("run")))
+		go func() {
+			steps := run(ctx)
+			close(runDone)
+			app.QueueUpdateDraw(func() {
+				cancel()
+				cancelRun = nil
+				finishRun(steps)
+			})
+		}()
+	}
+
+	// a program that ended stays as it ended until it is reset
+	programEnded := func() bool {
+		machine.LoadInstructions(strings.Split(instructions.GetText(), "\n"))
+		if !machine.Done() {
+			return false
+		}
+		title.SetText(fmt.Sprintf("Risc-V Interpreter - the program has ended, %s to run it again", keys.hint("reset")))
+		return true
+	}
+
+	runToCursor := func() {
+		if programEnded() {
+			return
+		}
+		tokens := strings.Split(instructions.GetText(), "\n")
+		line := cursorLine()
+		recordKey(func() string {
+			if address, ok := instructionFrom(cpu, line, len(tokens)); ok {
+				return fmt.Sprintf("u *0x%x", address)
+			}
+			return ""
+		})
+		startRun(func(ctx context.Context) uint64 {
+			steps, err := runUntilLine(ctx, machine, tokens, line)
+			if err != nil {
+				app.QueueUpdate(func() { status(fmt.Sprintf("Instructions - %s", err)) })
+			}
+			return steps
+		})
+	}
+
+	// what each action does, by name. The macro and palette actions are
+	// added once what they need is set up
+	perform := map[string]func(){
+		"step": func() {
+			if programEnded() {
+				return
+			}
+			recordKey(func() string { return "si" })
+			tokens := strings.Split(instructions.GetText(), "\n")
+			rememberRegisters()
+			step(machine, tokens)
+			refresh()
+			if loc, ok := stopLocation(cpu); ok {
+				navigate(loc)
+			}
+		},
+		"run": func() {
+			if programEnded() {
+				return
+			}
+			recordKey(func() string { return "c" })
+			tokens := strings.Split(instructions.GetText(), "\n")
+			startRun(func(ctx context.Context) uint64 {
+				return exectute(ctx, machine, tokens)
+			})
+		},
+		"run-to-cursor": runToCursor,
+		"reset": func() {
+			recordKey(func() string { return "reset" })
+			for _, hart := range machine.Harts {
+				hart.Restart()
+			}
+			rememberRegisters()
+			refresh()
+			title.SetText("Risc-V Interpreter")
+		},
+		"watch": func() {
+			app.SetFocus(watchInput)
+		},
+		"debugger": func() {
+			middlePages.SwitchToPage("debugger")
+			app.SetFocus(debugInput)
+		},
+		"open": func() {
+			showFileDialog("Open", openFile)
+		},
+		"save": func() {
+			if currentFile != "" {
+				saveFile(currentFile)
+			} else {
+				showFileDialog("Save As", saveFile)
+			}
+		},
+		"pipeline": func() {
+			if cpu.Pipeline() == nil {
+				cpu.EnablePipeline()
+				updatePipeline(cpu, pipelineInfo)
+				middlePages.SwitchToPage("pipeline")
+			} else {
+				cpu.DisablePipeline()
+				middlePages.SwitchToPage("registers")
+			}
+		},
+		"csrs": func() {
+			showCSRs = !showCSRs
+			updateRegisterTitle()
+			updateRegisterText(cpu, registerInfo, showCSRs, previousRegisters[selectedHart], displayMode)
+		},
+		"memory-view": func() {
+			if name, _ := middlePages.GetFrontPage(); name == "memory" || name == "history" || name == "listing" || name == "symbols" || name == "diff" || name == "debugger" {
+				middlePages.SwitchToPage("registers")
+			} else {
+				updateMemoryView(cpu, memView, memoryViewInfo, displayMode)
+				middlePages.SwitchToPage("memory")
+			}
+		},
+		"clear-memory-history": func() {
+			for _, hart := range machine.Harts {
+				hart.ClearMemoryHistory()
+			}
+			updateMemHist(cpu, memHistView, memoryInfo)
+		},
+		"coverage": func() {
+			showCoverage = !showCoverage
+			updateCoverage()
+		},
+		"clear-coverage": func() {
+			machine.ClearCoverage()
+			refresh()
+		},
+		"format": func() {
+			displayMode = displayMode.Next()
+			refresh()
+		},
+		"next-hart": func() {
+			selectHart((selectedHart + 1) % len(machine.Harts))
+			refresh()
+		},
+		"arguments": showArgsDialog,
+		"back": func() {
+			if loc, ok := history.back(); ok {
+				showLocation(loc)
+			}
+		},
+		"forward": func() {
+			if loc, ok := history.forward(); ok {
+				showLocation(loc)
+			}
+		},
+		"toggle-side": func() {
+			showSide = !showSide
+			layoutGrid()
+		},
+		"toggle-bottom": func() {
+			showBottom = !showBottom
+			layoutGrid()
+		},
+		"toggle-controls": func() {
+			showControls = !showControls
+			layoutGrid()
+		},
+	}
+
+	handleKey := func(event *tcell.EventKey) *tcell.EventKey {
+		name, bound := keys.lookup(event)
+		if cancelRun != nil {
+			if name == "run" || name == "run-to-cursor" {
+				cancelRun()
+				return nil
+			}
+			if event.Key() == tcell.KeyCtrlC {
+				return event
+			}
+			return nil
+		}
+
+		if bound {
+			perform[name]()
+		}
+		updateCurrInstr()
+
+		if bound {
+			return nil
+		}
 		return event
+	}
+
+	// replayed keys take the same path as typed ones
+	dispatch := func(event *tcell.EventKey) {
+		if handleKey(event) == nil {
+			return
+		}
+		if focused := app.GetFocus(); focused != nil {
+			if handler := focused.InputHandler(); handler != nil {
+				handler(event, func(p tview.Primitive) { app.SetFocus(p) })
+			}
+		}
+	}
+
+	stopped := func() bool {
+		state := cpu.GetState()
+		return state.Halted || state.Stop != riscv.StopNone
+	}
+
+	playMacro := func(times int) {
+		passes := macro.replay(times, dispatch, stopped)
+		title.SetText(fmt.Sprintf("Risc-V Interpreter - macro replayed %d times", passes))
+	}
+
+	watchInput.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			command := watchInput.GetText()
+			watchInput.SetText("")
+
+			if times, ok := parseMacroCommand(command); ok {
+				app.SetFocus(instructions)
+				playMacro(times)
+				return
+			}
+
+			if message, ok := parseBindCommand(command, keys, keysPath); ok {
+				controls.SetText(keys.controls())
+				updateDiagnostics(cpu, diagnosticsInfo, keys)
+				updateWatches(cpu, watchInfo, message)
+			} else if input, ok := strings.CutPrefix(command, "input "); ok {
+				uart.Feed([]byte(input + "\n"))
+				recordKey(func() string { return "input " + input })
+			} else if loc, ok, err := parseGotoCommand(cpu, command); ok {
+				if err != nil {
+					updateWatches(cpu, watchInfo, err.Error())
+				} else {
+					navigate(loc)
+				}
+			} else if loc, ok, err := parseUsesCommand(cpu, command, cursorLine()); ok {
+				if err != nil {
+					updateWatches(cpu, watchInfo, err.Error())
+				} else {
+					navigate(loc)
+				}
+			} else if message, ok := parseMemHistoryCommand(cpu, command, &memHistView); ok {
+				updateMemHist(cpu, memHistView, memoryInfo)
+				updateWatches(cpu, watchInfo, message)
+			} else if report, ok := parseDiffCommand(cpu, strings.Split(instructions.GetText(), "\n"), command, &runs); ok {
+				rememberRegisters()
+				diffInfo.SetText(report)
+				middlePages.SwitchToPage("diff")
+				refresh()
+				updateCurrInstr()
+			} else if strings.TrimSpace(command) == "listing" {
+				updateListing(cpu, listingInfo)
+				middlePages.SwitchToPage("listing")
+			} else if strings.TrimSpace(command) == "symbols" {
+				updateSymbols(cpu, symbolsInfo)
+				middlePages.SwitchToPage("symbols")
+			} else if register, ok := parseHistoryCommand(cpu, command); ok {
+				historyRegister = register
+				updateRegisterHistory(cpu, historyRegister, registerHistoryInfo, displayMode)
+				middlePages.SwitchToPage("history")
+			} else if view, ok := parseMemoryView(command); ok {
+				memView = view
+				updateMemoryView(cpu, memView, memoryViewInfo, displayMode)
+				middlePages.SwitchToPage("memory")
+			} else {
+				message := watchCommand(cpu, command)
+				updateWatches(cpu, watchInfo, message)
+				if message == "" {
+					recordKey(func() string { return watchDebugCommand(command) })
+				}
+			}
+		}
+		app.SetFocus(instructions)
 	})
 
-	if err := app.SetRoot(grid, true).SetFocus(grid).Run(); err != nil {
+	debugInput.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			app.SetFocus(instructions)
+			return
+		}
+
+		command := debugInput.GetText()
+		debugInput.SetText("")
+		if strings.TrimSpace(command) == "" {
+			return
+		}
+
+		// runs are bounded by the step budget rather than cancelable
+		debugger.Load(currentFile, instructions.GetText())
+		rememberRegisters()
+		debugger.Hart = selectedHart
+		output, err := debugger.Execute(context.Background(), command)
+		if err != nil {
+			output = err.Error()
+		}
+		fmt.Fprintf(debugLog, "(rv) %s\n%s\n", command, output)
+		debugLog.ScrollToEnd()
+
+		selectHart(debugger.Hart)
+		refresh()
+		updateCurrInstr()
+		if loc, ok := stopLocation(cpu); ok {
+			navigate(loc)
+			app.SetFocus(debugInput)
+		}
+	})
+
+	perform["macro-record"] = func() {
+		macro.start()
+		title.SetText(fmt.Sprintf("Risc-V Interpreter - recording macro, %s to stop", keys.hint("macro-play")))
+	}
+	perform["macro-play"] = func() {
+		if macro.recording {
+			macro.stop()
+			title.SetText(fmt.Sprintf("Risc-V Interpreter - recorded %d keys", len(macro.keys)))
+		} else {
+			playMacro(1)
+		}
+	}
+	perform["palette"] = func() {
+		if pages.HasPage("palette") {
+			return
+		}
+		palette := newPalette(keys, func(name string) {
+			pages.RemovePage("palette")
+			app.SetFocus(instructions)
+			if name != "" && cancelRun == nil {
+				perform[name]()
+				updateCurrInstr()
+			}
+		})
+		pages.AddPage("palette", palette, true, true)
+	}
+
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		// kept out of the macro they start and stop
+		if name, ok := keys.lookup(event); ok && (name == "macro-record" || name == "macro-play") {
+			if cancelRun == nil {
+				perform[name]()
+			}
+			return nil
+		}
+
+		macro.record(event)
+		return handleKey(event)
+	})
+
+	if err := app.SetRoot(pages, true).SetFocus(instructions).Run(); err != nil {
 		panic(err)
 	}
+
+	// let a run still going finish before the trace is flushed
+	if cancelRun != nil {
+		cancelRun()
+		<-runDone
+	}
+
+	if *recordFile != "" {
+		if err := saveSession(debugger, *recordFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+		}
+	}
 }
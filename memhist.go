@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// which loads and stores the memory summary lists
+type memHistoryView struct {
+	filter riscv.MemOpFilter
+	search string // only operations whose description contains it
+	place  string // the range as it was typed, for the heading
+}
+
+// the loads and stores the view shows, newest first
+func (view memHistoryView) ops(cpu *riscv.CPU) []riscv.MemOp {
+	ops := cpu.MemoryHistory(view.filter)
+	if view.search == "" {
+		return ops
+	}
+	return slices.DeleteFunc(ops, func(op riscv.MemOp) bool {
+		return !strings.Contains(cpu.DescribeMemOp(op), view.search)
+	})
+}
+
+// a heading saying what the view leaves out, empty when it shows everything
+func (view memHistoryView) String() string {
+	var parts []string
+	switch {
+	case view.filter.Loads && !view.filter.Stores:
+		parts = append(parts, "loads")
+	case view.filter.Stores && !view.filter.Loads:
+		parts = append(parts, "stores")
+	}
+	if view.place != "" {
+		parts = append(parts, "in "+view.place)
+	}
+	if view.search != "" {
+		parts = append(parts, fmt.Sprintf("matching %q", view.search))
+	}
+	return strings.Join(parts, " ")
+}
+
+// "mem" shows every load and store again, "mem loads|stores [range]" and
+// "mem <range>" filter them, "mem find <text>" searches them and
+// "mem export <file>" writes what is shown as CSV. Returns what to tell the
+// user.
+func parseMemHistoryCommand(cpu *riscv.CPU, command string, view *memHistoryView) (string, bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || fields[0] != "mem" {
+		return "", false
+	}
+	args := fields[1:]
+	if len(args) == 0 {
+		*view = memHistoryView{}
+		return "showing every load and store", true
+	}
+
+	switch args[0] {
+	case "find":
+		_, view.search, _ = strings.Cut(command, "find")
+		view.search = strings.TrimSpace(view.search)
+		return "", true
+	case "export":
+		if len(args) != 2 {
+			return "usage: mem export <file>", true
+		}
+		return exportMemHistory(cpu, *view, args[1]), true
+	}
+
+	filtered := memHistoryView{search: view.search}
+	switch args[0] {
+	case "loads":
+		filtered.filter.Loads = true
+		args = args[1:]
+	case "stores":
+		filtered.filter.Stores = true
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		return "usage: mem [loads|stores] [range]", true
+	}
+	if len(args) == 1 {
+		start, end, err := cpu.ResolveRange(args[0])
+		if err != nil {
+			return err.Error(), true
+		}
+		filtered.filter.Start, filtered.filter.End = start, end
+		filtered.place = args[0]
+	}
+	*view = filtered
+	return "", true
+}
+
+// writes what the view shows, oldest first
+func exportMemHistory(cpu *riscv.CPU, view memHistoryView, path string) string {
+	file, err := os.Create(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	ops := view.ops(cpu)
+	slices.Reverse(ops)
+	if err := riscv.WriteMemOps(file, ops); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("wrote %d loads and stores to %s", len(ops), path)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// a source line the user was taken to and why, e.g. a goto or a fault
+type location struct {
+	line   int // 1-based
+	reason string
+}
+
+func (loc location) String() string {
+	return fmt.Sprintf("line %d (%s)", loc.line, loc.reason)
+}
+
+// back/forward history of visited locations, like an IDE's
+type navHistory struct {
+	locations []location
+	index     int
+}
+
+// records a jump from one location to another, dropping anything ahead of
+// the current position the way a browser does
+func (history *navHistory) visit(from, to location) {
+	history.locations = history.locations[:min(history.index+1, len(history.locations))]
+
+	if len(history.locations) == 0 || history.locations[len(history.locations)-1].line != from.line {
+		history.locations = append(history.locations, from)
+	}
+	if history.locations[len(history.locations)-1].line != to.line {
+		history.locations = append(history.locations, to)
+	}
+
+	history.index = len(history.locations) - 1
+}
+
+func (history *navHistory) back() (location, bool) {
+	if history.index <= 0 {
+		return location{}, false
+	}
+	history.index--
+	return history.locations[history.index], true
+}
+
+func (history *navHistory) forward() (location, bool) {
+	if history.index >= len(history.locations)-1 {
+		return location{}, false
+	}
+	history.index++
+	return history.locations[history.index], true
+}
+
+// "goto <label>", "goto <line>" or "goto *<address>"
+func parseGotoCommand(cpu *riscv.CPU, command string) (location, bool, error) {
+	target, found := strings.CutPrefix(strings.TrimSpace(command), "goto ")
+	if !found {
+		return location{}, false, nil
+	}
+	target = strings.TrimSpace(target)
+
+	if addressStr, isAddress := strings.CutPrefix(target, "*"); isAddress {
+		address, err := strconv.ParseUint(addressStr, 0, 32)
+		if err != nil {
+			return location{}, true, fmt.Errorf("invalid address: %s", addressStr)
+		}
+		line, ok := cpu.LineOfAddress(uint32(address))
+		if !ok {
+			return location{}, true, fmt.Errorf("no instruction at %s", addressStr)
+		}
+		return location{line: line, reason: "goto " + target}, true, nil
+	}
+
+	if line, err := strconv.Atoi(target); err == nil {
+		return location{line: line, reason: "goto " + target}, true, nil
+	}
+
+	symbol, ok := cpu.Symbol(target)
+	if !ok {
+		return location{}, true, fmt.Errorf("unknown label: %s", target)
+	}
+	return location{line: symbol.Line, reason: "goto " + target}, true, nil
+}
+
+// "uses <label>" goes to the next line after the cursor that refers to the
+// label, wrapping around to the first
+func parseUsesCommand(cpu *riscv.CPU, command string, cursorLine int) (location, bool, error) {
+	target, found := strings.CutPrefix(strings.TrimSpace(command), "uses ")
+	if !found {
+		return location{}, false, nil
+	}
+	target = strings.TrimSpace(target)
+
+	symbol, ok := cpu.Symbol(target)
+	if !ok {
+		return location{}, true, fmt.Errorf("unknown label: %s", target)
+	}
+	if len(symbol.References) == 0 {
+		return location{}, true, fmt.Errorf("%s is never used", target)
+	}
+
+	line := symbol.References[0]
+	for _, reference := range symbol.References {
+		if reference > cursorLine {
+			line = reference
+			break
+		}
+	}
+	return location{line: line, reason: "use of " + target}, true, nil
+}
+
+// the address of the first instruction on or after a line, so running to a
+// label's own line stops at the instruction it labels
+func instructionFrom(cpu *riscv.CPU, line, lines int) (uint32, bool) {
+	for ; line <= lines; line++ {
+		if address, ok := cpu.AddressOfLine(line); ok {
+			return address, true
+		}
+	}
+	return 0, false
+}
+
+// where a run or step stopped, if it stopped somewhere worth going back to
+func stopLocation(cpu *riscv.CPU) (location, bool) {
+	if trap, ok := cpu.Err().(*riscv.Trap); ok && trap.Line != 0 {
+		return location{line: trap.Line, reason: trap.Cause.String()}, true
+	}
+
+	if cpu.PausedAtBreakpoint() {
+		if line, ok := cpu.CurrentLine(); ok {
+			return location{line: line, reason: "breakpoint"}, true
+		}
+	}
+
+	// both stop after the pc has moved past the instruction
+	if cpu.AtBreakpoint() {
+		if line, ok := cpu.LineOfAddress(cpu.GetState().PC - 4); ok {
+			return location{line: line, reason: "ebreak"}, true
+		}
+	}
+
+	if err := cpu.Err(); err == riscv.ErrStepLimit || err == riscv.ErrCanceled {
+		if line, ok := cpu.CurrentLine(); ok {
+			return location{line: line, reason: err.Error()}, true
+		}
+	}
+
+	if hits := cpu.WatchHits(); len(hits) > 0 {
+		if line, ok := cpu.LineOfAddress(hits[0].PC); ok {
+			return location{line: line, reason: "watch " + hits[0].Watch.Expression}, true
+		}
+	}
+
+	return location{}, false
+}
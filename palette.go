@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// whether every word of the search is in the action's name or description
+func matchesSearch(action action, search string) bool {
+	text := strings.ToLower(action.name + " " + action.description)
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// every action with the keys it is bound to, narrowed down as a search is
+// typed. Up and down pick one and Enter runs it. onDone is called with the
+// action's name, or an empty name if the palette was cancelled.
+func newPalette(keys keymap, onDone func(name string)) tview.Primitive {
+	input := tview.NewInputField().
+		SetLabel("Search: ")
+
+	list := tview.NewList().
+		ShowSecondaryText(false)
+
+	var shown []action
+	fill := func(search string) {
+		list.Clear()
+		shown = nil
+		for _, action := range actions {
+			if action.name == "palette" || !matchesSearch(action, search) {
+				continue
+			}
+
+			text := action.description
+			if bound := keys.keysFor(action.name); len(bound) > 0 {
+				text = fmt.Sprintf("%s [gray](%s)[-]", text, tview.Escape(strings.Join(bound, ", ")))
+			}
+			list.AddItem(text, "", 0, nil)
+			shown = append(shown, action)
+		}
+	}
+	fill("")
+
+	input.SetChangedFunc(fill)
+
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter && len(shown) > 0 {
+			onDone(shown[list.GetCurrentItem()].name)
+		} else if key == tcell.KeyEscape {
+			onDone("")
+		}
+	})
+
+	// the list is moved from the search so typing never has to stop
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn:
+			if handler := list.InputHandler(); handler != nil {
+				handler(event, func(tview.Primitive) {})
+			}
+			return nil
+		}
+		return event
+	})
+
+	layout := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(input, 1, 0, true).
+		AddItem(list, 0, 1, false)
+
+	layout.SetBorder(true).
+		SetTitle("Commands")
+
+	// centre the dialog over the main layout
+	return tview.NewGrid().
+		SetColumns(0, 80, 0).
+		SetRows(0, 20, 0).
+		AddItem(layout, 1, 1, 1, 1, 0, 0, true)
+}
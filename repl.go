@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+	"github.com/ckashino/riscv_interpreter/riscv/debug"
+)
+
+// loads file and runs debugger commands read from in until quit or the end of
+// input, without the interface. What the program writes goes to console and
+// stderr. With a record path the session is saved there at the end.
+func runREPL(machine *riscv.Machine, file string, in io.Reader, out, console, stderr io.Writer, record string) (err error) {
+	if file == "" {
+		return fmt.Errorf("--repl needs a --file to debug")
+	}
+
+	source, err := loadSource(file)
+	if err != nil {
+		return err
+	}
+
+	uart, _, err := machine.MapStandardDevices()
+	if err != nil {
+		return err
+	}
+	attachProgramOutput(machine, console, stderr)
+
+	debugger := debug.New(machine)
+	debugger.UART = uart
+	if record != "" {
+		debugger.Record()
+		defer func() {
+			if saveErr := saveSession(debugger, record); err == nil {
+				err = saveErr
+			}
+		}()
+	}
+	debugger.Load(file, source)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "(rv) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "":
+			continue
+		case "q", "quit":
+			return nil
+		}
+
+		output, err := debugger.Execute(context.Background(), line)
+		if err != nil {
+			fmt.Fprintf(out, "error: %s\n", err)
+			continue
+		}
+		if output != "" {
+			fmt.Fprintln(out, output)
+		}
+	}
+}
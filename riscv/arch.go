@@ -0,0 +1,75 @@
+package riscv
+
+import "fmt"
+
+// an instruction set front end. The CPU core (memory, hooks, watches, call
+// stack, snapshots) and the TUI only interact with the ISA through this, so a
+// second ISA can reuse them by implementing it.
+type Arch interface {
+	Name() string
+	// decodes a single comment-stripped source line
+	Decode(line string) Instr
+	Execute(cpu *CPU, instr Instr)
+	// display names indexed by register number
+	RegisterNames() []string
+	RegisterNumber(name string) (int, bool)
+	StackPointer() int
+	// the register a call leaves its return address in
+	ReturnAddress() int
+}
+
+var archs = map[string]Arch{}
+
+// makes an Arch available to Restore
+func RegisterArch(arch Arch) {
+	archs[arch.Name()] = arch
+}
+
+func lookupArch(name string) (Arch, error) {
+	if arch, ok := archs[name]; ok {
+		return arch, nil
+	}
+	return nil, fmt.Errorf("unknown architecture: %s", name)
+}
+
+func init() {
+	RegisterArch(RV32I{})
+}
+
+type RV32I struct{}
+
+var rv32iRegisterNames = []string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"fp", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+func (arch RV32I) Name() string {
+	return "rv32i"
+}
+
+func (arch RV32I) Decode(line string) Instr {
+	return DecodeInstr(&line)
+}
+
+func (arch RV32I) Execute(cpu *CPU, instr Instr) {
+	instr.Operate(cpu)
+}
+
+func (arch RV32I) RegisterNames() []string {
+	return rv32iRegisterNames
+}
+
+func (arch RV32I) RegisterNumber(name string) (int, bool) {
+	register, ok := abiToRegister[name]
+	return register, ok
+}
+
+func (arch RV32I) StackPointer() int {
+	return abiToRegister["sp"]
+}
+
+func (arch RV32I) ReturnAddress() int {
+	return abiToRegister["ra"]
+}
@@ -0,0 +1,129 @@
+package riscv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// passes arguments to the program the way a C runtime hands them to main.
+// When a run starts the strings are copied to the top of the stack with the
+// NULL terminated argv array below them, a0 holds argc, a1 holds argv and sp
+// is moved below both, 16 byte aligned. Every run lays them out again at the
+// stack pointer from the first call, so programs can't see a previous run's.
+func (cpu *CPU) SetArgs(args []string) error {
+	top := cpu.argsTop
+	if !cpu.hasArgs {
+		top = uint32(cpu.Registers[cpu.Arch.StackPointer()])
+	}
+
+	if size := argsSize(args); top > uint32(len(cpu.Memory)) || size > top {
+		return fmt.Errorf("arguments need %d bytes of stack below 0x%x", size, top)
+	}
+
+	cpu.args = slices.Clone(args)
+	cpu.argsTop = top
+	cpu.hasArgs = true
+	return nil
+}
+
+// the arguments set with SetArgs
+func (cpu *CPU) Args() []string {
+	return slices.Clone(cpu.args)
+}
+
+// the most stack the strings, argv and alignment can take
+func argsSize(args []string) uint32 {
+	size := uint32(4*(len(args)+1) + 3 + 15)
+	for _, arg := range args {
+		size += uint32(len(arg) + 1)
+	}
+	return size
+}
+
+// copies the arguments below argsTop and points a0, a1 and sp at them
+func (cpu *CPU) layoutArgs() {
+	address := cpu.argsTop
+	pointers := make([]uint32, len(cpu.args)+1)
+	for i := len(cpu.args) - 1; i >= 0; i-- {
+		address -= uint32(len(cpu.args[i]) + 1)
+		copy(cpu.Memory[address:], cpu.args[i])
+		cpu.Memory[address+uint32(len(cpu.args[i]))] = 0
+		pointers[i] = address
+	}
+
+	address &^= 3
+	address -= uint32(4 * len(pointers))
+	argv := address
+	for i, pointer := range pointers {
+		cpu.byteOrder.PutUint32(cpu.Memory[argv+uint32(4*i):], pointer)
+	}
+
+	cpu.SetRegister(abiToRegister["a0"], int32(len(cpu.args)))
+	cpu.SetRegister(abiToRegister["a1"], int32(argv))
+	cpu.SetRegister(cpu.Arch.StackPointer(), int32(argv&^15))
+}
+
+// sets the same arguments on every hart, each on its own stack
+func (machine *Machine) SetArgs(args []string) error {
+	for _, hart := range machine.Harts {
+		if err := hart.SetArgs(args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splits a command line into arguments for SetArgs. Single or double quotes
+// keep spaces inside an argument
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, char := range line {
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(char)
+		case char == '"' || char == '\'':
+			quote = char
+			inArg = true
+		case char == ' ' || char == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c in arguments", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// the reverse of SplitArgs, quoting arguments that need it
+func JoinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t'\"") {
+			if strings.Contains(arg, "\"") {
+				arg = "'" + arg + "'"
+			} else {
+				arg = "\"" + arg + "\""
+			}
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
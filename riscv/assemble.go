@@ -0,0 +1,338 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type Diagnostic struct {
+	Line    int // 1-based source line
+	Message string
+}
+
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("line %d: %s", diagnostic.Line, diagnostic.Message)
+}
+
+type assembledLine struct {
+	instr Instr
+	err   error
+}
+
+// a label at the start of a line, which may be followed by an instruction
+var labelLineRe = regexp.MustCompile(`^([\w.]+):\s*`)
+
+// a reference to a numeric local label, e.g. 1b or 1f
+var localRefRe = regexp.MustCompile(`\b(\d+)([bf])\b`)
+
+var numericLabelRe = regexp.MustCompile(`^\d+$`)
+
+// removes a trailing "#" or "//" comment, which can't start inside a string
+func stripComment(line string) string {
+	quoted, escaped := false, false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && line[i] == '\\':
+			escaped = true
+		case line[i] == '"':
+			quoted = !quoted
+		case !quoted && (line[i] == '#' || strings.HasPrefix(line[i:], "//")):
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// whether a comment-stripped line occupies an address. Blank lines, labels and
+// directives don't.
+func isInstructionLine(line string) bool {
+	_, line = splitLabels(line)
+	return line != "" && !strings.HasPrefix(line, ".")
+}
+
+// splits any labels off the front of a comment-stripped line
+func splitLabels(line string) ([]string, string) {
+	var labels []string
+	for {
+		match := labelLineRe.FindStringSubmatch(line)
+		if match == nil {
+			return labels, line
+		}
+		labels = append(labels, match[1])
+		line = line[len(match[0]):]
+	}
+}
+
+// numeric local labels can be defined many times, so each definition gets
+// its own name
+func localLabelName(label string, definition int) string {
+	return fmt.Sprintf(".Llocal_%s_%d", label, definition)
+}
+
+var localLabelRe = regexp.MustCompile(`\.Llocal_(\d+)_-?\d+`)
+
+// gives every label an address and returns the source with comments and
+// labels removed, one entry per line. References to numeric local labels are
+// rewritten to the name of the definition they refer to: 1b to the closest 1:
+// at or before the line, 1f to the closest one after it. Lines after .data
+// are laid out at dataBase, or just after the code when it is 0, and left out
+// of the lines returned. No more than memorySize bytes of data are laid out.
+func layoutSource(instrs []string, base, dataBase, memorySize uint32) ([]string, map[string]uint32, dataSection) {
+	labels := make(map[string]uint32)
+	lines := make([]string, len(instrs))
+	definitions := make(map[string]int)
+	address := base
+
+	// data addresses are offsets until the end of the code is known
+	section := dataSection{labels: make(map[string]int)}
+	dataOffsets := make(map[string]uint32)
+	inData := false
+	var dataOffset uint32
+
+	for i, instr := range instrs {
+		defined, line := splitLabels(stripComment(instr))
+		if isData, ok := parseSection(line); ok {
+			inData = isData
+			line = ""
+		}
+
+		for _, label := range defined {
+			name := label
+			if numericLabelRe.MatchString(label) {
+				name = localLabelName(label, definitions[label])
+				definitions[label]++
+			}
+			if inData {
+				dataOffsets[name] = dataOffset
+				if name == label {
+					section.labels[name] = i
+				}
+			} else {
+				labels[name] = address
+			}
+		}
+
+		if inData {
+			data := layoutDataLine(line, dataOffset, memorySize)
+			if data.size > 0 || data.err != nil {
+				data.line, data.address = i, dataOffset
+				section.lines = append(section.lines, data)
+			}
+			dataOffset += data.size
+			if data.directive == "" {
+				continue
+			}
+		}
+
+		if !isInstructionLine(line) {
+			lines[i] = line
+			continue
+		}
+
+		lines[i] = localRefRe.ReplaceAllStringFunc(line, func(ref string) string {
+			match := localRefRe.FindStringSubmatch(ref)
+			definition := definitions[match[1]]
+			if match[2] == "b" {
+				definition--
+			}
+			return localLabelName(match[1], definition)
+		})
+		address += lineSize(line)
+	}
+
+	if dataBase == 0 {
+		dataBase = (address + 3) &^ 3
+	}
+	for name, offset := range dataOffsets {
+		labels[name] = dataBase + offset
+	}
+	for i := range section.lines {
+		section.lines[i].address += dataBase
+	}
+	section.end = uint64(dataBase) + uint64(dataOffset)
+
+	return lines, labels, section
+}
+
+// decodes a line, giving the NoOp that traps in its place along with the error
+// when it can't be
+func assembleLine(arch Arch, line string) (Instr, error) {
+	instr := arch.Decode(line)
+
+	if noop, ok := instr.(*NoOp); ok {
+		return instr, errors.New(noop.reason)
+	}
+
+	return instr, nil
+}
+
+// decodes the program, reusing the previous decoding of any line whose text is
+// unchanged. Decoded instructions refer to labels by name so they can be reused
+// wherever the line moves, but everything is re-assembled when the labels move
+// as a precaution for anything resolved against them.
+func (cpu *CPU) assemble(lines []string, labels map[string]uint32) {
+	if !maps.Equal(labels, cpu.assembledLabels) {
+		cpu.assembled = make(map[string]assembledLine)
+		cpu.assembledLabels = maps.Clone(labels)
+	}
+
+	cache := make(map[string]assembledLine, len(lines))
+
+	cpu.program = nil
+	cpu.sourceLines = nil
+	cpu.addresses = nil
+	cpu.compressed = false
+	cpu.diagnostics = nil
+	address := cpu.textBase()
+
+	for i, line := range lines {
+		line = stripComment(line)
+		if !isInstructionLine(line) {
+			continue
+		}
+
+		assembled, ok := cache[line]
+		if !ok {
+			if assembled, ok = cpu.assembled[line]; !ok {
+				instr, err := assembleLine(cpu.Arch, line)
+				if err == nil {
+					if err = checkSymbols(instr, labels); err != nil {
+						instr = &NoOp{reason: err.Error()}
+					}
+				}
+				assembled = assembledLine{instr: instr, err: err}
+			}
+			cache[line] = assembled
+		}
+
+		cpu.program = append(cpu.program, assembled.instr)
+		cpu.sourceLines = append(cpu.sourceLines, i)
+		cpu.addresses = append(cpu.addresses, address)
+		_, instrLine := splitLabels(line)
+		address += lineSize(instrLine)
+		cpu.compressed = cpu.compressed || lineSize(instrLine) == 2
+		if assembled.err != nil {
+			cpu.diagnostics = append(cpu.diagnostics, Diagnostic{Line: cpu.sourceLine(i), Message: assembled.err.Error()})
+		}
+	}
+
+	cpu.assembled = cache
+}
+
+// drops repeats of a diagnostic on the same source line, keeping the first
+func dedupeDiagnostics(diagnostics []Diagnostic) []Diagnostic {
+	seen := make(map[Diagnostic]bool)
+	return slices.DeleteFunc(diagnostics, func(diagnostic Diagnostic) bool {
+		if seen[diagnostic] {
+			return true
+		}
+		seen[diagnostic] = true
+		return false
+	})
+}
+
+func (cpu *CPU) Diagnostics() []Diagnostic {
+	return cpu.diagnostics
+}
+
+// 1-based source line of the instruction at an address
+func (cpu *CPU) LineOfAddress(address uint32) (int, bool) {
+	instr_num, ok := cpu.instrIndex(address)
+	if !ok {
+		return 0, false
+	}
+
+	return cpu.sourceLine(cpu.sourceLines[instr_num]), true
+}
+
+// address of the instruction on a 1-based source line, the first one for a
+// line that expands to several
+func (cpu *CPU) AddressOfLine(line int) (uint32, bool) {
+	for instr_num, sourceLine := range cpu.sourceLines {
+		if cpu.sourceLine(sourceLine) == line {
+			return cpu.addresses[instr_num], true
+		}
+	}
+	return 0, false
+}
+
+// 1-based line of the source as it was loaded that line i of instructions
+// came from, which differs once macros are expanded
+func (cpu *CPU) sourceLine(i int) int {
+	if cpu.lineOrigins == nil {
+		return i + 1
+	}
+	return cpu.lineOrigins[i] + 1
+}
+
+// index into program of the instruction starting at an address
+func (cpu *CPU) instrIndex(address uint32) (int, bool) {
+	return slices.BinarySearch(cpu.addresses, address)
+}
+
+// the address just past the last instruction
+func (cpu *CPU) programEnd() uint32 {
+	if len(cpu.addresses) == 0 {
+		return cpu.textBase()
+	}
+	last := len(cpu.program) - 1
+	return cpu.addresses[last] + instrSize(cpu.program[last])
+}
+
+// 1-based source line of the next instruction to execute
+func (cpu *CPU) CurrentLine() (int, bool) {
+	return cpu.LineOfAddress(cpu.PC)
+}
+
+// an assembled program, for checking one without running it and loading it
+// into any number of cpus. Labels and Listing are laid out as on a cpu
+// without a memory map.
+type Program struct {
+	Source      []string
+	Labels      map[string]uint32
+	Listing     []ListingEntry
+	Diagnostics []Diagnostic
+}
+
+// returned by Assemble for a program with diagnostics
+type AssemblyError struct {
+	Diagnostics []Diagnostic
+}
+
+func (err *AssemblyError) Error() string {
+	if len(err.Diagnostics) == 1 {
+		return err.Diagnostics[0].String()
+	}
+	return fmt.Sprintf("%s, and %d more errors", err.Diagnostics[0], len(err.Diagnostics)-1)
+}
+
+// assembles source, one instruction or directive per line. The program comes
+// back with an *AssemblyError too when it has diagnostics, since lines that
+// failed to assemble trap when they run.
+func Assemble(source string) (*Program, error) {
+	cpu := NewCPU(DefaultMemorySize)
+	lines := strings.Split(source, "\n")
+	cpu.LoadInstructions(lines)
+
+	program := &Program{
+		Source:      lines,
+		Labels:      maps.Clone(cpu.Labels),
+		Listing:     cpu.Listing(),
+		Diagnostics: slices.Clone(cpu.Diagnostics()),
+	}
+	if len(program.Diagnostics) > 0 {
+		return program, &AssemblyError{Diagnostics: program.Diagnostics}
+	}
+	return program, nil
+}
+
+// loads an assembled program, laid out for this cpu
+func (cpu *CPU) Load(program *Program) {
+	cpu.LoadInstructions(program.Source)
+}
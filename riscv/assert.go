@@ -0,0 +1,188 @@
+package riscv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a comparison checked when the program halts, or each time the instruction
+// at label At is about to run. Operands are registers, numbers, labels (their
+// address) or *<address, label or register> for the word in memory there.
+// Comparisons are signed.
+type Assertion struct {
+	Left  string
+	Op    string
+	Right string
+	At    string // empty to check when the program halts
+	Line  int    // 1-based source line of an .assert, 0 for AddAssertion
+}
+
+func (assertion Assertion) String() string {
+	text := fmt.Sprintf("%s %s %s", assertion.Left, assertion.Op, assertion.Right)
+	if assertion.At != "" {
+		text += " at " + assertion.At
+	}
+	if assertion.Line != 0 {
+		text = fmt.Sprintf("line %d: %s", assertion.Line, text)
+	}
+	return text
+}
+
+type AssertionResult struct {
+	Assertion Assertion
+	Checks    int    // times the assertion was evaluated this run
+	Failure   string // why the first failing check failed
+}
+
+// an assertion that was never checked fails, so a checkpoint the program
+// skipped is reported
+func (result AssertionResult) Passed() bool {
+	return result.Checks > 0 && result.Failure == ""
+}
+
+func (result AssertionResult) String() string {
+	switch {
+	case result.Checks == 0:
+		return fmt.Sprintf("%s: FAIL (not reached)", result.Assertion)
+	case result.Failure != "":
+		return fmt.Sprintf("%s: FAIL (%s)", result.Assertion, result.Failure)
+	}
+	return fmt.Sprintf("%s: PASS", result.Assertion)
+}
+
+var assertionRe = regexp.MustCompile(`^(\S+?)\s*(==|!=|<=|>=|<|>)\s*(\S+)(?:\s+at\s+([\w.]+))?$`)
+
+var assertDirectiveRe = regexp.MustCompile(`^\s*\.assert\s+(.*)$`)
+
+var assertionOps = map[string]func(int32, int32) bool{
+	"==": func(a, b int32) bool { return a == b },
+	"!=": func(a, b int32) bool { return a != b },
+	"<":  func(a, b int32) bool { return a < b },
+	"<=": func(a, b int32) bool { return a <= b },
+	">":  func(a, b int32) bool { return a > b },
+	">=": func(a, b int32) bool { return a >= b },
+}
+
+// "x10 == 42" or "*result != 0 at done"
+func ParseAssertion(text string) (Assertion, error) {
+	match := assertionRe.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return Assertion{}, fmt.Errorf("invalid assertion %q, expected <value> <op> <value> [at <label>]", text)
+	}
+	return Assertion{Left: match[1], Op: match[2], Right: match[3], At: match[4]}, nil
+}
+
+// checks an assertion along with any .assert directives in the source
+func (cpu *CPU) AddAssertion(text string) error {
+	assertion, err := ParseAssertion(text)
+	if err != nil {
+		return err
+	}
+	cpu.assertions = append(cpu.assertions, assertion)
+	return nil
+}
+
+func (cpu *CPU) ClearAssertions() {
+	cpu.assertions = nil
+}
+
+// the assertions added with AddAssertion followed by the source's, with how
+// they fared so far this run
+func (cpu *CPU) AssertionResults() []AssertionResult {
+	var results []AssertionResult
+	for _, assertion := range append(cpu.assertions, cpu.sourceAssertions...) {
+		result := AssertionResult{Assertion: assertion}
+		for _, checked := range cpu.assertionResults {
+			if checked.Assertion == assertion {
+				result = checked
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// parses ".assert <assertion>"
+func parseAssertDirective(line string) (Assertion, bool, error) {
+	match := assertDirectiveRe.FindStringSubmatch(line)
+	if match == nil {
+		return Assertion{}, false, nil
+	}
+	assertion, err := ParseAssertion(match[1])
+	return assertion, true, err
+}
+
+// checks the assertions for the end of the program, or for the checkpoint at
+// pc when atEnd is false
+func (cpu *CPU) checkAssertions(pc uint32, atEnd bool) {
+	for _, assertion := range append(cpu.assertions, cpu.sourceAssertions...) {
+		if atEnd != (assertion.At == "") {
+			continue
+		}
+		if !atEnd {
+			if address, ok := cpu.Labels[assertion.At]; !ok || address != pc {
+				continue
+			}
+		}
+		cpu.recordAssertion(assertion, cpu.evaluateAssertion(assertion))
+	}
+}
+
+func (cpu *CPU) recordAssertion(assertion Assertion, failure string) {
+	for i, result := range cpu.assertionResults {
+		if result.Assertion == assertion {
+			cpu.assertionResults[i].Checks++
+			if result.Failure == "" {
+				cpu.assertionResults[i].Failure = failure
+			}
+			return
+		}
+	}
+	cpu.assertionResults = append(cpu.assertionResults, AssertionResult{Assertion: assertion, Checks: 1, Failure: failure})
+}
+
+// why the assertion doesn't hold, or "" if it does
+func (cpu *CPU) evaluateAssertion(assertion Assertion) string {
+	left, err := cpu.assertionValue(assertion.Left)
+	if err != nil {
+		return err.Error()
+	}
+	right, err := cpu.assertionValue(assertion.Right)
+	if err != nil {
+		return err.Error()
+	}
+
+	if assertionOps[assertion.Op](left, right) {
+		return ""
+	}
+	if _, err := strconv.ParseInt(assertion.Left, 0, 64); err == nil {
+		return fmt.Sprintf("%s is %d", assertion.Right, right)
+	}
+	return fmt.Sprintf("%s is %d", assertion.Left, left)
+}
+
+func (cpu *CPU) assertionValue(operand string) (int32, error) {
+	if address, found := strings.CutPrefix(operand, "*"); found {
+		location, err := cpu.assertionValue(address)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(uint32(location))+4 > uint64(len(cpu.Memory)) {
+			return 0, fmt.Errorf("%s is outside memory", operand)
+		}
+		return int32(cpu.byteOrder.Uint32(cpu.Memory[uint32(location):])), nil
+	}
+
+	if register, ok := cpu.Arch.RegisterNumber(operand); ok {
+		return cpu.Registers[register], nil
+	}
+	if address, ok := cpu.Labels[operand]; ok {
+		return int32(address), nil
+	}
+	if value, err := strconv.ParseInt(operand, 0, 64); err == nil && value >= -1<<31 && value < 1<<32 {
+		return int32(value), nil
+	}
+	return 0, fmt.Errorf("unknown value %s", operand)
+}
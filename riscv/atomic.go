@@ -0,0 +1,52 @@
+package riscv
+
+import "strings"
+
+// the reservation set of lr.w is the aligned word it loaded from
+
+func (cpu *CPU) reserve(address uint32) {
+	cpu.reservation = address &^ 3
+	cpu.reserved = true
+}
+
+func (cpu *CPU) holdsReservation(address uint32) bool {
+	return cpu.reserved && cpu.reservation == address&^3
+}
+
+// stores to the reserved word make the next sc.w fail
+func (cpu *CPU) invalidateReservation(address uint32, size uint32) {
+	if cpu.reserved && address < cpu.reservation+4 && address+size > cpu.reservation {
+		cpu.reserved = false
+	}
+}
+
+// reads, modifies and writes a word, returning the old value. faults are
+// reported as store/AMO exceptions even though the word is read first
+func (cpu *CPU) amo(address uint32, value int32, op func(old, value int32) int32) int32 {
+	cpu.checkAtomicAlignment(address, true)
+	cpu.checkMemoryAccess(address, 4, true)
+	old := cpu.loadWord(address)
+	cpu.storeWord(address, op(old, value))
+	return old
+}
+
+// atomics have to be aligned even when other loads and stores needn't be
+func (cpu *CPU) checkAtomicAlignment(address uint32, write bool) {
+	if address%4 == 0 {
+		return
+	}
+	if write {
+		cpu.raise(ExcStoreMisaligned, address)
+	}
+	cpu.raise(ExcLoadMisaligned, address)
+}
+
+// the .aq and .rl ordering suffixes don't matter with a single hart
+func atomicMnemonic(mnemonic string) string {
+	for _, suffix := range []string{".aqrl", ".aq", ".rl"} {
+		if trimmed, found := strings.CutSuffix(mnemonic, suffix); found {
+			return trimmed
+		}
+	}
+	return mnemonic
+}
@@ -0,0 +1,124 @@
+package riscv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// how Benchmark runs a program
+type BenchmarkConfig struct {
+	Options    Options
+	Iterations int           // runs of the program
+	Duration   time.Duration // or keep running until this much time has passed
+	MaxSteps   uint64        // instructions per run before it fails, 0 for no limit
+}
+
+// how long a program took to decode and run, and what it allocated, added up
+// over every iteration
+type BenchmarkResult struct {
+	Iterations    int
+	Instructions  uint64
+	Decode        time.Duration
+	Execute       time.Duration
+	DecodeAllocs  uint64
+	DecodeBytes   uint64
+	ExecuteAllocs uint64
+	ExecuteBytes  uint64
+}
+
+// instructions executed per second of execute time
+func (result BenchmarkResult) InstructionsPerSecond() float64 {
+	if result.Execute <= 0 {
+		return 0
+	}
+	return float64(result.Instructions) / result.Execute.Seconds()
+}
+
+func (result BenchmarkResult) String() string {
+	if result.Iterations == 0 {
+		return "no runs\n"
+	}
+	runs := uint64(result.Iterations)
+	total := result.Decode + result.Execute
+	percent := func(part time.Duration) float64 {
+		if total <= 0 {
+			return 0
+		}
+		return float64(part) / float64(total) * 100
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d runs, %d instructions in %v\n", result.Iterations, result.Instructions, total.Round(time.Microsecond))
+	fmt.Fprintf(&builder, "%.0f instructions/s, %d instructions per run\n", result.InstructionsPerSecond(), result.Instructions/runs)
+	fmt.Fprintf(&builder, "decode  %v per run (%.1f%%), %d allocs, %d bytes\n",
+		(result.Decode / time.Duration(runs)).Round(time.Nanosecond), percent(result.Decode), result.DecodeAllocs/runs, result.DecodeBytes/runs)
+	fmt.Fprintf(&builder, "execute %v per run (%.1f%%), %d allocs, %d bytes\n",
+		(result.Execute / time.Duration(runs)).Round(time.Nanosecond), percent(result.Execute), result.ExecuteAllocs/runs, result.ExecuteBytes/runs)
+	return builder.String()
+}
+
+// heap allocations so far, in objects and bytes
+func heapAllocs() (uint64, uint64) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Mallocs, stats.TotalAlloc
+}
+
+// decodes and runs source on a fresh cpu for config.Iterations runs, or until
+// config.Duration has passed, whichever is later, and at least once.
+// Allocations are counted outside the timed parts, and count anything else
+// the process allocates meanwhile. When ctx is done the runs that finished
+// are reported.
+func Benchmark(ctx context.Context, source string, config BenchmarkConfig) (BenchmarkResult, error) {
+	lines := strings.Split(source, "\n")
+	var result BenchmarkResult
+	start := time.Now()
+
+	for result.Iterations == 0 || result.Iterations < config.Iterations || time.Since(start) < config.Duration {
+		if ctx.Err() != nil {
+			break
+		}
+		cpu := NewCPUWithOptions(config.Options)
+		cpu.SetStepBudget(config.MaxSteps)
+
+		allocs, bytes := heapAllocs()
+		decodeStart := time.Now()
+		cpu.LoadInstructions(lines)
+		decode := time.Since(decodeStart)
+		decodeAllocs, decodeBytes := heapAllocs()
+
+		if result.Iterations == 0 && len(cpu.Diagnostics()) > 0 {
+			return result, &AssemblyError{Diagnostics: cpu.Diagnostics()}
+		}
+
+		executeStart := time.Now()
+		steps := cpu.RunContext(ctx)
+		execute := time.Since(executeStart)
+		executeAllocs, executeBytes := heapAllocs()
+
+		if errors.Is(cpu.Err(), ErrCanceled) {
+			break
+		}
+		if cpu.Err() != nil {
+			return result, fmt.Errorf("run %d: %w", result.Iterations+1, cpu.Err())
+		}
+
+		result.Iterations++
+		result.Instructions += steps
+		result.Decode += decode
+		result.Execute += execute
+		result.DecodeAllocs += decodeAllocs - allocs
+		result.DecodeBytes += decodeBytes - bytes
+		result.ExecuteAllocs += executeAllocs - decodeAllocs
+		result.ExecuteBytes += executeBytes - decodeBytes
+	}
+
+	if result.Iterations == 0 && ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	return result, nil
+}
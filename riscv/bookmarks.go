@@ -0,0 +1,156 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// a named address range, e.g. "the output buffer". End is exclusive.
+type Bookmark struct {
+	Name  string
+	Start uint32
+	End   uint32
+	Color string
+}
+
+func (bookmark Bookmark) Contains(address uint32) bool {
+	return address >= bookmark.Start && address < bookmark.End
+}
+
+func parseAddress(address_str string) (uint32, error) {
+	address, err := strconv.ParseUint(strings.TrimSpace(address_str), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address: %s", address_str)
+	}
+	return uint32(address), nil
+}
+
+func (cpu *CPU) AddBookmark(name string, start, end uint32, color string) error {
+	if name == "" {
+		return errors.New("bookmark needs a name")
+	}
+
+	if end <= start {
+		return fmt.Errorf("bookmark %s: end must be after start", name)
+	}
+
+	if end > cpu.MemorySize {
+		return fmt.Errorf("bookmark %s: range exceeds memory", name)
+	}
+
+	if color == "" {
+		color = "yellow"
+	}
+
+	cpu.bookmarks[name] = Bookmark{Name: name, Start: start, End: end, Color: color}
+	return nil
+}
+
+func (cpu *CPU) RemoveBookmark(name string) {
+	delete(cpu.bookmarks, name)
+}
+
+func (cpu *CPU) Bookmark(name string) (Bookmark, bool) {
+	bookmark, ok := cpu.bookmarks[name]
+	return bookmark, ok
+}
+
+// bookmarks ordered by start address
+func (cpu *CPU) Bookmarks() []Bookmark {
+	bookmarks := make([]Bookmark, 0, len(cpu.bookmarks))
+	for _, bookmark := range cpu.bookmarks {
+		bookmarks = append(bookmarks, bookmark)
+	}
+
+	slices.SortFunc(bookmarks, func(a, b Bookmark) int {
+		if a.Start != b.Start {
+			return int(a.Start) - int(b.Start)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return bookmarks
+}
+
+// returns the first (lowest starting) bookmark containing the address. It's
+// called for every address shown, so it looks through the map rather than
+// sorting it like Bookmarks does.
+func (cpu *CPU) BookmarkAt(address uint32) (Bookmark, bool) {
+	var first Bookmark
+	found := false
+	for _, bookmark := range cpu.bookmarks {
+		if !bookmark.Contains(address) {
+			continue
+		}
+		if !found || bookmark.Start < first.Start || bookmark.Start == first.Start && bookmark.Name < first.Name {
+			first, found = bookmark, true
+		}
+	}
+	return first, found
+}
+
+// resolves a bookmark name, a memory region name such as "stack", a data
+// label or an explicit "start-end" range
+func (cpu *CPU) ResolveRange(spec string) (uint32, uint32, error) {
+	spec = strings.TrimSpace(spec)
+
+	if bookmark, ok := cpu.bookmarks[spec]; ok {
+		return bookmark.Start, bookmark.End, nil
+	}
+	for _, region := range cpu.MemoryRegions() {
+		if region.Name == spec && region.End > region.Start {
+			return region.Start, region.End, nil
+		}
+	}
+	for _, symbol := range cpu.dataSymbols {
+		if symbol.Name == spec && symbol.Size > 0 {
+			return symbol.Address, symbol.Address + symbol.Size, nil
+		}
+	}
+
+	start_str, end_str, found := strings.Cut(spec, "-")
+	if !found {
+		address, err := parseAddress(spec)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown bookmark or address: %s", spec)
+		}
+		return address, address + 1, nil
+	}
+
+	start, err := parseAddress(start_str)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := parseAddress(end_str)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if end <= start {
+		return 0, 0, fmt.Errorf("invalid range: %s", spec)
+	}
+
+	return start, end, nil
+}
+
+// formats an address for display, annotated with its bookmark, data label,
+// device or memory region if it has one
+func (cpu *CPU) describeAddress(address uint32) string {
+	if bookmark, ok := cpu.BookmarkAt(address); ok {
+		return fmt.Sprintf("%d (%s+%d)", address, bookmark.Name, address-bookmark.Start)
+	}
+	if name := cpu.symbolName(address); name != "" {
+		return fmt.Sprintf("%d (%s)", address, name)
+	}
+	if device, ok := cpu.deviceAt(address); ok {
+		return fmt.Sprintf("%d (%s+%d)", address, device.Device.Name(), address-device.Base)
+	}
+	if region, ok := cpu.regionAt(address); ok {
+		return fmt.Sprintf("%d (%s)", address, region.Name)
+	}
+	return fmt.Sprintf("%d", address)
+}
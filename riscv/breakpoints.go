@@ -0,0 +1,95 @@
+package riscv
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// pauses runs before the instruction at address executes. Unlike an ebreak
+// the program doesn't change, so breakpoints can come and go while debugging.
+// They are kept by address, so they stay put when the source is edited.
+func (cpu *CPU) SetBreakpoint(address uint32) error {
+	if _, ok := cpu.instrIndex(address); !ok {
+		return fmt.Errorf("no instruction at 0x%04x", address)
+	}
+	if cpu.breakpoints == nil {
+		cpu.breakpoints = make(map[uint32]bool)
+	}
+	cpu.breakpoints[address] = true
+	return nil
+}
+
+func (cpu *CPU) ClearBreakpoint(address uint32) {
+	delete(cpu.breakpoints, address)
+}
+
+// addresses with a breakpoint, lowest first
+func (cpu *CPU) Breakpoints() []uint32 {
+	return slices.Sorted(maps.Keys(cpu.breakpoints))
+}
+
+// whether the last run paused at a breakpoint set with SetBreakpoint. The
+// instruction at the pc hasn't run yet.
+func (cpu *CPU) PausedAtBreakpoint() bool {
+	return cpu.pausedAtBreakpoint
+}
+
+// pauses if the pc has a breakpoint, unless the run paused here already and
+// is now carrying on past it
+func (cpu *CPU) pauseAtBreakpoint() bool {
+	if cpu.Done || cpu.pausedAtBreakpoint {
+		return false
+	}
+	if !cpu.breakpoints[cpu.PC] && !(cpu.runningUntil && cpu.PC == cpu.untilAddress) {
+		return false
+	}
+	cpu.pausedAtBreakpoint = true
+	return true
+}
+
+func (cpu *CPU) RunUntil(address uint32) (uint64, error) {
+	return cpu.RunUntilContext(context.Background(), address)
+}
+
+// runs with a temporary breakpoint at address, so the run pauses there like
+// at any other breakpoint unless it ends or stops first. When the pc is at
+// address already the instruction there runs first, so running until the top
+// of a loop goes round it once.
+func (cpu *CPU) RunUntilContext(ctx context.Context, address uint32) (uint64, error) {
+	if err := cpu.runUntil(address); err != nil {
+		return 0, err
+	}
+	defer cpu.stopRunningUntil()
+	return cpu.RunContext(ctx), nil
+}
+
+// sets the temporary breakpoint
+func (cpu *CPU) runUntil(address uint32) error {
+	if _, ok := cpu.instrIndex(address); !ok {
+		return fmt.Errorf("no instruction at 0x%04x", address)
+	}
+	cpu.untilAddress = address
+	cpu.runningUntil = true
+	if cpu.PC == address {
+		cpu.pausedAtBreakpoint = true
+	}
+	return nil
+}
+
+func (cpu *CPU) stopRunningUntil() {
+	cpu.runningUntil = false
+}
+
+// like CPU.RunUntilContext with the temporary breakpoint on every hart, so
+// whichever hart gets to address first pauses the run
+func (machine *Machine) RunUntilContext(ctx context.Context, address uint32) (uint64, error) {
+	for _, hart := range machine.Harts {
+		if err := hart.runUntil(address); err != nil {
+			return 0, err
+		}
+		defer hart.stopRunningUntil()
+	}
+	return machine.RunContext(ctx), nil
+}
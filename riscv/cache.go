@@ -0,0 +1,282 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+type WritePolicy int
+
+const (
+	// dirty blocks are written back on eviction, write misses allocate
+	WriteBack WritePolicy = iota
+	// every write goes to memory, write misses don't allocate
+	WriteThrough
+)
+
+func ParseWritePolicy(policy string) (WritePolicy, error) {
+	switch strings.ToLower(policy) {
+	case "wb", "write-back":
+		return WriteBack, nil
+	case "wt", "write-through":
+		return WriteThrough, nil
+	}
+	return 0, fmt.Errorf("unknown write policy: %s", policy)
+}
+
+func (policy WritePolicy) String() string {
+	if policy == WriteThrough {
+		return "write-through"
+	}
+	return "write-back"
+}
+
+type CacheConfig struct {
+	Size          uint32 // total bytes of data
+	Associativity uint32 // ways per set
+	BlockSize     uint32 // bytes per block
+	WritePolicy   WritePolicy
+	HitLatency    int // cycles
+	MissPenalty   int // extra cycles to go to memory
+}
+
+var DefaultCacheConfig = CacheConfig{
+	Size:          1024,
+	Associativity: 2,
+	BlockSize:     16,
+	WritePolicy:   WriteBack,
+	HitLatency:    1,
+	MissPenalty:   20,
+}
+
+func (cfg CacheConfig) validate() error {
+	for _, value := range []uint32{cfg.Size, cfg.Associativity, cfg.BlockSize} {
+		if value == 0 || bits.OnesCount32(value) != 1 {
+			return errors.New("cache size, associativity and block size must be powers of two")
+		}
+	}
+
+	if cfg.BlockSize*cfg.Associativity > cfg.Size {
+		return errors.New("cache is smaller than one set")
+	}
+
+	return nil
+}
+
+type cacheLine struct {
+	valid   bool
+	dirty   bool
+	tag     uint32
+	lastUse uint64
+}
+
+type CacheStats struct {
+	Accesses         int
+	Hits             int
+	CompulsoryMiss   int
+	CapacityMiss     int
+	ConflictMiss     int
+	Writebacks       int
+	TotalLatency     int
+	LastLatency      int
+	LastAccessWasHit bool
+}
+
+func (stats CacheStats) Misses() int {
+	return stats.CompulsoryMiss + stats.CapacityMiss + stats.ConflictMiss
+}
+
+func (stats CacheStats) HitRate() float64 {
+	if stats.Accesses == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Accesses)
+}
+
+func (stats CacheStats) AverageLatency() float64 {
+	if stats.Accesses == 0 {
+		return 0
+	}
+	return float64(stats.TotalLatency) / float64(stats.Accesses)
+}
+
+func (stats CacheStats) String() string {
+	return fmt.Sprintf(
+		"%d accesses, %.1f%% hits\nmisses: %d compulsory, %d capacity, %d conflict\n%d writebacks, %.2f cycles/access",
+		stats.Accesses, stats.HitRate()*100,
+		stats.CompulsoryMiss, stats.CapacityMiss, stats.ConflictMiss,
+		stats.Writebacks, stats.AverageLatency(),
+	)
+}
+
+// set-associative LRU data cache model. It only tracks tags, the data itself
+// always lives in CPU memory.
+type Cache struct {
+	Config CacheConfig
+	Stats  CacheStats
+
+	sets  [][]cacheLine
+	clock uint64
+
+	// seen blocks and a fully associative LRU cache of the same capacity, to
+	// tell compulsory, capacity and conflict misses apart
+	seen      map[uint32]bool
+	shadow    map[uint32]uint64
+	shadowCap int
+}
+
+func NewCache(cfg CacheConfig) (*Cache, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	cache := &Cache{Config: cfg}
+	cache.Reset()
+	return cache, nil
+}
+
+func (cache *Cache) Reset() {
+	cfg := cache.Config
+	numSets := cfg.Size / (cfg.BlockSize * cfg.Associativity)
+
+	cache.sets = make([][]cacheLine, numSets)
+	for i := range cache.sets {
+		cache.sets[i] = make([]cacheLine, cfg.Associativity)
+	}
+
+	cache.Stats = CacheStats{}
+	cache.clock = 0
+	cache.seen = make(map[uint32]bool)
+	cache.shadow = make(map[uint32]uint64)
+	cache.shadowCap = int(cfg.Size / cfg.BlockSize)
+}
+
+// simulates an access of size bytes and returns its latency in cycles
+func (cache *Cache) Access(address uint32, size uint32, write bool) int {
+	latency := 0
+	first := address / cache.Config.BlockSize
+	last := (address + size - 1) / cache.Config.BlockSize
+
+	// accesses straddling a block boundary touch both blocks
+	for block := first; block <= last; block++ {
+		latency += cache.accessBlock(block, write)
+	}
+
+	cache.Stats.LastLatency = latency
+	cache.Stats.TotalLatency += latency
+	return latency
+}
+
+func (cache *Cache) accessBlock(block uint32, write bool) int {
+	cfg := cache.Config
+	cache.clock++
+	cache.Stats.Accesses++
+
+	numSets := uint32(len(cache.sets))
+	set := cache.sets[block%numSets]
+	tag := block / numSets
+
+	shadowHit := cache.touchShadow(block)
+	wasSeen := cache.seen[block]
+	cache.seen[block] = true
+
+	latency := cfg.HitLatency
+	if write && cfg.WritePolicy == WriteThrough {
+		latency += cfg.MissPenalty
+	}
+
+	for i := range set {
+		if set[i].valid && set[i].tag == tag {
+			set[i].lastUse = cache.clock
+			if write && cfg.WritePolicy == WriteBack {
+				set[i].dirty = true
+			}
+			cache.Stats.Hits++
+			cache.Stats.LastAccessWasHit = true
+			return latency
+		}
+	}
+
+	cache.Stats.LastAccessWasHit = false
+	switch {
+	case !wasSeen:
+		cache.Stats.CompulsoryMiss++
+	case shadowHit:
+		cache.Stats.ConflictMiss++
+	default:
+		cache.Stats.CapacityMiss++
+	}
+
+	if write && cfg.WritePolicy == WriteThrough {
+		// no write allocate, the write already went to memory
+		return latency
+	}
+
+	latency += cfg.MissPenalty
+
+	victim := 0
+	for i := range set {
+		if !set[i].valid {
+			victim = i
+			break
+		}
+		if set[i].lastUse < set[victim].lastUse {
+			victim = i
+		}
+	}
+
+	if set[victim].valid && set[victim].dirty {
+		cache.Stats.Writebacks++
+		latency += cfg.MissPenalty
+	}
+
+	set[victim] = cacheLine{valid: true, dirty: write, tag: tag, lastUse: cache.clock}
+	return latency
+}
+
+// returns whether the fully associative shadow cache holds the block, then
+// brings it in
+func (cache *Cache) touchShadow(block uint32) bool {
+	_, hit := cache.shadow[block]
+	cache.shadow[block] = cache.clock
+
+	if len(cache.shadow) > cache.shadowCap {
+		var oldest uint32
+		oldestUse := cache.clock + 1
+		for candidate, lastUse := range cache.shadow {
+			if lastUse < oldestUse {
+				oldest, oldestUse = candidate, lastUse
+			}
+		}
+		delete(cache.shadow, oldest)
+	}
+
+	return hit
+}
+
+func (cpu *CPU) AttachCache(cfg CacheConfig) (*Cache, error) {
+	cache, err := NewCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cpu.cache = cache
+	return cache, nil
+}
+
+func (cpu *CPU) DetachCache() {
+	cpu.cache = nil
+}
+
+// nil unless a cache is attached
+func (cpu *CPU) Cache() *Cache {
+	return cpu.cache
+}
+
+func (cpu *CPU) cacheAccess(address uint32, size uint32, write bool) {
+	if cpu.cache != nil {
+		cpu.cache.Access(address, size, write)
+	}
+}
@@ -0,0 +1,71 @@
+package riscv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// a shadow call stack entry, pushed by linking jumps and popped by returns
+type StackFrame struct {
+	Function      string
+	ReturnAddress uint32
+	SP            int32
+}
+
+func (frame StackFrame) String() string {
+	return fmt.Sprintf("%s (ret %d, sp %d)", frame.Function, frame.ReturnAddress, frame.SP)
+}
+
+// innermost frame first
+func (cpu *CPU) CallStack() []StackFrame {
+	frames := slices.Clone(cpu.callStack)
+	slices.Reverse(frames)
+	return frames
+}
+
+// name of the label at an address, or the address itself if none
+func (cpu *CPU) labelAt(address uint32) string {
+	var names []string
+	for label, labelAddress := range cpu.Labels {
+		if labelAddress == address {
+			names = append(names, label)
+		}
+	}
+
+	if len(names) == 0 {
+		return fmt.Sprintf("%d", address)
+	}
+
+	// prefer global names over compiler generated local labels
+	slices.SortFunc(names, func(a, b string) int {
+		aLocal, bLocal := strings.HasPrefix(a, "."), strings.HasPrefix(b, ".")
+		if aLocal != bLocal {
+			if aLocal {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a, b)
+	})
+
+	return names[0]
+}
+
+func (cpu *CPU) pushFrame(target, returnAddress uint32) {
+	cpu.callStack = append(cpu.callStack, StackFrame{
+		Function:      cpu.labelAt(target),
+		ReturnAddress: returnAddress,
+		SP:            cpu.Registers[cpu.Arch.StackPointer()],
+	})
+}
+
+// pops up to and including the frame returning to target, if there is one
+func (cpu *CPU) popFrame(target uint32) {
+	for i := len(cpu.callStack) - 1; i >= 0; i-- {
+		if cpu.callStack[i].ReturnAddress == target {
+			cpu.callStack = cpu.callStack[:i]
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package riscv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// verifies the contents of a memory region once the program halts
+type Checker interface {
+	Name() string
+	Check(region []byte) error
+}
+
+// region holds signed words in ascending order
+type SortedAscending struct {
+	// of the words, the checking cpu's when nil
+	Order binary.ByteOrder
+}
+
+func (checker SortedAscending) Name() string {
+	return "sorted"
+}
+
+func (checker SortedAscending) Check(region []byte) error {
+	if len(region)%4 != 0 {
+		return fmt.Errorf("region size %d is not a multiple of 4", len(region))
+	}
+
+	order := checker.Order
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	for i := 4; i < len(region); i += 4 {
+		prev := int32(order.Uint32(region[i-4:]))
+		curr := int32(order.Uint32(region[i:]))
+		if curr < prev {
+			return fmt.Errorf("word %d (%d) is less than word %d (%d)", i/4, curr, i/4-1, prev)
+		}
+	}
+
+	return nil
+}
+
+// region is byte-for-byte equal to the contents of a file
+type EqualsFile struct {
+	Path string
+}
+
+func (checker EqualsFile) Name() string {
+	return "file " + checker.Path
+}
+
+func (checker EqualsFile) Check(region []byte) error {
+	expected, err := os.ReadFile(checker.Path)
+	if err != nil {
+		return err
+	}
+
+	if len(expected) != len(region) {
+		return fmt.Errorf("file is %d bytes, region is %d bytes", len(expected), len(region))
+	}
+
+	if i := firstDifference(expected, region); i >= 0 {
+		return fmt.Errorf("byte %d differs: expected %d, got %d", i, expected[i], region[i])
+	}
+
+	return nil
+}
+
+// region has the given IEEE CRC32 checksum
+type CRC32Matches struct {
+	Sum uint32
+}
+
+func (checker CRC32Matches) Name() string {
+	return fmt.Sprintf("crc32 0x%08x", checker.Sum)
+}
+
+func (checker CRC32Matches) Check(region []byte) error {
+	if sum := crc32.ChecksumIEEE(region); sum != checker.Sum {
+		return fmt.Errorf("checksum is 0x%08x", sum)
+	}
+	return nil
+}
+
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+type attachedChecker struct {
+	region  string
+	checker Checker
+}
+
+type CheckResult struct {
+	Region  string
+	Checker string
+	Err     error
+}
+
+func (result CheckResult) Passed() bool {
+	return result.Err == nil
+}
+
+func (result CheckResult) String() string {
+	if result.Passed() {
+		return fmt.Sprintf("%s %s: PASS", result.Region, result.Checker)
+	}
+	return fmt.Sprintf("%s %s: FAIL (%s)", result.Region, result.Checker, result.Err)
+}
+
+// region is a bookmark name or an address range, resolved when the checks run
+func (cpu *CPU) AttachChecker(region string, checker Checker) {
+	cpu.checkers = append(cpu.checkers, attachedChecker{region: region, checker: checker})
+}
+
+func (cpu *CPU) ClearCheckers() {
+	cpu.checkers = nil
+}
+
+// results from the last time the program halted
+func (cpu *CPU) CheckResults() []CheckResult {
+	return cpu.checkResults
+}
+
+func (cpu *CPU) runCheckers() {
+	cpu.checkResults = nil
+
+	for _, attached := range append(cpu.checkers, cpu.sourceCheckers...) {
+		result := CheckResult{Region: attached.region, Checker: attached.checker.Name()}
+
+		start, end, err := cpu.ResolveRange(attached.region)
+		if err == nil && end > uint32(len(cpu.Memory)) {
+			err = fmt.Errorf("range exceeds memory")
+		}
+
+		checker := attached.checker
+		if sorted, ok := checker.(SortedAscending); ok && sorted.Order == nil {
+			sorted.Order = cpu.byteOrder
+			checker = sorted
+		}
+
+		if err != nil {
+			result.Err = err
+		} else {
+			result.Err = checker.Check(cpu.Memory[start:end])
+		}
+
+		cpu.checkResults = append(cpu.checkResults, result)
+	}
+}
+
+var checkDirectiveRe = regexp.MustCompile(`^\s*\.check\s+(\S+)\s+(\w+)(?:\s+(\S+))?`)
+
+// parses ".check <region> sorted|crc32 <sum>|file <path>"
+func parseCheckDirective(line string) (attachedChecker, bool) {
+	match := checkDirectiveRe.FindStringSubmatch(line)
+	if len(match) != 4 {
+		return attachedChecker{}, false
+	}
+
+	var checker Checker
+
+	switch match[2] {
+	case "sorted":
+		checker = SortedAscending{}
+	case "crc32":
+		sum, err := strconv.ParseUint(match[3], 0, 32)
+		if err != nil {
+			return attachedChecker{}, false
+		}
+		checker = CRC32Matches{Sum: uint32(sum)}
+	case "file":
+		if match[3] == "" {
+			return attachedChecker{}, false
+		}
+		checker = EqualsFile{Path: match[3]}
+	default:
+		return attachedChecker{}, false
+	}
+
+	return attachedChecker{region: match[1], checker: checker}, true
+}
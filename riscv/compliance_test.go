@@ -0,0 +1,121 @@
+//go:build compliance
+
+package riscv
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// go test -tags compliance . -run TestCompliance [-compliance <dir>]
+//
+// Every <name>.s in the directory is run and the words of its signature
+// bookmark are compared with <name>.reference_output, one hex word per line
+// as riscv-arch-test writes them. The arch-test sources need the C
+// preprocessor and data sections, so they have to be ported: store the
+// results into a region and name it with ".bookmark signature <start> <end>".
+var complianceDir = flag.String("compliance", filepath.Join("testdata", "compliance"), "directory of compliance tests")
+
+const complianceMaxSteps = 1000000
+
+func readReference(path string) ([]uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var words []uint32
+	for i, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		word, err := strconv.ParseUint(line, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		words = append(words, uint32(word))
+	}
+	return words, nil
+}
+
+// the differences between a test's signature and its reference, or why it
+// couldn't run
+func runCompliance(sourcePath string) []string {
+	source, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	reference, err := readReference(strings.TrimSuffix(sourcePath, ".s") + ".reference_output")
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	cpu := NewCPU(1024 * 64)
+	cpu.SetStepBudget(complianceMaxSteps)
+	cpu.LoadInstructions(strings.Split(string(source), "\n"))
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) > 0 {
+		return []string{fmt.Sprintf("does not assemble: %s", diagnostics[0])}
+	}
+
+	cpu.RunProgram()
+	if err := cpu.Err(); err != nil {
+		return []string{fmt.Sprintf("did not finish: %s", err)}
+	}
+
+	start, end, err := cpu.ResolveRange("signature")
+	if err != nil {
+		return []string{"no signature bookmark"}
+	}
+
+	var diffs []string
+	if words := int(end-start) / 4; words != len(reference) {
+		diffs = append(diffs, fmt.Sprintf("signature is %d words, reference is %d", words, len(reference)))
+	}
+	for i, expected := range reference {
+		address := start + uint32(i)*4
+		if address+4 > end {
+			break
+		}
+		if actual := binary.LittleEndian.Uint32(cpu.Memory[address:]); actual != expected {
+			diffs = append(diffs, fmt.Sprintf("word %d at 0x%04x: expected %08x, got %08x", i, address, expected, actual))
+		}
+	}
+	return diffs
+}
+
+func TestCompliance(t *testing.T) {
+	sources, err := filepath.Glob(filepath.Join(*complianceDir, "*.s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) == 0 {
+		t.Fatalf("no tests in %s", *complianceDir)
+	}
+
+	// arch-test names start with the instruction, e.g. lh-align-01
+	var failing []string
+	for _, sourcePath := range sources {
+		name := strings.TrimSuffix(filepath.Base(sourcePath), ".s")
+
+		t.Run(name, func(t *testing.T) {
+			diffs := runCompliance(sourcePath)
+			for _, diff := range diffs {
+				t.Error(diff)
+			}
+			if instr, _, _ := strings.Cut(name, "-"); len(diffs) > 0 && !slices.Contains(failing, instr) {
+				failing = append(failing, instr)
+			}
+		})
+	}
+
+	if len(failing) > 0 {
+		t.Errorf("non-conformant: %s", strings.Join(failing, ", "))
+	}
+}
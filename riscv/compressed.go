@@ -0,0 +1,283 @@
+package riscv
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a C extension instruction. It runs as the 32 bit instruction it expands to
+// but takes 2 bytes, so the pc moves on by 2 and links save pc+2.
+type CompressedInstr struct {
+	Instr
+}
+
+// the 32 bit instruction a compressed one runs as
+func baseInstr(instr Instr) Instr {
+	if compressed, ok := instr.(*CompressedInstr); ok {
+		return compressed.Instr
+	}
+	return instr
+}
+
+// the size in bytes an instruction takes up
+func instrSize(instr Instr) uint32 {
+	if _, ok := instr.(*CompressedInstr); ok {
+		return 2
+	}
+	return 4
+}
+
+// the size of a comment and label stripped source line, decided by its
+// mnemonic alone so addresses can be laid out before anything is decoded
+func lineSize(line string) uint32 {
+	if strings.HasPrefix(line, "c.") {
+		return 2
+	}
+	return 4
+}
+
+// the address of the instruction after the one running
+func (cpu *CPU) nextPC() uint32 {
+	return cpu.PC + cpu.instrSize
+}
+
+// jumps must land on a 2 byte boundary once the program uses compressed
+// instructions, otherwise on a 4 byte one
+func (cpu *CPU) instrAlign() uint32 {
+	if cpu.compressed {
+		return 2
+	}
+	return 4
+}
+
+var compressedMemRe = regexp.MustCompile(`^(-?\w+)\((\w+)\)$`)
+
+// turns the operands of a compressed instruction into the 32 bit instruction
+// it stands for, checking the tighter register and immediate limits
+type compressedForm struct {
+	operands int
+	expand   func(mnemonic string, ops []string) (string, error)
+}
+
+var compressedForms = map[string]compressedForm{
+	"c.nop": {0, func(mnemonic string, ops []string) (string, error) {
+		return "addi zero, zero, 0", nil
+	}},
+	"c.addi": {2, func(mnemonic string, ops []string) (string, error) {
+		_, immErr := compressedImm(mnemonic, ops[1], -32, 31, 1)
+		return fmt.Sprintf("addi %s, %s, %s", ops[0], ops[0], ops[1]), cmp.Or(nonZeroRegister(mnemonic, ops[0]), immErr)
+	}},
+	"c.li": {2, func(mnemonic string, ops []string) (string, error) {
+		_, immErr := compressedImm(mnemonic, ops[1], -32, 31, 1)
+		return fmt.Sprintf("addi %s, zero, %s", ops[0], ops[1]), cmp.Or(nonZeroRegister(mnemonic, ops[0]), immErr)
+	}},
+	"c.lui": {2, func(mnemonic string, ops []string) (string, error) {
+		if err := nonZeroRegister(mnemonic, ops[0]); err != nil {
+			return "", err
+		}
+		if abiToRegister[ops[0]] == abiToRegister["sp"] {
+			return "", fmt.Errorf("%s can't write sp, use c.addi16sp", mnemonic)
+		}
+		// a sign extended 6 bit value in bits 17..12
+		imm, err := parseImmRange(mnemonic, ops[1], 0, 1<<20-1)
+		if err != nil {
+			return "", err
+		}
+		if imm == 0 || (imm > 31 && imm < 0xfffe0) {
+			return "", fmt.Errorf("immediate %s out of range for %s, expected 1 to 31 or 0xfffe0 to 0xfffff", ops[1], mnemonic)
+		}
+		return fmt.Sprintf("lui %s, %s", ops[0], ops[1]), nil
+	}},
+	"c.addi16sp": {2, func(mnemonic string, ops []string) (string, error) {
+		if err := stackPointer(mnemonic, ops[0]); err != nil {
+			return "", err
+		}
+		imm, err := compressedImm(mnemonic, ops[1], -512, 496, 16)
+		return fmt.Sprintf("addi sp, sp, %s", ops[1]), cmp.Or(err, nonZeroImm(mnemonic, imm))
+	}},
+	"c.addi4spn": {3, func(mnemonic string, ops []string) (string, error) {
+		if err := cmp.Or(compressedRegister(mnemonic, ops[0]), stackPointer(mnemonic, ops[1])); err != nil {
+			return "", err
+		}
+		imm, err := compressedImm(mnemonic, ops[2], 0, 1020, 4)
+		return fmt.Sprintf("addi %s, sp, %s", ops[0], ops[2]), cmp.Or(err, nonZeroImm(mnemonic, imm))
+	}},
+	"c.slli": {2, func(mnemonic string, ops []string) (string, error) {
+		_, immErr := compressedImm(mnemonic, ops[1], 1, 31, 1)
+		return fmt.Sprintf("slli %s, %s, %s", ops[0], ops[0], ops[1]), cmp.Or(nonZeroRegister(mnemonic, ops[0]), immErr)
+	}},
+	"c.srli": {2, compressedShift("srli")},
+	"c.srai": {2, compressedShift("srai")},
+	"c.andi": {2, func(mnemonic string, ops []string) (string, error) {
+		_, immErr := compressedImm(mnemonic, ops[1], -32, 31, 1)
+		return fmt.Sprintf("andi %s, %s, %s", ops[0], ops[0], ops[1]), cmp.Or(compressedRegister(mnemonic, ops[0]), immErr)
+	}},
+	"c.mv": {2, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("add %s, zero, %s", ops[0], ops[1]), cmp.Or(nonZeroRegister(mnemonic, ops[0]), nonZeroRegister(mnemonic, ops[1]))
+	}},
+	"c.add": {2, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("add %s, %s, %s", ops[0], ops[0], ops[1]), cmp.Or(nonZeroRegister(mnemonic, ops[0]), nonZeroRegister(mnemonic, ops[1]))
+	}},
+	"c.sub": {2, compressedArith("sub")},
+	"c.xor": {2, compressedArith("xor")},
+	"c.or":  {2, compressedArith("or")},
+	"c.and": {2, compressedArith("and")},
+	"c.lw": {2, func(mnemonic string, ops []string) (string, error) {
+		offset, base, err := compressedMem(mnemonic, ops[1])
+		if err != nil {
+			return "", err
+		}
+		_, immErr := compressedImm(mnemonic, offset, 0, 124, 4)
+		return fmt.Sprintf("lw %s, %s(%s)", ops[0], offset, base), cmp.Or(compressedRegister(mnemonic, ops[0]), compressedRegister(mnemonic, base), immErr)
+	}},
+	"c.sw": {2, func(mnemonic string, ops []string) (string, error) {
+		offset, base, err := compressedMem(mnemonic, ops[1])
+		if err != nil {
+			return "", err
+		}
+		_, immErr := compressedImm(mnemonic, offset, 0, 124, 4)
+		return fmt.Sprintf("sw %s, %s(%s)", ops[0], offset, base), cmp.Or(compressedRegister(mnemonic, ops[0]), compressedRegister(mnemonic, base), immErr)
+	}},
+	"c.lwsp": {2, func(mnemonic string, ops []string) (string, error) {
+		offset, base, err := compressedMem(mnemonic, ops[1])
+		if err != nil {
+			return "", err
+		}
+		_, immErr := compressedImm(mnemonic, offset, 0, 252, 4)
+		return fmt.Sprintf("lw %s, %s(sp)", ops[0], offset), cmp.Or(nonZeroRegister(mnemonic, ops[0]), stackPointer(mnemonic, base), immErr)
+	}},
+	"c.swsp": {2, func(mnemonic string, ops []string) (string, error) {
+		offset, base, err := compressedMem(mnemonic, ops[1])
+		if err != nil {
+			return "", err
+		}
+		_, regErr := getRegisterNumber(ops[0])
+		_, immErr := compressedImm(mnemonic, offset, 0, 252, 4)
+		return fmt.Sprintf("sw %s, %s(sp)", ops[0], offset), cmp.Or(regErr, stackPointer(mnemonic, base), immErr)
+	}},
+	"c.j": {1, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("jal zero, %s", ops[0]), checkOffset(mnemonic, ops[0], 12)
+	}},
+	"c.jal": {1, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("jal ra, %s", ops[0]), checkOffset(mnemonic, ops[0], 12)
+	}},
+	"c.jr": {1, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("jalr zero, %s, 0", ops[0]), nonZeroRegister(mnemonic, ops[0])
+	}},
+	"c.jalr": {1, func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("jalr ra, %s, 0", ops[0]), nonZeroRegister(mnemonic, ops[0])
+	}},
+	"c.beqz": {2, compressedBranch("beq")},
+	"c.bnez": {2, compressedBranch("bne")},
+	"c.ebreak": {0, func(mnemonic string, ops []string) (string, error) {
+		return "ebreak", nil
+	}},
+}
+
+func compressedShift(base string) func(string, []string) (string, error) {
+	return func(mnemonic string, ops []string) (string, error) {
+		_, immErr := compressedImm(mnemonic, ops[1], 1, 31, 1)
+		return fmt.Sprintf("%s %s, %s, %s", base, ops[0], ops[0], ops[1]), cmp.Or(compressedRegister(mnemonic, ops[0]), immErr)
+	}
+}
+
+func compressedArith(base string) func(string, []string) (string, error) {
+	return func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("%s %s, %s, %s", base, ops[0], ops[0], ops[1]), cmp.Or(compressedRegister(mnemonic, ops[0]), compressedRegister(mnemonic, ops[1]))
+	}
+}
+
+func compressedBranch(base string) func(string, []string) (string, error) {
+	return func(mnemonic string, ops []string) (string, error) {
+		return fmt.Sprintf("%s %s, zero, %s", base, ops[0], ops[1]), cmp.Or(compressedRegister(mnemonic, ops[0]), checkOffset(mnemonic, ops[1], 9))
+	}
+}
+
+// the 3 bit register fields only reach x8 to x15
+func compressedRegister(mnemonic, name string) error {
+	register, err := getRegisterNumber(name)
+	if err != nil {
+		return err
+	}
+	if register < 8 || register > 15 {
+		return fmt.Errorf("%s needs a register from x8 to x15 (s0, s1, a0 to a5), got %s", mnemonic, name)
+	}
+	return nil
+}
+
+func nonZeroRegister(mnemonic, name string) error {
+	register, err := getRegisterNumber(name)
+	if err != nil {
+		return err
+	}
+	if register == 0 {
+		return fmt.Errorf("%s can't use x0", mnemonic)
+	}
+	return nil
+}
+
+func stackPointer(mnemonic, name string) error {
+	if register, ok := abiToRegister[name]; !ok || register != abiToRegister["sp"] {
+		return fmt.Errorf("%s only works on sp, got %s", mnemonic, name)
+	}
+	return nil
+}
+
+// an immediate between min and max that is a multiple of scale
+func compressedImm(mnemonic, imm_str string, min, max int64, scale int32) (int32, error) {
+	imm, err := parseImmRange(mnemonic, imm_str, min, max)
+	if err != nil {
+		return 0, err
+	}
+	if imm%scale != 0 {
+		return 0, fmt.Errorf("immediate %s for %s must be a multiple of %d", imm_str, mnemonic, scale)
+	}
+	return imm, nil
+}
+
+func nonZeroImm(mnemonic string, imm int32) error {
+	if imm == 0 {
+		return fmt.Errorf("immediate for %s can't be 0", mnemonic)
+	}
+	return nil
+}
+
+// splits "offset(base)"
+func compressedMem(mnemonic, operand string) (string, string, error) {
+	match := compressedMemRe.FindStringSubmatch(operand)
+	if match == nil {
+		return "", "", fmt.Errorf("invalid operands for %s", mnemonic)
+	}
+	if _, err := strconv.ParseInt(match[1], 0, 32); err != nil {
+		return "", "", fmt.Errorf("immediate parse error: %s", match[1])
+	}
+	return match[1], match[2], nil
+}
+
+// expands a compressed instruction and decodes what it expands to
+func decodeCompressed(mnemonic string, line string) (Instr, error) {
+	form := compressedForms[mnemonic]
+
+	var ops []string
+	if rest := strings.TrimSpace(strings.TrimPrefix(line, mnemonic)); rest != "" {
+		for _, op := range strings.Split(rest, ",") {
+			ops = append(ops, strings.TrimSpace(op))
+		}
+	}
+	if len(ops) != form.operands {
+		return nil, fmt.Errorf("invalid operands for %s", mnemonic)
+	}
+
+	expanded, err := form.expand(mnemonic, ops)
+	if err != nil {
+		return nil, err
+	}
+	instr, err := decodeInstr(expanded)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedInstr{Instr: instr}, nil
+}
@@ -0,0 +1,182 @@
+package riscv
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// how often each instruction of the program has run. It adds up across runs
+// until a different program is loaded or ClearCoverage.
+type instrCoverage struct {
+	count, taken, notTaken uint64
+}
+
+// one instruction of the program and how much it was exercised
+type CoveredInstr struct {
+	Address uint32
+	Line    int // 1-based source line
+	Source  string
+	Count   uint64 // times it ran
+	// for conditional branches, the times each way was taken
+	Branch   bool   `json:",omitempty"`
+	Taken    uint64 `json:",omitempty"`
+	NotTaken uint64 `json:",omitempty"`
+}
+
+// whether a conditional branch has gone both ways
+func (instr CoveredInstr) BothWays() bool {
+	return instr.Taken > 0 && instr.NotTaken > 0
+}
+
+func (instr CoveredInstr) String() string {
+	text := fmt.Sprintf("0x%04x line %d: %s", instr.Address, instr.Line, instr.Source)
+	if instr.Branch && instr.Count > 0 && !instr.BothWays() {
+		if instr.Taken == 0 {
+			return text + ", never taken"
+		}
+		return text + ", always taken"
+	}
+	return text
+}
+
+// which instructions of a program ran, and which branches went both ways
+type Coverage struct {
+	Instructions int
+	Executed     int
+	Branches     int
+	BothWays     int
+	Covered      []CoveredInstr
+}
+
+func newCoverage(instrs []CoveredInstr) Coverage {
+	coverage := Coverage{Instructions: len(instrs), Covered: instrs}
+	for _, instr := range instrs {
+		if instr.Count > 0 {
+			coverage.Executed++
+		}
+		if instr.Branch {
+			coverage.Branches++
+			if instr.BothWays() {
+				coverage.BothWays++
+			}
+		}
+	}
+	return coverage
+}
+
+// the fraction of instructions that ran
+func (coverage Coverage) Ratio() float64 {
+	if coverage.Instructions == 0 {
+		return 0
+	}
+	return float64(coverage.Executed) / float64(coverage.Instructions)
+}
+
+// every source line with an instruction on it, and whether any of them ran
+func (coverage Coverage) Lines() map[int]bool {
+	lines := make(map[int]bool)
+	for _, instr := range coverage.Covered {
+		lines[instr.Line] = lines[instr.Line] || instr.Count > 0
+	}
+	return lines
+}
+
+// the instructions that never ran and the branches that only went one way
+func (coverage Coverage) Gaps() []CoveredInstr {
+	var gaps []CoveredInstr
+	for _, instr := range coverage.Covered {
+		if instr.Count == 0 || instr.Branch && !instr.BothWays() {
+			gaps = append(gaps, instr)
+		}
+	}
+	return gaps
+}
+
+func (coverage Coverage) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d of %d instructions run (%.1f%%), %d of %d branches both ways\n",
+		coverage.Executed, coverage.Instructions, coverage.Ratio()*100, coverage.BothWays, coverage.Branches)
+	for _, instr := range coverage.Gaps() {
+		if instr.Count == 0 {
+			fmt.Fprintf(&builder, "never run %s\n", instr)
+		} else {
+			fmt.Fprintf(&builder, "one way %s\n", instr)
+		}
+	}
+	return builder.String()
+}
+
+func (coverage Coverage) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(coverage)
+}
+
+// adds up the coverage of harts running the same program, by address
+func MergeCoverage(coverages ...Coverage) Coverage {
+	indexes := make(map[uint32]int)
+	var merged []CoveredInstr
+	for _, coverage := range coverages {
+		for _, instr := range coverage.Covered {
+			index, ok := indexes[instr.Address]
+			if !ok {
+				indexes[instr.Address] = len(merged)
+				merged = append(merged, instr)
+				continue
+			}
+			merged[index].Count += instr.Count
+			merged[index].Taken += instr.Taken
+			merged[index].NotTaken += instr.NotTaken
+		}
+	}
+
+	slices.SortFunc(merged, func(a, b CoveredInstr) int { return cmp.Compare(a.Address, b.Address) })
+	return newCoverage(merged)
+}
+
+// how much of the program has run since it was loaded or ClearCoverage
+func (cpu *CPU) Coverage() Coverage {
+	instrs := make([]CoveredInstr, len(cpu.program))
+	for instr_num, entry := range cpu.Listing() {
+		instr := CoveredInstr{Address: entry.Address, Line: entry.Line, Source: entry.Source, Branch: isConditionalBranch(cpu.program[instr_num])}
+		if instr_num < len(cpu.coverage) {
+			counts := cpu.coverage[instr_num]
+			instr.Count, instr.Taken, instr.NotTaken = counts.count, counts.taken, counts.notTaken
+		}
+		instrs[instr_num] = instr
+	}
+	return newCoverage(instrs)
+}
+
+func (cpu *CPU) ClearCoverage() {
+	cpu.coverage = make([]instrCoverage, len(cpu.program))
+}
+
+func isConditionalBranch(instr Instr) bool {
+	switch baseInstr(instr).(type) {
+	case *BranchThreeInstr, *BranchTwoInstr:
+		return true
+	}
+	return false
+}
+
+// counts an executed instruction, one that trapped included. nextPC is the
+// PC after it retired, and a branch that trapped went neither way.
+func (cpu *CPU) recordCoverage(pc uint32, instr_num int, instr Instr, nextPC uint32, retired bool) {
+	if instr_num >= len(cpu.coverage) {
+		return
+	}
+	counts := &cpu.coverage[instr_num]
+	counts.count++
+	if retired && isConditionalBranch(instr) {
+		if nextPC != pc+instrSize(instr) {
+			counts.taken++
+		} else {
+			counts.notTaken++
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package riscv
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	CSRMstatus  uint16 = 0x300
+	CSRMisa     uint16 = 0x301
+	CSRMie      uint16 = 0x304
+	CSRMtvec    uint16 = 0x305
+	CSRMscratch uint16 = 0x340
+	CSRMepc     uint16 = 0x341
+	CSRMcause   uint16 = 0x342
+	CSRMtval    uint16 = 0x343
+	CSRMip      uint16 = 0x344
+	CSRMcycle   uint16 = 0xB00
+	CSRMinstret uint16 = 0xB02
+	CSRCycle    uint16 = 0xC00
+	CSRTime     uint16 = 0xC01
+	CSRInstret  uint16 = 0xC02
+	CSRCycleh   uint16 = 0xC80
+	CSRTimeh    uint16 = 0xC81
+	CSRInstreth uint16 = 0xC82
+	CSRMhartid  uint16 = 0xF14
+)
+
+type CSRInfo struct {
+	Name    string
+	Address uint16
+}
+
+// implemented CSRs in display order
+var CSRList = []CSRInfo{
+	{"mstatus", CSRMstatus},
+	{"misa", CSRMisa},
+	{"mie", CSRMie},
+	{"mtvec", CSRMtvec},
+	{"mscratch", CSRMscratch},
+	{"mepc", CSRMepc},
+	{"mcause", CSRMcause},
+	{"mtval", CSRMtval},
+	{"mip", CSRMip},
+	{"mcycle", CSRMcycle},
+	{"minstret", CSRMinstret},
+	{"cycle", CSRCycle},
+	{"time", CSRTime},
+	{"instret", CSRInstret},
+	{"cycleh", CSRCycleh},
+	{"timeh", CSRTimeh},
+	{"instreth", CSRInstreth},
+	{"mhartid", CSRMhartid},
+}
+
+var csrNameToAddress = func() map[string]uint16 {
+	names := make(map[string]uint16, len(CSRList))
+	for _, csr := range CSRList {
+		names[csr.Name] = csr.Address
+	}
+	return names
+}()
+
+// RV32IMA with Zicsr
+const misaRV32IMA = 1<<30 | 1<<('I'-'A') | 1<<('M'-'A') | 1<<('A'-'A')
+
+func parseCSR(csr_str string) (uint16, error) {
+	if address, ok := csrNameToAddress[csr_str]; ok {
+		return address, nil
+	}
+
+	if address, err := strconv.ParseUint(csr_str, 0, 12); err == nil {
+		if _, ok := csrName(uint16(address)); ok {
+			return uint16(address), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid csr: %s", csr_str)
+}
+
+func csrName(address uint16) (string, bool) {
+	for _, csr := range CSRList {
+		if csr.Address == address {
+			return csr.Name, true
+		}
+	}
+	return "", false
+}
+
+// the top two address bits are 0b11 for read-only CSRs
+func csrReadOnly(address uint16) bool {
+	return address>>10 == 0b11
+}
+
+func (cpu *CPU) resetCSRs() {
+	cpu.csrs = map[uint16]int32{
+		CSRMisa: misaRV32IMA,
+	}
+	cpu.instret = 0
+}
+
+func (cpu *CPU) ReadCSR(address uint16) int32 {
+	switch address {
+	case CSRCycle, CSRMcycle, CSRTime, CSRInstret, CSRMinstret:
+		return int32(cpu.instret)
+	case CSRCycleh, CSRTimeh, CSRInstreth:
+		return int32(cpu.instret >> 32)
+	case CSRMip:
+		return cpu.csrs[CSRMip] | cpu.pendingInterrupts()
+	}
+	return cpu.csrs[address]
+}
+
+// writes by instructions, which can't modify read-only CSRs
+func (cpu *CPU) writeCSR(address uint16, value int32) error {
+	if csrReadOnly(address) {
+		name, _ := csrName(address)
+		return fmt.Errorf("csr %s is read-only", name)
+	}
+
+	switch address {
+	case CSRMisa:
+		// writes are ignored, the extensions are fixed
+		return nil
+	case CSRMcycle, CSRMinstret:
+		cpu.setCounter(value, false)
+		return nil
+	case CSRMip:
+		value &^= deviceInterruptBits
+	}
+
+	cpu.csrs[address] = value
+	return nil
+}
+
+// sets any CSR, read-only ones included, e.g. for the debugger or tests.
+// The counters share one 64 bit count, so setting any of cycle, time and
+// instret sets all three, and the h CSRs set its upper half.
+func (cpu *CPU) SetCSR(address uint16, value int32) {
+	switch address {
+	case CSRCycle, CSRMcycle, CSRTime, CSRInstret, CSRMinstret:
+		cpu.setCounter(value, false)
+		return
+	case CSRCycleh, CSRTimeh, CSRInstreth:
+		cpu.setCounter(value, true)
+		return
+	case CSRMip:
+		value &^= deviceInterruptBits
+	}
+	cpu.csrs[address] = value
+}
+
+// replaces the lower or upper half of the count the counter CSRs read
+func (cpu *CPU) setCounter(value int32, upper bool) {
+	if upper {
+		cpu.instret = uint64(uint32(value))<<32 | cpu.instret&0xFFFFFFFF
+		return
+	}
+	cpu.instret = cpu.instret&^0xFFFFFFFF | uint64(uint32(value))
+}
@@ -0,0 +1,164 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// the registers and immediate of a custom instruction, 0 when unused
+type Operands struct {
+	Rd, Rs1, Rs2 int
+	Imm          int32
+}
+
+// turns a comment-stripped source line into the instruction's operands
+type Parser func(line string) (Operands, error)
+
+// runs a custom instruction. The pc moves on to the next instruction unless
+// the executor changes cpu.PC, so an executor can't jump to itself.
+type Executor func(cpu *CPU, operands Operands)
+
+// parsers for the usual operand shapes, using the same patterns as the built
+// in instructions of that shape
+var (
+	// rd, rs1, rs2 like add
+	RegisterOperands = operandParser(threePtRe, func(tokens []string) (Operands, error) {
+		regs, err := getRegisterNumbers(tokens[1], tokens[2], tokens[3])
+		if err != nil {
+			return Operands{}, err
+		}
+		return Operands{Rd: int(regs[0]), Rs1: int(regs[1]), Rs2: int(regs[2])}, nil
+	})
+	// rd, rs1, imm like addi, with a signed 12 bit immediate
+	ImmediateOperands = operandParser(threePtRe, func(tokens []string) (Operands, error) {
+		regs, err := getRegisterNumbers(tokens[1], tokens[2])
+		if err != nil {
+			return Operands{}, err
+		}
+		imm, err := parseImmRange(tokens[0], tokens[3], -2048, 2047)
+		return Operands{Rd: int(regs[0]), Rs1: int(regs[1]), Imm: imm}, err
+	})
+	// rd, imm like lui, with a 20 bit immediate
+	UpperOperands = operandParser(twoPtImmRe, func(tokens []string) (Operands, error) {
+		rd, err := getRegisterNumber(tokens[1])
+		if err != nil {
+			return Operands{}, err
+		}
+		imm, err := parseImmRange(tokens[0], tokens[2], 0, 1<<20-1)
+		return Operands{Rd: int(rd), Imm: imm}, err
+	})
+	// rd, imm(rs1) like lw, with a signed 12 bit offset
+	MemoryOperands = operandParser(loadStoreRe, func(tokens []string) (Operands, error) {
+		regs, err := getRegisterNumbers(tokens[1], tokens[3])
+		if err != nil {
+			return Operands{}, err
+		}
+		imm, err := parseImmRange(tokens[0], tokens[2], -2048, 2047)
+		return Operands{Rd: int(regs[0]), Rs1: int(regs[1]), Imm: imm}, err
+	})
+	// nothing after the mnemonic, like ebreak
+	NoOperands Parser = func(line string) (Operands, error) {
+		if match := firstTokenRe.FindString(line); match != line {
+			return Operands{}, errors.New("expected no operands")
+		}
+		return Operands{}, nil
+	}
+)
+
+// a parser that matches re and hands the submatches, starting with the
+// mnemonic, to parse
+func operandParser(re *regexp.Regexp, parse func(tokens []string) (Operands, error)) Parser {
+	return func(line string) (Operands, error) {
+		tokens := re.FindStringSubmatch(line)
+		if len(tokens) == 0 {
+			return Operands{}, errors.New("invalid operands")
+		}
+		return parse(tokens[1:])
+	}
+}
+
+type customInstrDef struct {
+	mnemonic string
+	parse    Parser
+	execute  Executor
+}
+
+var (
+	customInstrsMu sync.RWMutex
+	customInstrs   = map[string]customInstrDef{}
+)
+
+// adds an instruction to the assembler without touching the op maps. It
+// should be called before anything is assembled, typically from an init
+// function, since CPUs keep the decoding of lines they have already seen.
+// Built in mnemonics can't be replaced.
+func RegisterInstruction(mnemonic string, parser Parser, executor Executor) error {
+	if firstTokenRe.FindString(mnemonic) != mnemonic {
+		return fmt.Errorf("invalid mnemonic: %q", mnemonic)
+	}
+	if parser == nil || executor == nil {
+		return fmt.Errorf("%s needs a parser and an executor", mnemonic)
+	}
+	if _, ok := lookupSpec(mnemonic); ok {
+		return fmt.Errorf("%s is a built in instruction", mnemonic)
+	}
+
+	customInstrsMu.Lock()
+	defer customInstrsMu.Unlock()
+
+	if _, ok := customInstrs[mnemonic]; ok {
+		return fmt.Errorf("%s is already registered", mnemonic)
+	}
+	customInstrs[mnemonic] = customInstrDef{mnemonic: mnemonic, parse: parser, execute: executor}
+	return nil
+}
+
+func lookupCustomInstr(mnemonic string) (customInstrDef, bool) {
+	customInstrsMu.RLock()
+	defer customInstrsMu.RUnlock()
+
+	def, ok := customInstrs[mnemonic]
+	return def, ok
+}
+
+func (def customInstrDef) decode(line string) (Instr, error) {
+	operands, err := def.parse(line)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", def.mnemonic, err)
+	}
+
+	for _, register := range []int{operands.Rd, operands.Rs1, operands.Rs2} {
+		if register < 0 || register >= 32 {
+			return nil, fmt.Errorf("%s: invalid register: x%d", def.mnemonic, register)
+		}
+	}
+
+	return &customInstr{operands: operands, execute: def.execute}, nil
+}
+
+type customInstr struct {
+	operands Operands
+	execute  Executor
+}
+
+func (instr *customInstr) Operate(cpu *CPU) {
+	pc := cpu.PC
+	instr.execute(cpu, instr.operands)
+	if cpu.PC == pc {
+		cpu.PC = cpu.nextPC()
+	}
+}
+
+// writes a custom instruction's result to a register as the running
+// instruction, so the write is traced, recorded and checked against watches
+// like any other. A register out of range raises an illegal instruction
+// exception, so it's only for use from an executor. Writes to x0 are
+// discarded.
+func (cpu *CPU) WriteResult(register int, value int32) {
+	if register < 0 || register >= len(cpu.Registers) {
+		cpu.raise(ExcIllegalInstruction, 0)
+	}
+	cpu.setRegister(int8(register), value)
+}
@@ -0,0 +1,343 @@
+package riscv
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// what a data label holds, from the first directive that puts something
+// after it
+type DataType int
+
+const (
+	DataNone   DataType = iota // a text label, or a data label with nothing after it
+	DataWord                   // .word
+	DataHalf                   // .half and .short
+	DataByte                   // .byte
+	DataString                 // .string, .asciz and .ascii
+	DataSpace                  // .space, .zero and .skip
+)
+
+func (dataType DataType) String() string {
+	return [...]string{"", "word", "half", "byte", "string", "space"}[dataType]
+}
+
+func (dataType DataType) elementSize() uint32 {
+	switch dataType {
+	case DataWord:
+		return 4
+	case DataHalf:
+		return 2
+	}
+	return 1
+}
+
+// a line of the .data section laid out in memory. Values are assembled once
+// every label has an address.
+type dataLine struct {
+	line      int // index into instructions
+	address   uint32
+	size      uint32
+	dataType  DataType
+	directive string
+	operands  []string
+	bytes     []byte
+	err       error
+}
+
+// the data section of a program as laid out by layoutSource
+type dataSection struct {
+	lines  []dataLine
+	labels map[string]int // index into instructions each label is defined on
+	end    uint64
+}
+
+// ".data" and ".section .data" start the data section, ".text" goes back to
+// the code. .rodata and .bss are data too.
+var sectionRe = regexp.MustCompile(`^(?:\.section\s+)?\.(text|data|rodata|bss)\b`)
+
+var dataDirectiveRe = regexp.MustCompile(`^\.(\w+)\s*(.*)$`)
+
+// whether a comment-stripped line starts a section, and whether that section
+// is data
+func parseSection(line string) (isData, ok bool) {
+	match := sectionRe.FindStringSubmatch(line)
+	if match == nil {
+		return false, false
+	}
+	return match[1] != "text", true
+}
+
+// the operands of a directive split on commas, except inside strings
+func splitDataOperands(operands string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted, escaped := false, false
+	for _, r := range operands {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if text := strings.TrimSpace(field.String()); text != "" || len(fields) > 0 {
+		fields = append(fields, text)
+	}
+	return fields
+}
+
+// lays out a line of the data section at offset bytes into it. Directives
+// that don't hold data, like .global, take no space, and a line that would
+// run past limit bytes is an error and takes none either.
+func layoutDataLine(line string, offset, limit uint32) dataLine {
+	if line == "" {
+		return dataLine{}
+	}
+	if isInstructionLine(line) {
+		return dataLine{err: errors.New("instructions belong in .text, not the data section")}
+	}
+
+	match := dataDirectiveRe.FindStringSubmatch(line)
+	if match == nil {
+		return dataLine{}
+	}
+	data := dataLine{directive: match[1], operands: splitDataOperands(match[2])}
+
+	count := uint32(len(data.operands))
+	switch data.directive {
+	case "word":
+		data.dataType, data.size = DataWord, 4*count
+	case "half", "short":
+		data.dataType, data.size = DataHalf, 2*count
+	case "byte":
+		data.dataType, data.size = DataByte, count
+	case "string", "asciz", "ascii":
+		data.dataType = DataString
+		for _, operand := range data.operands {
+			text, err := strconv.Unquote(operand)
+			if err != nil || !strings.HasPrefix(operand, `"`) {
+				data.err = fmt.Errorf("invalid string: %s", operand)
+				return data
+			}
+			data.bytes = append(data.bytes, text...)
+			if data.directive != "ascii" {
+				data.bytes = append(data.bytes, 0)
+			}
+		}
+		data.size = uint32(len(data.bytes))
+	case "space", "zero", "skip":
+		data.dataType = DataSpace
+		if count == 0 || count > 2 {
+			data.err = fmt.Errorf("usage: .%s <size>[, <fill>]", data.directive)
+			return data
+		}
+		size, err := strconv.ParseUint(data.operands[0], 0, 32)
+		if err != nil {
+			data.err = fmt.Errorf("invalid size: %s", data.operands[0])
+			return data
+		}
+		data.size = uint32(size)
+	case "align", "p2align", "balign":
+		if count != 1 {
+			data.err = fmt.Errorf("usage: .%s <alignment>", data.directive)
+			return data
+		}
+		alignment, err := strconv.ParseUint(data.operands[0], 0, 32)
+		if data.directive != "balign" && err == nil && alignment < 32 {
+			alignment = 1 << alignment
+		}
+		if err != nil || alignment == 0 || alignment&(alignment-1) != 0 || alignment > 1<<16 {
+			data.err = fmt.Errorf("invalid alignment: %s", data.operands[0])
+			return data
+		}
+		data.size = uint32((uint64(offset)+alignment-1)&^(alignment-1) - uint64(offset))
+	default:
+		// .global, .check and the like work the same in any section
+		data.operands = nil
+	}
+
+	if uint64(offset)+uint64(data.size) > uint64(limit) {
+		return dataLine{directive: data.directive, err: fmt.Errorf("the data runs past the end of memory at 0x%x", limit)}
+	}
+	return data
+}
+
+// a .word, .half or .byte value: a number that fits, or a label
+func dataValue(labels map[string]uint32, operand string, size uint32) (uint32, error) {
+	if value, err := strconv.ParseInt(operand, 0, 64); err == nil {
+		bits := 8 * size
+		if value < -1<<(bits-1) || value > 1<<bits-1 {
+			return 0, fmt.Errorf("%s doesn't fit in %d bits", operand, bits)
+		}
+		return uint32(value), nil
+	}
+	if value, ok := symbolValue(labels, operand); ok {
+		if size < 4 && value > math.MaxUint32>>(32-8*size) {
+			return 0, fmt.Errorf("%s doesn't fit in %d bits", operand, 8*size)
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf("undefined symbol: %s", operand)
+}
+
+// the bytes the line puts in memory
+func (data *dataLine) assemble(labels map[string]uint32, order binary.ByteOrder) {
+	if data.err != nil {
+		return
+	}
+
+	switch data.dataType {
+	case DataWord, DataHalf, DataByte:
+		size := data.dataType.elementSize()
+		data.bytes = make([]byte, 0, data.size)
+		for _, operand := range data.operands {
+			value, err := dataValue(labels, operand, size)
+			if err != nil {
+				data.err = err
+				return
+			}
+			element := make([]byte, size)
+			switch size {
+			case 4:
+				order.PutUint32(element, value)
+			case 2:
+				order.PutUint16(element, uint16(value))
+			default:
+				element[0] = byte(value)
+			}
+			data.bytes = append(data.bytes, element...)
+		}
+	case DataSpace:
+		var fill uint32
+		if len(data.operands) == 2 {
+			value, err := dataValue(labels, data.operands[1], 1)
+			if err != nil {
+				data.err = err
+				return
+			}
+			fill = value
+		}
+		data.bytes = slices.Repeat([]byte{byte(fill)}, int(data.size))
+	}
+}
+
+// the labels of the data section, each with the type of what follows it and
+// the bytes up to the next one, ordered by address
+func (cpu *CPU) layoutDataSymbols(section dataSection, labels map[string]uint32) {
+	cpu.dataSymbols = nil
+	for name, index := range section.labels {
+		symbol := Symbol{Name: name, Address: labels[name], Kind: SymbolData, Line: cpu.sourceLine(index)}
+		for _, data := range section.lines {
+			if data.address >= symbol.Address && data.size > 0 && data.dataType != DataNone {
+				symbol.Type = data.dataType
+				break
+			}
+		}
+		cpu.dataSymbols = append(cpu.dataSymbols, symbol)
+	}
+
+	slices.SortFunc(cpu.dataSymbols, func(a, b Symbol) int {
+		return cmp.Or(cmp.Compare(a.Address, b.Address), strings.Compare(a.Name, b.Name))
+	})
+	for i, symbol := range cpu.dataSymbols {
+		next := section.end
+		for _, other := range cpu.dataSymbols[i+1:] {
+			if other.Address > symbol.Address {
+				next = uint64(other.Address)
+				break
+			}
+		}
+		cpu.dataSymbols[i].Size = uint32(next - uint64(symbol.Address))
+	}
+}
+
+// assembles the data section, with diagnostics for what can't be, without
+// putting it in memory
+func (cpu *CPU) assembleData(section dataSection, labels map[string]uint32) {
+	cpu.data = section.lines
+	for i := range cpu.data {
+		data := &cpu.data[i]
+		data.assemble(labels, cpu.byteOrder)
+		if data.err != nil {
+			cpu.diagnostics = append(cpu.diagnostics, Diagnostic{Line: cpu.sourceLine(data.line), Message: data.err.Error()})
+		}
+	}
+
+	if len(cpu.data) > 0 {
+		last := cpu.data[len(cpu.data)-1]
+		switch {
+		case section.end > uint64(cpu.MemorySize):
+			cpu.diagnostics = append(cpu.diagnostics, Diagnostic{Line: cpu.sourceLine(last.line), Message: fmt.Sprintf("the data runs past the end of memory at 0x%x", cpu.MemorySize)})
+		case cpu.memoryMap != nil && section.end > uint64(cpu.memoryMap.HeapBase):
+			cpu.diagnostics = append(cpu.diagnostics, Diagnostic{Line: cpu.sourceLine(last.line), Message: fmt.Sprintf("the data runs into the heap at 0x%x", cpu.memoryMap.HeapBase)})
+		}
+	}
+
+	cpu.layoutDataSymbols(section, labels)
+}
+
+// puts the initial values of the data section into memory
+func (cpu *CPU) writeData() {
+	for _, data := range cpu.data {
+		if data.bytes != nil && uint64(data.address)+uint64(len(data.bytes)) <= uint64(len(cpu.Memory)) {
+			copy(cpu.Memory[data.address:], data.bytes)
+		}
+	}
+}
+
+// the labels of the data section ordered by address
+func (cpu *CPU) DataSymbols() []Symbol {
+	return slices.Clone(cpu.dataSymbols)
+}
+
+// the data symbol an address is in, false if it isn't in one. Of labels on
+// the same address the first by name is given.
+func (cpu *CPU) SymbolAt(address uint32) (Symbol, bool) {
+	// the first symbol after the address
+	i, _ := slices.BinarySearchFunc(cpu.dataSymbols, address, func(symbol Symbol, address uint32) int {
+		if symbol.Address <= address {
+			return -1
+		}
+		return 1
+	})
+	if i == 0 {
+		return Symbol{}, false
+	}
+
+	symbol := cpu.dataSymbols[i-1]
+	for i--; i > 0 && cpu.dataSymbols[i-1].Address == symbol.Address; i-- {
+		symbol = cpu.dataSymbols[i-1]
+	}
+	if address >= symbol.Address+symbol.Size {
+		return Symbol{}, false
+	}
+	return symbol, true
+}
+
+// "counter" or "counter+4" for an address in a data symbol, "" for one that
+// isn't
+func (cpu *CPU) symbolName(address uint32) string {
+	symbol, ok := cpu.SymbolAt(address)
+	if !ok {
+		return ""
+	}
+	if address == symbol.Address {
+		return symbol.Name
+	}
+	return fmt.Sprintf("%s+%d", symbol.Name, address-symbol.Address)
+}
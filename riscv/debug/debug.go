@@ -0,0 +1,670 @@
+// Package debug is a gdb style command line over a riscv.Machine. The
+// interface's debugger pane and the --repl mode both run commands through it.
+package debug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+	"github.com/ckashino/riscv_interpreter/riscv/format"
+)
+
+// a parsed command line, e.g. "x/8xw 0x100"
+type Command struct {
+	Name   string // the full name, e.g. "examine" for "x"
+	Args   []string
+	Count  int         // steps for stepi, units for examine
+	Size   int         // bytes per unit for examine: 1, 2 or 4
+	Format format.Mode // for print and examine
+}
+
+var aliases = map[string]string{
+	"p":  "print",
+	"x":  "examine",
+	"b":  "break",
+	"br": "break",
+	"d":  "delete",
+	"si": "stepi",
+	"u":  "until",
+	"c":  "continue",
+	"r":  "run",
+	"i":  "info",
+	"h":  "help",
+}
+
+var commandNames = []string{"print", "examine", "break", "delete", "stepi", "until", "continue", "run", "reset", "set", "watch", "unwatch", "args", "input", "info", "help"}
+
+// gdb's format letters
+var formatLetters = map[rune]format.Mode{
+	'd': format.Decimal,
+	'x': format.Hex,
+	't': format.Binary,
+	'u': format.Unsigned,
+}
+
+var sizeLetters = map[rune]int{'b': 1, 'h': 2, 'w': 4}
+
+func Parse(line string) (Command, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Command{}, errors.New("empty command")
+	}
+
+	name, suffix, _ := strings.Cut(fields[0], "/")
+	if full, ok := aliases[name]; ok {
+		name = full
+	}
+	if !slices.Contains(commandNames, name) {
+		return Command{}, fmt.Errorf("unknown command: %s, try help", name)
+	}
+
+	command := Command{Name: name, Args: fields[1:], Count: 1, Size: 4}
+	if name == "examine" {
+		command.Format = format.Hex
+	}
+
+	if suffix != "" {
+		if name != "print" && name != "examine" {
+			return Command{}, fmt.Errorf("%s doesn't take a /format", name)
+		}
+		if err := parseSuffix(&command, suffix); err != nil {
+			return Command{}, err
+		}
+	}
+
+	switch name {
+	case "set":
+		// "set x5=42" and "set x5 = 42" are the same
+		target, value, found := strings.Cut(strings.Join(command.Args, ""), "=")
+		if !found || target == "" || value == "" {
+			return Command{}, errors.New("usage: set <register|pc|*addr>=<value>")
+		}
+		command.Args = []string{target, value}
+	case "stepi":
+		if len(command.Args) > 0 {
+			count, err := strconv.Atoi(command.Args[0])
+			if err != nil || count < 1 {
+				return Command{}, fmt.Errorf("invalid step count: %s", command.Args[0])
+			}
+			command.Count = count
+		}
+	case "watch":
+		if len(command.Args) == 0 {
+			return Command{}, errors.New("usage: watch <expression>")
+		}
+	case "unwatch":
+		if len(command.Args) != 1 {
+			return Command{}, errors.New("usage: unwatch <id>")
+		}
+	case "args", "input":
+		// quotes and spaces matter, so these take the rest of the line as it is
+		_, rest, _ := strings.Cut(strings.TrimSpace(line), fields[0])
+		if name == "args" {
+			rest = strings.TrimSpace(rest)
+		} else if rest != "" {
+			rest = rest[1:]
+		}
+		command.Args = []string{rest}
+	}
+
+	return command, nil
+}
+
+// "8xw" style counts, format and size letters
+func parseSuffix(command *Command, suffix string) error {
+	digits := len(suffix) - len(strings.TrimLeft(suffix, "0123456789"))
+	if digits > 0 {
+		count, err := strconv.Atoi(suffix[:digits])
+		if err != nil || count < 1 {
+			return fmt.Errorf("invalid count: %s", suffix[:digits])
+		}
+		command.Count = count
+	}
+
+	for _, letter := range suffix[digits:] {
+		if mode, ok := formatLetters[letter]; ok {
+			command.Format = mode
+		} else if size, ok := sizeLetters[letter]; ok && command.Name == "examine" {
+			command.Size = size
+		} else {
+			return fmt.Errorf("unknown format letter: %c", letter)
+		}
+	}
+	return nil
+}
+
+type Breakpoint struct {
+	ID       int
+	Address  uint32
+	Location string // as it was given to break
+}
+
+// runs commands against a machine, keeping the breakpoints it set
+type Debugger struct {
+	Machine *riscv.Machine
+	// the hart commands read and change. A run that stops moves it to the
+	// hart that stopped.
+	Hart int
+	// where input sends the program's input, nil if the machine has no UART
+	UART *riscv.UART
+
+	breakpoints []Breakpoint
+	nextID      int
+	session     *Session // nil unless recording
+	loaded      string   // the source Load loaded last
+}
+
+func New(machine *riscv.Machine) *Debugger {
+	return &Debugger{Machine: machine}
+}
+
+func (debugger *Debugger) cpu() *riscv.CPU {
+	return debugger.Machine.Harts[debugger.Hart]
+}
+
+func (debugger *Debugger) Breakpoints() []Breakpoint {
+	return debugger.breakpoints
+}
+
+// parses and runs a command line, returning what to show for it, and records
+// it in the session. ctx bounds continue. "# text" is a note for the session.
+func (debugger *Debugger) Execute(ctx context.Context, line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if note, ok := strings.CutPrefix(line, "#"); ok {
+		debugger.record(Action{Kind: ActionNote, Text: strings.TrimSpace(note)})
+		return "", nil
+	}
+
+	hart := debugger.Hart
+	output, err := debugger.execute(ctx, line)
+	debugger.record(Action{Kind: ActionCommand, Text: line, Hart: hart, Output: shown(output, err)})
+	return output, err
+}
+
+func (debugger *Debugger) execute(ctx context.Context, line string) (string, error) {
+	command, err := Parse(line)
+	if err != nil {
+		return "", err
+	}
+	return debugger.Run(ctx, command)
+}
+
+func (debugger *Debugger) Run(ctx context.Context, command Command) (string, error) {
+	switch command.Name {
+	case "print":
+		return debugger.print(command)
+	case "examine":
+		return debugger.examine(command)
+	case "break":
+		return debugger.setBreakpoint(command)
+	case "delete":
+		return debugger.deleteBreakpoints(command)
+	case "stepi", "until", "continue":
+		if debugger.Machine.Done() {
+			return "", errors.New("the program has ended, reset or r to start it over")
+		}
+	}
+
+	switch command.Name {
+	case "stepi":
+		return debugger.step(ctx, command.Count), nil
+	case "until":
+		return debugger.until(ctx, command)
+	case "continue":
+		return debugger.stopped(debugger.Machine.RunContext(ctx)), nil
+	case "run":
+		debugger.reset()
+		return debugger.stopped(debugger.Machine.RunContext(ctx)), nil
+	case "reset":
+		debugger.reset()
+		return debugger.where(), nil
+	case "set":
+		return debugger.set(command)
+	case "watch":
+		return debugger.watch(command)
+	case "unwatch":
+		return debugger.unwatch(command)
+	case "args":
+		return debugger.args(command)
+	case "input":
+		if debugger.UART == nil {
+			return "", errors.New("there is no UART to send input to")
+		}
+		debugger.UART.Feed([]byte(command.Args[0] + "\n"))
+		return "", nil
+	case "info":
+		return debugger.info(command)
+	}
+	return help, nil
+}
+
+const help = `p[/f] <reg|pc|csr|label|*addr>  print a value, f is x, d, u or t
+x/[n][f][b|h|w] <addr|label>    examine n units of memory
+b <label|line|*addr>            break before an instruction
+d [id]                          delete a breakpoint, or all of them
+si [n]                          step n instructions
+u <label|line|*addr>            run until the pc gets there
+c                               continue to the next breakpoint or the end
+r                               run from the first instruction
+reset                           go back to the first instruction
+set <reg|pc|*addr>=<value>      change a register, the pc or a word of memory
+watch <expression>              stop when a register or memory changes
+unwatch <id>                    remove a watch
+args [arguments]                set the program's arguments for the next run
+input <text>                    send a line of input to the UART
+info registers|breakpoints      list registers or breakpoints
+info coverage                   list instructions that never ran and one-way branches
+# <text>                        a note in the recorded session`
+
+// a register, pc, csr, label, or *address for the word there
+func (debugger *Debugger) value(expression string) (int32, error) {
+	cpu := debugger.cpu()
+
+	if register, ok := cpu.Arch.RegisterNumber(expression); ok {
+		return cpu.GetState().Registers[register], nil
+	}
+	if expression == "pc" || expression == "$pc" {
+		return int32(cpu.GetState().PC), nil
+	}
+	for _, csr := range riscv.CSRList {
+		if csr.Name == expression {
+			return cpu.ReadCSR(csr.Address), nil
+		}
+	}
+	if addressStr, found := strings.CutPrefix(expression, "*"); found {
+		address, err := debugger.address(addressStr)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(address)+4 > uint64(len(cpu.Memory)) {
+			return 0, fmt.Errorf("address 0x%x is outside memory", address)
+		}
+		return int32(cpu.ByteOrder().Uint32(cpu.Memory[address:])), nil
+	}
+	if address, ok := cpu.Labels[expression]; ok {
+		return int32(address), nil
+	}
+	return 0, fmt.Errorf("no register, csr or label named %s", expression)
+}
+
+// a number, label or bookmark
+func (debugger *Debugger) address(expression string) (uint32, error) {
+	cpu := debugger.cpu()
+	if address, ok := cpu.Labels[expression]; ok {
+		return address, nil
+	}
+	if bookmark, ok := cpu.Bookmark(expression); ok {
+		return bookmark.Start, nil
+	}
+	address, err := strconv.ParseUint(expression, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address: %s", expression)
+	}
+	return uint32(address), nil
+}
+
+func (debugger *Debugger) print(command Command) (string, error) {
+	if len(command.Args) != 1 {
+		return "", errors.New("usage: p <reg|pc|csr|label|*addr>")
+	}
+	value, err := debugger.value(command.Args[0])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s = %s", command.Args[0], format.Word(value, command.Format)), nil
+}
+
+func (debugger *Debugger) examine(command Command) (string, error) {
+	if len(command.Args) != 1 {
+		return "", errors.New("usage: x/[n][f][b|h|w] <addr>")
+	}
+	start, err := debugger.address(command.Args[0])
+	if err != nil {
+		return "", err
+	}
+
+	// the count can be as big as an int, so it's checked without multiplying
+	cpu := debugger.cpu()
+	memory := uint64(len(cpu.Memory))
+	if uint64(start) > memory || uint64(command.Count) > (memory-uint64(start))/uint64(command.Size) {
+		return "", fmt.Errorf("%d %d byte units from 0x%x run outside memory", command.Count, command.Size, start)
+	}
+
+	perLine := 16 / command.Size
+	var lines []string
+	var builder strings.Builder
+	for i := range command.Count {
+		address := start + uint32(i*command.Size)
+		if i%perLine == 0 {
+			if i > 0 {
+				lines = append(lines, builder.String())
+				builder.Reset()
+			}
+			builder.WriteString(fmt.Sprintf("0x%04x:", address))
+		}
+
+		var value uint32
+		switch command.Size {
+		case 4:
+			value = cpu.ByteOrder().Uint32(cpu.Memory[address:])
+		case 2:
+			value = uint32(cpu.ByteOrder().Uint16(cpu.Memory[address:]))
+		default:
+			value = uint32(cpu.Memory[address])
+		}
+		builder.WriteString(" " + format.Sized(value, command.Size, command.Format))
+	}
+	lines = append(lines, builder.String())
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// a label, 1-based source line or *address
+func (debugger *Debugger) location(location string) (uint32, error) {
+	cpu := debugger.cpu()
+
+	if addressStr, found := strings.CutPrefix(location, "*"); found {
+		address, err := strconv.ParseUint(addressStr, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid address: %s", addressStr)
+		}
+		return uint32(address), nil
+	}
+
+	if line, err := strconv.Atoi(location); err == nil {
+		address, ok := cpu.AddressOfLine(line)
+		if !ok {
+			return 0, fmt.Errorf("no instruction on line %d", line)
+		}
+		return address, nil
+	}
+
+	address, ok := cpu.Labels[location]
+	if !ok {
+		return 0, fmt.Errorf("unknown label: %s", location)
+	}
+	return address, nil
+}
+
+func (debugger *Debugger) setBreakpoint(command Command) (string, error) {
+	if len(command.Args) != 1 {
+		return "", errors.New("usage: b <label|line|*addr>")
+	}
+	address, err := debugger.location(command.Args[0])
+	if err != nil {
+		return "", err
+	}
+
+	for _, hart := range debugger.Machine.Harts {
+		if err := hart.SetBreakpoint(address); err != nil {
+			return "", err
+		}
+	}
+
+	debugger.nextID++
+	breakpoint := Breakpoint{ID: debugger.nextID, Address: address, Location: command.Args[0]}
+	debugger.breakpoints = append(debugger.breakpoints, breakpoint)
+	return "breakpoint " + debugger.describeBreakpoint(breakpoint), nil
+}
+
+func (debugger *Debugger) describeBreakpoint(breakpoint Breakpoint) string {
+	description := fmt.Sprintf("%d at 0x%04x", breakpoint.ID, breakpoint.Address)
+	if line, ok := debugger.cpu().LineOfAddress(breakpoint.Address); ok {
+		description += fmt.Sprintf(", line %d", line)
+	}
+	return description
+}
+
+func (debugger *Debugger) deleteBreakpoints(command Command) (string, error) {
+	if len(command.Args) == 0 {
+		deleted := debugger.breakpoints
+		debugger.breakpoints = nil
+		for _, breakpoint := range deleted {
+			debugger.clear(breakpoint.Address)
+		}
+		return fmt.Sprintf("deleted %d breakpoints", len(deleted)), nil
+	}
+
+	id, err := strconv.Atoi(command.Args[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid breakpoint: %s", command.Args[0])
+	}
+	for i, breakpoint := range debugger.breakpoints {
+		if breakpoint.ID == id {
+			debugger.breakpoints = slices.Delete(debugger.breakpoints, i, i+1)
+			debugger.clear(breakpoint.Address)
+			return fmt.Sprintf("deleted breakpoint %d", id), nil
+		}
+	}
+	return "", fmt.Errorf("no breakpoint %d", id)
+}
+
+// clears address on every hart, unless another breakpoint is still there
+func (debugger *Debugger) clear(address uint32) {
+	for _, breakpoint := range debugger.breakpoints {
+		if breakpoint.Address == address {
+			return
+		}
+	}
+	for _, hart := range debugger.Machine.Harts {
+		hart.ClearBreakpoint(address)
+	}
+}
+
+// puts every hart back at the entry point, so an ended program can run again
+func (debugger *Debugger) reset() {
+	for _, hart := range debugger.Machine.Harts {
+		hart.Restart()
+	}
+}
+
+// runs with a temporary breakpoint at a location, so getting there shows
+// where the hart is without reporting a breakpoint
+func (debugger *Debugger) until(ctx context.Context, command Command) (string, error) {
+	if len(command.Args) != 1 {
+		return "", errors.New("usage: u <label|line|*addr>")
+	}
+	address, err := debugger.location(command.Args[0])
+	if err != nil {
+		return "", err
+	}
+	steps, err := debugger.Machine.RunUntilContext(ctx, address)
+	if err != nil {
+		return "", err
+	}
+
+	if last := debugger.Machine.LastHart; last >= 0 {
+		debugger.Hart = last
+	}
+	cpu := debugger.cpu()
+	if cpu.PausedAtBreakpoint() && cpu.GetState().PC == address && !slices.ContainsFunc(debugger.breakpoints, func(breakpoint Breakpoint) bool {
+		return breakpoint.Address == address
+	}) {
+		return debugger.where(), nil
+	}
+	return debugger.stopped(steps), nil
+}
+
+// runs count instructions, or fewer when the step limit runs out or ctx is
+// done, like a run would
+func (debugger *Debugger) step(ctx context.Context, count int) string {
+	steps := uint64(0)
+	for steps < uint64(count) && debugger.Machine.CanStep(ctx, steps) {
+		hart := debugger.Machine.Step()
+		if hart < 0 {
+			break
+		}
+		debugger.Hart = hart
+		steps++
+
+		state := debugger.cpu().GetState()
+		if state.Halted || state.Stop != riscv.StopNone {
+			break
+		}
+	}
+	return debugger.stopped(steps)
+}
+
+// where the selected hart is after running steps instructions
+func (debugger *Debugger) stopped(steps uint64) string {
+	if last := debugger.Machine.LastHart; last >= 0 {
+		debugger.Hart = last
+	}
+	cpu := debugger.cpu()
+	state := cpu.GetState()
+
+	var reason string
+	switch state.Stop {
+	case riscv.StopTrap, riscv.StopStepLimit, riscv.StopCanceled:
+		reason = state.Err.Error()
+	case riscv.StopBreakpoint:
+		reason = "ebreak"
+		if cpu.PausedAtBreakpoint() {
+			reason = "breakpoint"
+			for _, breakpoint := range debugger.breakpoints {
+				if breakpoint.Address == state.PC {
+					reason = "breakpoint " + debugger.describeBreakpoint(breakpoint)
+				}
+			}
+		}
+	case riscv.StopWatch:
+		var hits []string
+		for _, hit := range cpu.WatchHits() {
+			hits = append(hits, hit.String())
+		}
+		reason = strings.Join(hits, "\n")
+	}
+
+	if state.Halted || debugger.Machine.Done() {
+		if reason == "" {
+			reason = "program ended"
+		}
+		if code, ended := cpu.ExitCode(); ended {
+			return fmt.Sprintf("%s after %d instructions, exit code %d (%s)", reason, steps, code, cpu.Termination())
+		}
+		return fmt.Sprintf("%s after %d instructions", reason, steps)
+	}
+
+	if reason == "" {
+		return debugger.where()
+	}
+	return reason + "\n" + debugger.where()
+}
+
+// the pc and next instruction of the selected hart
+func (debugger *Debugger) where() string {
+	cpu := debugger.cpu()
+	where := fmt.Sprintf("0x%04x", cpu.GetState().PC)
+	if line, ok := cpu.CurrentLine(); ok {
+		where += fmt.Sprintf(" line %d: %s", line, cpu.GetCurrInstr())
+	}
+	if len(debugger.Machine.Harts) > 1 {
+		where = fmt.Sprintf("hart %d %s", debugger.Hart, where)
+	}
+	return where
+}
+
+// adds a watch to the selected hart
+func (debugger *Debugger) watch(command Command) (string, error) {
+	expression := strings.Join(command.Args, " ")
+	id, err := debugger.cpu().AddWatch(expression)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("watch %d: %s", id, expression), nil
+}
+
+func (debugger *Debugger) unwatch(command Command) (string, error) {
+	id, err := strconv.Atoi(command.Args[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid watch id: %s", command.Args[0])
+	}
+	return "", debugger.cpu().RemoveWatch(id)
+}
+
+// sets every hart's arguments, quoted as they would be in a shell
+func (debugger *Debugger) args(command Command) (string, error) {
+	args, err := riscv.SplitArgs(command.Args[0])
+	if err == nil {
+		err = debugger.Machine.SetArgs(args)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d arguments, applied on the next run", len(args)), nil
+}
+
+func (debugger *Debugger) set(command Command) (string, error) {
+	target, valueStr := command.Args[0], command.Args[1]
+	value, err := strconv.ParseInt(valueStr, 0, 64)
+	if err != nil || value < -1<<31 || value > 1<<32-1 {
+		return "", fmt.Errorf("invalid value: %s", valueStr)
+	}
+
+	cpu := debugger.cpu()
+	if target == "pc" || target == "$pc" {
+		state := cpu.GetState()
+		state.PC = uint32(value)
+		if err := cpu.SetState(state); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("pc = 0x%04x", state.PC), nil
+	}
+
+	if addressStr, found := strings.CutPrefix(target, "*"); found {
+		address, err := debugger.address(addressStr)
+		if err != nil {
+			return "", err
+		}
+		data := make([]byte, 4)
+		cpu.ByteOrder().PutUint32(data, uint32(value))
+		if err := cpu.WriteMemory(address, data); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("*0x%04x = %d", address, int32(value)), nil
+	}
+
+	register, ok := cpu.Arch.RegisterNumber(target)
+	if !ok {
+		return "", fmt.Errorf("no register named %s", target)
+	}
+	if err := cpu.SetRegister(register, int32(value)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s = %d", target, cpu.GetState().Registers[register]), nil
+}
+
+func (debugger *Debugger) info(command Command) (string, error) {
+	if len(command.Args) != 1 {
+		return "", errors.New("usage: info registers|breakpoints|coverage")
+	}
+
+	var lines []string
+	switch command.Args[0] {
+	case "registers", "r":
+		cpu := debugger.cpu()
+		state := cpu.GetState()
+		names := cpu.Arch.RegisterNames()
+		for i, value := range state.Registers {
+			lines = append(lines, fmt.Sprintf("x%-2d %-4s %s %d", i, names[i], format.Word(value, format.Hex), value))
+		}
+		lines = append(lines, fmt.Sprintf("pc       0x%08x", state.PC))
+	case "breakpoints", "b":
+		if len(debugger.breakpoints) == 0 {
+			return "no breakpoints", nil
+		}
+		for _, breakpoint := range debugger.breakpoints {
+			lines = append(lines, fmt.Sprintf("%s (%s)", debugger.describeBreakpoint(breakpoint), breakpoint.Location))
+		}
+	case "coverage", "c":
+		return strings.TrimSuffix(debugger.Machine.Coverage().String(), "\n"), nil
+	default:
+		return "", fmt.Errorf("unknown info: %s", command.Args[0])
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,279 @@
+package debug
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+func TestParse(t *testing.T) {
+	command, err := Parse("x/8xh 0x100")
+	if err != nil || command.Name != "examine" || command.Count != 8 || command.Size != 2 || command.Args[0] != "0x100" {
+		t.Errorf("Parse examine fail. actual %+v %v", command, err)
+	}
+	if command, err = Parse("set x5 = 42"); err != nil || command.Args[0] != "x5" || command.Args[1] != "42" {
+		t.Errorf("Parse set fail. actual %+v %v", command, err)
+	}
+	if command, err = Parse("si 3"); err != nil || command.Name != "stepi" || command.Count != 3 {
+		t.Errorf("Parse stepi fail. actual %+v %v", command, err)
+	}
+	for _, line := range []string{"frobnicate", "x/8q 0", "c/x", "set x5", "si 0"} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("Parse %q should fail", line)
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	cpu := riscv.NewCPU(1024)
+	machine := riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})
+	machine.LoadInstructions([]string{
+		"li a0, 0",
+		"li a1, 3",
+		"loop:",
+		"addi a0, a0, 2",
+		"addi a1, a1, -1",
+		"bnez a1, loop",
+		"sw a0, 0x100(zero)",
+	})
+	debugger := New(machine)
+	ctx := context.Background()
+
+	run := func(line string) string {
+		t.Helper()
+		output, err := debugger.Execute(ctx, line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return output
+	}
+
+	if output := run("b loop"); output != "breakpoint 1 at 0x0018, line 4" {
+		t.Errorf("break fail. actual %q", output)
+	}
+	if output := run("c"); !strings.HasPrefix(output, "breakpoint 1 at 0x0018") {
+		t.Errorf("continue fail. actual %q", output)
+	}
+	run("c")
+	if output := run("p a0"); output != "a0 = 2" {
+		t.Errorf("print fail. actual %q", output)
+	}
+	if output := run("si"); output != "0x001c line 5: addi a1, a1, -1" {
+		t.Errorf("stepi fail. actual %q", output)
+	}
+	run("set a1=1")
+	run("b 4")
+	if output := run("d"); output != "deleted 2 breakpoints" {
+		t.Errorf("delete all fail. actual %q", output)
+	}
+	if output := run("c"); output != "program ended after 3 instructions, exit code 0 (ran off the end)" {
+		t.Errorf("continue to end fail. actual %q", output)
+	}
+	if _, err := debugger.Execute(ctx, "c"); err == nil {
+		t.Errorf("continue after the end should fail")
+	}
+	if output := run("reset"); output != "0x0010 line 1: li a0, 0" {
+		t.Errorf("reset fail. actual %q", output)
+	}
+	// coverage adds up across runs of the same program
+	if output := run("info coverage"); output != "6 of 6 instructions run (100.0%), 1 of 1 branches both ways" {
+		t.Errorf("info coverage fail. actual %q", output)
+	}
+	if output := run("x/2xw 0x100"); output != "0x0100: 0x00000004 0x00000000" {
+		t.Errorf("examine fail. actual %q", output)
+	}
+	if output := run("p/t *0x100"); output != "*0x100 = 0b00000000000000000000000000000100" {
+		t.Errorf("print memory fail. actual %q", output)
+	}
+	if output := run("set *0x104 = -2"); output != "*0x0104 = -2" || run("p *0x104") != "*0x104 = -2" {
+		t.Errorf("set memory fail. actual %q", output)
+	}
+
+	for _, line := range []string{"b nowhere", "p q9", "x/4w 0xfffffff0", "x/4611686018427387904w 0", "set s99=1", "set *0xfffffff0=1", "d 7"} {
+		if _, err := debugger.Execute(ctx, line); err == nil {
+			t.Errorf("%q should fail", line)
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	cpu := riscv.NewCPU(1024)
+	machine := riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})
+	machine.LoadInstructions([]string{
+		"loop:",
+		"addi a0, a0, 1",
+		"j loop",
+	})
+	machine.StepBudget = 5
+	debugger := New(machine)
+
+	if output, err := debugger.Execute(context.Background(), "si 100"); err != nil || !strings.HasPrefix(output, "step limit exceeded\n") {
+		t.Errorf("stepi limit fail. actual %q %v", output, err)
+	}
+	if output, _ := debugger.Execute(context.Background(), "p a0"); output != "a0 = 3" {
+		t.Errorf("stepi limit steps fail. actual %q", output)
+	}
+	// the next stepi carries on
+	debugger.Execute(context.Background(), "si 2")
+	if output, _ := debugger.Execute(context.Background(), "p a0"); output != "a0 = 4" {
+		t.Errorf("stepi after limit fail. actual %q", output)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if output, err := debugger.Execute(ctx, "si 100"); err != nil || !strings.HasPrefix(output, "run canceled\n") {
+		t.Errorf("stepi canceled fail. actual %q %v", output, err)
+	}
+}
+
+func TestWatchArgsInput(t *testing.T) {
+	cpu := riscv.NewCPU(1024)
+	machine := riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})
+	uart, _, err := machine.MapStandardDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.LoadInstructions([]string{
+		"li t0, 0x10000000",
+		"lbu a2, 0(t0)",
+		"li a3, 1",
+	})
+	debugger := New(machine)
+	ctx := context.Background()
+
+	if output, err := debugger.Execute(ctx, "watch a3"); err != nil || output != "watch 1: a3" {
+		t.Errorf("watch fail. actual %q %v", output, err)
+	}
+	if output, err := debugger.Execute(ctx, `args one "two three"`); err != nil || output != "2 arguments, applied on the next run" || !slices.Equal(cpu.Args(), []string{"one", "two three"}) {
+		t.Errorf("args fail. actual %q %v %q", output, err, cpu.Args())
+	}
+	if _, err := debugger.Execute(ctx, "input hi"); err == nil {
+		t.Error("input without a UART should fail")
+	}
+
+	debugger.UART = uart
+	debugger.Execute(ctx, "input hi")
+	if output, _ := debugger.Execute(ctx, "si 2"); output != "0x0018 line 3: li a3, 1" {
+		t.Errorf("input stepi fail. actual %q", output)
+	}
+	if output, _ := debugger.Execute(ctx, "p/x a2"); output != "a2 = 0x00000068" {
+		t.Errorf("input fail. actual %q", output)
+	}
+	if output, _ := debugger.Execute(ctx, "si"); !strings.HasPrefix(output, "watch 1: a3 changed 0 -> 1") {
+		t.Errorf("watch hit fail. actual %q", output)
+	}
+
+	if _, err := debugger.Execute(ctx, "unwatch 1"); err != nil || len(cpu.Watches()) != 0 {
+		t.Errorf("unwatch fail. actual %v %v", cpu.Watches(), err)
+	}
+	for _, line := range []string{"watch", "watch nowhere", "unwatch 1", "unwatch x", `args "open`} {
+		if _, err := debugger.Execute(ctx, line); err == nil {
+			t.Errorf("%q should fail", line)
+		}
+	}
+}
+
+func TestUntil(t *testing.T) {
+	cpu := riscv.NewCPU(1024)
+	machine := riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})
+	machine.LoadInstructions([]string{
+		"li a0, 0",
+		"li a1, 3",
+		"loop:",
+		"addi a0, a0, 2",
+		"addi a1, a1, -1",
+		"bnez a1, loop",
+		"sw a0, 0x100(zero)",
+	})
+	debugger := New(machine)
+	ctx := context.Background()
+
+	run := func(line string) string {
+		t.Helper()
+		output, err := debugger.Execute(ctx, line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return output
+	}
+
+	if output := run("u loop"); output != "0x0018 line 4: addi a0, a0, 2" {
+		t.Errorf("until label fail. actual %q", output)
+	}
+	// already there, so it goes round the loop once
+	run("u loop")
+	if output := run("p a0"); output != "a0 = 2" {
+		t.Errorf("until again fail. actual %q", output)
+	}
+	if output := run("u 7"); output != "0x0024 line 7: sw a0, 0x100(zero)" {
+		t.Errorf("until line fail. actual %q", output)
+	}
+	if output := run("p a0"); output != "a0 = 6" {
+		t.Errorf("until past loop fail. actual %q", output)
+	}
+	if len(cpu.Breakpoints()) != 0 {
+		t.Errorf("until breakpoint left fail. actual %v", cpu.Breakpoints())
+	}
+	if output := run("u loop"); !strings.HasPrefix(output, "program ended") {
+		t.Errorf("until end fail. actual %q", output)
+	}
+
+	if _, err := debugger.Execute(ctx, "u *0x2"); err == nil {
+		t.Errorf("until without an instruction should fail")
+	}
+}
+
+func TestSession(t *testing.T) {
+	source := "li a0, 1\nloop:\naddi a0, a0, 1\nj loop"
+	newDebugger := func() *Debugger {
+		cpu := riscv.NewCPU(1024)
+		return New(riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{}))
+	}
+
+	recorder := newDebugger()
+	recorder.Record()
+	recorder.Load("loop.s", source)
+	recorder.Load("loop.s", source)
+	for _, line := range []string{"b loop", "c", "# a0 should be 2", "set a0=40", "si 2", "p a0", "frobnicate"} {
+		recorder.Execute(context.Background(), line)
+	}
+	session := recorder.StopRecording()
+
+	// the repeated load isn't recorded
+	if len(session.Actions) != 8 || session.Actions[0].Kind != ActionLoad || session.Actions[3].Kind != ActionNote || session.Actions[6].Output != "a0 = 41" {
+		t.Fatalf("Session record fail. actual %+v", session.Actions)
+	}
+
+	var saved strings.Builder
+	if err := session.Write(&saved); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSession(strings.NewReader(saved.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := newDebugger().Replay(context.Background(), read)
+	for _, action := range replayed {
+		if action.Diverged() {
+			t.Errorf("Session replay fail. %q showed %q, recorded %q", action.Text, action.Replayed, action.Output)
+		}
+	}
+
+	// a changed recording is marked in the transcript
+	read.Actions[6].Output = "a0 = 7"
+	var transcript strings.Builder
+	WriteTranscript(&transcript, newDebugger().Replay(context.Background(), read))
+	for _, want := range []string{"# load loop.s (4 lines)\n", "#    3  addi a0, a0, 1\n", "(rv) p a0\na0 = 41\n! differs from the recording, which showed:\n! a0 = 7\n", "# a0 should be 2\n"} {
+		if !strings.Contains(transcript.String(), want) {
+			t.Errorf("Session transcript fail. missing %q in\n%s", want, transcript.String())
+		}
+	}
+
+	if _, err := ReadSession(strings.NewReader(`{"Actions":[{"Kind":"poke"}]}`)); err == nil {
+		t.Error("ReadSession should reject unknown actions")
+	}
+}
@@ -0,0 +1,172 @@
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// kinds of Action
+const (
+	ActionLoad    = "load"
+	ActionCommand = "command"
+	ActionNote    = "note"
+)
+
+// one thing done in a session
+type Action struct {
+	Kind string
+	// the whole program for a load, so a replay doesn't depend on files that
+	// may have changed since, and the file it came from if any
+	Source string `json:",omitempty"`
+	File   string `json:",omitempty"`
+	// the command line, or the text of a note
+	Text string `json:",omitempty"`
+	Hart int    `json:",omitempty"`
+	// what the command showed, errors included. Empty for commands added with
+	// AddToSession, which aren't compared on replay
+	Output string `json:",omitempty"`
+}
+
+// everything done to a machine through a Debugger, in order. Replaying it on
+// a machine set up with the same options does the same again.
+type Session struct {
+	Actions []Action
+}
+
+func ReadSession(r io.Reader) (*Session, error) {
+	var session Session
+	if err := json.NewDecoder(r).Decode(&session); err != nil {
+		return nil, err
+	}
+	for i, action := range session.Actions {
+		switch action.Kind {
+		case ActionLoad, ActionCommand, ActionNote:
+		default:
+			return nil, fmt.Errorf("action %d: unknown kind %q", i+1, action.Kind)
+		}
+	}
+	return &session, nil
+}
+
+func (session *Session) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(session)
+}
+
+// starts recording a new session of every load, command and note
+func (debugger *Debugger) Record() *Session {
+	debugger.session = &Session{}
+	return debugger.session
+}
+
+// stops recording and returns what was recorded, nil if nothing was
+func (debugger *Debugger) StopRecording() *Session {
+	session := debugger.session
+	debugger.session = nil
+	return session
+}
+
+func (debugger *Debugger) record(action Action) {
+	if debugger.session != nil {
+		debugger.session.Actions = append(debugger.session.Actions, action)
+	}
+}
+
+// loads source into every hart. A session records it when it differs from
+// the source loaded last.
+func (debugger *Debugger) Load(file, source string) {
+	debugger.Machine.LoadInstructions(strings.Split(source, "\n"))
+	if source != debugger.loaded {
+		debugger.record(Action{Kind: ActionLoad, File: file, Source: source})
+	}
+	debugger.loaded = source
+}
+
+// adds a command that was carried out some other way, e.g. by a key in the
+// interface, to the session. Its output isn't checked on replay.
+func (debugger *Debugger) AddToSession(line string) {
+	debugger.record(Action{Kind: ActionCommand, Text: line, Hart: debugger.Hart})
+}
+
+// a replayed action and what it showed this time
+type ReplayedAction struct {
+	Action
+	Replayed string
+}
+
+// whether a command showed something different from when it was recorded
+func (action ReplayedAction) Diverged() bool {
+	return action.Kind == ActionCommand && action.Output != "" && action.Output != action.Replayed
+}
+
+// loads the programs and runs the commands of a session in order, and
+// returns what each showed
+func (debugger *Debugger) Replay(ctx context.Context, session *Session) []ReplayedAction {
+	var replayed []ReplayedAction
+	for _, action := range session.Actions {
+		result := ReplayedAction{Action: action}
+		switch action.Kind {
+		case ActionLoad:
+			debugger.Load(action.File, action.Source)
+		case ActionCommand:
+			debugger.Hart = min(max(action.Hart, 0), len(debugger.Machine.Harts)-1)
+			result.Replayed = shown(debugger.Execute(ctx, action.Text))
+		case ActionNote:
+			debugger.record(action)
+		}
+		replayed = append(replayed, result)
+	}
+	return replayed
+}
+
+// what a command shows, with errors shown as they are in the repl
+func shown(output string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return output
+}
+
+// writes a replay as an annotated transcript: each program loaded, with its
+// line numbers, then each command and what it showed, notes as comments and
+// anything that differs from the recording marked with what it was then
+func WriteTranscript(w io.Writer, actions []ReplayedAction) error {
+	var builder strings.Builder
+	for _, action := range actions {
+		switch action.Kind {
+		case ActionLoad:
+			name := action.File
+			if name == "" {
+				name = "program"
+			}
+			lines := strings.Split(strings.TrimSuffix(action.Source, "\n"), "\n")
+			fmt.Fprintf(&builder, "# load %s (%d lines)\n", name, len(lines))
+			for i, line := range lines {
+				fmt.Fprintf(&builder, "# %4d  %s\n", i+1, line)
+			}
+		case ActionNote:
+			fmt.Fprintf(&builder, "# %s\n", action.Text)
+		case ActionCommand:
+			prompt := "(rv)"
+			if action.Hart != 0 {
+				prompt = fmt.Sprintf("(rv hart %d)", action.Hart)
+			}
+			fmt.Fprintf(&builder, "%s %s\n", prompt, action.Text)
+			if action.Replayed != "" {
+				fmt.Fprintln(&builder, action.Replayed)
+			}
+			if action.Diverged() {
+				builder.WriteString("! differs from the recording, which showed:\n")
+				for _, line := range strings.Split(action.Output, "\n") {
+					fmt.Fprintf(&builder, "! %s\n", line)
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
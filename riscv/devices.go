@@ -0,0 +1,233 @@
+package riscv
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// a memory-mapped device. addresses passed to it are offsets from the start
+// of its range. Reads are always of the aligned word, which the cpu narrows
+// for byte and half loads, while stores pass their own offset and narrowed
+// value.
+type Device interface {
+	Name() string
+	Read(addr uint32) uint32
+	Write(addr uint32, val uint32)
+}
+
+// devices that also implement Ticker are ticked once per retired instruction,
+// or once per step of a Machine that mapped them for all its harts
+type Ticker interface {
+	Tick()
+}
+
+type DeviceMapping struct {
+	Base   uint32
+	Size   uint32
+	Device Device
+	shared bool // mapped by a Machine, which ticks it
+}
+
+func (mapping DeviceMapping) contains(address uint32) bool {
+	return address >= mapping.Base && address-mapping.Base < mapping.Size
+}
+
+// claims [base, base+size) for a device. the range may lie outside memory
+// but can't overlap another device
+func (cpu *CPU) MapDevice(base, size uint32, device Device) error {
+	return cpu.mapDevice(base, size, device, false)
+}
+
+func (cpu *CPU) mapDevice(base, size uint32, device Device, shared bool) error {
+	if size == 0 || uint64(base)+uint64(size) > 1<<32 {
+		return fmt.Errorf("invalid device range %d-%d", base, uint64(base)+uint64(size))
+	}
+
+	for _, mapping := range cpu.devices {
+		if base < mapping.Base+mapping.Size && mapping.Base < base+size {
+			return fmt.Errorf("%s overlaps %s", device.Name(), mapping.Device.Name())
+		}
+	}
+
+	cpu.devices = append(cpu.devices, DeviceMapping{Base: base, Size: size, Device: device, shared: shared})
+	slices.SortFunc(cpu.devices, func(a, b DeviceMapping) int { return cmp.Compare(a.Base, b.Base) })
+	return nil
+}
+
+// mapped devices sorted by base address
+func (cpu *CPU) Devices() []DeviceMapping {
+	return slices.Clone(cpu.devices)
+}
+
+func (cpu *CPU) deviceAt(address uint32) (DeviceMapping, bool) {
+	for _, mapping := range cpu.devices {
+		if mapping.contains(address) {
+			return mapping, true
+		}
+	}
+	return DeviceMapping{}, false
+}
+
+func (cpu *CPU) tickDevices() {
+	for _, mapping := range cpu.devices {
+		if ticker, ok := mapping.Device.(Ticker); ok && !mapping.shared {
+			ticker.Tick()
+		}
+	}
+}
+
+func sizeMask(size uint32) uint32 {
+	return uint32(uint64(1)<<(8*size) - 1)
+}
+
+// UART registers, relative to its base
+const (
+	UARTData   = 0
+	UARTStatus = 4
+)
+
+// UARTStatus bits
+const (
+	UARTRxReady = 1 << 0
+	UARTTxReady = 1 << 1
+)
+
+// where MapStandardDevices puts the devices, and how much space they take
+const (
+	UARTBase  = 0x10000000
+	UARTSize  = 8
+	TimerBase = 0x02000000
+	TimerSize = 16
+)
+
+// a console. bytes stored to the data register go to Output, and loads from
+// it return fed input one byte at a time, or 0 when there is none
+type UART struct {
+	Output io.Writer
+	input  []byte
+}
+
+func NewUART(output io.Writer) *UART {
+	return &UART{Output: output}
+}
+
+func (uart *UART) Name() string {
+	return "uart"
+}
+
+func (uart *UART) Read(addr uint32) uint32 {
+	switch addr {
+	case UARTData:
+		if len(uart.input) == 0 {
+			return 0
+		}
+		value := uart.input[0]
+		uart.input = uart.input[1:]
+		return uint32(value)
+	case UARTStatus:
+		if len(uart.input) > 0 {
+			return UARTRxReady | UARTTxReady
+		}
+		return UARTTxReady
+	}
+	return 0
+}
+
+func (uart *UART) Write(addr uint32, val uint32) {
+	if addr == UARTData && uart.Output != nil {
+		uart.Output.Write([]byte{byte(val)})
+	}
+}
+
+// queues bytes for the program to read
+func (uart *UART) Feed(data []byte) {
+	uart.input = append(uart.input, data...)
+}
+
+// Timer registers, relative to its base
+const (
+	TimerTime        = 0
+	TimerTimeHigh    = 4
+	TimerCompare     = 8
+	TimerCompareHigh = 12
+	timerRegsLength  = 16
+)
+
+// a free running counter that advances once per instruction, with a
+// compare register for timer interrupts: mtime at TimerBase and mtimecmp at
+// TimerBase+8. The machine timer interrupt is pending while mtime >=
+// mtimecmp, so a handler clears it by moving mtimecmp on.
+type Timer struct {
+	Time    uint64
+	Compare uint64
+}
+
+func NewTimer() *Timer {
+	return &Timer{Compare: ^uint64(0)}
+}
+
+func (timer *Timer) Name() string {
+	return "timer"
+}
+
+func (timer *Timer) Read(addr uint32) uint32 {
+	switch addr {
+	case TimerTime:
+		return uint32(timer.Time)
+	case TimerTimeHigh:
+		return uint32(timer.Time >> 32)
+	case TimerCompare:
+		return uint32(timer.Compare)
+	case TimerCompareHigh:
+		return uint32(timer.Compare >> 32)
+	}
+	return 0
+}
+
+func (timer *Timer) Write(addr uint32, val uint32) {
+	switch addr {
+	case TimerTime:
+		timer.Time = timer.Time&^0xffffffff | uint64(val)
+	case TimerTimeHigh:
+		timer.Time = timer.Time&0xffffffff | uint64(val)<<32
+	case TimerCompare:
+		timer.Compare = timer.Compare&^0xffffffff | uint64(val)
+	case TimerCompareHigh:
+		timer.Compare = timer.Compare&0xffffffff | uint64(val)<<32
+	}
+}
+
+func (timer *Timer) Tick() {
+	timer.Time++
+}
+
+// whether the time has reached the compare value
+func (timer *Timer) Pending() bool {
+	return timer.Time >= timer.Compare
+}
+
+func (timer *Timer) Interrupt() Interrupt {
+	return IntMachineTimer
+}
+
+// for wfi. A compare value that was never set would never be reached.
+func (timer *Timer) skipToCompare() {
+	if timer.Compare != ^uint64(0) && timer.Time < timer.Compare {
+		timer.Time = timer.Compare
+	}
+}
+
+// maps a UART writing to the console stream at UARTBase and a Timer at
+// TimerBase
+func (cpu *CPU) MapStandardDevices() (*UART, *Timer, error) {
+	uart, timer := NewUART(cpu.Output(StreamConsole)), NewTimer()
+	if err := cpu.MapDevice(UARTBase, UARTSize, uart); err != nil {
+		return nil, nil, err
+	}
+	if err := cpu.MapDevice(TimerBase, TimerSize, timer); err != nil {
+		return nil, nil, err
+	}
+	return uart, timer, nil
+}
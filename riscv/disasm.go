@@ -0,0 +1,165 @@
+package riscv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv/format"
+)
+
+// spec entries that are real instructions, in a stable order for matching
+var machineSpecs = func() []string {
+	var mnemonics []string
+	for mnemonic, spec := range instrSpecs {
+		if !spec.IsPseudo() {
+			mnemonics = append(mnemonics, mnemonic)
+		}
+	}
+	slices.Sort(mnemonics)
+	return mnemonics
+}()
+
+func signExtend(value uint32, bits uint) int32 {
+	shift := 32 - bits
+	return int32(value<<shift) >> shift
+}
+
+func regName(register uint32) string {
+	return rv32iRegisterNames[register&31]
+}
+
+// decodes a 32-bit machine instruction into assembly this interpreter accepts
+func Disassemble(word uint32) (string, bool) {
+	opcode := word & 0x7f
+	rd := (word >> 7) & 31
+	funct3 := int((word >> 12) & 7)
+	rs1 := (word >> 15) & 31
+	rs2 := (word >> 20) & 31
+	funct7 := int(word >> 25)
+
+	// the system instructions only differ in their immediate
+	if opcode == 0x73 && funct3 == 0 && rd == 0 && rs1 == 0 {
+		switch word >> 20 {
+		case 0:
+			return "ecall", true
+		case 1:
+			return "ebreak", true
+		case 0x302:
+			return "mret", true
+		case 0x105:
+			return "wfi", true
+		}
+		return "", false
+	}
+
+	for _, mnemonic := range machineSpecs {
+		spec := instrSpecs[mnemonic]
+		if spec.Opcode != opcode || (spec.Funct3 != -1 && spec.Funct3 != funct3) || (spec.Funct7 != -1 && spec.Funct7 != funct7) || (spec.Funct5 != -1 && spec.Funct5 != funct7>>2) {
+			continue
+		}
+
+		immI := signExtend(word>>20, 12)
+
+		switch {
+		case mnemonic == "ecall" || mnemonic == "ebreak" || mnemonic == "mret" || mnemonic == "wfi":
+			continue
+		case mnemonic == "fence":
+			return "fence", true
+		case spec.Extension == "rv_zicsr":
+			csr := uint16(word >> 20)
+			csrStr := fmt.Sprintf("0x%03x", csr)
+			if name, ok := csrName(csr); ok {
+				csrStr = name
+			}
+			if strings.HasSuffix(mnemonic, "i") {
+				return fmt.Sprintf("%s %s, %s, %d", mnemonic, regName(rd), csrStr, rs1), true
+			}
+			return fmt.Sprintf("%s %s, %s, %s", mnemonic, regName(rd), csrStr, regName(rs1)), true
+		case spec.Extension == "rv_a":
+			ordering := [4]string{"", ".rl", ".aq", ".aqrl"}[funct7&3]
+			if mnemonic == "lr.w" {
+				return fmt.Sprintf("%s%s %s, (%s)", mnemonic, ordering, regName(rd), regName(rs1)), true
+			}
+			return fmt.Sprintf("%s%s %s, %s, (%s)", mnemonic, ordering, regName(rd), regName(rs2), regName(rs1)), true
+		case spec.Format == "R":
+			return fmt.Sprintf("%s %s, %s, %s", mnemonic, regName(rd), regName(rs1), regName(rs2)), true
+		case spec.Format == "I" && spec.Opcode == 0x03:
+			return fmt.Sprintf("%s %s, %d(%s)", mnemonic, regName(rd), immI, regName(rs1)), true
+		case spec.Format == "I" && slices.Contains(spec.Operands, "shamtw"):
+			return fmt.Sprintf("%s %s, %s, %d", mnemonic, regName(rd), regName(rs1), rs2), true
+		case spec.Format == "I":
+			return fmt.Sprintf("%s %s, %s, %d", mnemonic, regName(rd), regName(rs1), immI), true
+		case spec.Format == "S":
+			imm := signExtend((word>>25)<<5|(word>>7)&31, 12)
+			return fmt.Sprintf("%s %s, %d(%s)", mnemonic, regName(rs2), imm, regName(rs1)), true
+		case spec.Format == "B":
+			imm := (word>>31)<<12 | ((word>>7)&1)<<11 | ((word>>25)&0x3f)<<5 | ((word>>8)&0xf)<<1
+			return fmt.Sprintf("%s %s, %s, %d", mnemonic, regName(rs1), regName(rs2), signExtend(imm, 13)), true
+		case spec.Format == "U":
+			return fmt.Sprintf("%s %s, %d", mnemonic, regName(rd), word>>12), true
+		case spec.Format == "J":
+			imm := (word>>31)<<20 | ((word>>12)&0xff)<<12 | ((word>>20)&1)<<11 | ((word>>21)&0x3ff)<<1
+			return fmt.Sprintf("%s %s, %d", mnemonic, regName(rd), signExtend(imm, 21)), true
+		}
+	}
+
+	return "", false
+}
+
+func (cpu *CPU) memoryRangeCheck(start, end uint32) error {
+	if end <= start || end > uint32(len(cpu.Memory)) {
+		return fmt.Errorf("invalid memory range %d-%d", start, end)
+	}
+	return nil
+}
+
+// hex dump of [start, end), four words per line
+func (cpu *CPU) HexDump(start, end uint32) ([]string, error) {
+	return cpu.Dump(start, end, format.Hex)
+}
+
+// dump of [start, end) with words shown in mode. A line where data labels
+// start ends with what they hold, e.g. "# counter: word, table: 4 words".
+func (cpu *CPU) Dump(start, end uint32, mode format.Mode) ([]string, error) {
+	if err := cpu.memoryRangeCheck(start, end); err != nil {
+		return nil, err
+	}
+
+	lines := format.DumpOrder(cpu.Memory, start, end, mode, cpu.byteOrder)
+	step := format.LineBytes(mode)
+	for i := range lines {
+		lineStart := start + uint32(i)*step
+		var labels []string
+		for _, symbol := range cpu.dataSymbols {
+			if symbol.Address >= lineStart && symbol.Address < min(lineStart+step, end) {
+				labels = append(labels, symbol.Describe())
+			}
+		}
+		if len(labels) > 0 {
+			lines[i] += "  # " + strings.Join(labels, ", ")
+		}
+	}
+	return lines, nil
+}
+
+// each word of [start, end) decoded as an instruction
+func (cpu *CPU) DisassembleRange(start, end uint32) ([]string, error) {
+	if err := cpu.memoryRangeCheck(start, end); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for address := start; address+4 <= end; address += 4 {
+		// instructions are little endian whatever the order of data
+		word := binary.LittleEndian.Uint32(cpu.Memory[address:])
+		text, ok := Disassemble(word)
+		if !ok {
+			text = fmt.Sprintf(".word 0x%08x", word)
+		}
+		lines = append(lines, fmt.Sprintf("0x%04x: %08x  %s", address, word, text))
+	}
+
+	return lines, nil
+}
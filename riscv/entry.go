@@ -0,0 +1,61 @@
+package riscv
+
+// returning here ends the program. Nothing is assembled at 0, and ra
+// holds this address when the program starts, so the entry function can end
+// with ret like any other function.
+const exitAddress uint32 = 0
+
+// where the program starts: the .global (or .globl) symbol, otherwise main,
+// otherwise the first instruction
+func (cpu *CPU) EntryAddress() uint32 {
+	for _, label := range []string{cpu.entryPoint, "main"} {
+		address, ok := cpu.Labels[label]
+		if label == "" || !ok {
+			continue
+		}
+		if _, ok := cpu.instrIndex(address); ok {
+			return address
+		}
+	}
+	return cpu.textBase()
+}
+
+// puts the cpu back at the entry point so the next run starts the program
+// over. A program that ended stays ended, its final state on show, until
+// this is called. Registers and memory are left as they are, apart from ra
+// which is pointed back at the exit when the first instruction runs, and the
+// heap which is emptied.
+func (cpu *CPU) Restart() {
+	cpu.PC = cpu.EntryAddress()
+	cpu.Done = false
+	cpu.termination, cpu.exitCode = TerminationNone, 0
+	cpu.started = false
+	cpu.callStack = nil
+	cpu.err = nil
+	cpu.breakpoint = false
+	cpu.pausedAtBreakpoint = false
+	cpu.watchHits = nil
+	if cpu.memoryMap != nil {
+		cpu.memoryMap.brk = cpu.memoryMap.HeapBase
+	}
+	cpu.writeData()
+}
+
+// sets up the entry function's return and arguments before the first
+// instruction runs
+func (cpu *CPU) start() {
+	cpu.started = true
+	cpu.assertionResults = nil
+	cpu.termination, cpu.exitCode = TerminationNone, 0
+	ra := cpu.Arch.ReturnAddress()
+	if cpu.Registers[ra] != int32(exitAddress) {
+		cpu.SetRegister(ra, int32(exitAddress))
+	}
+	if cpu.hasArgs {
+		cpu.layoutArgs()
+	}
+	if cpu.strict != nil {
+		cpu.resetStrict()
+	}
+	cpu.resetStack()
+}
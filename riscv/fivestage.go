@@ -0,0 +1,310 @@
+package riscv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// classic in-order IF/ID/EX/MEM/WB timing model. It is fed the instructions
+// the CPU retires and works out when each would occupy each stage, assuming
+// full forwarding, a one cycle load-use stall and branches resolved in EX.
+// With a branch predictor attached, correctly predicted branches are fetched
+// from the right place straight away and only mispredictions flush.
+
+const (
+	StageIF = iota
+	StageID
+	StageEX
+	StageMEM
+	StageWB
+)
+
+var StageNames = [5]string{"IF", "ID", "EX", "MEM", "WB"}
+
+const pipelineHistory = 16
+
+// branch penalty when a taken branch or jump is resolved in EX
+const flushPenalty = 2
+
+// whether a retired instruction was a branch the predictor saw, and how it did
+type branchOutcome int
+
+const (
+	unpredicted branchOutcome = iota
+	predictedRight
+	predictedWrong
+)
+
+type PipelineEntry struct {
+	PC      uint32
+	Text    string
+	Fetch   int // first cycle in IF
+	Decode  int // first cycle in ID
+	Execute int // cycle in EX
+}
+
+// first cycle the entry is in the given stage
+func (entry PipelineEntry) StageCycle(stage int) int {
+	switch stage {
+	case StageIF:
+		return entry.Fetch
+	case StageID:
+		return entry.Decode
+	}
+	return entry.Execute + stage - StageEX
+}
+
+// whether the entry is in the given stage during a cycle
+func (entry PipelineEntry) InStage(stage int, cycle int) bool {
+	switch stage {
+	case StageIF:
+		return cycle >= entry.Fetch && cycle < entry.Decode
+	case StageID:
+		return cycle >= entry.Decode && cycle < entry.Execute
+	}
+	return cycle == entry.StageCycle(stage)
+}
+
+type Hazard struct {
+	Cycle   int
+	Kind    string // "load-use", "forward" or "flush"
+	Message string
+}
+
+func (hazard Hazard) String() string {
+	return fmt.Sprintf("cycle %d: %s", hazard.Cycle, hazard.Message)
+}
+
+type Pipeline struct {
+	Entries      []PipelineEntry // most recent last
+	Hazards      []Hazard        // most recent last
+	Instructions int
+	Stalls       int
+	Flushes      int
+
+	prev        PipelineEntry
+	prevDest    int8
+	prevIsLoad  bool
+	prev2Dest   int8
+	prev2Text   string
+	pendingTake bool
+	pendingWhy  string // "taken" or "mispredicted"
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+func (pipeline *Pipeline) Reset() {
+	*pipeline = *NewPipeline()
+}
+
+// cycle the most recent instruction was fetched in
+func (pipeline *Pipeline) Cycle() int {
+	if len(pipeline.Entries) == 0 {
+		return 0
+	}
+	return pipeline.Entries[len(pipeline.Entries)-1].Fetch
+}
+
+// total cycles once the last instruction drains out of WB
+func (pipeline *Pipeline) Cycles() int {
+	if len(pipeline.Entries) == 0 {
+		return 0
+	}
+	return pipeline.Entries[len(pipeline.Entries)-1].StageCycle(StageWB)
+}
+
+func (pipeline *Pipeline) CPI() float64 {
+	if pipeline.Instructions == 0 {
+		return 0
+	}
+	return float64(pipeline.Cycles()) / float64(pipeline.Instructions)
+}
+
+// the instruction in each stage during a cycle, nil for a bubble
+func (pipeline *Pipeline) Occupancy(cycle int) [5]*PipelineEntry {
+	var stages [5]*PipelineEntry
+	for i := range pipeline.Entries {
+		entry := &pipeline.Entries[i]
+		for stage := StageIF; stage <= StageWB; stage++ {
+			if entry.InStage(stage, cycle) {
+				stages[stage] = entry
+			}
+		}
+	}
+	return stages
+}
+
+func (pipeline *Pipeline) addHazard(cycle int, kind string, message string) {
+	pipeline.Hazards = append(pipeline.Hazards, Hazard{Cycle: cycle, Kind: kind, Message: message})
+	if len(pipeline.Hazards) > pipelineHistory {
+		pipeline.Hazards = pipeline.Hazards[1:]
+	}
+}
+
+// records a retired instruction. nextPC is the PC after it executed.
+func (pipeline *Pipeline) retire(pc uint32, text string, instr Instr, nextPC uint32, outcome branchOutcome) {
+	prev := pipeline.prev
+	entry := PipelineEntry{PC: pc, Text: text}
+
+	// fetched once the previous instruction moves to ID, or once a taken
+	// branch resolves in EX and the wrongly fetched instructions are flushed
+	if pipeline.Instructions == 0 {
+		entry.Fetch = 1
+	} else if pipeline.pendingTake {
+		entry.Fetch = prev.Execute + 1
+		pipeline.addHazard(prev.Execute, "flush", fmt.Sprintf("flushed %d instructions after %s %s", flushPenalty, pipeline.pendingWhy, prev.Text))
+	} else {
+		entry.Fetch = prev.Decode
+	}
+
+	entry.Decode = max(entry.Fetch+1, prev.Execute)
+	entry.Execute = max(entry.Decode+1, prev.Execute+1)
+
+	dest, sources := instrRegisters(instr)
+
+	for _, source := range sources {
+		if source == 0 {
+			continue
+		}
+
+		if source == pipeline.prevDest && pipeline.prevIsLoad {
+			// the loaded value is only forwarded from MEM/WB
+			entry.Execute = max(entry.Execute, prev.Execute+2)
+			pipeline.addHazard(entry.Decode, "load-use", fmt.Sprintf("stall: %s needs x%d from %s", text, source, prev.Text))
+		} else if source == pipeline.prevDest {
+			pipeline.addHazard(entry.Execute, "forward", fmt.Sprintf("forward x%d from %s (EX/MEM)", source, prev.Text))
+		} else if source == pipeline.prev2Dest {
+			pipeline.addHazard(entry.Execute, "forward", fmt.Sprintf("forward x%d from %s (MEM/WB)", source, pipeline.prev2Text))
+		}
+	}
+
+	pipeline.Stalls += entry.Execute - entry.Decode - 1
+
+	pipeline.Entries = append(pipeline.Entries, entry)
+	if len(pipeline.Entries) > pipelineHistory {
+		pipeline.Entries = pipeline.Entries[1:]
+	}
+	pipeline.Instructions++
+
+	_, isLoad := instr.(*LoadInstr)
+	if _, isAtomic := instr.(*AtomicInstr); isAtomic {
+		isLoad = true
+	}
+	pipeline.prev2Dest, pipeline.prev2Text = pipeline.prevDest, prev.Text
+	pipeline.prev, pipeline.prevDest, pipeline.prevIsLoad = entry, dest, isLoad
+
+	switch outcome {
+	case unpredicted:
+		pipeline.pendingTake, pipeline.pendingWhy = nextPC != pc+instrSize(instr), "taken"
+	case predictedRight:
+		pipeline.pendingTake = false
+	case predictedWrong:
+		pipeline.pendingTake, pipeline.pendingWhy = true, "mispredicted"
+	}
+	if pipeline.pendingTake {
+		pipeline.Flushes++
+	}
+}
+
+// destination and source registers of an instruction, 0 when unused
+func instrRegisters(instr Instr) (int8, []int8) {
+	switch v := baseInstr(instr).(type) {
+	case *InstrThreePt:
+		return v.rd, []int8{v.rs1, v.rs2}
+	case *InstrThreePtImm:
+		return v.rd, []int8{v.rs1}
+	case *LoadImmInstr:
+		return v.rd, nil
+	case *LoadInstr:
+		return v.rd, []int8{v.rs1}
+	case *StoreInstr:
+		return 0, []int8{v.rs1, v.rs2}
+	case *BranchThreeInstr:
+		return 0, []int8{v.rs1, v.rs2}
+	case *BranchTwoInstr:
+		return 0, []int8{v.rs1}
+	case *JumpAndLinkInstr:
+		return v.rd, nil
+	case *JumpAndLinkRInstr:
+		return v.rd, []int8{v.rs1}
+	case *AtomicInstr:
+		return v.rd, []int8{v.rs1, v.rs2}
+	case *SetInstr:
+		return v.rd, []int8{v.rs1, v.rs2}
+	case *SetImmInstr:
+		return v.rd, []int8{v.rs1}
+	case *CSRInstr:
+		if v.useImm {
+			return v.rd, nil
+		}
+		return v.rd, []int8{v.rs1}
+	case *EcallInstr:
+		return 10, []int8{10, 17}
+	case *customInstr:
+		return int8(v.operands.Rd), []int8{int8(v.operands.Rs1), int8(v.operands.Rs2)}
+	}
+	return 0, nil
+}
+
+// classic pipeline diagram of the most recent instructions, one row each
+func (pipeline *Pipeline) Diagram(rows int) string {
+	entries := pipeline.Entries
+	if len(entries) > rows {
+		entries = entries[len(entries)-rows:]
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	first := entries[0].Fetch
+	last := entries[len(entries)-1].StageCycle(StageWB)
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%-20s", "cycle"))
+	for cycle := first; cycle <= last; cycle++ {
+		builder.WriteString(fmt.Sprintf("%-4d", cycle))
+	}
+	builder.WriteString("\n")
+
+	for _, entry := range entries {
+		text := entry.Text
+		if len(text) > 19 {
+			text = text[:19]
+		}
+		builder.WriteString(fmt.Sprintf("%-20s", text))
+
+		for cycle := first; cycle <= last; cycle++ {
+			cell := ""
+			for stage := StageIF; stage <= StageWB; stage++ {
+				if entry.InStage(stage, cycle) {
+					cell = StageNames[stage]
+					if cycle != entry.StageCycle(stage) {
+						// stalled in the stage
+						cell = "**"
+					}
+				}
+			}
+			builder.WriteString(fmt.Sprintf("%-4s", cell))
+		}
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// starts feeding retired instructions to a new five-stage pipeline model
+func (cpu *CPU) EnablePipeline() *Pipeline {
+	cpu.pipeline = NewPipeline()
+	return cpu.pipeline
+}
+
+func (cpu *CPU) DisablePipeline() {
+	cpu.pipeline = nil
+}
+
+// nil unless enabled
+func (cpu *CPU) Pipeline() *Pipeline {
+	return cpu.pipeline
+}
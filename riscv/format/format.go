@@ -0,0 +1,125 @@
+// Package format renders register and memory values the way the interpreter
+// displays them, so the interface and command line output agree.
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// how a value is shown
+type Mode int
+
+const (
+	Decimal  Mode = iota // signed
+	Hex                  // zero padded to the full width
+	Binary               // zero padded to the full width
+	Unsigned             // decimal, treating the value as unsigned
+)
+
+var modeNames = [...]string{"decimal", "hex", "binary", "unsigned"}
+
+func (mode Mode) String() string {
+	if mode >= 0 && int(mode) < len(modeNames) {
+		return modeNames[mode]
+	}
+	return fmt.Sprintf("mode %d", int(mode))
+}
+
+// the mode after this one, wrapping back to decimal
+func (mode Mode) Next() Mode {
+	return (mode + 1) % Mode(len(modeNames))
+}
+
+// "decimal", "hex", "binary" or "unsigned"
+func ParseMode(name string) (Mode, error) {
+	for mode, modeName := range modeNames {
+		if name == modeName {
+			return Mode(mode), nil
+		}
+	}
+	return Decimal, fmt.Errorf("unknown format %q, expected decimal, hex, binary or unsigned", name)
+}
+
+// a register or other 32 bit value on its own
+func Word(value int32, mode Mode) string {
+	return Sized(uint32(value), 4, mode)
+}
+
+// the low size bytes (1, 2 or 4) of value. Hex and binary are padded to the
+// full width of size and decimal is sign extended from it
+func Sized(value uint32, size int, mode Mode) string {
+	bits := size * 8
+	value &= uint32(1<<bits - 1)
+	switch mode {
+	case Hex:
+		return fmt.Sprintf("0x%0*x", size*2, value)
+	case Binary:
+		return fmt.Sprintf("0b%0*b", bits, value)
+	case Unsigned:
+		return fmt.Sprintf("%d", value)
+	}
+	return fmt.Sprintf("%d", int32(value<<(32-bits))>>(32-bits))
+}
+
+// a word in a column of a dump, padded so the columns line up
+func column(value uint32, mode Mode) string {
+	switch mode {
+	case Hex:
+		return fmt.Sprintf("%08x", value)
+	case Binary:
+		return fmt.Sprintf("%032b", value)
+	case Unsigned:
+		return fmt.Sprintf("%10d", value)
+	}
+	return fmt.Sprintf("%11d", int32(value))
+}
+
+// a single byte left over at the end of a dump
+func byteColumn(value byte, mode Mode) string {
+	switch mode {
+	case Hex:
+		return fmt.Sprintf("%02x", value)
+	case Binary:
+		return fmt.Sprintf("%08b", value)
+	case Unsigned:
+		return fmt.Sprintf("%3d", value)
+	}
+	return fmt.Sprintf("%4d", int8(value))
+}
+
+// bytes shown on each line of a dump: four words, or one in binary
+func LineBytes(mode Mode) uint32 {
+	if mode == Binary {
+		return 4
+	}
+	return 16
+}
+
+// the little endian words of memory[start:end], each line starting with its
+// address. A trailing partial word is shown byte by byte
+func Dump(memory []byte, start, end uint32, mode Mode) []string {
+	return DumpOrder(memory, start, end, mode, binary.LittleEndian)
+}
+
+// like Dump with words in the given byte order
+func DumpOrder(memory []byte, start, end uint32, mode Mode, order binary.ByteOrder) []string {
+	var lines []string
+	step := LineBytes(mode)
+	for address := start; address < end; address += step {
+		var builder strings.Builder
+		builder.WriteString(fmt.Sprintf("0x%04x:", address))
+		for offset := address; offset < min(address+step, end); offset += 4 {
+			if offset+4 <= end {
+				builder.WriteString(" " + column(order.Uint32(memory[offset:]), mode))
+			} else {
+				for ; offset < end; offset++ {
+					builder.WriteString(" " + byteColumn(memory[offset], mode))
+				}
+			}
+		}
+		lines = append(lines, builder.String())
+	}
+	return lines
+}
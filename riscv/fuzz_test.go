@@ -0,0 +1,110 @@
+package riscv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test . -run '^$' -fuzz FuzzRunProgram
+//
+// Malformed source has to end up as diagnostics or traps, never a panic.
+// The seeds below and the testdata programs run as ordinary tests.
+
+var fuzzSeedLines = []string{
+	"addi a0, a0, 1",
+	"li a0, 0x12345678",
+	"lui a0, %hi(data)",
+	"lw a0, 4(sp)",
+	"sb a1, -1(a0)",
+	"jalr ra, 0(a0)",
+	"jalr a0",
+	"jal ra, loop",
+	"beq a0, a1, 1f",
+	"bnez a0, -4",
+	"div a0, a1, zero",
+	"rem a0, a1, a2",
+	"csrrwi a0, mstatus, 3",
+	"csrr a0, mcause",
+	"amoadd.w a0, a1, (a2)",
+	"lr.w a0, (a1)",
+	"c.addi a0, 1",
+	"c.lwsp a0, 4(sp)",
+	"c.j loop",
+	"ecall",
+	"wfi",
+	"ret",
+	"loop: j loop",
+	".macro m a\naddi \\a, \\a, 1\n.endm\nm a0",
+	".rept 3\nslli a0, a0, 1\n.endr",
+	".global main\nmain:\nli a0, 1\nret",
+	".assert a0 == 1",
+	".bookmark out 0x100 0x110 word",
+}
+
+func FuzzDecodeInstr(f *testing.F) {
+	for _, line := range fuzzSeedLines {
+		f.Add(line)
+	}
+
+	// nothing recovers here, so a parser that panics fails the fuzzer
+	f.Fuzz(func(t *testing.T, line string) {
+		instr, err := decodeInstr(stripComment(line))
+		if (err == nil) == (instr == nil) {
+			t.Errorf("%q: %v %v", line, instr, err)
+		}
+	})
+}
+
+func FuzzRunProgram(f *testing.F) {
+	f.Add(strings.Join(fuzzSeedLines, "\n"))
+	for _, line := range fuzzSeedLines {
+		f.Add(line)
+	}
+	sources, _ := filepath.Glob(filepath.Join("testdata", "*.s"))
+	for _, path := range sources {
+		if source, err := os.ReadFile(path); err == nil {
+			f.Add(string(source))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, source string) {
+		cpu := NewCPU(1024)
+		cpu.SetStepBudget(1000)
+		if _, _, err := cpu.MapStandardDevices(); err != nil {
+			t.Fatal(err)
+		}
+		cpu.LoadInstructions(strings.Split(source, "\n"))
+		cpu.RunProgram()
+
+		for _, diagnostic := range cpu.Diagnostics() {
+			if strings.Contains(diagnostic.Message, "runtime error") {
+				t.Errorf("line %d: %s", diagnostic.Line, diagnostic.Message)
+			}
+		}
+		if err := cpu.Err(); err != nil && strings.Contains(err.Error(), "runtime error") {
+			t.Error(err)
+		}
+	})
+}
+
+// snapshots come from files too, so a damaged one has to fail to restore
+// rather than panic
+func FuzzRestore(f *testing.F) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{".macro inc r\naddi \\r, \\r, 1\n.endm", "li a0, 5", "inc a0", "sw a0, 8(zero)"})
+	cpu.RunNextInstruction()
+	if data, err := cpu.Snapshot(); err == nil {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		restored, err := Restore(data)
+		if err != nil {
+			return
+		}
+		restored.SetStepBudget(100)
+		restored.RunProgram()
+	})
+}
@@ -0,0 +1,3 @@
+module github.com/ckashino/riscv_interpreter/riscv
+
+go 1.24.1
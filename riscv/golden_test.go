@@ -0,0 +1,170 @@
+package riscv
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// go test . -run TestGolden -update rewrites the expected states
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+const goldenMaxSteps = 100000
+
+type goldenMemory struct {
+	Address uint32  `json:"address"`
+	Words   []int32 `json:"words"`
+}
+
+// expected final state of a program in testdata/<name>.s
+type goldenState struct {
+	Registers map[string]int32 `json:"registers"`
+	Memory    []goldenMemory   `json:"memory,omitempty"`
+}
+
+func runGolden(source []byte) (*CPU, error) {
+	cpu := NewCPU(1024 * 10)
+	cpu.LoadInstructions(strings.Split(string(source), "\n"))
+
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) > 0 {
+		return nil, fmt.Errorf("%s", diagnostics[0])
+	}
+
+	for steps := 0; !cpu.Done; steps++ {
+		if steps == goldenMaxSteps {
+			return nil, fmt.Errorf("did not halt after %d steps", goldenMaxSteps)
+		}
+		cpu.RunNextInstruction()
+	}
+
+	return &cpu, nil
+}
+
+// every non-zero register and every non-zero word of memory
+func captureGolden(cpu *CPU) goldenState {
+	state := goldenState{Registers: make(map[string]int32)}
+	names := cpu.Arch.RegisterNames()
+
+	for i, value := range cpu.Registers {
+		if value != 0 {
+			state.Registers[names[i]] = value
+		}
+	}
+
+	for address := uint32(0); address+4 <= uint32(len(cpu.Memory)); address += 4 {
+		word := int32(binary.LittleEndian.Uint32(cpu.Memory[address:]))
+		if word == 0 {
+			continue
+		}
+
+		last := len(state.Memory) - 1
+		if last >= 0 && state.Memory[last].Address+uint32(len(state.Memory[last].Words))*4 == address {
+			state.Memory[last].Words = append(state.Memory[last].Words, word)
+		} else {
+			state.Memory = append(state.Memory, goldenMemory{Address: address, Words: []int32{word}})
+		}
+	}
+
+	return state
+}
+
+// compares the whole register file and every word of memory, with anything
+// the golden file leaves out expected to be 0
+func diffGolden(cpu *CPU, expected goldenState) []string {
+	var diffs []string
+
+	names := make([]string, 0, len(expected.Registers))
+	for name := range expected.Registers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var registers [32]int32
+	for _, name := range names {
+		register, ok := cpu.Arch.RegisterNumber(name)
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("unknown register %s", name))
+			continue
+		}
+		registers[register] = expected.Registers[name]
+	}
+	for i, name := range cpu.Arch.RegisterNames() {
+		if actual := cpu.Registers[i]; actual != registers[i] {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %d, got %d", name, registers[i], actual))
+		}
+	}
+
+	words := make(map[uint32]int32)
+	for _, region := range expected.Memory {
+		for i, word := range region.Words {
+			address := region.Address + uint32(i)*4
+			if address+4 > uint32(len(cpu.Memory)) {
+				diffs = append(diffs, fmt.Sprintf("address %d is out of memory", address))
+				continue
+			}
+			words[address] = word
+		}
+	}
+	for address := uint32(0); address+4 <= uint32(len(cpu.Memory)); address += 4 {
+		if actual := int32(binary.LittleEndian.Uint32(cpu.Memory[address:])); actual != words[address] {
+			diffs = append(diffs, fmt.Sprintf("word at %d: expected %d, got %d", address, words[address], actual))
+		}
+	}
+
+	return diffs
+}
+
+func TestGolden(t *testing.T) {
+	sources, err := filepath.Glob(filepath.Join("testdata", "*.s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sourcePath := range sources {
+		name := strings.TrimSuffix(filepath.Base(sourcePath), ".s")
+		expectedPath := strings.TrimSuffix(sourcePath, ".s") + ".json"
+
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(sourcePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cpu, err := runGolden(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *updateGolden {
+				data, err := json.MarshalIndent(captureGolden(cpu), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(expectedPath, append(data, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			data, err := os.ReadFile(expectedPath)
+			if err != nil {
+				t.Fatalf("%s (run with -update to create it)", err)
+			}
+
+			var expected goldenState
+			if err := json.Unmarshal(data, &expected); err != nil {
+				t.Fatalf("%s: %s", expectedPath, err)
+			}
+
+			for _, diff := range diffGolden(cpu, expected) {
+				t.Error(diff)
+			}
+		})
+	}
+}
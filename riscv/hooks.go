@@ -0,0 +1,56 @@
+package riscv
+
+// called after a register is written, even if the value did not change
+type RegisterHook func(register int, old, new int32)
+
+// called after size bytes of memory are written at address
+type MemoryHook func(address uint32, size uint32, value int32)
+
+func (cpu *CPU) OnRegisterWrite(hook RegisterHook) {
+	cpu.registerHooks = append(cpu.registerHooks, hook)
+}
+
+func (cpu *CPU) OnMemoryWrite(hook MemoryHook) {
+	cpu.memoryHooks = append(cpu.memoryHooks, hook)
+}
+
+// all register writes made by instructions go through here. Writes to x0 are
+// discarded.
+func (cpu *CPU) setRegister(register int8, value int32) {
+	cpu.writeRegister(register, value, true)
+}
+
+// every register write, by instructions or SetRegister, goes through here
+func (cpu *CPU) writeRegister(register int8, value int32, byInstruction bool) {
+	if register == 0 {
+		return
+	}
+
+	old := cpu.Registers[register]
+	cpu.Registers[register] = value
+	if cpu.strict != nil {
+		cpu.strictRegisterWritten(register)
+	}
+	cpu.recordRegisterChange(register, old, value, byInstruction)
+	if byInstruction {
+		cpu.traceRegister(register, value)
+		if int(register) == cpu.Arch.StackPointer() {
+			cpu.stackPointerMoved(uint32(value))
+		}
+	}
+
+	for _, hook := range cpu.registerHooks {
+		hook(int(register), old, value)
+	}
+	if byInstruction {
+		cpu.checkRegisterWatches(register, old, value)
+	}
+}
+
+func (cpu *CPU) memoryWritten(address uint32, size uint32, value int32) {
+	cpu.invalidateReservation(address, size)
+	for _, hook := range cpu.memoryHooks {
+		hook(address, size, value)
+	}
+	cpu.checkMemoryWatches(address, size, value)
+}
@@ -0,0 +1,180 @@
+package riscv
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// a %hi(symbol) or %lo(symbol) operand. Like branch targets it is resolved
+// when the instruction runs, so the decoded line can be reused wherever the
+// symbol moves.
+type relocation struct {
+	kind   string // hi, lo, or abs for the whole address
+	symbol string
+}
+
+var relocationRe = regexp.MustCompile(`^%(\w+)\(\s*([^)]+?)\s*\)$`)
+
+// a symbol plus or minus a constant, e.g. table+4
+var symbolExprRe = regexp.MustCompile(`^([\w.]+)\s*([+-])\s*(\w+)$`)
+
+// instructions that can take a relocation
+type relocatable interface {
+	relocation() *relocation
+}
+
+func (instr *InstrThreePtImm) relocation() *relocation { return instr.reloc }
+func (instr *LoadImmInstr) relocation() *relocation    { return instr.reloc }
+func (instr *LoadInstr) relocation() *relocation       { return instr.reloc }
+func (instr *StoreInstr) relocation() *relocation      { return instr.reloc }
+
+// a label's address, or the symbol itself when it is a number, with an
+// optional offset added or subtracted
+func symbolValue(labels map[string]uint32, symbol string) (uint32, bool) {
+	// branches resolve their label every time they run, so try the plain
+	// label before the regexp
+	if address, ok := labels[symbol]; ok {
+		return address, true
+	}
+
+	if match := symbolExprRe.FindStringSubmatch(symbol); match != nil {
+		base, ok := symbolValue(labels, match[1])
+		offset, err := strconv.ParseUint(match[3], 0, 32)
+		if !ok || err != nil {
+			return 0, false
+		}
+		if match[2] == "-" {
+			return base - uint32(offset), true
+		}
+		return base + uint32(offset), true
+	}
+
+	value, err := strconv.ParseUint(symbol, 0, 32)
+	return uint32(value), err == nil
+}
+
+// the immediate to use, imm when there is no relocation. %hi rounds so that
+// adding the sign extended %lo gives back the address
+func (reloc *relocation) resolve(cpu *CPU, imm int32) int32 {
+	if reloc == nil {
+		return imm
+	}
+
+	address, ok := symbolValue(cpu.Labels, reloc.symbol)
+	if !ok {
+		cpu.raise(ExcIllegalInstruction, 0)
+	}
+
+	hi := (address + 0x800) >> 12
+	switch reloc.kind {
+	case "hi":
+		return int32(hi)
+	case "lo":
+		return int32(address - hi<<12)
+	}
+	return int32(address)
+}
+
+// branches and jumps, whose destination is an offset or a label
+type branching interface {
+	target() string
+}
+
+func (instr *BranchThreeInstr) target() string { return instr.destination }
+func (instr *BranchTwoInstr) target() string   { return instr.destination }
+func (instr *JumpInstr) target() string        { return instr.destination }
+func (instr *JumpAndLinkInstr) target() string { return instr.destination }
+
+// an error when instr refers to a symbol that isn't defined
+func checkSymbols(instr Instr, labels map[string]uint32) error {
+	var symbol string
+	switch instr := baseInstr(instr).(type) {
+	case relocatable:
+		if instr.relocation() == nil {
+			return nil
+		}
+		symbol = instr.relocation().symbol
+	case branching:
+		if _, err := strconv.ParseInt(instr.target(), 0, 32); err == nil {
+			return nil
+		}
+		symbol = instr.target()
+	default:
+		return nil
+	}
+
+	if _, ok := symbolValue(labels, symbol); !ok {
+		if match := localLabelRe.FindStringSubmatch(symbol); match != nil {
+			return fmt.Errorf("undefined local label: %s", match[1])
+		}
+		return fmt.Errorf("undefined symbol: %s", symbol)
+	}
+	return nil
+}
+
+// parses a number and checks it is within min and max
+func parseImmRange(mnemonic, imm_str string, min, max int64) (int32, error) {
+	imm, err := strconv.ParseInt(imm_str, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("immediate parse error: %s", imm_str)
+	}
+	if imm < min || imm > max {
+		return 0, fmt.Errorf("immediate %s out of range for %s, expected %d to %d", imm_str, mnemonic, min, max)
+	}
+	return int32(imm), nil
+}
+
+// parses a number or a relocation of the given kind
+func parseRelocatable(mnemonic, operand, kind string, min, max int64) (int32, *relocation, error) {
+	match := relocationRe.FindStringSubmatch(operand)
+	if match == nil {
+		imm, err := parseImmRange(mnemonic, operand, min, max)
+		return imm, nil, err
+	}
+
+	if match[1] != "hi" && match[1] != "lo" {
+		return 0, nil, fmt.Errorf("unknown relocation: %%%s", match[1])
+	}
+	if match[1] != kind {
+		return 0, nil, fmt.Errorf("%%%s is not allowed in %s", match[1], mnemonic)
+	}
+	return 0, &relocation{kind: kind, symbol: match[2]}, nil
+}
+
+// the signed 12 bit immediate of I and S type instructions, or %lo(symbol)
+func parseImm12(mnemonic, operand string) (int32, *relocation, error) {
+	return parseRelocatable(mnemonic, operand, "lo", -2048, 2047)
+}
+
+// the 20 bit immediate of lui and auipc, or %hi(symbol)
+func parseImm20(mnemonic, operand string) (int32, *relocation, error) {
+	return parseRelocatable(mnemonic, operand, "hi", 0, 1<<20-1)
+}
+
+// shift amounts are 5 bits
+func parseShamt(mnemonic, operand string) (int32, error) {
+	return parseImmRange(mnemonic, operand, 0, 31)
+}
+
+// li expands to as many instructions as it needs, so takes any 32 bit value
+func parseImm32(mnemonic, operand string) (int32, error) {
+	return parseImmRange(mnemonic, operand, math.MinInt32, math.MaxUint32)
+}
+
+// numeric branch and jump offsets must be even and fit in bits, labels are
+// checked when the branch is taken
+func checkOffset(mnemonic, destination string, bits uint) error {
+	if _, err := strconv.ParseInt(destination, 0, 64); err != nil {
+		return nil
+	}
+	offset, err := parseImmRange(mnemonic, destination, -1<<(bits-1), 1<<(bits-1)-1)
+	if err != nil {
+		return err
+	}
+	if offset%2 != 0 {
+		return fmt.Errorf("offset %s for %s must be even", destination, mnemonic)
+	}
+	return nil
+}
@@ -11,22 +11,9 @@ type NoOp struct {
 	reason string
 }
 
+// lines that failed to assemble
 func (instr *NoOp) Operate(cpu *CPU) {
-	cpu.PC += 4
-}
-
-var threePtInstrTypes = []string{
-	"add",
-	"sub",
-	"mul",
-	"div",
-	"rem",
-	"and",
-	"or",
-	"xor",
-	"sll",
-	"srl",
-	"sra",
+	cpu.raise(ExcIllegalInstruction, 0)
 }
 
 type InstrThreePt struct {
@@ -38,111 +25,71 @@ type InstrThreePt struct {
 
 func (instr *InstrThreePt) Operate(cpu *CPU) {
 	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = instr.op(
+		cpu.setRegister(instr.rd, instr.op(
 			cpu.Registers[instr.rs1],
 			cpu.Registers[instr.rs2],
-		)
+		))
 	}
-	cpu.PC += 4
-}
-
-var threePtImmInstrTypes = []string{
-	"addi",
-	"andi",
-	"ori",
-	"xori",
-	"slli",
-	"srli",
-	"srai",
+	cpu.PC = cpu.nextPC()
 }
 
 type InstrThreePtImm struct {
-	rd  int8
-	rs1 int8
-	imm int32
-	op  func(int32, int32) int32
+	rd    int8
+	rs1   int8
+	imm   int32
+	reloc *relocation
+	op    func(int32, int32) int32
 }
 
 func (instr *InstrThreePtImm) Operate(cpu *CPU) {
 	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = instr.op(
+		cpu.setRegister(instr.rd, instr.op(
 			cpu.Registers[instr.rs1],
-			instr.imm,
-		)
+			instr.reloc.resolve(cpu, instr.imm),
+		))
 	}
-	cpu.PC += 4
-}
-
-var loadImmInstrTypes = []string{
-	"li",
-	"lui",
-	"auipc",
+	cpu.PC = cpu.nextPC()
 }
 
 type LoadImmInstr struct {
-	rd  int8
-	imm int32
-	op  func(*CPU, int32) int32
+	rd    int8
+	imm   int32
+	reloc *relocation
+	op    func(*CPU, int32) int32
 }
 
 func (instr *LoadImmInstr) Operate(cpu *CPU) {
 	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = instr.op(cpu, instr.imm)
+		cpu.setRegister(instr.rd, instr.op(cpu, instr.reloc.resolve(cpu, instr.imm)))
 	}
-	cpu.PC += 4
-}
-
-var loadInstrTypes = []string{
-	"lw",
-	"lh",
-	"lhu",
-	"lb",
-	"lbu",
+	cpu.PC = cpu.nextPC()
 }
 
 type LoadInstr struct {
-	rd  int8
-	rs1 int8
-	imm int32
-	op  func(*CPU, int32, int32) int32
+	rd    int8
+	rs1   int8
+	imm   int32
+	reloc *relocation
+	op    func(*CPU, int32, int32) int32
 }
 
 func (instr *LoadInstr) Operate(cpu *CPU) {
-	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = instr.op(cpu, cpu.Registers[instr.rs1], instr.imm)
-	}
-	cpu.PC += 4
-}
-
-var storeInstrTypes = []string{
-	"sw",
-	"sh",
-	"sb",
+	// loads into x0 still access memory and can fault
+	cpu.setRegister(instr.rd, instr.op(cpu, cpu.Registers[instr.rs1], instr.reloc.resolve(cpu, instr.imm)))
+	cpu.PC = cpu.nextPC()
 }
 
 type StoreInstr struct {
-	rs1 int8
-	rs2 int8
-	imm int32
-	op  func(*CPU, int32, int32, int32)
+	rs1   int8
+	rs2   int8
+	imm   int32
+	reloc *relocation
+	op    func(*CPU, int32, int32, int32)
 }
 
 func (instr *StoreInstr) Operate(cpu *CPU) {
-	instr.op(cpu, cpu.Registers[instr.rs1], cpu.Registers[instr.rs2], instr.imm)
-	cpu.PC += 4
-}
-
-var branchThreeInstrTypes = []string{
-	"beq",
-	"bne",
-	"blt",
-	"bltu",
-	"bgt",
-	"bgtu",
-	"ble",
-	"bleu",
-	"bge",
-	"bgeu",
+	instr.op(cpu, cpu.Registers[instr.rs1], cpu.Registers[instr.rs2], instr.reloc.resolve(cpu, instr.imm))
+	cpu.PC = cpu.nextPC()
 }
 
 type BranchThreeInstr struct {
@@ -156,15 +103,6 @@ func (instr *BranchThreeInstr) Operate(cpu *CPU) {
 	instr.op(cpu, cpu.Registers[instr.rs1], cpu.Registers[instr.rs2], instr.destination)
 }
 
-var branchTwoInstrTypes = []string{
-	"beqz",
-	"bnez",
-	"bltz",
-	"bgtz",
-	"blez",
-	"bgez",
-}
-
 type BranchTwoInstr struct {
 	rs1         int8
 	destination string
@@ -180,7 +118,9 @@ type JumpInstr struct {
 }
 
 func (instr *JumpInstr) Operate(cpu *CPU) {
-	cpu.PC += uint32(immOrLabel(cpu, instr.destination))
+	target := cpu.PC + uint32(immOrLabel(cpu, instr.destination))
+	cpu.checkJumpTarget(target)
+	cpu.PC = target
 }
 
 type JumpAndLinkInstr struct {
@@ -189,10 +129,17 @@ type JumpAndLinkInstr struct {
 }
 
 func (instr *JumpAndLinkInstr) Operate(cpu *CPU) {
+	returnAddress := cpu.nextPC()
+	target := cpu.PC + uint32(immOrLabel(cpu, instr.destination))
+	cpu.checkJumpTarget(target)
+	if instr.rd != 0 {
+		cpu.setRegister(instr.rd, int32(returnAddress))
+	}
+	cpu.PC = target
+
 	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = int32(cpu.PC) + 4
+		cpu.pushFrame(cpu.PC, returnAddress)
 	}
-	cpu.PC += uint32(immOrLabel(cpu, instr.destination))
 }
 
 type JumpAndLinkRInstr struct {
@@ -202,15 +149,19 @@ type JumpAndLinkRInstr struct {
 }
 
 func (instr *JumpAndLinkRInstr) Operate(cpu *CPU) {
+	returnAddress := cpu.nextPC()
+	target := uint32(int(instr.imm) + int(cpu.Registers[instr.rs1]))
+	cpu.checkJumpTarget(target)
 	if instr.rd != 0 {
-		cpu.Registers[instr.rd] = int32(cpu.PC) + 4
+		cpu.setRegister(instr.rd, int32(returnAddress))
 	}
-	cpu.PC = uint32(int(instr.imm) + int(cpu.Registers[instr.rs1]))
-}
+	cpu.PC = target
 
-var setInstrTypes = []string{
-	"slt",
-	"sltu",
+	if instr.rd != 0 {
+		cpu.pushFrame(target, returnAddress)
+	} else {
+		cpu.popFrame(target)
+	}
 }
 
 type SetInstr struct {
@@ -221,17 +172,12 @@ type SetInstr struct {
 func (instr *SetInstr) Operate(cpu *CPU) {
 	if instr.rd != 0 {
 		if instr.op(cpu.Registers[instr.rs1], cpu.Registers[instr.rs2]) {
-			cpu.Registers[instr.rd] = 1
+			cpu.setRegister(instr.rd, 1)
 		} else {
-			cpu.Registers[instr.rd] = 0
+			cpu.setRegister(instr.rd, 0)
 		}
 	}
-	cpu.PC += 4
-}
-
-var setImmInstrTypes = []string{
-	"slti",
-	"sltiu",
+	cpu.PC = cpu.nextPC()
 }
 
 type SetImmInstr struct {
@@ -243,10 +189,90 @@ type SetImmInstr struct {
 func (instr *SetImmInstr) Operate(cpu *CPU) {
 	if instr.rd != 0 {
 		if instr.op(cpu.Registers[instr.rs1], instr.imm) {
-			cpu.Registers[instr.rd] = 1
+			cpu.setRegister(instr.rd, 1)
 		} else {
-			cpu.Registers[instr.rd] = 0
+			cpu.setRegister(instr.rd, 0)
 		}
 	}
-	cpu.PC += 4
+	cpu.PC = cpu.nextPC()
+}
+
+type CSRInstr struct {
+	rd, rs1 int8
+	csr     uint16
+	imm     int32
+	useImm  bool
+	// returns the new csr value and whether to write it
+	op func(old, operand int32, operandIsZero bool) (int32, bool)
+}
+
+func (instr *CSRInstr) Operate(cpu *CPU) {
+	operand := instr.imm
+	operandIsZero := instr.imm == 0
+	if !instr.useImm {
+		operand = cpu.Registers[instr.rs1]
+		operandIsZero = instr.rs1 == 0
+	}
+
+	old := cpu.ReadCSR(instr.csr)
+	if value, write := instr.op(old, operand, operandIsZero); write {
+		if err := cpu.writeCSR(instr.csr, value); err != nil {
+			cpu.raise(ExcIllegalInstruction, 0)
+		}
+	}
+
+	cpu.setRegister(instr.rd, old)
+	cpu.PC = cpu.nextPC()
+}
+
+type AtomicInstr struct {
+	rd, rs1, rs2 int8
+	op           func(*CPU, uint32, int32) int32
+}
+
+func (instr *AtomicInstr) Operate(cpu *CPU) {
+	cpu.setRegister(instr.rd, instr.op(cpu, uint32(cpu.Registers[instr.rs1]), cpu.Registers[instr.rs2]))
+	cpu.PC = cpu.nextPC()
+}
+
+type BreakpointInstr struct{}
+
+func (instr *BreakpointInstr) Operate(cpu *CPU) {
+	cpu.raise(ExcBreakpoint, cpu.PC)
+}
+
+// calls the trap handler when one is installed, otherwise makes the system
+// call numbered in a7
+type EcallInstr struct{}
+
+func (instr *EcallInstr) Operate(cpu *CPU) {
+	if cpu.csrs[CSRMtvec] != 0 {
+		cpu.raise(ExcEnvironmentCall, 0)
+	}
+	cpu.syscall()
+	cpu.PC = cpu.nextPC()
+}
+
+// returns from a trap handler, turning interrupts back on if they were on
+// before it
+type MretInstr struct{}
+
+func (instr *MretInstr) Operate(cpu *CPU) {
+	status := cpu.csrs[CSRMstatus]
+	status &^= MstatusMIE
+	if status&MstatusMPIE != 0 {
+		status |= MstatusMIE
+	}
+	cpu.csrs[CSRMstatus] = status | MstatusMPIE
+	cpu.PC = uint32(cpu.csrs[CSRMepc])
+}
+
+// waits for an enabled interrupt. Nothing else happens while the hart
+// waits, so the timers skip ahead to the next interrupt instead. With no
+// interrupt enabled it carries on straight away, which the spec allows.
+type WfiInstr struct{}
+
+func (instr *WfiInstr) Operate(cpu *CPU) {
+	cpu.waitForInterrupt()
+	cpu.PC = cpu.nextPC()
 }
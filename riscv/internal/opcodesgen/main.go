@@ -0,0 +1,207 @@
+// Generates riscv/opcodes_gen.go from instruction descriptions in the
+// riscv-opcodes format (https://github.com/riscv/riscv-opcodes).
+//
+//	go run ./internal/opcodesgen -o opcodes_gen.go spec/rv_i spec/rv_m spec/rv_a spec/rv_zicsr spec/rv_system spec/rv_c spec/pseudo
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type spec struct {
+	mnemonic  string
+	extension string
+	format    string
+	opcode    int
+	funct3    int
+	funct7    int
+	funct5    int
+	operands  []string
+	base      string
+}
+
+// instruction format implied by the operand fields
+func formatOf(operands []string) string {
+	switch {
+	case slices.Contains(operands, "jimm20"):
+		return "J"
+	case slices.Contains(operands, "imm20"):
+		return "U"
+	case slices.Contains(operands, "bimm12hi"), slices.Contains(operands, "bimm12"):
+		return "B"
+	case slices.Contains(operands, "imm12hi"):
+		return "S"
+	case slices.Contains(operands, "rd") && slices.Contains(operands, "rs2"), slices.Contains(operands, "aq"):
+		return "R"
+	}
+	return "I"
+}
+
+// parses "hi..lo=value" or "bit=value"
+func parseField(field string) (int, int, int, bool) {
+	bitRange, valueStr, found := strings.Cut(field, "=")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	value, err := strconv.ParseInt(valueStr, 0, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	hiStr, loStr, isRange := strings.Cut(bitRange, "..")
+	if !isRange {
+		loStr = hiStr
+	}
+
+	hi, hiErr := strconv.Atoi(hiStr)
+	lo, loErr := strconv.Atoi(loStr)
+	if hiErr != nil || loErr != nil {
+		return 0, 0, 0, false
+	}
+
+	return hi, lo, int(value), true
+}
+
+func parseFile(path string, specs map[string]*spec) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	extension := filepath.Base(path)
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "$pseudo_op" {
+			if len(fields) < 3 {
+				return fmt.Errorf("%s:%d: malformed pseudo op", path, lineNum)
+			}
+			baseExtension, base, _ := strings.Cut(fields[1], "::")
+			// pseudo ops in an extension's own file, like the compressed
+			// instructions, belong to that extension rather than their base's
+			if extension != "pseudo" {
+				baseExtension = extension
+			}
+			specs[fields[2]] = &spec{
+				mnemonic:  fields[2],
+				extension: baseExtension,
+				operands:  fields[3:],
+				base:      base,
+				funct3:    -1,
+				funct7:    -1,
+				funct5:    -1,
+			}
+			continue
+		}
+
+		entry := &spec{mnemonic: fields[0], extension: extension, funct3: -1, funct7: -1, funct5: -1}
+
+		for _, field := range fields[1:] {
+			hi, lo, value, ok := parseField(field)
+			if !ok {
+				entry.operands = append(entry.operands, field)
+				continue
+			}
+
+			switch {
+			case hi == 6 && lo == 2:
+				entry.opcode |= value << 2
+			case hi == 1 && lo == 0:
+				entry.opcode |= value
+			case hi == 14 && lo == 12:
+				entry.funct3 = value
+			case hi == 31 && lo == 25:
+				entry.funct7 = value
+			case hi == 31 && lo == 29:
+				// atomics split funct5 around the aq and rl bits
+				entry.funct5 = max(entry.funct5, 0) | value<<2
+			case hi == 28 && lo == 27:
+				entry.funct5 = max(entry.funct5, 0) | value
+			}
+		}
+
+		entry.format = formatOf(entry.operands)
+		specs[entry.mnemonic] = entry
+	}
+
+	return scanner.Err()
+}
+
+func main() {
+	output := flag.String("o", "opcodes_gen.go", "output file")
+	flag.Parse()
+
+	specs := make(map[string]*spec)
+	for _, path := range flag.Args() {
+		if err := parseFile(path, specs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// pseudo instructions take their format and encoding from their base
+	for _, entry := range specs {
+		if entry.base == "" {
+			continue
+		}
+		base, ok := specs[entry.base]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: unknown base instruction %s\n", entry.mnemonic, entry.base)
+			os.Exit(1)
+		}
+		entry.format = base.format
+		entry.opcode = base.opcode
+		entry.funct3 = base.funct3
+		entry.funct7 = base.funct7
+		entry.funct5 = base.funct5
+	}
+
+	mnemonics := make([]string, 0, len(specs))
+	for mnemonic := range specs {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	slices.Sort(mnemonics)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by internal/opcodesgen from %s. DO NOT EDIT.\n\n", strings.Join(flag.Args(), ", "))
+	fmt.Fprintf(&buf, "package riscv\n\n")
+	fmt.Fprintf(&buf, "var instrSpecs = map[string]instrSpec{\n")
+	for _, mnemonic := range mnemonics {
+		entry := specs[mnemonic]
+		fmt.Fprintf(&buf, "%q: {Extension: %q, Format: %q, Opcode: 0x%02x, Funct3: %d, Funct7: %d, Funct5: %d, Operands: %#v, Base: %q},\n",
+			mnemonic, entry.extension, entry.format, entry.opcode, entry.funct3, entry.funct7, entry.funct5, entry.operands, entry.base)
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(*output, source, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package riscv
+
+import "fmt"
+
+// mstatus bits
+const (
+	MstatusMIE  int32 = 1 << 3 // machine interrupts enabled
+	MstatusMPIE int32 = 1 << 7 // MIE before the last trap
+)
+
+// mcause codes of interrupts, which are also their bits in mie and mip
+type Interrupt int32
+
+const (
+	IntMachineSoftware Interrupt = 3
+	IntMachineTimer    Interrupt = 7
+	IntMachineExternal Interrupt = 11
+)
+
+var interruptNames = map[Interrupt]string{
+	IntMachineSoftware: "machine software interrupt",
+	IntMachineTimer:    "machine timer interrupt",
+	IntMachineExternal: "machine external interrupt",
+}
+
+func (interrupt Interrupt) String() string {
+	if name, ok := interruptNames[interrupt]; ok {
+		return name
+	}
+	return fmt.Sprintf("interrupt %d", int32(interrupt))
+}
+
+// the top bit of mcause tells interrupts from exceptions
+const mcauseInterrupt int32 = -1 << 31
+
+// mip bits that only devices set, writes to them are ignored
+const deviceInterruptBits int32 = 1<<IntMachineTimer | 1<<IntMachineExternal
+
+// the order interrupts are taken in when several are pending
+var interruptPriority = []Interrupt{IntMachineExternal, IntMachineSoftware, IntMachineTimer}
+
+// devices that also implement Interrupter raise their interrupt for as long
+// as it is pending
+type Interrupter interface {
+	Interrupt() Interrupt
+	Pending() bool
+}
+
+// the mip bits of the interrupts devices have pending
+func (cpu *CPU) pendingInterrupts() int32 {
+	var pending int32
+	for _, mapping := range cpu.devices {
+		if interrupter, ok := mapping.Device.(Interrupter); ok && interrupter.Pending() {
+			pending |= 1 << interrupter.Interrupt()
+		}
+	}
+	return pending
+}
+
+// before an instruction runs, vectors to mtvec for the most important
+// interrupt that is pending and enabled in mie, as long as mstatus.MIE is
+// set. In vectored mode (mtvec ending in 1) it goes to mtvec + 4*cause.
+func (cpu *CPU) takeInterrupt() bool {
+	vector := uint32(cpu.csrs[CSRMtvec])
+	if cpu.csrs[CSRMstatus]&MstatusMIE == 0 || vector == 0 {
+		return false
+	}
+	ready := cpu.ReadCSR(CSRMip) & cpu.csrs[CSRMie]
+	if ready == 0 {
+		return false
+	}
+
+	for _, interrupt := range interruptPriority {
+		if ready&(1<<interrupt) == 0 {
+			continue
+		}
+		cpu.csrs[CSRMepc] = int32(cpu.PC)
+		cpu.csrs[CSRMcause] = mcauseInterrupt | int32(interrupt)
+		cpu.csrs[CSRMtval] = 0
+		cpu.enterTrap()
+		cpu.PC = vector &^ 3
+		if vector&3 == 1 {
+			cpu.PC += 4 * uint32(interrupt)
+		}
+		return true
+	}
+	return false
+}
+
+// saves MIE in MPIE and turns interrupts off, as taking any trap does
+func (cpu *CPU) enterTrap() {
+	status := cpu.csrs[CSRMstatus] &^ MstatusMPIE
+	if status&MstatusMIE != 0 {
+		status |= MstatusMPIE
+	}
+	cpu.csrs[CSRMstatus] = status &^ MstatusMIE
+}
+
+// moves timers with their interrupt enabled on to their compare value, unless
+// an enabled interrupt is pending already
+func (cpu *CPU) waitForInterrupt() {
+	enabled := cpu.csrs[CSRMie]
+	if cpu.ReadCSR(CSRMip)&enabled != 0 || enabled&(1<<IntMachineTimer) == 0 {
+		return
+	}
+	for _, mapping := range cpu.devices {
+		if timer, ok := mapping.Device.(*Timer); ok {
+			timer.skipToCompare()
+		}
+	}
+}
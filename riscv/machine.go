@@ -0,0 +1,278 @@
+package riscv
+
+import (
+	"context"
+	"io"
+	"math/rand"
+)
+
+// how far apart the initial stack pointers of neighbouring harts are
+const hartStackSize = 1024
+
+// picks which hart runs the next instruction
+type Scheduler interface {
+	// returns one of the runnable hart indices, which are in ascending order
+	Next(runnable []int) int
+}
+
+// runs the harts one instruction each in turn
+type RoundRobin struct {
+	next int
+}
+
+func (scheduler *RoundRobin) Next(runnable []int) int {
+	chosen := runnable[0]
+	for _, i := range runnable {
+		if i >= scheduler.next {
+			chosen = i
+			break
+		}
+	}
+	scheduler.next = chosen + 1
+	return chosen
+}
+
+// picks a random hart each instruction, the seed makes a schedule repeatable
+type RandomScheduler struct {
+	rng *rand.Rand
+}
+
+func NewRandomScheduler(seed int64) *RandomScheduler {
+	return &RandomScheduler{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (scheduler *RandomScheduler) Next(runnable []int) int {
+	return runnable[scheduler.rng.Intn(len(runnable))]
+}
+
+// several harts sharing the memory of the first one, interleaved by a scheduler
+type Machine struct {
+	Harts      []*CPU
+	Scheduler  Scheduler
+	LastHart   int    // the hart that ran the last instruction, -1 before the first
+	StepBudget uint64 // instructions per run across all harts, 0 for no limit
+	tickers    []Ticker
+}
+
+// each hart gets its index in mhartid and its own stack below the previous
+// hart's. stores by any hart break the lr.w reservations of the others
+func NewMachine(harts []*CPU, scheduler Scheduler) *Machine {
+	machine := &Machine{Harts: harts, Scheduler: scheduler, LastHart: -1}
+
+	for i, hart := range harts {
+		hart.Memory = harts[0].Memory
+		hart.MemorySize = harts[0].MemorySize
+		hart.SetCSR(CSRMhartid, int32(i))
+		hart.SetRegister(hart.Arch.StackPointer(), int32(hart.MemorySize)-int32(i*hartStackSize))
+
+		hart.OnMemoryWrite(func(address uint32, size uint32, value int32) {
+			for j, other := range harts {
+				if j != i {
+					other.invalidateReservation(address, size)
+				}
+			}
+		})
+	}
+
+	return machine
+}
+
+// maps a device shared by every hart. With more than one hart a Ticker is
+// ticked once per Step rather than by each hart's instructions, so a lone
+// hart run on its own still ticks it.
+func (machine *Machine) MapDevice(base, size uint32, device Device) error {
+	shared := len(machine.Harts) > 1
+	for _, hart := range machine.Harts {
+		if err := hart.mapDevice(base, size, device, shared); err != nil {
+			return err
+		}
+	}
+	if ticker, ok := device.(Ticker); ok && shared {
+		machine.tickers = append(machine.tickers, ticker)
+	}
+	return nil
+}
+
+// maps a UART and a Timer shared by every hart. The UART writes to the
+// console stream of the first hart.
+func (machine *Machine) MapStandardDevices() (*UART, *Timer, error) {
+	uart, timer := NewUART(machine.Harts[0].Output(StreamConsole)), NewTimer()
+	if err := machine.MapDevice(UARTBase, UARTSize, uart); err != nil {
+		return nil, nil, err
+	}
+	if err := machine.MapDevice(TimerBase, TimerSize, timer); err != nil {
+		return nil, nil, err
+	}
+	return uart, timer, nil
+}
+
+// the harts share r as standard input for the read system call
+func (machine *Machine) SetStdin(r io.Reader) {
+	for _, hart := range machine.Harts {
+		hart.SetStdin(r)
+	}
+}
+
+// traces every hart to w. Entries from different harts are interleaved in
+// the order they ran and can be told apart by their Hart.
+func (machine *Machine) EnableTrace(w io.Writer, format TraceFormat) error {
+	for i, hart := range machine.Harts {
+		if err := hart.enableTrace(w, format, i == 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stops tracing every hart and returns the first write error
+func (machine *Machine) DisableTrace() error {
+	var first error
+	for _, hart := range machine.Harts {
+		if err := hart.DisableTrace(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (machine *Machine) LoadInstructions(instrs []string) {
+	for _, hart := range machine.Harts {
+		hart.LoadInstructions(instrs)
+	}
+}
+
+// the coverage of every hart added up
+func (machine *Machine) Coverage() Coverage {
+	var coverages []Coverage
+	for _, hart := range machine.Harts {
+		coverages = append(coverages, hart.Coverage())
+	}
+	return MergeCoverage(coverages...)
+}
+
+func (machine *Machine) ClearCoverage() {
+	for _, hart := range machine.Harts {
+		hart.ClearCoverage()
+	}
+}
+
+func (machine *Machine) runnable() []int {
+	var runnable []int
+	for i, hart := range machine.Harts {
+		if hart.Done {
+			continue
+		}
+		// halt harts that ran off the end now so they aren't scheduled for nothing
+		if _, ok := hart.CurrentLine(); !ok {
+			hart.endProgram()
+			continue
+		}
+		runnable = append(runnable, i)
+	}
+	return runnable
+}
+
+// whether every hart has halted
+func (machine *Machine) Done() bool {
+	return len(machine.runnable()) == 0
+}
+
+// runs one instruction on the next scheduled hart and returns its index,
+// or -1 once every hart has halted
+func (machine *Machine) Step() int {
+	runnable := machine.runnable()
+	if len(runnable) == 0 {
+		return -1
+	}
+
+	i := machine.Scheduler.Next(runnable)
+	machine.Harts[i].RunNextInstruction()
+	machine.LastHart = i
+	for _, ticker := range machine.tickers {
+		ticker.Tick()
+	}
+	return i
+}
+
+// runs until every hart halts, or one of them faults, hits an ebreak or a
+// breakpoint or triggers a watch. The harts are left as they stopped either
+// way, and Restart each of them to run the program again
+func (machine *Machine) Run() {
+	machine.RunContext(context.Background())
+}
+
+// the most instructions a run of all harts together may execute, 0 for no
+// limit. The limit is the smallest of StepBudget and the harts' sandbox
+// MaxSteps, so sandboxed harts stay capped however many there are.
+func (machine *Machine) StepLimit() uint64 {
+	limit := machine.StepBudget
+	for _, hart := range machine.Harts {
+		if hart.sandbox != nil && hart.sandbox.MaxSteps != 0 && (limit == 0 || hart.sandbox.MaxSteps < limit) {
+			limit = hart.sandbox.MaxSteps
+		}
+	}
+	return limit
+}
+
+// like CPU.RunContext for every hart, with StepLimit counting the
+// instructions of all harts together. The hart that ran last gets the
+// ErrStepLimit or ErrCanceled.
+func (machine *Machine) RunContext(ctx context.Context) uint64 {
+	for _, hart := range machine.Harts {
+		hart.err = nil
+	}
+
+	steps := uint64(0)
+	for machine.CanStep(ctx, steps) {
+		for i, hart := range machine.Harts {
+			if hart.pauseAtBreakpoint() {
+				machine.LastHart = i
+				return steps
+			}
+		}
+
+		i := machine.Step()
+		if i < 0 {
+			break
+		}
+		steps++
+
+		hart := machine.Harts[i]
+		if len(hart.watchHits) > 0 || hart.breakpoint || hart.err != nil {
+			return steps
+		}
+	}
+
+	return steps
+}
+
+// whether a run that has taken steps instructions may take another. When
+// StepLimit has run out or ctx is done the hart that ran last gets
+// ErrStepLimit or ErrCanceled, so loops calling Step themselves, like a
+// debugger's stepi, are held to the same limits as RunContext.
+func (machine *Machine) CanStep(ctx context.Context, steps uint64) bool {
+	// a run that ran out of steps or was canceled carries on in the next one
+	if steps == 0 {
+		for _, hart := range machine.Harts {
+			if hart.err == ErrStepLimit || hart.err == ErrCanceled {
+				hart.err = nil
+			}
+		}
+	}
+	if limit := machine.StepLimit(); limit != 0 && steps >= limit {
+		machine.stopLastHart(ErrStepLimit)
+		return false
+	}
+	if steps%cancelCheckInterval == 0 && ctx.Err() != nil {
+		machine.stopLastHart(ErrCanceled)
+		return false
+	}
+	return true
+}
+
+func (machine *Machine) stopLastHart(err error) {
+	if machine.LastHart < 0 {
+		machine.LastHart = 0
+	}
+	machine.Harts[machine.LastHart].err = err
+}
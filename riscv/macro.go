@@ -0,0 +1,247 @@
+package riscv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// how deep macros can call macros, which catches one that calls itself
+const maxMacroDepth = 64
+
+// the most lines macros and .rept can expand a program to
+const maxExpandedLines = 1 << 16
+
+type macroParam struct {
+	name       string
+	defaultArg string
+	hasDefault bool
+}
+
+// a .macro definition
+type macro struct {
+	name   string
+	params []macroParam
+	body   []string
+}
+
+// \param, \@ for the number of the expansion, and \() which separates a
+// parameter from text right after it
+var macroArgRe = regexp.MustCompile(`\\(\w+|@|\(\))`)
+
+type macroExpander struct {
+	macros      map[string]*macro
+	lines       []string
+	origins     []int
+	diagnostics []Diagnostic
+	expansions  int
+	overflowed  bool
+}
+
+// expands .macro and .rept before anything else looks at the source:
+//
+//	.macro push reg        .rept 3
+//	addi sp, sp, -4        slli a0, a0, 1
+//	sw \reg, 0(sp)         .endr
+//	.endm
+//
+// Definitions become blank lines, and a macro call becomes its body with
+// \param replaced by the arguments, which may be separated by commas or
+// spaces. Parameters can have defaults, e.g. ".macro inc reg, by=1". The
+// returned origins give the 0-based source line each expanded line came
+// from: the call for a macro's body, and the line in the source for a .rept
+// body, so stepping through a loop moves through its lines.
+func expandMacros(instrs []string) ([]string, []int, []Diagnostic) {
+	expander := macroExpander{macros: make(map[string]*macro)}
+	origins := make([]int, len(instrs))
+	for i := range origins {
+		origins[i] = i
+	}
+	expander.expand(instrs, origins, 0)
+	return expander.lines, expander.origins, expander.diagnostics
+}
+
+func (expander *macroExpander) emit(line string, origin int) {
+	if len(expander.lines) == maxExpandedLines {
+		if !expander.overflowed {
+			expander.overflowed = true
+			expander.diagnose(origin, fmt.Sprintf("macros expand the program to more than %d lines", maxExpandedLines))
+		}
+		return
+	}
+	expander.lines = append(expander.lines, line)
+	expander.origins = append(expander.origins, origin)
+}
+
+func (expander *macroExpander) diagnose(origin int, message string) {
+	expander.diagnostics = append(expander.diagnostics, Diagnostic{Line: origin + 1, Message: message})
+}
+
+// keeps any labels in front of a line that expands to something else, so
+// they name what it expands to
+func labelsOnly(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return strings.Join(labels, ": ") + ":"
+}
+
+func (expander *macroExpander) expand(lines []string, origins []int, depth int) {
+	for i := 0; i < len(lines); i++ {
+		labels, line := splitLabels(stripComment(lines[i]))
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			expander.emit(lines[i], origins[i])
+			continue
+		}
+
+		switch fields[0] {
+		case ".macro":
+			end := blockEnd(lines, i, ".macro", ".endm")
+			bodyEnd := end
+			if end < 0 {
+				expander.diagnose(origins[i], ".macro without .endm")
+				end, bodyEnd = len(lines)-1, len(lines)
+			}
+			expander.define(fields[1:], lines[i+1:bodyEnd], origins[i])
+			expander.emit(labelsOnly(labels), origins[i])
+			for j := i + 1; j <= end; j++ {
+				expander.emit("", origins[j])
+			}
+			i = end
+		case ".rept":
+			end := blockEnd(lines, i, ".rept", ".endr")
+			if end < 0 {
+				expander.diagnose(origins[i], ".rept without .endr")
+				end = len(lines)
+			}
+			count, err := strconv.ParseInt(strings.Join(fields[1:], ""), 0, 32)
+			if err != nil || count < 0 {
+				expander.diagnose(origins[i], fmt.Sprintf("invalid .rept count: %s", strings.Join(fields[1:], " ")))
+				count = 0
+			}
+			expander.emit(labelsOnly(labels), origins[i])
+			for range count {
+				if expander.overflowed {
+					break
+				}
+				expander.expand(lines[i+1:end], origins[i+1:end], depth+1)
+			}
+			if end < len(lines) {
+				expander.emit("", origins[end])
+			}
+			i = end
+		case ".endm", ".endr":
+			expander.diagnose(origins[i], fmt.Sprintf("%s without a matching start", fields[0]))
+			expander.emit(labelsOnly(labels), origins[i])
+		default:
+			macro, ok := expander.macros[fields[0]]
+			if !ok {
+				expander.emit(lines[i], origins[i])
+				continue
+			}
+			expander.emit(labelsOnly(labels), origins[i])
+			if depth == maxMacroDepth {
+				expander.diagnose(origins[i], fmt.Sprintf("macro %s nests more than %d deep, does it call itself?", macro.name, maxMacroDepth))
+				continue
+			}
+			body, err := expander.call(macro, splitMacroArgs(strings.TrimSpace(line[len(fields[0]):])))
+			if err != nil {
+				expander.diagnose(origins[i], err.Error())
+				continue
+			}
+			bodyOrigins := make([]int, len(body))
+			for j := range bodyOrigins {
+				bodyOrigins[j] = origins[i]
+			}
+			expander.expand(body, bodyOrigins, depth+1)
+		}
+	}
+}
+
+// the line of the end directive closing the block started at lines[start],
+// skipping over nested blocks, -1 if there isn't one
+func blockEnd(lines []string, start int, open, close string) int {
+	depth := 0
+	for i := start; i < len(lines); i++ {
+		_, line := splitLabels(stripComment(lines[i]))
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// commas and spaces both separate macro arguments and parameters
+func splitMacroArgs(args string) []string {
+	return strings.FieldsFunc(args, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func (expander *macroExpander) define(fields []string, body []string, origin int) {
+	if len(fields) == 0 {
+		expander.diagnose(origin, ".macro needs a name")
+		return
+	}
+	name, fields := fields[0], splitMacroArgs(strings.Join(fields[1:], " "))
+	// ".macro name, a, b" is allowed too
+	name = strings.TrimSuffix(name, ",")
+
+	definition := &macro{name: name, body: body}
+	for _, field := range fields {
+		paramName, defaultArg, hasDefault := strings.Cut(field, "=")
+		definition.params = append(definition.params, macroParam{name: paramName, defaultArg: defaultArg, hasDefault: hasDefault})
+	}
+	expander.macros[name] = definition
+}
+
+// the body of a macro with its parameters replaced by args
+func (expander *macroExpander) call(macro *macro, args []string) ([]string, error) {
+	if len(args) > len(macro.params) {
+		return nil, fmt.Errorf("macro %s takes %d arguments, got %d", macro.name, len(macro.params), len(args))
+	}
+	values := make(map[string]string, len(macro.params))
+	for i, param := range macro.params {
+		switch {
+		case i < len(args):
+			values[param.name] = args[i]
+		case param.hasDefault:
+			values[param.name] = param.defaultArg
+		default:
+			return nil, fmt.Errorf("macro %s is missing its %s argument", macro.name, param.name)
+		}
+	}
+
+	expander.expansions++
+	expansion := strconv.Itoa(expander.expansions)
+	body := make([]string, len(macro.body))
+	for i, line := range macro.body {
+		body[i] = macroArgRe.ReplaceAllStringFunc(line, func(ref string) string {
+			name := ref[1:]
+			switch name {
+			case "@":
+				return expansion
+			case "()":
+				return ""
+			}
+			if value, ok := values[name]; ok {
+				return value
+			}
+			return ref
+		})
+	}
+	return body, nil
+}
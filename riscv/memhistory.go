@@ -0,0 +1,174 @@
+package riscv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// how many loads and stores a cpu remembers unless SetMemoryHistoryDepth
+// says otherwise
+const DefaultMemoryHistoryDepth = 1000
+
+type MemOpType int
+
+const (
+	MemLoad MemOpType = iota
+	MemStore
+)
+
+func (opType MemOpType) String() string {
+	if opType == MemStore {
+		return "store"
+	}
+	return "load"
+}
+
+// one load or store. Value is what was loaded or stored, zero extended for
+// bytes and halves.
+type MemOp struct {
+	Type  MemOpType
+	Addr  uint32
+	Size  uint32
+	Value int32
+	PC    uint32 // of the instruction that made it
+	// a store made with WriteMemory rather than by an instruction, PC is
+	// where the cpu was at the time
+	Manual bool `json:",omitempty"`
+	// the data label Addr was in when the op was made, e.g. "counter+4"
+	Symbol string `json:",omitempty"`
+}
+
+// "store", or "set" for a manual store
+func (op MemOp) kind() string {
+	if op.Manual {
+		return "set"
+	}
+	return op.Type.String()
+}
+
+func (op MemOp) String() string {
+	return fmt.Sprintf("0x%04x: %s %d bytes at 0x%04x: %d", op.PC, op.kind(), op.Size, op.Addr, op.Value)
+}
+
+// which operations MemoryHistory returns. The zero value matches everything.
+type MemOpFilter struct {
+	// only operations touching Start up to End, exclusive. No range when End
+	// is 0.
+	Start, End uint32
+	// only loads or only stores, both when neither is set
+	Loads, Stores bool
+}
+
+func (filter MemOpFilter) Match(op MemOp) bool {
+	if filter.Loads != filter.Stores && filter.Stores != (op.Type == MemStore) {
+		return false
+	}
+	if filter.End != 0 && (op.Addr >= filter.End || op.Addr+op.Size <= filter.Start) {
+		return false
+	}
+	return true
+}
+
+// a ring buffer of the latest loads and stores, so recording one costs the
+// same however long the program runs
+type memHistory struct {
+	ops     []MemOp
+	next    int // where the next op goes once ops is full
+	depth   int
+	dropped uint64 // ops pushed out or never kept because the history is full
+}
+
+func (history *memHistory) add(op MemOp) {
+	if len(history.ops) < history.depth {
+		history.ops = append(history.ops, op)
+		return
+	}
+	history.dropped++
+	if history.depth == 0 {
+		return
+	}
+	history.ops[history.next] = op
+	history.next = (history.next + 1) % history.depth
+}
+
+// newest first
+func (history *memHistory) newest() []MemOp {
+	ops := make([]MemOp, 0, len(history.ops))
+	for i := range history.ops {
+		ops = append(ops, history.ops[(history.next-1-i+2*len(history.ops))%len(history.ops)])
+	}
+	return ops
+}
+
+// the loads and stores the history still holds that match filter, newest
+// first
+func (cpu *CPU) MemoryHistory(filter MemOpFilter) []MemOp {
+	var ops []MemOp
+	for _, op := range cpu.memoryHistory.newest() {
+		if filter.Match(op) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// how many loads and stores have been dropped from the history to stay within
+// its depth since it was last cleared
+func (cpu *CPU) MemoryHistoryDropped() uint64 {
+	return cpu.memoryHistory.dropped
+}
+
+// keeps the latest depth loads and stores, 0 to keep none. The newest ones
+// already kept stay, and the rest count as dropped.
+func (cpu *CPU) SetMemoryHistoryDepth(depth int) {
+	depth = max(depth, 0)
+	ops := cpu.memoryHistory.newest()
+	dropped := cpu.memoryHistory.dropped + uint64(len(ops)-min(len(ops), depth))
+	ops = ops[:min(len(ops), depth)]
+	cpu.memoryHistory = memHistory{depth: depth, dropped: dropped}
+	for i := len(ops) - 1; i >= 0; i-- {
+		cpu.memoryHistory.add(ops[i])
+	}
+}
+
+func (cpu *CPU) ClearMemoryHistory() {
+	cpu.memoryHistory = memHistory{depth: cpu.memoryHistory.depth}
+}
+
+// a load or store as a sentence, e.g. "Stored word (7) to address 36
+// (output+4)", naming the bookmark, device or region the address is in, or
+// "Stored word (5) to counter+4 (address 36)" for one in a data label
+func (cpu *CPU) DescribeMemOp(op MemOp) string {
+	address := "address " + cpu.describeAddress(op.Addr)
+	if op.Symbol != "" {
+		address = fmt.Sprintf("%s (address %d)", op.Symbol, op.Addr)
+	}
+
+	if op.Manual {
+		return fmt.Sprintf("Set %s (%d) at %s by hand", [5]string{1: "byte", 2: "half-word", 4: "word"}[op.Size], op.Value, address)
+	}
+	if op.Type == MemStore {
+		return fmt.Sprintf("Stored %s (%d) to %s", [5]string{1: "byte", 2: "half-word", 4: "word"}[op.Size], op.Value, address)
+	}
+	return fmt.Sprintf("Loaded %s (%d) from %s", [5]string{1: "byte", 2: "half", 4: "word"}[op.Size], op.Value, address)
+}
+
+// writes ops as CSV in the order given, with a header row of pc, type (load,
+// store or set), address, size and value
+func WriteMemOps(w io.Writer, ops []MemOp) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"pc", "type", "address", "size", "value"})
+	for _, op := range ops {
+		writer.Write([]string{
+			fmt.Sprintf("0x%04x", op.PC),
+			op.kind(),
+			fmt.Sprintf("0x%04x", op.Addr),
+			strconv.Itoa(int(op.Size)),
+			strconv.Itoa(int(op.Value)),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
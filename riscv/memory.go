@@ -0,0 +1,94 @@
+package riscv
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the order bytes of data are kept in memory, little endian unless the cpu
+// was made with Options.BigEndian
+func (cpu *CPU) ByteOrder() binary.ByteOrder {
+	return cpu.byteOrder
+}
+
+// the size bytes at the start of data as a value
+func (cpu *CPU) decode(data []byte, size uint32) uint32 {
+	switch size {
+	case 4:
+		return cpu.byteOrder.Uint32(data)
+	case 2:
+		return uint32(cpu.byteOrder.Uint16(data))
+	}
+	return uint32(data[0])
+}
+
+// writes data to memory from outside the program, e.g. from a debugger. Each
+// word is kept in the memory history as a manual store and memory hooks see
+// it, but watches don't. Nothing is written if any of it is outside memory or
+// in a device.
+func (cpu *CPU) WriteMemory(address uint32, data []byte) error {
+	end := uint64(address) + uint64(len(data))
+	if end > uint64(len(cpu.Memory)) {
+		return fmt.Errorf("0x%x-0x%x is outside memory", address, end)
+	}
+	if mapping, ok := cpu.deviceIn(address, end); ok {
+		return fmt.Errorf("0x%x-0x%x overlaps the %s at 0x%x", address, end, mapping.Device.Name(), mapping.Base)
+	}
+
+	copy(cpu.Memory[address:], data)
+	cpu.eachStore(address, data, func(address, size uint32, value int32) {
+		op := MemOp{Type: MemStore, Addr: address, Size: size, Value: value, PC: cpu.PC, Manual: true, Symbol: cpu.symbolName(address)}
+		cpu.memoryHistory.add(op)
+		if cpu.hasSinks(StreamMemory) {
+			cpu.emitLine(StreamMemory, cpu.DescribeMemOp(op))
+		}
+		cpu.memoryWritten(address, size, value)
+	})
+	return nil
+}
+
+// the first device mapped anywhere in address up to end
+func (cpu *CPU) deviceIn(address uint32, end uint64) (DeviceMapping, bool) {
+	for _, mapping := range cpu.devices {
+		if uint64(mapping.Base) < end && uint64(address) < uint64(mapping.Base)+uint64(mapping.Size) {
+			return mapping, true
+		}
+	}
+	return DeviceMapping{}, false
+}
+
+// whether the program can store size bytes at address in one go: all of it in
+// mapped memory and none of it in a device
+func (cpu *CPU) canStoreBlock(address uint32, size uint32) bool {
+	end := uint64(address) + uint64(size)
+	if end > uint64(len(cpu.Memory)) {
+		return false
+	}
+	if _, ok := cpu.deviceIn(address, end); ok {
+		return false
+	}
+	return cpu.memoryMap == nil || cpu.memoryMap.mapped(address, size)
+}
+
+// stores a block canStoreBlock allowed as the running instruction. It's
+// copied at once, then traced and recorded a word at a time like sw would.
+func (cpu *CPU) storeBlock(address uint32, data []byte) {
+	copy(cpu.Memory[address:], data)
+	cpu.eachStore(address, data, func(address, size uint32, value int32) {
+		cpu.recordMemory(MemoryEffect{Write: true, Address: address, Size: size, Value: value})
+		cpu.cacheAccess(address, size, true)
+		cpu.memoryWritten(address, size, value)
+	})
+}
+
+// splits data at address into words, then a half and a byte for the rest
+func (cpu *CPU) eachStore(address uint32, data []byte, store func(address, size uint32, value int32)) {
+	for offset := uint32(0); offset < uint32(len(data)); {
+		size := min(4, uint32(len(data))-offset)
+		if size == 3 {
+			size = 2
+		}
+		store(address+offset, size, int32(cpu.decode(data[offset:], size)))
+		offset += size
+	}
+}
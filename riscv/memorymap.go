@@ -0,0 +1,225 @@
+package riscv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// where a program's segments go. Without one memory is flat: any address
+// inside it can be loaded and stored, the program starts at 16 and sp at the
+// end of memory. With one, loads and stores outside the data, heap and stack
+// fault like they would on hardware with nothing mapped there:
+//
+//	0         TextBase  DataBase  HeapBase  brk   StackTop-StackSize  StackTop
+//	| unmapped | text    | data     | heap    | ... guard | stack            |
+//
+// Code still isn't kept in memory, so loads and stores to the text fault too.
+// The heap starts out empty and grows with the brk system call, up to Guard
+// bytes below the stack.
+type MemoryMap struct {
+	TextBase  uint32 // where the first instruction is assembled
+	DataBase  uint32
+	HeapBase  uint32
+	StackTop  uint32 // sp when the program starts
+	StackSize uint32
+	Guard     uint32 // unmapped bytes between the most the heap can grow and the stack
+}
+
+// a named range of a memory map. End is exclusive.
+type MemoryRegion struct {
+	Name  string
+	Start uint32
+	End   uint32
+}
+
+// the text below a quarter of memory, the data up to half of it and the
+// stack taking the top quarter, leaving the first 256 bytes unmapped so null
+// pointers fault
+func DefaultMemoryMap(memorySize uint32) MemoryMap {
+	return MemoryMap{
+		TextBase:  0x100,
+		DataBase:  (memorySize / 4) &^ 0xff,
+		HeapBase:  (memorySize / 2) &^ 0xff,
+		StackTop:  memorySize &^ 15,
+		StackSize: (memorySize / 4) &^ 0xff,
+		Guard:     0x100,
+	}
+}
+
+// "default", or the default map with some of it changed, e.g.
+// "text=0x400,stack-size=2048". The keys are text, data, heap, stack,
+// stack-size and guard.
+func ParseMemoryMap(spec string, memorySize uint32) (MemoryMap, error) {
+	memoryMap := DefaultMemoryMap(memorySize)
+	if spec == "default" {
+		return memoryMap, nil
+	}
+
+	fields := map[string]*uint32{
+		"text":       &memoryMap.TextBase,
+		"data":       &memoryMap.DataBase,
+		"heap":       &memoryMap.HeapBase,
+		"stack":      &memoryMap.StackTop,
+		"stack-size": &memoryMap.StackSize,
+		"guard":      &memoryMap.Guard,
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		key, valueStr, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		field, ok := fields[key]
+		if !ok {
+			return MemoryMap{}, fmt.Errorf("unknown memory map setting %q, expected text, data, heap, stack, stack-size or guard", key)
+		}
+		value, err := strconv.ParseUint(valueStr, 0, 32)
+		if err != nil {
+			return MemoryMap{}, fmt.Errorf("invalid %s address: %s", key, valueStr)
+		}
+		*field = uint32(value)
+	}
+	return memoryMap, memoryMap.validate(memorySize)
+}
+
+func (memoryMap MemoryMap) validate(memorySize uint32) error {
+	switch {
+	case memoryMap.TextBase == 0 || memoryMap.TextBase%4 != 0:
+		return fmt.Errorf("text base 0x%x must be a non-zero multiple of 4", memoryMap.TextBase)
+	case memoryMap.DataBase <= memoryMap.TextBase:
+		return fmt.Errorf("data base 0x%x must be above the text at 0x%x", memoryMap.DataBase, memoryMap.TextBase)
+	case memoryMap.HeapBase < memoryMap.DataBase:
+		return fmt.Errorf("heap base 0x%x must not be below the data at 0x%x", memoryMap.HeapBase, memoryMap.DataBase)
+	case memoryMap.StackTop > memorySize || memoryMap.StackTop%16 != 0:
+		return fmt.Errorf("stack top 0x%x must be 16 byte aligned and inside memory", memoryMap.StackTop)
+	case memoryMap.StackSize == 0 || uint64(memoryMap.HeapBase)+uint64(memoryMap.Guard)+uint64(memoryMap.StackSize) > uint64(memoryMap.StackTop):
+		return fmt.Errorf("a 0x%x byte stack and 0x%x byte guard don't fit between the heap at 0x%x and 0x%x", memoryMap.StackSize, memoryMap.Guard, memoryMap.HeapBase, memoryMap.StackTop)
+	}
+	return nil
+}
+
+func (memoryMap MemoryMap) stackBottom() uint32 {
+	return memoryMap.StackTop - memoryMap.StackSize
+}
+
+// the most the break can be moved to
+func (memoryMap MemoryMap) heapLimit() uint32 {
+	return memoryMap.stackBottom() - memoryMap.Guard
+}
+
+// a memory map and the program break, shared by the harts of a machine
+type memoryLayout struct {
+	MemoryMap
+	brk uint32
+}
+
+// whether the bytes from address to address+size are in the data, heap or
+// stack
+func (layout *memoryLayout) mapped(address, size uint32) bool {
+	end := uint64(address) + uint64(size)
+	if address >= layout.DataBase && end <= uint64(layout.brk) {
+		return true
+	}
+	return address >= layout.stackBottom() && end <= uint64(layout.StackTop)
+}
+
+// lays the program and memory out as the map says and points sp at the top
+// of the stack. Programs are assembled at the new text base the next time
+// they are loaded.
+func (cpu *CPU) SetMemoryMap(memoryMap MemoryMap) error {
+	if err := memoryMap.validate(cpu.MemorySize); err != nil {
+		return err
+	}
+	cpu.useMemoryLayout(&memoryLayout{MemoryMap: memoryMap, brk: memoryMap.HeapBase}, memoryMap.StackTop)
+	return nil
+}
+
+func (cpu *CPU) useMemoryLayout(layout *memoryLayout, sp uint32) {
+	cpu.memoryMap = layout
+	cpu.loadedSource = nil
+	if !cpu.started {
+		cpu.PC = layout.TextBase
+	}
+	cpu.SetRegister(cpu.Arch.StackPointer(), int32(sp))
+	if cpu.hasArgs {
+		cpu.argsTop = sp
+	}
+}
+
+// the map set with SetMemoryMap, false if memory is flat
+func (cpu *CPU) MemoryMap() (MemoryMap, bool) {
+	if cpu.memoryMap == nil {
+		return MemoryMap{}, false
+	}
+	return cpu.memoryMap.MemoryMap, true
+}
+
+// the text, data, heap up to the current break, guard and stack, in address
+// order. None when memory is flat.
+func (cpu *CPU) MemoryRegions() []MemoryRegion {
+	layout := cpu.memoryMap
+	if layout == nil {
+		return nil
+	}
+	return []MemoryRegion{
+		{Name: "text", Start: layout.TextBase, End: cpu.programEnd()},
+		{Name: "data", Start: layout.DataBase, End: layout.HeapBase},
+		{Name: "heap", Start: layout.HeapBase, End: layout.brk},
+		{Name: "guard", Start: layout.heapLimit(), End: layout.stackBottom()},
+		{Name: "stack", Start: layout.stackBottom(), End: layout.StackTop},
+	}
+}
+
+// the region an address is in, if any
+func (cpu *CPU) regionAt(address uint32) (MemoryRegion, bool) {
+	for _, region := range cpu.MemoryRegions() {
+		if address >= region.Start && address < region.End {
+			return region, true
+		}
+	}
+	return MemoryRegion{}, false
+}
+
+// where the program is assembled from
+// where the data section goes, 0 for just after the code
+func (cpu *CPU) dataBase() uint32 {
+	if cpu.memoryMap == nil {
+		return 0
+	}
+	return cpu.memoryMap.DataBase
+}
+
+func (cpu *CPU) textBase() uint32 {
+	if cpu.memoryMap == nil {
+		return 16
+	}
+	return cpu.memoryMap.TextBase
+}
+
+// moves the program break to address if it stays within the heap, returning
+// the break. brk(0) returns the break without moving it, and with no memory
+// map there is no heap and the break is always 0.
+func (cpu *CPU) brk(address uint32) uint32 {
+	layout := cpu.memoryMap
+	if layout == nil {
+		return 0
+	}
+	if address >= layout.HeapBase && address <= layout.heapLimit() {
+		layout.brk = address
+	}
+	return layout.brk
+}
+
+// the same memory map for every hart, each with its own stack below the
+// previous hart's
+func (machine *Machine) SetMemoryMap(memoryMap MemoryMap) error {
+	if err := memoryMap.validate(machine.Harts[0].MemorySize); err != nil {
+		return err
+	}
+	if need := uint32(len(machine.Harts)-1) * hartStackSize; need >= memoryMap.StackSize {
+		return fmt.Errorf("%d harts need a stack of more than 0x%x bytes", len(machine.Harts), need)
+	}
+
+	layout := &memoryLayout{MemoryMap: memoryMap, brk: memoryMap.HeapBase}
+	for i, hart := range machine.Harts {
+		hart.useMemoryLayout(layout, memoryMap.StackTop-uint32(i*hartStackSize))
+	}
+	return nil
+}
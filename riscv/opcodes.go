@@ -0,0 +1,25 @@
+package riscv
+
+//go:generate go run ./internal/opcodesgen -o opcodes_gen.go spec/rv_i spec/rv_m spec/rv_a spec/rv_zicsr spec/rv_system spec/rv_c spec/pseudo
+
+// an instruction as described by the spec files. Pseudo instructions take
+// their format and encoding from their Base instruction.
+type instrSpec struct {
+	Extension string
+	Format    string // R, I, S, B, U or J
+	Opcode    uint32
+	Funct3    int // -1 when the format has none
+	Funct7    int // -1 when the format has none
+	Funct5    int // bits 31..27 of atomics, -1 for everything else
+	Operands  []string
+	Base      string
+}
+
+func (spec instrSpec) IsPseudo() bool {
+	return spec.Base != ""
+}
+
+func lookupSpec(mnemonic string) (instrSpec, bool) {
+	spec, ok := instrSpecs[mnemonic]
+	return spec, ok
+}
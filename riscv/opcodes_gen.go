@@ -0,0 +1,122 @@
+// Code generated by internal/opcodesgen from spec/rv_i, spec/rv_m, spec/rv_a, spec/rv_zicsr, spec/rv_system, spec/rv_c, spec/pseudo. DO NOT EDIT.
+
+package riscv
+
+var instrSpecs = map[string]instrSpec{
+	"add":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"addi":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"amoadd.w":   {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 0, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amoand.w":   {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 12, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amomax.w":   {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 20, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amomaxu.w":  {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 28, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amomin.w":   {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 16, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amominu.w":  {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 24, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amoor.w":    {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 8, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amoswap.w":  {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 1, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"amoxor.w":   {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 4, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"and":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 7, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"andi":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 7, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"auipc":      {Extension: "rv_i", Format: "U", Opcode: 0x17, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"rd", "imm20"}, Base: ""},
+	"beq":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"beqz":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rs1", "bimm12"}, Base: "beq"},
+	"bge":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"bgeu":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 7, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"bgez":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"rs1", "bimm12"}, Base: "bge"},
+	"bgt":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "rs1", "bimm12"}, Base: "blt"},
+	"bgtu":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 6, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "rs1", "bimm12"}, Base: "bltu"},
+	"bgtz":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "bimm12"}, Base: "blt"},
+	"ble":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "rs1", "bimm12"}, Base: "bge"},
+	"bleu":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 7, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "rs1", "bimm12"}, Base: "bgeu"},
+	"blez":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"rs2", "bimm12"}, Base: "bge"},
+	"blt":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"bltu":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 6, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"bltz":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"rs1", "bimm12"}, Base: "blt"},
+	"bne":        {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"bimm12hi", "rs1", "rs2", "bimm12lo"}, Base: ""},
+	"bnez":       {Extension: "rv_i", Format: "B", Opcode: 0x63, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"rs1", "bimm12"}, Base: "bne"},
+	"c.add":      {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_n0", "c_rs2_n0"}, Base: "add"},
+	"c.addi":     {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd_rs1_n0", "c_imm6"}, Base: "addi"},
+	"c.addi16sp": {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"sp", "c_nzimm10"}, Base: "addi"},
+	"c.addi4spn": {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd_p", "sp", "c_nzuimm10"}, Base: "addi"},
+	"c.and":      {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 7, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_p", "rs2_p"}, Base: "and"},
+	"c.andi":     {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 7, Funct7: -1, Funct5: -1, Operands: []string{"rd_rs1_p", "c_imm6"}, Base: "andi"},
+	"c.beqz":     {Extension: "rv_c", Format: "B", Opcode: 0x63, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rs1_p", "c_bimm9"}, Base: "beq"},
+	"c.bnez":     {Extension: "rv_c", Format: "B", Opcode: 0x63, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"rs1_p", "c_bimm9"}, Base: "bne"},
+	"c.ebreak":   {Extension: "rv_c", Format: "I", Opcode: 0x73, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{}, Base: "ebreak"},
+	"c.j":        {Extension: "rv_c", Format: "J", Opcode: 0x6f, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"c_imm12"}, Base: "jal"},
+	"c.jal":      {Extension: "rv_c", Format: "J", Opcode: 0x6f, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"c_imm12"}, Base: "jal"},
+	"c.jalr":     {Extension: "rv_c", Format: "I", Opcode: 0x67, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rs1_n0"}, Base: "jalr"},
+	"c.jr":       {Extension: "rv_c", Format: "I", Opcode: 0x67, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rs1_n0"}, Base: "jalr"},
+	"c.li":       {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd_n0", "c_imm6"}, Base: "addi"},
+	"c.lui":      {Extension: "rv_c", Format: "U", Opcode: 0x37, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"rd_n2", "c_nzimm6"}, Base: "lui"},
+	"c.lw":       {Extension: "rv_c", Format: "I", Opcode: 0x03, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd_p", "rs1_p", "c_uimm7"}, Base: "lw"},
+	"c.lwsp":     {Extension: "rv_c", Format: "I", Opcode: 0x03, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd_n0", "c_uimm8sp"}, Base: "lw"},
+	"c.mv":       {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 0, Funct5: -1, Operands: []string{"rd_n0", "c_rs2_n0"}, Base: "add"},
+	"c.nop":      {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{}, Base: "addi"},
+	"c.or":       {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 6, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_p", "rs2_p"}, Base: "or"},
+	"c.slli":     {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 1, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_n0", "c_shamt"}, Base: "slli"},
+	"c.srai":     {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 5, Funct7: 32, Funct5: -1, Operands: []string{"rd_rs1_p", "c_shamt"}, Base: "srai"},
+	"c.srli":     {Extension: "rv_c", Format: "I", Opcode: 0x13, Funct3: 5, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_p", "c_shamt"}, Base: "srli"},
+	"c.sub":      {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 32, Funct5: -1, Operands: []string{"rd_rs1_p", "rs2_p"}, Base: "sub"},
+	"c.sw":       {Extension: "rv_c", Format: "S", Opcode: 0x23, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rs1_p", "rs2_p", "c_uimm7"}, Base: "sw"},
+	"c.swsp":     {Extension: "rv_c", Format: "S", Opcode: 0x23, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"c_rs2", "c_uimm8sp"}, Base: "sw"},
+	"c.xor":      {Extension: "rv_c", Format: "R", Opcode: 0x33, Funct3: 4, Funct7: 0, Funct5: -1, Operands: []string{"rd_rs1_p", "rs2_p"}, Base: "xor"},
+	"call":       {Extension: "rv_i", Format: "J", Opcode: 0x6f, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"jimm20"}, Base: "jal"},
+	"csrc":       {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 3, Funct7: -1, Funct5: -1, Operands: []string{"csr", "rs1"}, Base: "csrrc"},
+	"csrr":       {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd", "csr"}, Base: "csrrs"},
+	"csrrc":      {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 3, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "csr"}, Base: ""},
+	"csrrci":     {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 7, Funct7: -1, Funct5: -1, Operands: []string{"rd", "csr", "zimm"}, Base: ""},
+	"csrrs":      {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "csr"}, Base: ""},
+	"csrrsi":     {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 6, Funct7: -1, Funct5: -1, Operands: []string{"rd", "csr", "zimm"}, Base: ""},
+	"csrrw":      {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "csr"}, Base: ""},
+	"csrrwi":     {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"rd", "csr", "zimm"}, Base: ""},
+	"csrs":       {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"csr", "rs1"}, Base: "csrrs"},
+	"csrw":       {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"csr", "rs1"}, Base: "csrrw"},
+	"div":        {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 4, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"divu":       {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 5, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"ebreak":     {Extension: "rv_i", Format: "I", Opcode: 0x73, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string(nil), Base: ""},
+	"ecall":      {Extension: "rv_i", Format: "I", Opcode: 0x73, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string(nil), Base: ""},
+	"fence":      {Extension: "rv_i", Format: "I", Opcode: 0x0f, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"fm", "pred", "succ", "rs1", "rd"}, Base: ""},
+	"j":          {Extension: "rv_i", Format: "J", Opcode: 0x6f, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"jimm20"}, Base: "jal"},
+	"jal":        {Extension: "rv_i", Format: "J", Opcode: 0x6f, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"rd", "jimm20"}, Base: ""},
+	"jalr":       {Extension: "rv_i", Format: "I", Opcode: 0x67, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"jr":         {Extension: "rv_i", Format: "I", Opcode: 0x67, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rs1"}, Base: "jalr"},
+	"lb":         {Extension: "rv_i", Format: "I", Opcode: 0x03, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"lbu":        {Extension: "rv_i", Format: "I", Opcode: 0x03, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"lh":         {Extension: "rv_i", Format: "I", Opcode: 0x03, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"lhu":        {Extension: "rv_i", Format: "I", Opcode: 0x03, Funct3: 5, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"li":         {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd", "imm"}, Base: "addi"},
+	"lr.w":       {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 2, Operands: []string{"rd", "rs1", "aq", "rl"}, Base: ""},
+	"lui":        {Extension: "rv_i", Format: "U", Opcode: 0x37, Funct3: -1, Funct7: -1, Funct5: -1, Operands: []string{"rd", "imm20"}, Base: ""},
+	"lw":         {Extension: "rv_i", Format: "I", Opcode: 0x03, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"mret":       {Extension: "rv_system", Format: "I", Opcode: 0x73, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string(nil), Base: ""},
+	"mul":        {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"mulh":       {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 1, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"mulhsu":     {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 2, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"mulhu":      {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 3, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"mv":         {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1"}, Base: "addi"},
+	"or":         {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 6, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"ori":        {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 6, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"rdcycle":    {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd"}, Base: "csrrs"},
+	"rdinstret":  {Extension: "rv_zicsr", Format: "I", Opcode: 0x73, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd"}, Base: "csrrs"},
+	"rem":        {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 6, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"remu":       {Extension: "rv_m", Format: "R", Opcode: 0x33, Funct3: 7, Funct7: 1, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"ret":        {Extension: "rv_i", Format: "I", Opcode: 0x67, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{}, Base: "jalr"},
+	"sb":         {Extension: "rv_i", Format: "S", Opcode: 0x23, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string{"imm12hi", "rs1", "rs2", "imm12lo"}, Base: ""},
+	"sc.w":       {Extension: "rv_a", Format: "R", Opcode: 0x2f, Funct3: 2, Funct7: -1, Funct5: 3, Operands: []string{"rd", "rs1", "rs2", "aq", "rl"}, Base: ""},
+	"sh":         {Extension: "rv_i", Format: "S", Opcode: 0x23, Funct3: 1, Funct7: -1, Funct5: -1, Operands: []string{"imm12hi", "rs1", "rs2", "imm12lo"}, Base: ""},
+	"sll":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 1, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"slli":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 1, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "shamtw"}, Base: ""},
+	"slt":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 2, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"slti":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"sltiu":      {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 3, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+	"sltu":       {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 3, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"sra":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 5, Funct7: 32, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"srai":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 5, Funct7: 32, Funct5: -1, Operands: []string{"rd", "rs1", "shamtw"}, Base: ""},
+	"srl":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 5, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"srli":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 5, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "shamtw"}, Base: ""},
+	"sub":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 0, Funct7: 32, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"sw":         {Extension: "rv_i", Format: "S", Opcode: 0x23, Funct3: 2, Funct7: -1, Funct5: -1, Operands: []string{"imm12hi", "rs1", "rs2", "imm12lo"}, Base: ""},
+	"wfi":        {Extension: "rv_system", Format: "I", Opcode: 0x73, Funct3: 0, Funct7: -1, Funct5: -1, Operands: []string(nil), Base: ""},
+	"xor":        {Extension: "rv_i", Format: "R", Opcode: 0x33, Funct3: 4, Funct7: 0, Funct5: -1, Operands: []string{"rd", "rs1", "rs2"}, Base: ""},
+	"xori":       {Extension: "rv_i", Format: "I", Opcode: 0x13, Funct3: 4, Funct7: -1, Funct5: -1, Operands: []string{"rd", "rs1", "imm12"}, Base: ""},
+}
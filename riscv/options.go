@@ -0,0 +1,75 @@
+package riscv
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// the memory NewCPUWithOptions gives a cpu when Options doesn't say
+const DefaultMemorySize = 1024 * 10
+
+// how NewCPUWithOptions sets a cpu up. The zero value is the same as
+// NewCPU(DefaultMemorySize).
+type Options struct {
+	Arch       Arch   // RV32I when nil
+	MemorySize uint32 // DefaultMemorySize when 0
+	// start the registers other than zero and sp, and memory, out as
+	// pseudo-random garbage from Seed instead of zeros, so programs that rely
+	// on them being 0 go wrong the way they would on hardware. A Seed of 0
+	// picks one from the clock, RandomSeed says which.
+	RandomInit bool
+	Seed       int64
+	// loads and stores put the most significant byte first. Instructions are
+	// little endian either way, as the spec has them.
+	BigEndian bool
+	// misaligned loads and stores work, as on cores that handle them in
+	// hardware, instead of raising a misaligned exception. lr, sc and amo
+	// still have to be aligned.
+	AllowMisaligned bool
+}
+
+func NewCPUWithOptions(options Options) CPU {
+	arch := options.Arch
+	if arch == nil {
+		arch = RV32I{}
+	}
+	memorySize := options.MemorySize
+	if memorySize == 0 {
+		memorySize = DefaultMemorySize
+	}
+
+	cpu := NewCPUForArch(arch, memorySize)
+	if options.BigEndian {
+		cpu.byteOrder = binary.BigEndian
+	}
+	cpu.allowMisaligned = options.AllowMisaligned
+	if options.RandomInit {
+		seed := options.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		cpu.Randomize(seed)
+	}
+	return cpu
+}
+
+// fills the registers other than zero and sp, and memory, with pseudo-random
+// bytes. The same seed always gives the same garbage.
+func (cpu *CPU) Randomize(seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for register := 1; register < len(cpu.Registers); register++ {
+		if register != cpu.Arch.StackPointer() {
+			cpu.SetRegister(register, int32(rng.Uint32()))
+		}
+	}
+	rng.Read(cpu.Memory)
+	cpu.randomSeed = seed
+	cpu.randomized = true
+}
+
+// the seed the registers and memory were last randomized with, false if they
+// started out as zeros
+func (cpu *CPU) RandomSeed() (int64, bool) {
+	return cpu.randomSeed, cpu.randomized
+}
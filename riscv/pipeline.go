@@ -1,25 +1,92 @@
 package riscv
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 )
 
+// PC, Registers and Done stay exported for existing callers, new code should
+// use GetState and SetState.
 type CPU struct {
-	PC            uint32
-	Registers     [32]int32
-	Memory        []byte
-	MemorySize    uint32
-	instructions  []string
-	Done          bool
-	Labels        map[string]uint32
-	MemoryHistory []string
-	entryPoint    string
+	Arch            Arch
+	PC              uint32
+	Registers       [32]int32
+	Memory          []byte
+	MemorySize      uint32
+	instructions    []string
+	Done            bool
+	Labels          map[string]uint32
+	entryPoint      string
+	bookmarks       map[string]Bookmark
+	checkers        []attachedChecker
+	sourceCheckers  []attachedChecker
+	checkResults    []CheckResult
+	callStack       []StackFrame
+	program         []Instr
+	sourceLines     []int    // index into instructions of each instruction in program
+	lineOrigins     []int    // 0-based source line each line of instructions was expanded from
+	addresses       []uint32 // address of each instruction in program
+	compressed      bool     // whether any instruction in program is 2 bytes
+	instrSize       uint32   // size of the running instruction
+	diagnostics     []Diagnostic
+	assembled       map[string]assembledLine
+	assembledLabels map[string]uint32
+	registerHooks   []RegisterHook
+	memoryHooks     []MemoryHook
+	watches         []Watch
+	nextWatchID     int
+	watchHits       []WatchHit
+	pipeline        *Pipeline
+	cache           *Cache
+	predictor       *BranchPredictor
+	csrs            map[uint16]int32
+	instret         uint64
+	sandbox         *Sandbox
+	err             error
+	lastTrap        *Trap // the last trap taken, for Step
+	breakpoint      bool
+	breakpoints     map[uint32]bool
+	reservation     uint32
+	reserved        bool
+	devices         []DeviceMapping
+	sinks           map[Stream][]io.Writer
+	tracer          *tracer
+	stepBudget      uint64
+
+	registerHistory      [][]RegisterChange
+	registerHistoryDepth int
+	pausedAtBreakpoint   bool
+	untilAddress         uint32 // the temporary breakpoint of RunUntil
+	runningUntil         bool
+	started              bool // whether the first instruction of this run has run
+	args                 []string
+	argsTop              uint32 // where args are laid out from
+	hasArgs              bool
+	assertions           []Assertion
+	sourceAssertions     []Assertion
+	assertionResults     []AssertionResult
+	strict               *strictState
+	loadedSource         []string // as passed to LoadInstructions
+	memoryMap            *memoryLayout
+	randomSeed           int64
+	memoryHistory        memHistory
+	stack                StackReport
+	randomized           bool // whether registers and memory started out random
+	stdin                io.Reader
+	termination          Termination
+	exitCode             int32
+	byteOrder            binary.ByteOrder // of data in memory
+	allowMisaligned      bool
+	coverage             []instrCoverage // by instruction in program
+	data                 []dataLine      // the data section, put in memory on load and Restart
+	dataSymbols          []Symbol        // the labels of data, ordered by address
 }
 
 var abiToRegister = map[string]int{
@@ -57,58 +124,163 @@ var abiToRegister = map[string]int{
 	"t6": 31, "x31": 31,
 }
 
-func getRegisterNumber(abiName string) int8 {
-	var reg int
-	var ok bool
-
-	if reg, ok = abiToRegister[abiName]; !ok {
-		panic(fmt.Sprintf("invalid register: %s", abiName))
+func getRegisterNumber(abiName string) (int8, error) {
+	reg, ok := abiToRegister[abiName]
+	if !ok {
+		return 0, fmt.Errorf("invalid register: %s", abiName)
 	}
 
-	return int8(reg)
+	return int8(reg), nil
 }
 
-func parseImm(imm_str string) int32 {
-	if imm, err := strconv.Atoi(imm_str); err == nil {
-		return int32(imm)
-	} else {
-		panic(fmt.Sprintf("immediate parse error: %s", imm_str))
+// the numbers of the named registers in order, or an error for the first name
+// that isn't a register
+func getRegisterNumbers(abiNames ...string) ([]int8, error) {
+	regs := make([]int8, len(abiNames))
+	for i, abiName := range abiNames {
+		reg, err := getRegisterNumber(abiName)
+		if err != nil {
+			return nil, err
+		}
+		regs[i] = reg
 	}
+	return regs, nil
 }
 
 func NewCPU(memorySize uint32) CPU {
+	return NewCPUForArch(RV32I{}, memorySize)
+}
+
+func NewCPUForArch(arch Arch, memorySize uint32) CPU {
 
 	cpu := CPU{
+		Arch:       arch,
 		Memory:     make([]byte, memorySize),
 		Labels:     make(map[string]uint32),
 		MemorySize: memorySize,
+		bookmarks:  make(map[string]Bookmark),
 		PC:         16,
+		byteOrder:  binary.LittleEndian,
 	}
+	cpu.memoryHistory.depth = DefaultMemoryHistoryDepth
 
-	cpu.Registers[abiToRegister["sp"]] = int32(memorySize)
+	cpu.SetRegister(arch.StackPointer(), int32(memorySize))
+	cpu.resetCSRs()
 
 	return cpu
 }
 
-func (cpu *CPU) checkMemoryAccess(address uint32) error {
-	if address+4 > uint32(len(cpu.Memory)) {
-		return errors.New("invalid memory access")
+// raises a misaligned or access fault exception for a bad access
+func (cpu *CPU) checkMemoryAccess(address uint32, size uint32, write bool) {
+	misaligned, fault := ExcLoadMisaligned, ExcLoadAccessFault
+	if write {
+		misaligned, fault = ExcStoreMisaligned, ExcStoreAccessFault
+	}
+
+	if address%size != 0 && !cpu.allowMisaligned {
+		cpu.raise(misaligned, address)
+	}
+
+	if device, ok := cpu.deviceAt(address); ok {
+		if address-device.Base+size > device.Size {
+			cpu.raise(fault, address)
+		}
+		return
+	}
+
+	if uint64(address)+uint64(size) > uint64(len(cpu.Memory)) {
+		cpu.raise(fault, address)
+	}
+	if cpu.memoryMap != nil && !cpu.memoryMap.mapped(address, size) {
+		cpu.raise(fault, address)
+	}
+}
+
+// reads a device register if one is mapped at the address. Devices are read
+// a word at a time, so a narrower load takes its bytes from the word they're
+// in, laid out in the cpu's byte order like memory.
+func (cpu *CPU) deviceRead(address uint32, size uint32) (uint32, bool) {
+	device, ok := cpu.deviceAt(address)
+	if !ok {
+		return 0, false
 	}
 
-	return nil
+	offset := address - device.Base
+	word, lane := offset&^3, offset&3
+	var bytes [8]byte
+	cpu.byteOrder.PutUint32(bytes[:], device.Device.Read(word))
+	// a misaligned load can run into the next word
+	if lane+size > 4 {
+		cpu.byteOrder.PutUint32(bytes[4:], device.Device.Read(word+4))
+	}
+	return cpu.decode(bytes[lane:], size), true
 }
 
+// writes a device register if one is mapped at the address
+func (cpu *CPU) deviceWrite(address uint32, size uint32, value int32) bool {
+	device, ok := cpu.deviceAt(address)
+	if !ok {
+		return false
+	}
+	device.Device.Write(address-device.Base, uint32(value)&sizeMask(size))
+	return true
+}
+
+var (
+	globalRe   = regexp.MustCompile(`^\s*\.globa?l\s+(\w+)`)
+	bookmarkRe = regexp.MustCompile(`^\s*\.bookmark\s+([\w.]+)\s+(\w+)\s+(\w+)(?:\s+(\w+))?`)
+)
+
+// assembles the program unless it is the one already loaded, so front ends
+// can load the source before every step and only pay for assembling it when
+// it changes. Lines are decoded once and run from the decoded program.
 func (cpu *CPU) LoadInstructions(instrs []string) {
-	labelRe := regexp.MustCompile(`(.+):`)
-	globalRe := regexp.MustCompile(`.global\s(\w+)`)
+	if !slices.Equal(instrs, cpu.loadedSource) {
+		cpu.load(instrs)
+		// how the last program ended doesn't apply to a different one
+		if cpu.termination != TerminationNone {
+			cpu.Restart()
+		}
+	}
 
+	// a cpu halted by a trap stays halted until the next run, and a program
+	// that ended stays ended until Restart
+	if cpu.err != nil || cpu.termination != TerminationNone {
+		return
+	}
+
+	// follow the entry point until the program starts
+	if !cpu.started {
+		cpu.PC = cpu.EntryAddress()
+	}
+
+	_, inProgram := cpu.instrIndex(cpu.PC)
+	cpu.Done = !inProgram
+}
+
+func (cpu *CPU) load(instrs []string) {
+	cpu.loadedSource = slices.Clone(instrs)
 	cpu.entryPoint = ""
+	cpu.sourceCheckers = nil
+	cpu.sourceAssertions = nil
+	var directiveDiagnostics []Diagnostic
+
+	instrs, sandboxDiagnostics := cpu.sandboxSource(instrs)
+	instrs, lineOrigins, macroDiagnostics := expandMacros(instrs)
+	instrs, lineOrigins, expandedDiagnostics := cpu.sandboxExpanded(instrs, lineOrigins)
+	sandboxDiagnostics = append(sandboxDiagnostics, expandedDiagnostics...)
+	cpu.lineOrigins = lineOrigins
+
+	// labels from the last program would otherwise linger
+	lines, labels, data := layoutSource(instrs, cpu.textBase(), cpu.dataBase(), cpu.MemorySize)
+	clear(cpu.Labels)
+	for label, address := range labels {
+		cpu.Labels[label] = address
+	}
 
-	for i, instr := range instrs {
-		labelMatch := labelRe.FindStringSubmatch(instr)
-		if len(labelMatch) == 2 {
-			label := labelMatch[1]
-			cpu.Labels[label] = uint32((i * 4) + 16 + 4)
+	// directives
+	for i, instr := range lines {
+		if instr == "" || isInstructionLine(instr) {
 			continue
 		}
 
@@ -116,55 +288,176 @@ func (cpu *CPU) LoadInstructions(instrs []string) {
 		if len(globalMatch) == 2 {
 			cpu.entryPoint = globalMatch[1]
 		}
-	}
 
-	cpu.instructions = instrs
+		bookmarkMatch := bookmarkRe.FindStringSubmatch(instr)
+		if len(bookmarkMatch) == 5 {
+			start, startErr := parseAddress(bookmarkMatch[2])
+			end, endErr := parseAddress(bookmarkMatch[3])
+			err := cmp.Or(startErr, endErr)
+			if err == nil {
+				err = cpu.AddBookmark(bookmarkMatch[1], start, end, bookmarkMatch[4])
+			}
+			if err != nil {
+				directiveDiagnostics = append(directiveDiagnostics, Diagnostic{Line: cpu.sourceLine(i), Message: err.Error()})
+			}
+		}
 
-	instr_num := int((cpu.PC - 16) / 4)
+		if checker, ok := parseCheckDirective(instr); ok {
+			if _, isFile := checker.checker.(EqualsFile); isFile && cpu.sandbox != nil && !cpu.sandbox.AllowHostFiles {
+				continue
+			}
+			cpu.sourceCheckers = append(cpu.sourceCheckers, checker)
+		}
 
-	if instr_num > (len(cpu.instructions) - 1) {
-		cpu.Done = true
-	} else {
-		cpu.Done = false
+		if assertion, ok, err := parseAssertDirective(instr); err != nil {
+			directiveDiagnostics = append(directiveDiagnostics, Diagnostic{Line: cpu.sourceLine(i), Message: err.Error()})
+		} else if ok {
+			assertion.Line = cpu.sourceLine(i)
+			cpu.sourceAssertions = append(cpu.sourceAssertions, assertion)
+		}
+	}
+
+	cpu.instructions = instrs
+	cpu.assemble(lines, labels)
+	cpu.ClearCoverage()
+	cpu.assembleData(data, labels)
+	cpu.writeData()
+	cpu.diagnostics = append(cpu.diagnostics, sandboxDiagnostics...)
+	cpu.diagnostics = append(cpu.diagnostics, macroDiagnostics...)
+	cpu.diagnostics = append(cpu.diagnostics, directiveDiagnostics...)
+	// a bad line in a .rept body would otherwise be reported once per repeat
+	cpu.diagnostics = dedupeDiagnostics(cpu.diagnostics)
+
+	if cpu.memoryMap != nil && cpu.programEnd() > cpu.memoryMap.DataBase {
+		for instr_num, address := range cpu.addresses {
+			if address+instrSize(cpu.program[instr_num]) > cpu.memoryMap.DataBase {
+				cpu.diagnostics = append(cpu.diagnostics, Diagnostic{Line: cpu.sourceLine(cpu.sourceLines[instr_num]), Message: fmt.Sprintf("the program runs into the data segment at 0x%x", cpu.memoryMap.DataBase)})
+				break
+			}
+		}
 	}
 }
 
 func (cpu *CPU) RunProgram() {
+	cpu.RunContext(context.Background())
+}
+
+// runs until the program ends, stops, reaches a breakpoint, runs out of steps
+// or ctx is done, and
+// returns the number of instructions executed. The limit is the smaller of
+// the step budget and the sandbox's MaxSteps. Running out of steps or being
+// canceled leaves the cpu where it stopped, with Err set to ErrStepLimit or
+// ErrCanceled, so the next run carries on from there. A program that ends is
+// left as it ended, see Termination, and runs again after Restart.
+func (cpu *CPU) RunContext(ctx context.Context) uint64 {
+	cpu.err = nil
+	steps := uint64(0)
+	limit := cpu.StepLimit()
+
 	for !cpu.Done {
+		if limit != 0 && steps == limit {
+			cpu.err = ErrStepLimit
+			return steps
+		}
+
+		if steps%cancelCheckInterval == 0 && ctx.Err() != nil {
+			cpu.err = ErrCanceled
+			return steps
+		}
+
+		if cpu.pauseAtBreakpoint() {
+			return steps
+		}
+
 		cpu.RunNextInstruction()
+		steps++
+		// leave the cpu where it stopped so it can be inspected
+		if len(cpu.watchHits) > 0 || cpu.breakpoint || cpu.err != nil {
+			return steps
+		}
 	}
 
-	cpu.PC = 16
-	cpu.Done = false
+	return steps
+}
+
+func (cpu *CPU) halt() {
+	if cpu.strict != nil {
+		cpu.strictHalt()
+	}
+	cpu.Done = true
+	cpu.runCheckers()
+	cpu.checkAssertions(cpu.PC, true)
 }
 
 func (cpu *CPU) RunNextInstruction() {
-	if cpu.PC < 16 {
-		cpu.Done = true
+	// the entry function returned
+	if cpu.PC == exitAddress && cpu.started {
+		cpu.endProgram()
 		return
 	}
 
-	instr_num := int((cpu.PC - 16) / 4)
+	instr_num, ok := cpu.instrIndex(cpu.PC)
+	if !ok {
+		// the pc can land inside a 4 byte instruction once 2 byte ones move
+		// the rest off a 4 byte boundary
+		if cpu.PC >= cpu.textBase() && cpu.PC < cpu.programEnd() {
+			cpu.takeTrap(&Trap{Cause: ExcIllegalInstruction, PC: cpu.PC})
+			return
+		}
+		cpu.endProgram()
+		return
+	}
 
-	if instr_num > (len(cpu.instructions) - 1) {
-		cpu.Done = true
+	cpu.watchHits = nil
+	cpu.breakpoint = false
+	cpu.pausedAtBreakpoint = false
+	if !cpu.started {
+		cpu.start()
+	}
+	if cpu.takeInterrupt() {
 		return
 	}
+	if len(cpu.assertions) > 0 || len(cpu.sourceAssertions) > 0 {
+		cpu.checkAssertions(cpu.PC, false)
+	}
 
-	instr := DecodeInstr(&cpu.instructions[instr_num])
+	pc := cpu.PC
+	instr := cpu.program[instr_num]
+	cpu.instrSize = instrSize(instr)
+	if cpu.strict != nil {
+		cpu.strictInstruction(instr)
+	}
+	cpu.traceStart(instr_num)
+	trap := cpu.execute(instr)
+	cpu.traceEnd(trap)
+	if trap != nil {
+		cpu.recordCoverage(pc, instr_num, instr, pc, false)
+		cpu.takeTrap(trap)
+		return
+	}
+	cpu.instret++
+	cpu.tickDevices()
 
-	switch v := instr.(type) {
-	case *NoOp:
-		print(v.reason)
+	if cpu.hasSinks(StreamTrace) {
+		cpu.emitLine(StreamTrace, fmt.Sprintf("0x%04x: %s", pc, cpu.sourceText(instr_num)))
+	}
+
+	cpu.recordCoverage(pc, instr_num, instr, cpu.PC, true)
+	outcome := cpu.predictBranch(pc, instr_num, instr, cpu.PC)
+	if cpu.pipeline != nil {
+		cpu.pipeline.retire(pc, cpu.sourceText(instr_num), instr, cpu.PC, outcome)
 	}
-	instr.Operate(cpu)
 }
 
-func (cpu *CPU) GetCurrInstr() string {
-	instr_num := int((cpu.PC - 16) / 4)
+// the source of an instruction with its comment and extra spaces removed
+func (cpu *CPU) sourceText(instr_num int) string {
+	_, line := splitLabels(stripComment(cpu.instructions[cpu.sourceLines[instr_num]]))
+	return strings.Join(strings.Fields(line), " ")
+}
 
-	if instr_num < (len(cpu.instructions)) && instr_num >= 0 {
-		return strings.TrimSpace(cpu.instructions[instr_num])
+func (cpu *CPU) GetCurrInstr() string {
+	if instr_num, ok := cpu.instrIndex(cpu.PC); ok {
+		return strings.TrimSpace(cpu.instructions[cpu.sourceLines[instr_num]])
 	} else {
 		return ""
 	}
@@ -174,33 +467,66 @@ var instrToThreePtOp = map[string]func(int32, int32) int32{
 	"add": func(a, b int32) int32 { return a + b },
 	"sub": func(a, b int32) int32 { return a - b },
 	"mul": func(a, b int32) int32 { return a * b },
-	"div": func(a, b int32) int32 { return a / b },
-	"rem": func(a, b int32) int32 { return a % b },
+	// the upper 32 bits of the 64 bit product, rs1 and rs2 signed or unsigned
+	"mulh":   func(a, b int32) int32 { return int32((int64(a) * int64(b)) >> 32) },
+	"mulhu":  func(a, b int32) int32 { return int32((uint64(uint32(a)) * uint64(uint32(b))) >> 32) },
+	"mulhsu": func(a, b int32) int32 { return int32((int64(a) * int64(uint32(b))) >> 32) },
+	// dividing by zero doesn't trap: the quotient is all ones and the
+	// remainder the dividend. The overflowing -2^31 / -1 gives -2^31 and 0,
+	// which Go's division already does
+	"div": func(a, b int32) int32 {
+		if b == 0 {
+			return -1
+		}
+		return a / b
+	},
+	"divu": func(a, b int32) int32 {
+		if b == 0 {
+			return -1
+		}
+		return int32(uint32(a) / uint32(b))
+	},
+	"rem": func(a, b int32) int32 {
+		if b == 0 {
+			return a
+		}
+		return a % b
+	},
+	"remu": func(a, b int32) int32 {
+		if b == 0 {
+			return a
+		}
+		return int32(uint32(a) % uint32(b))
+	},
 	"and": func(a, b int32) int32 { return a & b },
 	"or":  func(a, b int32) int32 { return a | b },
 	"xor": func(a, b int32) int32 { return a ^ b },
-	"sll": func(a, b int32) int32 { return a << b },
-	"srl": func(a, b int32) int32 { return int32(uint32(a) >> b) },
-	"sra": func(a, b int32) int32 { return a >> b },
+	// only the low 5 bits of rs2 are the shift amount
+	"sll": func(a, b int32) int32 { return a << (b & 31) },
+	"srl": func(a, b int32) int32 { return int32(uint32(a) >> (b & 31)) },
+	"sra": func(a, b int32) int32 { return a >> (b & 31) },
 }
 
-func parseThreePt(tokens []string) Instr {
-	var ok bool
-
+func parseThreePt(tokens []string) (Instr, error) {
 	op, ok := instrToThreePtOp[tokens[0]]
 
 	if !ok {
-		panic(fmt.Sprintf("invalid operation: %s", tokens[0]))
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[2], tokens[3])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := InstrThreePt{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[2]),
-		rs2: getRegisterNumber(tokens[3]),
+		rd:  regs[0],
+		rs1: regs[1],
+		rs2: regs[2],
 		op:  op,
 	}
 
-	return &instr
+	return &instr, nil
 }
 
 var instrToThreePtImmOp = map[string]func(int32, int32) int32{
@@ -213,23 +539,34 @@ var instrToThreePtImmOp = map[string]func(int32, int32) int32{
 	"srai": func(a, b int32) int32 { return a >> b },
 }
 
-func parseThreePtImm(tokens []string) Instr {
-	var ok bool
-
+func parseThreePtImm(tokens []string) (Instr, error) {
 	op, ok := instrToThreePtImmOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[2])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := InstrThreePtImm{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[2]),
-		imm: parseImm(tokens[3]),
+		rd:  regs[0],
+		rs1: regs[1],
 		op:  op,
 	}
 
-	return &instr
+	if strings.HasPrefix(tokens[0], "s") {
+		instr.imm, err = parseShamt(tokens[0], tokens[3])
+	} else {
+		instr.imm, instr.reloc, err = parseImm12(tokens[0], tokens[3])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &instr, nil
 }
 
 var instrToLoadImmOp = map[string]func(*CPU, int32) int32{
@@ -238,118 +575,187 @@ var instrToLoadImmOp = map[string]func(*CPU, int32) int32{
 	"auipc": func(cpu *CPU, imm int32) int32 { return int32(cpu.PC) + imm<<12 },
 }
 
-func parseLoadImm(tokens []string) Instr {
-
-	var ok bool
-
+func parseLoadImm(tokens []string) (Instr, error) {
 	op, ok := instrToLoadImmOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	rd, err := getRegisterNumber(tokens[1])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := LoadImmInstr{
-		rd:  getRegisterNumber(tokens[1]),
-		imm: parseImm(tokens[2]),
-		op:  op,
+		rd: rd,
+		op: op,
+	}
+
+	if tokens[0] == "li" {
+		instr.imm, err = parseImm32(tokens[0], tokens[2])
+	} else {
+		instr.imm, instr.reloc, err = parseImm20(tokens[0], tokens[2])
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return &instr
+	return &instr, nil
+}
+
+// adds a load or store to the memory history, the memory sinks and the trace
+func (cpu *CPU) recordMemory(effect MemoryEffect) {
+	if cpu.strict != nil {
+		cpu.strictMemory(effect)
+	}
+	cpu.stackAccess(effect)
+	cpu.traceMemory(effect)
+
+	op := MemOp{Type: MemLoad, Addr: effect.Address, Size: effect.Size, Value: effect.Value, PC: cpu.PC, Symbol: cpu.symbolName(effect.Address)}
+	if effect.Write {
+		op.Type = MemStore
+	}
+	cpu.memoryHistory.add(op)
+	if cpu.hasSinks(StreamMemory) {
+		cpu.emitLine(StreamMemory, cpu.DescribeMemOp(op))
+	}
 }
 
 func (cpu *CPU) loadWord(address uint32) int32 {
-	err := cpu.checkMemoryAccess(address)
-	if err != nil {
-		return 0
+	cpu.checkMemoryAccess(address, 4, false)
+
+	raw, isDevice := cpu.deviceRead(address, 4)
+	if !isDevice {
+		cpu.cacheAccess(address, 4, false)
+		raw = cpu.byteOrder.Uint32(cpu.Memory[address:])
 	}
 
-	value := int32(binary.LittleEndian.Uint32(cpu.Memory[address:]))
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Loaded word (%d) from address %d", value, address)}, cpu.MemoryHistory...)
+	value := int32(raw)
+	cpu.recordMemory(MemoryEffect{Address: address, Size: 4, Value: value})
 	return value
 }
 
 func (cpu *CPU) loadHalf(address uint32) uint16 {
-	err := cpu.checkMemoryAccess(address)
-	if err != nil {
-		return 0
+	cpu.checkMemoryAccess(address, 2, false)
+
+	raw, isDevice := cpu.deviceRead(address, 2)
+	if !isDevice {
+		cpu.cacheAccess(address, 2, false)
+		raw = uint32(cpu.byteOrder.Uint16(cpu.Memory[address:]))
 	}
-	value := binary.LittleEndian.Uint16(cpu.Memory[address:])
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Loaded half (%d) from address %d", value, address)}, cpu.MemoryHistory...)
+
+	value := uint16(raw)
+	cpu.recordMemory(MemoryEffect{Address: address, Size: 2, Value: int32(value)})
 	return value
 }
 
 func (cpu *CPU) loadByte(address uint32) uint8 {
-	err := cpu.checkMemoryAccess(address)
-	if err != nil {
-		return 0
+	cpu.checkMemoryAccess(address, 1, false)
+
+	raw, isDevice := cpu.deviceRead(address, 1)
+	if !isDevice {
+		cpu.cacheAccess(address, 1, false)
+		raw = uint32(cpu.Memory[address])
 	}
-	value := uint8(cpu.Memory[address])
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Loaded byte (%d) from address %d", value, address)}, cpu.MemoryHistory...)
+
+	value := uint8(raw)
+	cpu.recordMemory(MemoryEffect{Address: address, Size: 1, Value: int32(value)})
 	return value
 }
 
 var instrToLoadOp = map[string]func(*CPU, int32, int32) int32{
 	"lw": func(cpu *CPU, rs1_val int32, imm int32) int32 { return cpu.loadWord(uint32(rs1_val + imm)) },
 	"lh": func(cpu *CPU, rs1_val int32, imm int32) int32 {
-		return int32(cpu.loadHalf(uint32(rs1_val + imm)))
+		return int32(int16(cpu.loadHalf(uint32(rs1_val + imm))))
 	},
 	"lhu": func(cpu *CPU, rs1_val int32, imm int32) int32 {
 		return int32(uint32(cpu.loadHalf(uint32(rs1_val + imm))))
 	},
 	"lb": func(cpu *CPU, rs1_val int32, imm int32) int32 {
-		return int32(cpu.loadByte(uint32(rs1_val + imm)))
+		return int32(int8(cpu.loadByte(uint32(rs1_val + imm))))
 	},
 	"lbu": func(cpu *CPU, rs1_val int32, imm int32) int32 {
 		return int32(uint32(cpu.loadByte(uint32(rs1_val + imm))))
 	},
 }
 
-func parseLoad(tokens []string) Instr {
-	var ok bool
-
+func parseLoad(tokens []string) (Instr, error) {
 	op, ok := instrToLoadOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[3])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := LoadInstr{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[3]),
-		imm: parseImm(tokens[2]),
+		rd:  regs[0],
+		rs1: regs[1],
 		op:  op,
 	}
+	if instr.imm, instr.reloc, err = parseImm12(tokens[0], tokens[2]); err != nil {
+		return nil, err
+	}
 
-	return &instr
+	return &instr, nil
 }
 
-func (cpu *CPU) storeWord(address uint32, value int32) {
-	err := cpu.checkMemoryAccess(address)
+// "lw rd, symbol" loads from the symbol's address
+func parseLoadSymbol(tokens []string) (Instr, error) {
+	op, ok := instrToLoadOp[tokens[0]]
+
+	if !ok {
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	rd, err := getRegisterNumber(tokens[1])
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Stored word (%d) to address %d", value, address)}, cpu.MemoryHistory...)
-	binary.LittleEndian.PutUint32(cpu.Memory[address:], uint32(value))
+	return &LoadInstr{
+		rd:    rd,
+		rs1:   0,
+		reloc: &relocation{kind: "abs", symbol: tokens[2]},
+		op:    op,
+	}, nil
+}
+
+func (cpu *CPU) storeWord(address uint32, value int32) {
+	cpu.checkMemoryAccess(address, 4, true)
+
+	cpu.recordMemory(MemoryEffect{Write: true, Address: address, Size: 4, Value: value})
+	if !cpu.deviceWrite(address, 4, value) {
+		cpu.cacheAccess(address, 4, true)
+		cpu.byteOrder.PutUint32(cpu.Memory[address:], uint32(value))
+	}
+	cpu.memoryWritten(address, 4, value)
 }
 
 func (cpu *CPU) storeHalf(address uint32, value int32) {
-	err := cpu.checkMemoryAccess(address)
-	if err != nil {
-		return
+	cpu.checkMemoryAccess(address, 2, true)
+
+	cpu.recordMemory(MemoryEffect{Write: true, Address: address, Size: 2, Value: value})
+	if !cpu.deviceWrite(address, 2, value) {
+		cpu.cacheAccess(address, 2, true)
+		cpu.byteOrder.PutUint16(cpu.Memory[address:], uint16(value))
 	}
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Stored half-word (%d) to address %d", value, address)}, cpu.MemoryHistory...)
-	binary.LittleEndian.PutUint16(cpu.Memory[address:], uint16(value))
+	cpu.memoryWritten(address, 2, value)
 }
 
 func (cpu *CPU) storeByte(address uint32, value int32) {
-	err := cpu.checkMemoryAccess(address)
-	if err != nil {
-		return
-	}
+	cpu.checkMemoryAccess(address, 1, true)
 
-	cpu.MemoryHistory = append([]string{fmt.Sprintf("Stored byte (%d) to address %d", value, address)}, cpu.MemoryHistory...)
-	cpu.Memory[address] = uint8(value)
+	cpu.recordMemory(MemoryEffect{Write: true, Address: address, Size: 1, Value: value})
+	if !cpu.deviceWrite(address, 1, value) {
+		cpu.cacheAccess(address, 1, true)
+		cpu.Memory[address] = uint8(value)
+	}
+	cpu.memoryWritten(address, 1, value)
 }
 
 var instrToStoreOp = map[string]func(*CPU, int32, int32, int32){
@@ -358,45 +764,52 @@ var instrToStoreOp = map[string]func(*CPU, int32, int32, int32){
 	"sb": func(cpu *CPU, rs1_val int32, rs2_val int32, imm int32) { cpu.storeByte(uint32(imm+rs1_val), rs2_val) },
 }
 
-func parseStore(tokens []string) Instr {
-	var ok bool
-
+func parseStore(tokens []string) (Instr, error) {
 	op, ok := instrToStoreOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[3], tokens[1])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := StoreInstr{
-		rs1: getRegisterNumber(tokens[3]),
-		rs2: getRegisterNumber(tokens[1]),
-		imm: parseImm(tokens[2]),
+		rs1: regs[0],
+		rs2: regs[1],
 		op:  op,
 	}
+	if instr.imm, instr.reloc, err = parseImm12(tokens[0], tokens[2]); err != nil {
+		return nil, err
+	}
 
-	return &instr
+	return &instr, nil
 }
 
+// the offset to a branch or jump destination. A label that is no longer
+// defined, say because cpu.Labels was changed after assembling, raises an
+// illegal instruction exception.
 func immOrLabel(cpu *CPU, destination string) int {
-	var imm int
-	var targetAddr uint32
-	var err error
-	var ok bool
+	if offset, err := strconv.ParseInt(destination, 0, 32); err == nil {
+		return int(offset)
+	}
 
-	if imm, err = strconv.Atoi(destination); err != nil {
-		if targetAddr, ok = cpu.Labels[destination]; !ok {
-			panic("Invalid Jump")
-		}
-		imm = int(targetAddr) - int(cpu.PC)
+	targetAddr, ok := symbolValue(cpu.Labels, destination)
+	if !ok {
+		cpu.raise(ExcIllegalInstruction, 0)
 	}
-	return imm
+	return int(targetAddr) - int(cpu.PC)
 }
 
 func trueOrNext(cpu *CPU, valid bool, destination string) {
 	if valid {
-		cpu.PC += uint32(immOrLabel(cpu, destination))
+		target := cpu.PC + uint32(immOrLabel(cpu, destination))
+		cpu.checkJumpTarget(target)
+		cpu.PC = target
 	} else {
-		cpu.PC += 4
+		cpu.PC = cpu.nextPC()
 	}
 }
 
@@ -421,23 +834,30 @@ var instrToBranchThreeOp = map[string]func(*CPU, int32, int32, string){
 	},
 }
 
-func parseBranchThree(tokens []string) Instr {
-	var ok bool
-
+func parseBranchThree(tokens []string) (Instr, error) {
 	op, ok := instrToBranchThreeOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	if err := checkOffset(tokens[0], tokens[3], 13); err != nil {
+		return nil, err
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[2])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := BranchThreeInstr{
-		rs1:         getRegisterNumber(tokens[1]),
-		rs2:         getRegisterNumber(tokens[2]),
+		rs1:         regs[0],
+		rs2:         regs[1],
 		destination: tokens[3],
 		op:          op,
 	}
 
-	return &instr
+	return &instr, nil
 }
 
 var instrToBranchTwoOp = map[string]func(*CPU, int32, string){
@@ -445,43 +865,70 @@ var instrToBranchTwoOp = map[string]func(*CPU, int32, string){
 	"bnez": func(cpu *CPU, rs1 int32, destination string) { trueOrNext(cpu, rs1 != 0, destination) },
 	"bltz": func(cpu *CPU, rs1 int32, destination string) { trueOrNext(cpu, rs1 < 0, destination) },
 	"bgtz": func(cpu *CPU, rs1 int32, destination string) { trueOrNext(cpu, rs1 > 0, destination) },
+	"blez": func(cpu *CPU, rs1 int32, destination string) { trueOrNext(cpu, rs1 <= 0, destination) },
 	"bgez": func(cpu *CPU, rs1 int32, destination string) { trueOrNext(cpu, rs1 >= 0, destination) },
 }
 
-func parseBranchTwo(tokens []string) Instr {
+func parseBranchTwo(tokens []string) (Instr, error) {
 	op, ok := instrToBranchTwoOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	if err := checkOffset(tokens[0], tokens[2], 13); err != nil {
+		return nil, err
+	}
+
+	rs1, err := getRegisterNumber(tokens[1])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := BranchTwoInstr{
-		rs1:         getRegisterNumber(tokens[1]),
+		rs1:         rs1,
 		destination: tokens[2],
 		op:          op,
 	}
 
-	return &instr
+	return &instr, nil
 }
 
-func parseJal(tokens []string) Instr {
+func parseJal(tokens []string) (Instr, error) {
+	if err := checkOffset(tokens[0], tokens[2], 21); err != nil {
+		return nil, err
+	}
+
+	rd, err := getRegisterNumber(tokens[1])
+	if err != nil {
+		return nil, err
+	}
 
 	instr := JumpAndLinkInstr{
-		rd:          getRegisterNumber(tokens[1]),
+		rd:          rd,
 		destination: tokens[2],
 	}
 
-	return &instr
+	return &instr, nil
 }
 
-func parseJalr(tokens []string) Instr {
+func parseJalr(tokens []string) (Instr, error) {
+	regs, err := getRegisterNumbers(tokens[1], tokens[2])
+	if err != nil {
+		return nil, err
+	}
+
+	imm, err := parseImmRange(tokens[0], tokens[3], -2048, 2047)
+	if err != nil {
+		return nil, err
+	}
 
 	instr := JumpAndLinkRInstr{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[2]),
-		imm: parseImm(tokens[3])}
+		rd:  regs[0],
+		rs1: regs[1],
+		imm: imm}
 
-	return &instr
+	return &instr, nil
 }
 
 var instrToSetOp = map[string]func(int32, int32) bool{
@@ -489,22 +936,26 @@ var instrToSetOp = map[string]func(int32, int32) bool{
 	"sltu": func(rs1, rs2 int32) bool { return uint32(rs1) < uint32(rs2) },
 }
 
-func parseSet(tokens []string) Instr {
-
+func parseSet(tokens []string) (Instr, error) {
 	op, ok := instrToSetOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[2], tokens[3])
+	if err != nil {
+		return nil, err
 	}
 
 	instr := SetInstr{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[2]),
-		rs2: getRegisterNumber(tokens[3]),
+		rd:  regs[0],
+		rs1: regs[1],
+		rs2: regs[2],
 		op:  op,
 	}
 
-	return &instr
+	return &instr, nil
 }
 
 var instrToSetImmOp = map[string]func(int32, int32) bool{
@@ -512,109 +963,288 @@ var instrToSetImmOp = map[string]func(int32, int32) bool{
 	"sltiu": func(rs1, imm int32) bool { return uint32(rs1) < uint32(imm) },
 }
 
-func parseSetImm(tokens []string) Instr {
-
+func parseSetImm(tokens []string) (Instr, error) {
 	op, ok := instrToSetImmOp[tokens[0]]
 
 	if !ok {
-		return &NoOp{reason: "Invalid Operation"}
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1], tokens[2])
+	if err != nil {
+		return nil, err
+	}
+
+	imm, err := parseImmRange(tokens[0], tokens[3], -2048, 2047)
+	if err != nil {
+		return nil, err
 	}
 
 	instr := SetImmInstr{
-		rd:  getRegisterNumber(tokens[1]),
-		rs1: getRegisterNumber(tokens[2]),
-		imm: parseImm(tokens[3]),
+		rd:  regs[0],
+		rs1: regs[1],
+		imm: imm,
 		op:  op,
 	}
 
-	return &instr
+	return &instr, nil
 }
 
+var instrToAtomicOp = map[string]func(*CPU, uint32, int32) int32{
+	"lr.w": func(cpu *CPU, address uint32, _ int32) int32 {
+		cpu.checkAtomicAlignment(address, false)
+		value := cpu.loadWord(address)
+		cpu.reserve(address)
+		return value
+	},
+	"sc.w": func(cpu *CPU, address uint32, value int32) int32 {
+		cpu.checkAtomicAlignment(address, true)
+		if !cpu.holdsReservation(address) {
+			cpu.reserved = false
+			return 1
+		}
+		cpu.storeWord(address, value)
+		cpu.reserved = false
+		return 0
+	},
+	"amoswap.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return value })
+	},
+	"amoadd.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return old + value })
+	},
+	"amoxor.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return old ^ value })
+	},
+	"amoand.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return old & value })
+	},
+	"amoor.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return old | value })
+	},
+	"amomin.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return min(old, value) })
+	},
+	"amomax.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return max(old, value) })
+	},
+	"amominu.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return int32(min(uint32(old), uint32(value))) })
+	},
+	"amomaxu.w": func(cpu *CPU, address uint32, value int32) int32 {
+		return cpu.amo(address, value, func(old, value int32) int32 { return int32(max(uint32(old), uint32(value))) })
+	},
+}
+
+// lr.w rd, (rs1) and the rest as amoadd.w rd, rs2, (rs1)
+func parseAtomic(tokens []string) (Instr, error) {
+	op, ok := instrToAtomicOp[tokens[0]]
+
+	if !ok {
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	regs, err := getRegisterNumbers(tokens[1:]...)
+	if err != nil {
+		return nil, err
+	}
+
+	instr := AtomicInstr{
+		rd:  regs[0],
+		rs1: regs[len(regs)-1],
+		op:  op,
+	}
+
+	if len(regs) == 3 {
+		instr.rs2 = regs[1]
+	}
+
+	return &instr, nil
+}
+
+var instrToCSROp = map[string]func(int32, int32, bool) (int32, bool){
+	"csrrw":  func(old, operand int32, _ bool) (int32, bool) { return operand, true },
+	"csrrs":  func(old, operand int32, zero bool) (int32, bool) { return old | operand, !zero },
+	"csrrc":  func(old, operand int32, zero bool) (int32, bool) { return old &^ operand, !zero },
+	"csrrwi": func(old, operand int32, _ bool) (int32, bool) { return operand, true },
+	"csrrsi": func(old, operand int32, zero bool) (int32, bool) { return old | operand, !zero },
+	"csrrci": func(old, operand int32, zero bool) (int32, bool) { return old &^ operand, !zero },
+}
+
+// csrrw rd, csr, rs1 and csrrwi rd, csr, uimm
+func parseCSRInstr(tokens []string) (Instr, error) {
+	op, ok := instrToCSROp[tokens[0]]
+
+	if !ok {
+		return nil, fmt.Errorf("invalid operation: %s", tokens[0])
+	}
+
+	rd, err := getRegisterNumber(tokens[1])
+	if err != nil {
+		return nil, err
+	}
+	csr, err := parseCSR(tokens[2])
+	if err != nil {
+		return nil, err
+	}
+
+	instr := CSRInstr{
+		rd:  rd,
+		csr: csr,
+		op:  op,
+	}
+
+	if strings.HasSuffix(tokens[0], "i") {
+		instr.useImm = true
+		imm, err := strconv.ParseInt(tokens[3], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("immediate parse error: %s", tokens[3])
+		}
+		if imm < 0 || imm > 31 {
+			return nil, fmt.Errorf("csr immediate out of range: %s", tokens[3])
+		}
+		instr.imm = int32(imm)
+	} else if instr.rs1, err = getRegisterNumber(tokens[3]); err != nil {
+		return nil, err
+	}
+
+	return &instr, nil
+}
+
+// csr pseudo instructions, as the equivalent csrr* tokens
+func expandCSRPseudo(tokens []string) []string {
+	switch tokens[0] {
+	case "csrr":
+		return []string{"csrrs", tokens[1], tokens[2], "zero"}
+	case "csrw":
+		return []string{"csrrw", "zero", tokens[1], tokens[2]}
+	case "csrs":
+		return []string{"csrrs", "zero", tokens[1], tokens[2]}
+	case "csrc":
+		return []string{"csrrc", "zero", tokens[1], tokens[2]}
+	}
+	return tokens
+}
+
+// uses regex also means we dont need to check the amount of tokens, since in order to match,
+// they NEED to have the right amount. They're anchored at both ends so extra operands don't
+// match either.
+var (
+	firstTokenRe = regexp.MustCompile(`^([\w.]+)`)
+	threePtRe    = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(\w+)\s*,\s*(\-?\.?\w+(?:\s*[+-]\s*\w+)?|%\w+\([^)]*\))$`)
+	twoPtImmRe   = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(-?\.?\w+(?:\s*[+-]\s*\w+)?|%\w+\([^)]*\))$`)
+	loadStoreRe  = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(-?\w+|%\w+\([^)]*\))\(([a-z0-9]+)\)$`)
+	loadSymbolRe = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(\.?\w+(?:\s*[+-]\s*\w+)?)$`)
+	jumpRe       = regexp.MustCompile(`^([\w.]+)\s+([-.]?\w+(?:\s*[+-]\s*\w+)?)$`)
+	jalRe        = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(-?\.?\w+(?:\s*[+-]\s*\w+)?)$`)
+	lrRe         = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*0?\((\w+)\)$`)
+	amoRe        = regexp.MustCompile(`^([\w.]+)\s+(\w+)\s*,\s*(\w+)\s*,\s*0?\((\w+)\)$`)
+)
+
+// decodes a comment and label stripped line, giving a NoOp whose reason is
+// what is wrong with the line when it can't be decoded. The NoOp traps when
+// it runs.
 func DecodeInstr(instr_str_raw *string) Instr {
-	// simple decoding by matching the instr token with the lists defined in instructions.go
+	instr, err := decodeInstr(*instr_str_raw)
+	if err != nil {
+		return &NoOp{reason: err.Error()}
+	}
+	return instr
+}
 
-	instr_str := strings.TrimSpace(*instr_str_raw)
+func decodeInstr(instr_str string) (Instr, error) {
+	// simple decoding by matching the instr token with the spec table in opcodes_gen.go and
+	// the op maps that implement each group of instructions
 
-	// uses regex also means we dont need to check the amount of tokens, since in order to match,
-	// they NEED to have the right amount
+	instr_str = strings.TrimSpace(instr_str)
 
-	firstTokenRe := regexp.MustCompile(`^(\w+)`)
-	threePtRe := regexp.MustCompile(`(\w+)\s+(\w+)\s*,\s*(\w+)\s*,\s*(\-?\.?\w+)`)
-	twoPtImmRe := regexp.MustCompile(`(\w+)\s+(\w+)\s*,\s*(\w+)`)
-	loadStoreRe := regexp.MustCompile(`(\w+)\s+(\w+)\s*,\s*(-?[0-9]+)\(([a-z0-9]+)\)`)
-	jumpRe := regexp.MustCompile(`(\w)\s+(.?\w+)`)
+	instrTypeToken := atomicMnemonic(firstTokenRe.FindString(instr_str))
 
-	instrTypeToken := firstTokenRe.FindString(instr_str)
+	if custom, ok := lookupCustomInstr(instrTypeToken); ok {
+		return custom.decode(instr_str)
+	}
 
-	if slices.Contains(threePtInstrTypes, instrTypeToken) {
+	// the spec decides which mnemonics exist, the op maps which are implemented
+	if _, ok := lookupSpec(instrTypeToken); !ok {
+		return nil, fmt.Errorf("unknown instruction: %s", instr_str)
+	}
+
+	if _, ok := compressedForms[instrTypeToken]; ok {
+		return decodeCompressed(instrTypeToken, instr_str)
+	}
+
+	if _, ok := instrToThreePtOp[instrTypeToken]; ok {
 		tokens := threePtRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseThreePt(tokens[1:])
 	}
 
-	if slices.Contains(threePtImmInstrTypes, instrTypeToken) {
+	if _, ok := instrToThreePtImmOp[instrTypeToken]; ok {
 		tokens := threePtRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseThreePtImm(tokens[1:])
 	}
 
-	if slices.Contains(loadImmInstrTypes, instrTypeToken) {
+	if _, ok := instrToLoadImmOp[instrTypeToken]; ok {
 		tokens := twoPtImmRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseLoadImm(tokens[1:])
 	}
 
-	if slices.Contains(loadInstrTypes, instrTypeToken) {
+	if _, ok := instrToLoadOp[instrTypeToken]; ok {
 		tokens := loadStoreRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			if tokens = loadSymbolRe.FindStringSubmatch(instr_str); len(tokens) != 0 {
+				return parseLoadSymbol(tokens[1:])
+			}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseLoad(tokens[1:])
 	}
 
-	if slices.Contains(storeInstrTypes, instrTypeToken) {
+	if _, ok := instrToStoreOp[instrTypeToken]; ok {
 		tokens := loadStoreRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseStore(tokens[1:])
 	}
 
-	if slices.Contains(branchThreeInstrTypes, instrTypeToken) {
+	if _, ok := instrToBranchThreeOp[instrTypeToken]; ok {
 		tokens := threePtRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseBranchThree(tokens[1:])
 	}
 
-	if slices.Contains(branchTwoInstrTypes, instrTypeToken) {
+	if _, ok := instrToBranchTwoOp[instrTypeToken]; ok {
 		tokens := twoPtImmRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 		return parseBranchTwo(tokens[1:])
 	}
 
-	if slices.Contains(setInstrTypes, instrTypeToken) {
+	if _, ok := instrToSetOp[instrTypeToken]; ok {
 		tokens := threePtRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 
 		return parseSet(tokens[1:])
 	}
 
-	if slices.Contains(setImmInstrTypes, instrTypeToken) {
+	if _, ok := instrToSetImmOp[instrTypeToken]; ok {
 		tokens := threePtRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 
 		return parseSetImm(tokens[1:])
@@ -623,67 +1253,175 @@ func DecodeInstr(instr_str_raw *string) Instr {
 	if instrTypeToken == "j" {
 		tokens := jumpRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 
-		return &JumpInstr{destination: tokens[2]}
+		return &JumpInstr{destination: tokens[2]}, nil
 	}
 
 	if instrTypeToken == "call" {
 		tokens := jumpRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 
-		return &JumpAndLinkInstr{rd: int8(abiToRegister["ra"]), destination: tokens[2]}
+		return &JumpAndLinkInstr{rd: int8(abiToRegister["ra"]), destination: tokens[2]}, nil
 	}
 
 	if instrTypeToken == "jr" {
 		tokens := jumpRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		rs1, err := getRegisterNumber(tokens[2])
+		if err != nil {
+			return nil, err
 		}
 
 		return &JumpAndLinkRInstr{
 			rd:  0,
-			rs1: getRegisterNumber(tokens[2]),
+			rs1: rs1,
 			imm: 0,
+		}, nil
+	}
+
+	if instrTypeToken == "lr.w" {
+		tokens := lrRe.FindStringSubmatch(instr_str)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
+		tokens[1] = instrTypeToken
+
+		return parseAtomic(tokens[1:])
 	}
 
-	if instrTypeToken == "jal" {
+	if _, ok := instrToAtomicOp[instrTypeToken]; ok {
+		tokens := amoRe.FindStringSubmatch(instr_str)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+		tokens[1] = instrTypeToken
+
+		return parseAtomic(tokens[1:])
+	}
+
+	if _, ok := instrToCSROp[instrTypeToken]; ok {
+		tokens := threePtRe.FindStringSubmatch(instr_str)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		return parseCSRInstr(tokens[1:])
+	}
+
+	if instrTypeToken == "csrr" || instrTypeToken == "csrw" || instrTypeToken == "csrs" || instrTypeToken == "csrc" {
 		tokens := twoPtImmRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		return parseCSRInstr(expandCSRPseudo(tokens[1:]))
+	}
+
+	if instrTypeToken == "rdcycle" || instrTypeToken == "rdinstret" {
+		tokens := jumpRe.FindStringSubmatch(instr_str)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		return parseCSRInstr([]string{"csrrs", tokens[2], strings.TrimPrefix(instrTypeToken, "rd"), "zero"})
+	}
+
+	switch instrTypeToken {
+	case "ebreak", "ecall", "mret", "wfi", "ret":
+		if instr_str != instrTypeToken {
+			return nil, fmt.Errorf("%s takes no operands", instrTypeToken)
+		}
+	}
+
+	if instrTypeToken == "ebreak" {
+		return &BreakpointInstr{}, nil
+	}
+
+	if instrTypeToken == "ecall" {
+		return &EcallInstr{}, nil
+	}
+
+	if instrTypeToken == "mret" {
+		return &MretInstr{}, nil
+	}
+
+	if instrTypeToken == "wfi" {
+		return &WfiInstr{}, nil
+	}
+
+	if instrTypeToken == "ret" {
+		return &JumpAndLinkRInstr{
+			rd:  0,
+			rs1: int8(abiToRegister["ra"]),
+			imm: 0,
+		}, nil
+	}
+
+	if instrTypeToken == "jal" {
+		if tokens := jalRe.FindStringSubmatch(instr_str); len(tokens) != 0 {
+			return parseJal(tokens[1:])
+		}
+
+		tokens := jumpRe.FindStringSubmatch(instr_str)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
 		}
 
-		return parseJal(tokens)
+		return &JumpAndLinkInstr{rd: int8(abiToRegister["ra"]), destination: tokens[2]}, nil
 	}
 
 	if instrTypeToken == "jalr" {
-		tokens := threePtRe.FindStringSubmatch(instr_str)
+		if tokens := threePtRe.FindStringSubmatch(instr_str); len(tokens) != 0 {
+			return parseJalr(tokens[1:])
+		}
+		if tokens := loadStoreRe.FindStringSubmatch(instr_str); len(tokens) != 0 {
+			return parseJalr([]string{tokens[1], tokens[2], tokens[4], tokens[3]})
+		}
+
+		tokens := jumpRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		rs1, err := getRegisterNumber(tokens[2])
+		if err != nil {
+			return nil, err
 		}
 
-		parseJalr(tokens)
+		return &JumpAndLinkRInstr{
+			rd:  int8(abiToRegister["ra"]),
+			rs1: rs1,
+			imm: 0,
+		}, nil
 	}
 
 	if instrTypeToken == "mv" {
 		tokens := twoPtImmRe.FindStringSubmatch(instr_str)
 		if len(tokens) == 0 {
-			return &NoOp{}
+			return nil, fmt.Errorf("invalid operands for %s", instrTypeToken)
+		}
+
+		regs, err := getRegisterNumbers(tokens[2], tokens[3])
+		if err != nil {
+			return nil, err
 		}
 
 		instr := InstrThreePtImm{}
-		instr.rd = getRegisterNumber(tokens[2])
-		instr.rs1 = getRegisterNumber(tokens[3])
+		instr.rd = regs[0]
+		instr.rs1 = regs[1]
 		instr.imm = 0
 
 		instr.op = func(i1, i2 int32) int32 { return i1 }
 
-		return &instr
+		return &instr, nil
 	}
 
-	return &NoOp{}
+	return nil, fmt.Errorf("unsupported instruction: %s", instrTypeToken)
 }
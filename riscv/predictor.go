@@ -0,0 +1,312 @@
+package riscv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// table entries a counter or gshare predictor gets unless told otherwise
+const DefaultPredictorEntries = 64
+
+// guesses which way conditional branches go before they resolve. Jumps are
+// always taken and aren't predicted.
+type Predictor interface {
+	// whether the branch at pc, which goes to target when taken, will be
+	// taken
+	Predict(pc, target uint32) bool
+	// learns which way the branch went
+	Update(pc, target uint32, taken bool)
+	// forgets everything learnt
+	Reset()
+	String() string
+}
+
+// predicts backward branches (loops) taken and forward ones not taken
+type StaticPredictor struct{}
+
+func (StaticPredictor) Predict(pc, target uint32) bool       { return target <= pc }
+func (StaticPredictor) Update(pc, target uint32, taken bool) {}
+func (StaticPredictor) Reset()                               {}
+func (StaticPredictor) String() string                       { return "static" }
+
+// a table of saturating counters indexed by the branch address, taken when
+// the counter is in its upper half. One bit remembers the last outcome, two
+// bits need two wrong guesses in a row to change their mind.
+type CounterPredictor struct {
+	Bits     int
+	counters []uint8
+}
+
+func NewCounterPredictor(counterBits int, entries uint32) (*CounterPredictor, error) {
+	if counterBits < 1 || counterBits > 8 {
+		return nil, errors.New("counters must be 1 to 8 bits")
+	}
+	if err := validateEntries(entries); err != nil {
+		return nil, err
+	}
+
+	predictor := &CounterPredictor{Bits: counterBits, counters: make([]uint8, entries)}
+	predictor.Reset()
+	return predictor, nil
+}
+
+func (predictor *CounterPredictor) Predict(pc, target uint32) bool {
+	return predictTaken(predictor.counters[tableIndex(pc, len(predictor.counters))], predictor.Bits)
+}
+
+func (predictor *CounterPredictor) Update(pc, target uint32, taken bool) {
+	counter := &predictor.counters[tableIndex(pc, len(predictor.counters))]
+	*counter = train(*counter, predictor.Bits, taken)
+}
+
+// every counter starts weakly not taken
+func (predictor *CounterPredictor) Reset() {
+	for i := range predictor.counters {
+		predictor.counters[i] = weaklyNotTaken(predictor.Bits)
+	}
+}
+
+func (predictor *CounterPredictor) String() string {
+	return fmt.Sprintf("%d-bit, %d entries", predictor.Bits, len(predictor.counters))
+}
+
+// two bit counters indexed by the branch address xored with the outcomes of
+// the latest branches, so one branch can be predicted differently depending
+// on how the program got there
+type GsharePredictor struct {
+	HistoryBits int
+	history     uint32
+	counters    []uint8
+}
+
+// the history is as long as the table index
+func NewGsharePredictor(entries uint32) (*GsharePredictor, error) {
+	if err := validateEntries(entries); err != nil {
+		return nil, err
+	}
+
+	predictor := &GsharePredictor{HistoryBits: bits.TrailingZeros32(entries), counters: make([]uint8, entries)}
+	predictor.Reset()
+	return predictor, nil
+}
+
+func (predictor *GsharePredictor) index(pc uint32) int {
+	return tableIndex(pc^predictor.history<<1, len(predictor.counters))
+}
+
+func (predictor *GsharePredictor) Predict(pc, target uint32) bool {
+	return predictTaken(predictor.counters[predictor.index(pc)], 2)
+}
+
+func (predictor *GsharePredictor) Update(pc, target uint32, taken bool) {
+	counter := &predictor.counters[predictor.index(pc)]
+	*counter = train(*counter, 2, taken)
+
+	predictor.history <<= 1
+	if taken {
+		predictor.history |= 1
+	}
+	predictor.history &= 1<<predictor.HistoryBits - 1
+}
+
+func (predictor *GsharePredictor) Reset() {
+	predictor.history = 0
+	for i := range predictor.counters {
+		predictor.counters[i] = weaklyNotTaken(2)
+	}
+}
+
+func (predictor *GsharePredictor) String() string {
+	return fmt.Sprintf("gshare, %d entries, %d bits of history", len(predictor.counters), predictor.HistoryBits)
+}
+
+func validateEntries(entries uint32) error {
+	if entries == 0 || bits.OnesCount32(entries) != 1 {
+		return errors.New("predictor entries must be a power of two")
+	}
+	return nil
+}
+
+// compressed instructions are only two byte aligned, so the lowest pc bit is
+// the only one left out
+func tableIndex(pc uint32, entries int) int {
+	return int(pc>>1) & (entries - 1)
+}
+
+func predictTaken(counter uint8, counterBits int) bool {
+	return counter >= 1<<(counterBits-1)
+}
+
+func weaklyNotTaken(counterBits int) uint8 {
+	return 1<<(counterBits-1) - 1
+}
+
+func train(counter uint8, counterBits int, taken bool) uint8 {
+	if taken && counter < 1<<counterBits-1 {
+		return counter + 1
+	}
+	if !taken && counter > 0 {
+		return counter - 1
+	}
+	return counter
+}
+
+// a predictor by name: static, 1-bit, 2-bit or gshare
+func ParsePredictor(name string, entries uint32) (Predictor, error) {
+	switch strings.ToLower(name) {
+	case "static":
+		return StaticPredictor{}, nil
+	case "1-bit":
+		return NewCounterPredictor(1, entries)
+	case "2-bit":
+		return NewCounterPredictor(2, entries)
+	case "gshare":
+		return NewGsharePredictor(entries)
+	}
+	return nil, fmt.Errorf("unknown branch predictor: %s", name)
+}
+
+// how the predictor did on one branch instruction
+type BranchSite struct {
+	PC       uint32
+	Text     string
+	Branches int // times it ran
+	Taken    int
+	Correct  int // times it was predicted right
+}
+
+func (site BranchSite) Accuracy() float64 {
+	if site.Branches == 0 {
+		return 0
+	}
+	return float64(site.Correct) / float64(site.Branches)
+}
+
+// a predictor fed every conditional branch the CPU retires, with how well it
+// has done so far
+type BranchPredictor struct {
+	Predictor Predictor
+	Branches  int
+	Correct   int
+	// whether the latest branch was predicted right
+	LastCorrect bool
+
+	sites map[uint32]*BranchSite
+}
+
+func (predictor *BranchPredictor) Accuracy() float64 {
+	if predictor.Branches == 0 {
+		return 0
+	}
+	return float64(predictor.Correct) / float64(predictor.Branches)
+}
+
+func (predictor *BranchPredictor) Mispredictions() int {
+	return predictor.Branches - predictor.Correct
+}
+
+// every branch that has run, in address order
+func (predictor *BranchPredictor) Sites() []BranchSite {
+	sites := make([]BranchSite, 0, len(predictor.sites))
+	for _, site := range predictor.sites {
+		sites = append(sites, *site)
+	}
+	slices.SortFunc(sites, func(a, b BranchSite) int { return cmp.Compare(a.PC, b.PC) })
+	return sites
+}
+
+// forgets what the predictor learnt and its statistics
+func (predictor *BranchPredictor) Reset() {
+	predictor.Predictor.Reset()
+	predictor.Branches, predictor.Correct, predictor.LastCorrect = 0, 0, false
+	predictor.sites = make(map[uint32]*BranchSite)
+}
+
+func (predictor *BranchPredictor) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s predictor\n%d branches, %.1f%% predicted, %d mispredicted\n",
+		predictor.Predictor, predictor.Branches, predictor.Accuracy()*100, predictor.Mispredictions())
+	for _, site := range predictor.Sites() {
+		fmt.Fprintf(&builder, "0x%04x %-20s %5.1f%% of %d, %d taken\n", site.PC, site.Text, site.Accuracy()*100, site.Branches, site.Taken)
+	}
+	return builder.String()
+}
+
+// predicts the branch, then trains the predictor on what it did. Returns
+// whether the prediction was right.
+func (predictor *BranchPredictor) record(pc uint32, text string, target uint32, taken bool) bool {
+	correct := predictor.Predictor.Predict(pc, target) == taken
+	predictor.Predictor.Update(pc, target, taken)
+
+	site, ok := predictor.sites[pc]
+	if !ok {
+		site = &BranchSite{PC: pc, Text: text}
+		predictor.sites[pc] = site
+	}
+	site.Branches++
+	predictor.Branches++
+	if taken {
+		site.Taken++
+	}
+	if correct {
+		site.Correct++
+		predictor.Correct++
+	}
+	predictor.LastCorrect = correct
+	return correct
+}
+
+// where a conditional branch goes when it is taken
+func branchTarget(cpu *CPU, pc uint32, destination string) uint32 {
+	if offset, err := strconv.ParseInt(destination, 0, 32); err == nil {
+		return pc + uint32(offset)
+	}
+	address, _ := symbolValue(cpu.Labels, destination)
+	return address
+}
+
+// feeds a retired conditional branch to the predictor. nextPC is the PC after
+// it executed.
+func (cpu *CPU) predictBranch(pc uint32, instr_num int, instr Instr, nextPC uint32) branchOutcome {
+	if cpu.predictor == nil {
+		return unpredicted
+	}
+
+	var destination string
+	switch branch := baseInstr(instr).(type) {
+	case *BranchThreeInstr:
+		destination = branch.destination
+	case *BranchTwoInstr:
+		destination = branch.destination
+	default:
+		return unpredicted
+	}
+
+	taken := nextPC != pc+instrSize(instr)
+	if cpu.predictor.record(pc, cpu.sourceText(instr_num), branchTarget(cpu, pc, destination), taken) {
+		return predictedRight
+	}
+	return predictedWrong
+}
+
+// starts predicting conditional branches with predictor. When the pipeline
+// model is enabled too, only mispredicted branches flush it.
+func (cpu *CPU) AttachPredictor(predictor Predictor) *BranchPredictor {
+	cpu.predictor = &BranchPredictor{Predictor: predictor}
+	cpu.predictor.Reset()
+	return cpu.predictor
+}
+
+func (cpu *CPU) DetachPredictor() {
+	cpu.predictor = nil
+}
+
+// nil unless a predictor is attached
+func (cpu *CPU) BranchPredictor() *BranchPredictor {
+	return cpu.predictor
+}
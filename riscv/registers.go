@@ -0,0 +1,67 @@
+package riscv
+
+import (
+	"fmt"
+	"slices"
+)
+
+// a value written to a register
+type RegisterChange struct {
+	PC          uint32 // the pc when the register was written
+	Instruction string // source of the instruction that wrote it, empty for SetRegister
+	Old, New    int32
+}
+
+// keeps the last depth values written to each register, oldest first. 0
+// turns the history off and forgets it.
+func (cpu *CPU) KeepRegisterHistory(depth int) {
+	cpu.registerHistoryDepth = depth
+	if depth == 0 {
+		cpu.registerHistory = nil
+		return
+	}
+
+	cpu.registerHistory = make([][]RegisterChange, len(cpu.Registers))
+}
+
+// newest first
+func (cpu *CPU) RegisterHistory(register int) []RegisterChange {
+	if register < 0 || register >= len(cpu.registerHistory) {
+		return nil
+	}
+	changes := slices.Clone(cpu.registerHistory[register])
+	slices.Reverse(changes)
+	return changes
+}
+
+func (cpu *CPU) recordRegisterChange(register int8, old, new int32, byInstruction bool) {
+	if cpu.registerHistory == nil {
+		return
+	}
+
+	change := RegisterChange{PC: cpu.PC, Old: old, New: new}
+	if instr_num, ok := cpu.instrIndex(cpu.PC); byInstruction && ok {
+		change.Instruction = cpu.sourceText(instr_num)
+	}
+
+	changes := append(cpu.registerHistory[register], change)
+	if len(changes) > cpu.registerHistoryDepth {
+		changes = changes[len(changes)-cpu.registerHistoryDepth:]
+	}
+	cpu.registerHistory[register] = changes
+}
+
+// sets a register from outside the program, e.g. from a debugger. Register
+// hooks see the write but watches don't. Writes to x0 are discarded.
+func (cpu *CPU) SetRegister(register int, value int32) error {
+	if register < 0 || register >= len(cpu.Registers) {
+		return fmt.Errorf("invalid register: x%d", register)
+	}
+	cpu.writeRegister(int8(register), value, false)
+	return nil
+}
+
+// the same as SetRegister, named to go with WriteMemory
+func (cpu *CPU) WriteRegister(register int, value int32) error {
+	return cpu.SetRegister(register, value)
+}
@@ -1,8 +1,20 @@
 package riscv
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ckashino/riscv_interpreter/riscv/format"
 )
 
 func TestStoreByte(t *testing.T) {
@@ -74,7 +86,2408 @@ func TestLabel(t *testing.T) {
 		t.Error("Label Add Fail")
 	}
 
-	if cpu.Labels["main"] != 4+16 {
+	if cpu.Labels["main"] != 16 {
 		t.Errorf("Label PC fail. actual %d", cpu.Labels["main"])
 	}
 }
+
+func TestBookmark(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{".bookmark output 0x20 0x30 green", "li x1, 7", "sw x1, 36(x0)"})
+	cpu.RunProgram()
+
+	bookmark, ok := cpu.Bookmark("output")
+	if !ok || bookmark.Start != 32 || bookmark.End != 48 || bookmark.Color != "green" {
+		t.Errorf("Bookmark directive fail. actual %+v", bookmark)
+	}
+
+	start, end, err := cpu.ResolveRange("output")
+	if err != nil || start != 32 || end != 48 {
+		t.Error("Bookmark resolve fail")
+	}
+
+	if operation := cpu.DescribeMemOp(cpu.MemoryHistory(MemOpFilter{})[0]); operation != "Stored word (7) to address 36 (output+4)" {
+		t.Errorf("Bookmark history fail. actual %s", operation)
+	}
+
+	// the lowest starting bookmark wins where they overlap
+	cpu.AddBookmark("all", 0, 64, "")
+	cpu.AddBookmark("inner", 40, 44, "")
+	if bookmark, ok := cpu.BookmarkAt(41); !ok || bookmark.Name != "all" {
+		t.Errorf("Bookmark lookup fail. actual %+v", bookmark)
+	}
+	if _, ok := cpu.BookmarkAt(64); ok {
+		t.Error("Bookmark lookup outside fail")
+	}
+
+	cpu.LoadInstructions([]string{"li x1, 7", ".bookmark big 0x20 0x100"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0] != (Diagnostic{Line: 2, Message: "bookmark big: range exceeds memory"}) {
+		t.Errorf("Bookmark directive error fail. actual %v", diagnostics)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li x1, 5", "sw x1, 8(x0)", "addi x1, x1, 1"})
+	cpu.RunNextInstruction()
+	cpu.RunNextInstruction()
+
+	data, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Restore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.PC != cpu.PC || restored.Registers != cpu.Registers {
+		t.Error("Restore register fail")
+	}
+
+	if binary.LittleEndian.Uint32(restored.Memory[8:]) != 5 {
+		t.Error("Restore memory fail")
+	}
+
+	restored.RunNextInstruction()
+	if restored.Registers[1] != 6 {
+		t.Errorf("Restore resume fail. actual %d", restored.Registers[1])
+	}
+
+	damaged := bytes.Replace(data, []byte(`"LineOrigins":[0,1,2]`), []byte(`"LineOrigins":[0]`), 1)
+	if bytes.Equal(damaged, data) {
+		t.Fatal("Snapshot line origins missing")
+	}
+	if _, err := Restore(damaged); err == nil {
+		t.Error("Restore should reject mismatched line origins")
+	}
+
+	// reloading the program a snapshot was taken of keeps its memory
+	program := []string{".data", "value: .word 1", ".text", "li t1, 9", "sw t1, %lo(value)(zero)"}
+	cpu = NewCPU(256)
+	cpu.LoadInstructions(program)
+	cpu.RunProgram()
+	if data, err = cpu.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err = Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	restored.LoadInstructions(program)
+	if address := restored.Labels["value"]; binary.LittleEndian.Uint32(restored.Memory[address:]) != 9 {
+		t.Errorf("Restore reload fail. actual %d", binary.LittleEndian.Uint32(restored.Memory[address:]))
+	}
+}
+
+func TestCheckers(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		".bookmark array 0x20 0x2c",
+		".check array sorted",
+		"li x1, 3",
+		"sw x1, 32(x0)",
+		"li x1, 1",
+		"sw x1, 36(x0)",
+		"sw x1, 40(x0)",
+	})
+	cpu.AttachChecker("0x20-0x24", CRC32Matches{Sum: crc32.ChecksumIEEE([]byte{3, 0, 0, 0})})
+	cpu.RunProgram()
+
+	results := cpu.CheckResults()
+	if len(results) != 2 {
+		t.Fatalf("Checker count fail. actual %d", len(results))
+	}
+
+	if !results[0].Passed() {
+		t.Errorf("CRC32 check fail: %s", results[0])
+	}
+
+	if results[1].Passed() {
+		t.Error("Sorted check should fail")
+	}
+}
+
+func TestCallStack(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"call f", "li x5, 1", "f:", "jal t0, g", "ret", "g:", "jr t0"})
+
+	cpu.RunNextInstruction()
+	cpu.RunNextInstruction()
+	frames := cpu.CallStack()
+	if len(frames) != 2 || frames[0].Function != "g" || frames[1].Function != "f" {
+		t.Fatalf("Call stack push fail. actual %v", frames)
+	}
+
+	cpu.RunNextInstruction()
+	frames = cpu.CallStack()
+	if len(frames) != 1 || frames[0].Function != "f" {
+		t.Fatalf("Call stack pop fail. actual %v", frames)
+	}
+
+	cpu.RunNextInstruction()
+	if len(cpu.CallStack()) != 0 {
+		t.Error("Call stack return fail")
+	}
+}
+
+func TestIncrementalAssembly(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li x1, 1", "add x2, x1, x9000"})
+
+	diagnostics := cpu.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Line != 2 {
+		t.Fatalf("Diagnostic fail. actual %v", diagnostics)
+	}
+
+	first := cpu.program[0]
+	cpu.LoadInstructions([]string{"li x1, 1", "add x2, x1, x1"})
+	if cpu.program[0] != first {
+		t.Error("Unchanged line was re-assembled")
+	}
+
+	if len(cpu.Diagnostics()) != 0 {
+		t.Error("Diagnostic not cleared")
+	}
+
+	cpu.LoadInstructions([]string{"li x1, 1", "add x2, x1, x1", "end:"})
+	if cpu.program[0] == first {
+		t.Error("Label move did not re-assemble")
+	}
+}
+
+func TestWatches(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		".bookmark out 0x20 0x24",
+		"li x10, 0",
+		"li x10, 5",
+		"sw x10, 16(x0)",
+		"sb x10, 33(x0)",
+		"li x11, 1",
+	})
+
+	regWatch, err := cpu.AddWatch("a0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cpu.AddWatch("out"); err != nil {
+		t.Fatal(err)
+	}
+
+	cpu.RunProgram()
+	hits := cpu.WatchHits()
+	if len(hits) != 1 || hits[0].Watch.ID != regWatch || hits[0].New != 5 {
+		t.Fatalf("Register watch fail. actual %v", hits)
+	}
+
+	cpu.RunProgram()
+	hits = cpu.WatchHits()
+	if len(hits) != 1 || hits[0].Address != 33 {
+		t.Fatalf("Memory watch fail. actual %v", hits)
+	}
+
+	cpu.RunProgram()
+	if cpu.Registers[11] != 1 {
+		t.Error("Resume after watch fail")
+	}
+}
+
+func TestStats(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"main:", "li x1, 4096", "li x2, 1", "add x3, x1, x2", "sw x3, 0(x0)", "beqz x3, main", "j main"})
+
+	stats := cpu.Stats()
+	if stats.Instructions != 7 || stats.CodeBytes != 28 {
+		t.Errorf("Stats size fail. actual %s", stats)
+	}
+
+	expected := map[string]int{"R": 1, "I": 2, "S": 1, "B": 1, "U": 1, "J": 1}
+	for format, count := range expected {
+		if stats.ByFormat[format] != count {
+			t.Errorf("Stats format %s fail. actual %s", format, stats)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		"# counts down from 2",
+		"",
+		"li x1, 2 # start",
+		"loop:",
+		"  // decrement",
+		"  addi x1, x1, -1",
+		"  bnez x1, loop",
+	})
+
+	if len(cpu.Diagnostics()) != 0 {
+		t.Fatalf("Comment diagnostics fail. actual %v", cpu.Diagnostics())
+	}
+
+	if cpu.Labels["loop"] != 20 {
+		t.Errorf("Comment label fail. actual %d", cpu.Labels["loop"])
+	}
+
+	if line, ok := cpu.LineOfAddress(20); !ok || line != 6 {
+		t.Errorf("Source map fail. actual %d", line)
+	}
+
+	if address, ok := cpu.AddressOfLine(7); !ok || address != 24 {
+		t.Errorf("Source map fail. actual %d", address)
+	}
+
+	cpu.RunProgram()
+	if cpu.Registers[1] != 0 {
+		t.Errorf("Comment program fail. actual %d", cpu.Registers[1])
+	}
+}
+
+type incInstr struct{}
+
+func (instr *incInstr) Operate(cpu *CPU) {
+	cpu.Registers[1]++
+	cpu.PC += 4
+}
+
+// a toy ISA with a single accumulator instruction
+type toyArch struct{ RV32I }
+
+func (arch toyArch) Name() string { return "toy" }
+
+func (arch toyArch) Decode(line string) Instr {
+	if line == "inc" {
+		return &incInstr{}
+	}
+	return &NoOp{reason: "unknown instruction: " + line}
+}
+
+func TestCustomArch(t *testing.T) {
+	RegisterArch(toyArch{})
+	cpu := NewCPUForArch(toyArch{}, 64)
+	cpu.LoadInstructions([]string{"inc", "inc # again", "add x1, x1, x1"})
+
+	if len(cpu.Diagnostics()) != 1 {
+		t.Errorf("Custom arch decode fail. actual %v", cpu.Diagnostics())
+	}
+
+	cpu.RunProgram()
+	if cpu.Registers[1] != 2 {
+		t.Errorf("Custom arch execute fail. actual %d", cpu.Registers[1])
+	}
+
+	data, _ := cpu.Snapshot()
+	restored, err := Restore(data)
+	if err != nil || restored.Arch.Name() != "toy" {
+		t.Error("Custom arch restore fail")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	cpu := NewCPU(64)
+	pipeline := cpu.EnablePipeline()
+	cpu.LoadInstructions([]string{"lw x1, 0(x0)", "add x2, x1, x1", "j end", "li x3, 1", "end:", "li x4, 1"})
+	cpu.RunProgram()
+
+	if pipeline.Instructions != 4 || pipeline.Stalls != 1 || pipeline.Flushes != 1 {
+		t.Fatalf("Pipeline count fail. actual %+v", pipeline)
+	}
+
+	// 4 instructions + 4 fill cycles + 1 stall + 2 flushed
+	if pipeline.Cycles() != 11 {
+		t.Errorf("Pipeline cycles fail. actual %d", pipeline.Cycles())
+	}
+
+	stages := pipeline.Occupancy(4)
+	if stages[StageIF] == nil || stages[StageIF].Text != "j end" || stages[StageID].Text != "add x2, x1, x1" || stages[StageEX] != nil {
+		t.Errorf("Pipeline stall occupancy fail")
+	}
+}
+
+func TestCache(t *testing.T) {
+	cpu := NewCPU(1024)
+	cache, err := cpu.AttachCache(CacheConfig{Size: 64, Associativity: 1, BlockSize: 16, HitLatency: 1, MissPenalty: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 and 64 map to the same set of a direct mapped cache
+	cpu.LoadInstructions([]string{"lw x1, 0(x0)", "lw x1, 4(x0)", "lw x1, 64(x0)", "lw x1, 0(x0)"})
+	cpu.RunProgram()
+
+	stats := cache.Stats
+	if stats.Accesses != 4 || stats.Hits != 1 || stats.CompulsoryMiss != 2 || stats.ConflictMiss != 1 {
+		t.Errorf("Cache stats fail. actual %+v", stats)
+	}
+
+	if stats.TotalLatency != 34 {
+		t.Errorf("Cache latency fail. actual %d", stats.TotalLatency)
+	}
+
+	if _, err := cpu.AttachCache(CacheConfig{Size: 60, Associativity: 1, BlockSize: 16}); err == nil {
+		t.Error("Cache config validation fail")
+	}
+}
+
+func TestBranchPredictor(t *testing.T) {
+	// the bnez is taken three times, then falls through. gshare indexes a new
+	// counter each time round as the history fills up.
+	loop := []string{"li a0, 4", "loop:", "addi a0, a0, -1", "bnez a0, loop"}
+
+	for name, correct := range map[string]int{"static": 3, "1-bit": 2, "2-bit": 2, "gshare": 1} {
+		cpu := NewCPU(64)
+		predictor, err := ParsePredictor(name, DefaultPredictorEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := cpu.AttachPredictor(predictor)
+		pipeline := cpu.EnablePipeline()
+		cpu.LoadInstructions(loop)
+		cpu.RunProgram()
+
+		if stats.Branches != 4 || stats.Correct != correct {
+			t.Errorf("%s predictor fail. actual %d of %d", name, stats.Correct, stats.Branches)
+		}
+		if pipeline.Flushes != stats.Mispredictions() {
+			t.Errorf("%s pipeline flush fail. actual %d", name, pipeline.Flushes)
+		}
+
+		sites := stats.Sites()
+		if len(sites) != 1 || sites[0].PC != 24 || sites[0].Text != "bnez a0, loop" || sites[0].Taken != 3 {
+			t.Errorf("%s branch site fail. actual %+v", name, sites)
+		}
+	}
+
+	if _, err := ParsePredictor("3-bit", DefaultPredictorEntries); err == nil {
+		t.Error("Unknown predictor fail")
+	}
+	if _, err := NewGsharePredictor(48); err == nil {
+		t.Error("Predictor entries validation fail")
+	}
+}
+
+func TestSpecCoversOps(t *testing.T) {
+	var mnemonics []string
+	for _, ops := range []map[string]func(int32, int32) int32{instrToThreePtOp, instrToThreePtImmOp} {
+		for mnemonic := range ops {
+			mnemonics = append(mnemonics, mnemonic)
+		}
+	}
+	for mnemonic := range instrToLoadImmOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for mnemonic := range instrToLoadOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for mnemonic := range instrToStoreOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for mnemonic := range instrToBranchThreeOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for mnemonic := range instrToBranchTwoOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for _, ops := range []map[string]func(int32, int32) bool{instrToSetOp, instrToSetImmOp} {
+		for mnemonic := range ops {
+			mnemonics = append(mnemonics, mnemonic)
+		}
+	}
+
+	for mnemonic := range instrToCSROp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	for mnemonic := range instrToAtomicOp {
+		mnemonics = append(mnemonics, mnemonic)
+	}
+
+	for _, mnemonic := range mnemonics {
+		if _, ok := lookupSpec(mnemonic); !ok {
+			t.Errorf("%s is implemented but missing from the spec", mnemonic)
+		}
+	}
+}
+
+func TestCSR(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		"li t0, 8",
+		"csrrw zero, mscratch, t0",
+		"csrrsi a0, mscratch, 3",
+		"csrrc a1, mscratch, t0",
+		"csrr a2, mscratch",
+		"rdinstret a3",
+		"csrw cycle, t0",
+	})
+	cpu.RunProgram()
+
+	if cpu.Registers[10] != 8 || cpu.Registers[11] != 11 || cpu.Registers[12] != 3 {
+		t.Errorf("CSR read/modify/write fail. actual %d %d %d", cpu.Registers[10], cpu.Registers[11], cpu.Registers[12])
+	}
+
+	if cpu.Registers[13] != 5 {
+		t.Errorf("instret fail. actual %d", cpu.Registers[13])
+	}
+
+	// the write to a read-only csr traps and doesn't retire
+	if cpu.ReadCSR(CSRCycle) != 6 {
+		t.Errorf("Read-only CSR write fail. actual %d", cpu.ReadCSR(CSRCycle))
+	}
+
+	if trap, ok := cpu.Err().(*Trap); !ok || trap.Cause != ExcIllegalInstruction || trap.Line != 7 {
+		t.Errorf("Read-only CSR trap fail. actual %v", cpu.Err())
+	}
+
+	// the h counters set the upper half of the count, which the lower ones keep
+	cpu.SetCSR(CSRInstreth, 2)
+	cpu.SetCSR(CSRCycle, 9)
+	if cpu.ReadCSR(CSRTimeh) != 2 || cpu.ReadCSR(CSRInstret) != 9 {
+		t.Errorf("Upper counter fail. actual %d %d", cpu.ReadCSR(CSRTimeh), cpu.ReadCSR(CSRInstret))
+	}
+	state := cpu.GetState()
+	state.CSRs[CSRCycleh] = 4
+	if err := cpu.SetState(state); err != nil || cpu.ReadCSR(CSRInstreth) != 4 || cpu.ReadCSR(CSRMcycle) != 9 {
+		t.Errorf("Upper counter state fail. actual %d %d %v", cpu.ReadCSR(CSRInstreth), cpu.ReadCSR(CSRMcycle), err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	cases := map[uint32]string{
+		0x00500093: "addi ra, zero, 5",
+		0x40b50533: "sub a0, a0, a1",
+		0xffc42783: "lw a5, -4(fp)",
+		0x00112e23: "sw ra, 28(sp)",
+		0xfe0798e3: "bne a5, zero, -16",
+		0x008000ef: "jal ra, 8",
+		0x000122b7: "lui t0, 18",
+		0x40105093: "srai ra, zero, 1",
+		0x34029073: "csrrw zero, mscratch, t0",
+		0x00100073: "ebreak",
+		0x00b6252f: "amoadd.w a0, a1, (a2)",
+		0x140522af: "lr.w.aq t0, (a0)",
+	}
+
+	for word, expected := range cases {
+		if actual, ok := Disassemble(word); !ok || actual != expected {
+			t.Errorf("Disassemble 0x%08x fail. expected %s, actual %s", word, expected, actual)
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if _, err := NewSandboxedCPU(SafeSandbox, SafeSandbox.MaxMemory+1); err == nil {
+		t.Error("Sandbox memory limit Fail")
+	}
+
+	sandbox := SafeSandbox
+	sandbox.MaxSteps = 100
+	cpu, err := NewSandboxedCPU(sandbox, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpu.LoadInstructions([]string{".check 0x20-0x24 file /etc/passwd", "loop:", "addi x1, x1, 1", "j loop"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Line != 1 {
+		t.Errorf("Sandbox file check fail. actual %v", diagnostics)
+	}
+
+	cpu.RunProgram()
+	if cpu.Err() != ErrStepLimit {
+		t.Errorf("Sandbox step limit fail. actual %v", cpu.Err())
+	}
+
+	if cpu.Registers[1] != 50 {
+		t.Errorf("Sandbox step count fail. actual %d", cpu.Registers[1])
+	}
+
+	if len(cpu.CheckResults()) != 0 {
+		t.Error("Sandbox file checker should not run")
+	}
+}
+
+func TestTraps(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li x1, 1", "lw x2, 2(x0)", "li x3, 1"})
+	cpu.RunProgram()
+
+	trap, ok := cpu.Err().(*Trap)
+	if !ok || trap.Cause != ExcLoadMisaligned || trap.Value != 2 || trap.Line != 2 {
+		t.Fatalf("Misaligned load fail. actual %v", cpu.Err())
+	}
+
+	if !cpu.Done || cpu.PC != 20 || cpu.Registers[3] != 0 {
+		t.Errorf("Trap halt fail. actual pc %d", cpu.PC)
+	}
+
+	cpu = NewCPU(64)
+	cpu.LoadInstructions([]string{
+		"li t0, 36", // handler
+		"csrw mtvec, t0",
+		"sw x1, 64(x0)",
+		"li x5, 7",
+		"j end",
+		"handler:",
+		"csrr t1, mepc",
+		"addi t1, t1, 4",
+		"csrw mepc, t1",
+		"mret",
+		"end:",
+	})
+	cpu.RunProgram()
+
+	if cpu.Err() != nil {
+		t.Fatal(cpu.Err())
+	}
+
+	if cpu.ReadCSR(CSRMcause) != int32(ExcStoreAccessFault) || cpu.ReadCSR(CSRMtval) != 64 || cpu.Registers[5] != 7 {
+		t.Errorf("Trap handler fail. actual mcause %d mtval %d", cpu.ReadCSR(CSRMcause), cpu.ReadCSR(CSRMtval))
+	}
+
+	cpu = NewCPU(64)
+	cpu.LoadInstructions([]string{"li x1, 1", "ebreak", "li x1, 2"})
+	cpu.RunProgram()
+	if !cpu.AtBreakpoint() || cpu.Registers[1] != 1 || cpu.PC != 24 {
+		t.Fatalf("ebreak fail. actual pc %d", cpu.PC)
+	}
+
+	cpu.RunProgram()
+	if cpu.Registers[1] != 2 {
+		t.Error("Resume after ebreak fail")
+	}
+}
+
+func TestAtomics(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		"li a0, 32",
+		"li t1, 3",
+		"retry:",
+		"lr.w t0, (a0)",
+		"addi t0, t0, 1",
+		"sc.w t2, t0, (a0)",
+		"bnez t2, retry",
+		"amoadd.w a1, t1, (a0)",
+		"addi t3, zero, -1",
+		"amomaxu.w a2, t3, (a0)",
+		"lr.w t0, (a0)",
+		"sw zero, 32(zero)",
+		"sc.w a3, t1, (a0)",
+	})
+	cpu.RunProgram()
+
+	if cpu.Registers[11] != 1 || cpu.Registers[12] != 4 {
+		t.Errorf("AMO old value fail. actual %d %d", cpu.Registers[11], cpu.Registers[12])
+	}
+
+	if cpu.Registers[13] != 1 {
+		t.Error("sc.w after a store should fail")
+	}
+
+	if binary.LittleEndian.Uint32(cpu.Memory[32:]) != 0 {
+		t.Errorf("Failed sc.w stored. actual %d", binary.LittleEndian.Uint32(cpu.Memory[32:]))
+	}
+}
+
+func TestMachine(t *testing.T) {
+	counter := func(increment ...string) *Machine {
+		first, second := NewCPU(1024), NewCPU(1024)
+		machine := NewMachine([]*CPU{&first, &second}, &RoundRobin{})
+		program := []string{"csrr s0, mhartid", "li a0, 256", "li t1, 3", "loop:"}
+		program = append(program, increment...)
+		machine.LoadInstructions(append(program, "addi t1, t1, -1", "bnez t1, loop"))
+		machine.Run()
+		return machine
+	}
+
+	// both harts load the same value before either stores it back
+	racy := counter("lw t2, 0(a0)", "addi t2, t2, 1", "sw t2, 0(a0)")
+	if value := binary.LittleEndian.Uint32(racy.Harts[0].Memory[256:]); value != 3 {
+		t.Errorf("Racy counter fail. actual %d", value)
+	}
+
+	atomic := counter("li t2, 1", "amoadd.w zero, t2, (a0)")
+	if value := binary.LittleEndian.Uint32(atomic.Harts[0].Memory[256:]); value != 6 {
+		t.Errorf("Atomic counter fail. actual %d", value)
+	}
+
+	second := atomic.Harts[1]
+	if second.Registers[8] != 1 || second.Registers[2] != 1024-hartStackSize {
+		t.Errorf("Hart setup fail. actual hartid %d sp %d", second.Registers[8], second.Registers[2])
+	}
+
+	// the harts' sandbox step limit caps the run of them all
+	sandbox := SafeSandbox
+	sandbox.MaxSteps = 1000
+	first, _ := NewSandboxedCPU(sandbox, 1024)
+	other, _ := NewSandboxedCPU(sandbox, 1024)
+	sandboxed := NewMachine([]*CPU{&first, &other}, &RoundRobin{})
+	sandboxed.LoadInstructions([]string{"loop:", "j loop"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if steps := sandboxed.RunContext(ctx); steps != 1000 || sandboxed.Harts[sandboxed.LastHart].Err() != ErrStepLimit {
+		t.Errorf("Sandboxed machine step limit fail. actual %d steps", steps)
+	}
+
+	// a shared timer ticks once per machine step, a trapping one included
+	one, two := NewCPU(1024), NewCPU(1024)
+	timed := NewMachine([]*CPU{&one, &two}, &RoundRobin{})
+	_, timer, err := timed.MapStandardDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timed.LoadInstructions([]string{"li a0, 1", "li a0, 2", "lw a1, 1(zero)"})
+	if steps := timed.RunContext(context.Background()); steps != 5 || timer.Time != 5 || one.Err() == nil {
+		t.Errorf("Machine timer fail. actual %d steps, time %d", steps, timer.Time)
+	}
+}
+
+func TestState(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li x1, 1", "ebreak", "addi x1, x1, 1"})
+	cpu.RunProgram()
+
+	state := cpu.GetState()
+	if state.PC != 24 || state.Registers[1] != 1 || state.Stop != StopBreakpoint || state.Halted {
+		t.Fatalf("GetState fail. actual %+v", state)
+	}
+
+	state.PC = 16
+	state.Registers[1] = 41
+	state.CSRs[CSRInstret] = 100
+	if err := cpu.SetState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if cpu.GetState().Stop != StopNone || cpu.ReadCSR(CSRInstret) != 100 {
+		t.Errorf("SetState fail. actual %+v", cpu.GetState())
+	}
+
+	state.Registers[0] = 1
+	if err := cpu.SetState(state); err == nil {
+		t.Error("SetState should reject a non-zero x0")
+	}
+
+	cpu.RunNextInstruction()
+	if cpu.GetState().Registers[1] != 1 {
+		t.Errorf("Resume after SetState fail. actual %d", cpu.GetState().Registers[1])
+	}
+}
+
+func TestDevices(t *testing.T) {
+	var output bytes.Buffer
+	cpu := NewCPU(64)
+	uart, timer, err := cpu.MapStandardDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.AttachSink(StreamConsole, &output)
+	uart.Feed([]byte("!"))
+
+	cpu.LoadInstructions([]string{
+		"li t0, 268435456", // UARTBase
+		"li t1, 104",
+		"sb t1, 0(t0)",
+		"li t1, 105",
+		"sb t1, 0(t0)",
+		"lw a0, 4(t0)",
+		"lbu a1, 0(t0)",
+		"lw a2, 4(t0)",
+		"li t2, 33554432", // TimerBase
+		"lw a3, 0(t2)",
+	})
+	cpu.RunProgram()
+
+	if output.String() != "hi" {
+		t.Errorf("UART output fail. actual %q", output.String())
+	}
+
+	if cpu.Registers[10] != UARTRxReady|UARTTxReady || cpu.Registers[11] != '!' || cpu.Registers[12] != UARTTxReady {
+		t.Errorf("UART input fail. actual %d %d %d", cpu.Registers[10], cpu.Registers[11], cpu.Registers[12])
+	}
+
+	if cpu.Registers[13] != 9 || timer.Time != 10 {
+		t.Errorf("Timer fail. actual %d %d", cpu.Registers[13], timer.Time)
+	}
+
+	if err := cpu.MapDevice(UARTBase+4, 4, NewTimer()); err == nil {
+		t.Error("Overlapping device should fail")
+	}
+
+	// narrow loads take their bytes from the register's word, in memory order
+	lanes := []string{"li t0, 33554432", "lbu a0, 9(t0)", "lhu a1, 14(t0)", "lb a2, 15(t0)", "lw a3, 10(t0)"}
+	for _, options := range []Options{{MemorySize: 64, AllowMisaligned: true}, {MemorySize: 64, AllowMisaligned: true, BigEndian: true}} {
+		cpu := NewCPUWithOptions(options)
+		_, timer, _ := cpu.MapStandardDevices()
+		timer.Compare = 0x8877665544332211
+		cpu.LoadInstructions(lanes)
+		cpu.RunProgram()
+
+		expected := []int32{0x22, 0x8877, -0x78, 0x66554433}
+		if options.BigEndian {
+			expected = []int32{0x33, 0x6655, 0x55, 0x22118877}
+		}
+		if !slices.Equal(cpu.Registers[10:14], expected) {
+			t.Errorf("Device byte lanes fail. big endian %v actual %x", options.BigEndian, cpu.Registers[10:14])
+		}
+	}
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	cpu := NewCPU(64)
+	_, timer, err := cpu.MapStandardDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpu.LoadInstructions([]string{
+		"j main",
+		"handler:",
+		"csrr s0, mcause",
+		"li t1, -1",
+		"sw t1, 12(t2) # mtimecmp high, clears the interrupt",
+		"addi s1, s1, 1",
+		"mret",
+		"main:",
+		"li t0, 20", // handler
+		"csrw mtvec, t0",
+		"li t2, 33554432", // TimerBase
+		"li t1, 1000",
+		"sw t1, 8(t2)",
+		"sw zero, 12(t2)",
+		"li t1, 128",
+		"csrw mie, t1",
+		"li t1, 8",
+		"csrs mstatus, t1",
+		"wfi",
+		"csrr s2, mstatus",
+	})
+	cpu.RunProgram()
+
+	if cpu.Err() != nil {
+		t.Fatal(cpu.Err())
+	}
+
+	if cpu.Registers[8] != mcauseInterrupt|int32(IntMachineTimer) || cpu.Registers[9] != 1 {
+		t.Errorf("Timer interrupt fail. actual mcause %#x handled %d times", uint32(cpu.Registers[8]), cpu.Registers[9])
+	}
+
+	if timer.Time < 1000 || cpu.ReadCSR(CSRMinstret) > 100 {
+		t.Errorf("wfi fail. actual time %d after %d instructions", timer.Time, cpu.ReadCSR(CSRMinstret))
+	}
+
+	if cpu.Registers[18]&MstatusMIE == 0 || cpu.Registers[18]&MstatusMPIE == 0 {
+		t.Errorf("mret fail. actual mstatus %#x", cpu.Registers[18])
+	}
+
+	if cpu.ReadCSR(CSRMip) != 0 {
+		t.Errorf("mip fail. actual %#x", cpu.ReadCSR(CSRMip))
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	cpu := NewCPU(256)
+	program := []string{"li a0, 5", "li a1, 6", "add a2, a0, a1", "sw a2, 128(zero)"}
+	cpu.LoadInstructions(program)
+	start := cpu.CaptureState()
+	before := cpu.RecordRun(context.Background())
+
+	if len(before.Trace) != 4 || before.Trace[3].Memory[0].Address != 128 {
+		t.Fatalf("RecordRun trace fail. actual %+v", before.Trace)
+	}
+
+	if err := cpu.RestoreState(start); err != nil {
+		t.Fatal(err)
+	}
+	if diff := DiffStates(before, cpu.RecordRun(context.Background())); !diff.Same() {
+		t.Errorf("Same run diff fail. actual %s", diff)
+	}
+
+	if err := cpu.RestoreState(start); err != nil {
+		t.Fatal(err)
+	}
+	program[1] = "li a1, 7"
+	cpu.LoadInstructions(program)
+	diff := DiffStates(before, cpu.RecordRun(context.Background()))
+
+	if diff.Divergence != 1 || diff.BeforeEntry.Instruction != "li a1, 6" || diff.AfterEntry.Instruction != "li a1, 7" {
+		t.Errorf("Divergence fail. actual %d", diff.Divergence)
+	}
+
+	if len(diff.Registers) != 2 || diff.Registers[0].Name != "a1" || diff.Registers[1].Before != 11 || diff.Registers[1].After != 12 {
+		t.Errorf("Register diff fail. actual %+v", diff.Registers)
+	}
+
+	if len(diff.Memory) != 1 || diff.Memory[0] != (MemoryDiff{Address: 128, Before: 11, After: 12}) {
+		t.Errorf("Memory diff fail. actual %+v", diff.Memory)
+	}
+
+	if err := cpu.RestoreState(CPUState{}); err == nil {
+		t.Error("RestoreState should reject a different memory size")
+	}
+}
+
+func TestWriteMemory(t *testing.T) {
+	cpu := NewCPU(64)
+	if err := cpu.MapDevice(48, 16, NewTimer()); err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadInstructions([]string{"lw a0, 32(zero)", "lbu a1, 38(zero)"})
+
+	if err := cpu.WriteMemory(32, []byte{1, 2, 3, 4, 5, 6, 7}); err != nil {
+		t.Fatal(err)
+	}
+	cpu.RunProgram()
+
+	if cpu.Registers[10] != 0x04030201 || cpu.Registers[11] != 7 {
+		t.Errorf("WriteMemory fail. actual %#x %d", cpu.Registers[10], cpu.Registers[11])
+	}
+
+	stores := cpu.MemoryHistory(MemOpFilter{Stores: true})
+	if len(stores) != 3 || !stores[0].Manual || stores[0].Addr != 38 || stores[1].Size != 2 || stores[2].Value != 0x04030201 {
+		t.Errorf("WriteMemory history fail. actual %v", stores)
+	}
+
+	if err := cpu.WriteMemory(63, []byte{1, 2}); err == nil {
+		t.Error("WriteMemory past the end should fail")
+	}
+
+	if err := cpu.WriteMemory(46, []byte{1, 2, 3}); err == nil || cpu.Memory[46] != 0 {
+		t.Error("WriteMemory to a device should fail")
+	}
+}
+
+func TestAssembleAndStep(t *testing.T) {
+	if _, err := Assemble("li a0, 1\nfrobnicate a0"); err == nil || err.(*AssemblyError).Diagnostics[0].Line != 2 {
+		t.Errorf("Assemble error fail. actual %v", err)
+	}
+
+	program, err := Assemble("li t0, 32\ncsrw mtvec, t0\nlw a0, 2(zero)\nsw a0, 64(zero)\nhandler:\nli a1, 3")
+	if err != nil || program.Labels["handler"] != 32 || len(program.Listing) != 5 {
+		t.Fatalf("Assemble fail. actual %+v %v", program, err)
+	}
+
+	cpu := NewCPU(64)
+	cpu.Load(program)
+	var results []StepResult
+	for {
+		result, err := cpu.Step()
+		if err != nil {
+			if err != ErrHalted {
+				t.Fatal(err)
+			}
+			break
+		}
+		results = append(results, result)
+	}
+
+	if len(results) != 4 || results[0].Registers[0] != (RegisterWrite{Register: 5, Value: 32}) || results[0].Line != 1 {
+		t.Fatalf("Step fail. actual %+v", results)
+	}
+
+	if trap := results[2].Trap; trap == nil || trap.Cause != ExcLoadMisaligned || results[2].NextPC != 32 {
+		t.Errorf("Step trap fail. actual %+v", results[2])
+	}
+
+	if results[3].Instruction != "li a1, 3" || results[3].Stop != StopEnd {
+		t.Errorf("Step end fail. actual %+v", results[3])
+	}
+
+	if err := RegisterInstruction("crash", NoOperands, func(cpu *CPU, operands Operands) { panic("broken") }); err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadInstructions([]string{"crash"})
+	if _, err := cpu.Step(); err == nil || !cpu.Done {
+		t.Errorf("Step should turn a panic into an error. actual %v", err)
+	}
+
+	cpu = NewCPU(64)
+	cpu.LoadInstructions([]string{"sw a0, 64(zero)"})
+	if _, err := cpu.Step(); err == nil || err.(*Trap).Cause != ExcStoreAccessFault {
+		t.Errorf("Step halting trap fail. actual %v", err)
+	}
+
+	// a label removed after assembling is an illegal instruction, not a panic
+	cpu = NewCPU(64)
+	cpu.LoadInstructions([]string{"j end", "end:", "li a0, 1"})
+	delete(cpu.Labels, "end")
+	if _, err := cpu.Step(); err == nil || err.(*Trap).Cause != ExcIllegalInstruction {
+		t.Errorf("Step missing label fail. actual %v", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := map[string]string{
+		"add x1, x2, bogus":      "invalid register: bogus",
+		"addi a0, a0, 5000":      "immediate 5000 out of range for addi, expected -2048 to 2047",
+		"lw a0, %hi(x)(zero)":    "%hi is not allowed in lw",
+		"csrrwi a0, mstatus, 40": "csr immediate out of range: 40",
+		"csrr a0, nonsense":      "invalid csr: nonsense",
+		"beq a0, a1, 3":          "offset 3 for beq must be even",
+		"c.addi zero, 1":         "c.addi can't use x0",
+		"c.addi16sp sp, 0":       "immediate for c.addi16sp can't be 0",
+		"c.lw a0, 4(t0)":         "c.lw needs a register from x8 to x15 (s0, s1, a0 to a5), got t0",
+		"add x1, x2, x3, x4":     "invalid operands for add",
+		"addi a0,a0,1,2":         "invalid operands for addi",
+		"lw a0, 4(sp), 8":        "invalid operands for lw",
+		"j loop, 4":              "invalid operands for j",
+		"lr.w a0, (a1) a2":       "invalid operands for lr.w",
+		"ecall a0":               "ecall takes no operands",
+	}
+	for line, expected := range cases {
+		instr, err := decodeInstr(line)
+		if err == nil || err.Error() != expected || instr != nil {
+			t.Errorf("Decode %q fail. actual %v", line, err)
+		}
+		if noop, ok := DecodeInstr(&line).(*NoOp); !ok || noop.reason != expected {
+			t.Errorf("DecodeInstr %q fail. actual %v", line, DecodeInstr(&line))
+		}
+	}
+
+	// jalr also takes its offset the way loads do
+	instr, err := decodeInstr("jalr ra, 8(a0)")
+	if jalr, ok := instr.(*JumpAndLinkRInstr); err != nil || !ok || jalr.rd != 1 || jalr.rs1 != 10 || jalr.imm != 8 {
+		t.Errorf("Decode jalr offset fail. actual %#v %v", instr, err)
+	}
+}
+
+func TestSyscalls(t *testing.T) {
+	cpu := NewCPU(1024)
+	var stdout, stderr bytes.Buffer
+	cpu.SetStdin(strings.NewReader("hello"))
+	cpu.AttachSink(StreamConsole, &stdout)
+	cpu.AttachSink(StreamStderr, &stderr)
+	cpu.LoadInstructions([]string{
+		"li a0, 0", "li a1, 256", "li a2, 8", "li a7, 63", "ecall",
+		"mv a2, a0", "li a0, 1", "li a1, 256", "li a7, 64", "ecall",
+		"li a0, 2", "li a2, 2", "ecall",
+		"li a0, 5", "ecall",
+		"mv s0, a0",
+		"li a0, 3", "li a7, 93", "ecall",
+		"li s1, 1",
+	})
+	cpu.RunProgram()
+
+	if stdout.String() != "hello" || stderr.String() != "he" {
+		t.Errorf("Syscall write fail. actual %q %q", stdout.String(), stderr.String())
+	}
+	if cpu.Registers[8] != -9 {
+		t.Errorf("Syscall bad fd fail. actual %d", cpu.Registers[8])
+	}
+	if code, exited := cpu.ExitCode(); code != 3 || !exited || cpu.Registers[9] != 0 {
+		t.Errorf("Syscall exit fail. actual %d %v s1 %d", code, exited, cpu.Registers[9])
+	}
+
+	if cpu.Termination() != TerminationExit {
+		t.Errorf("Syscall exit termination fail. actual %v", cpu.Termination())
+	}
+
+	// reading with no stdin is the end of the input, and running off the end
+	// exits with 0
+	cpu.SetStdin(nil)
+	cpu.LoadInstructions([]string{"li a0, 0", "li a1, 256", "li a2, 8", "li a7, 63", "ecall"})
+	cpu.RunProgram()
+	if code, exited := cpu.ExitCode(); !exited || code != 0 || cpu.Registers[10] != 0 || cpu.Termination() != TerminationEnd {
+		t.Errorf("Syscall end of input fail. actual %d %v", cpu.Registers[10], cpu.Termination())
+	}
+
+	// a buffer past the end of memory fails without taking any input, and a
+	// good one is stored as a word and a half
+	cpu.SetStdin(strings.NewReader("abcdef"))
+	cpu.LoadInstructions([]string{
+		"li a0, 0", "li a1, 1020", "li a2, 8", "li a7, 63", "ecall", "mv s0, a0",
+		"li a0, 0", "li a1, 512", "ecall",
+	})
+	cpu.RunProgram()
+	if cpu.Registers[8] != -14 || cpu.Registers[10] != 6 || string(cpu.Memory[512:518]) != "abcdef" || cpu.Memory[1020] != 0 {
+		t.Errorf("Syscall read fault fail. actual %d %d %q", cpu.Registers[8], cpu.Registers[10], cpu.Memory[512:518])
+	}
+	if ops := cpu.MemoryHistory(MemOpFilter{}); len(ops) < 2 || ops[0].Addr != 516 || ops[0].Size != 2 || ops[1].Addr != 512 || ops[1].Size != 4 {
+		t.Errorf("Syscall read history fail. actual %v", ops)
+	}
+}
+
+func TestTermination(t *testing.T) {
+	cases := []struct {
+		source      []string
+		termination Termination
+		code        int32
+	}{
+		{[]string{"li a0, 7", "li a7, 93", "ecall", "li a0, 1"}, TerminationExit, 7},
+		{[]string{".global main", "main:", "li a0, 6", "ret"}, TerminationReturn, 6},
+		{[]string{"li a0, 5"}, TerminationEnd, 0},
+	}
+	for _, c := range cases {
+		cpu := NewCPU(1024)
+		cpu.LoadInstructions(c.source)
+		if code, ended := cpu.ExitCode(); ended || code != 0 || cpu.Termination() != TerminationNone {
+			t.Errorf("Termination before run fail. actual %d %v %v", code, ended, cpu.Termination())
+		}
+		cpu.RunProgram()
+		if code, ended := cpu.ExitCode(); !ended || code != c.code || cpu.Termination() != c.termination || cpu.GetState().Stop != StopEnd {
+			t.Errorf("Termination %v fail. actual %d %v %v", c.termination, code, ended, cpu.Termination())
+		}
+
+		cpu.Restart()
+		if _, ended := cpu.ExitCode(); ended || cpu.Termination() != TerminationNone {
+			t.Errorf("Termination restart fail. actual %v", cpu.Termination())
+		}
+	}
+
+	// a trap without a handler stops the program without ending it
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions([]string{"li a0, 3", "lw a1, 1(zero)"})
+	cpu.RunProgram()
+	if code, ended := cpu.ExitCode(); ended || code != 0 || cpu.Termination() != TerminationNone || cpu.GetState().Stop != StopTrap {
+		t.Errorf("Termination trap fail. actual %d %v %v", code, ended, cpu.Termination())
+	}
+
+	names := map[fmt.Stringer]string{
+		TerminationNone:  "not ended",
+		TerminationExit:  "called exit",
+		Termination(-1):  "termination -1",
+		Termination(9):   "termination 9",
+		StopTrap:         "trap",
+		StopReason(-1):   "stop reason -1",
+		StopCanceled + 1: "stop reason 7",
+	}
+	for value, expected := range names {
+		if value.String() != expected {
+			t.Errorf("Termination name fail. actual %q expected %q", value.String(), expected)
+		}
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var memory, trace bytes.Buffer
+	lines := make(chan string, 8)
+	cpu := NewCPU(64)
+	if _, _, err := cpu.MapStandardDevices(); err != nil {
+		t.Fatal(err)
+	}
+	cpu.AttachSink(StreamMemory, &memory)
+	cpu.AttachSink(StreamTrace, &trace)
+	cpu.AttachSink(StreamConsole, ChannelSink(lines))
+
+	cpu.LoadInstructions([]string{
+		"li t0, 268435456",
+		"li t1, 10",
+		"sw t1, 32(zero) # not console output",
+		"li t1, 111",
+		"sb t1, 0(t0)",
+		"li t1, 10",
+		"sb t1, 0(t0)",
+	})
+	cpu.RunProgram()
+
+	if !bytes.HasPrefix(memory.Bytes(), []byte("Stored word (10) to address 32\n")) {
+		t.Errorf("Memory sink fail. actual %q", memory.String())
+	}
+
+	if !bytes.HasPrefix(trace.Bytes(), []byte("0x0010: li t0, 268435456\n0x0014: li t1, 10\n0x0018: sw t1, 32(zero)\n")) {
+		t.Errorf("Trace sink fail. actual %q", trace.String())
+	}
+
+	if len(lines) != 1 || <-lines != "o" {
+		t.Error("Channel sink fail")
+	}
+
+	cpu.DetachSink(StreamTrace, &trace)
+	trace.Reset()
+	cpu.RunProgram()
+	if trace.Len() != 0 {
+		t.Errorf("Detach sink fail. actual %q", trace.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	program := []string{
+		"li t0, 5",
+		"sw t0, 32(zero)",
+		"lw t1, 32(zero)",
+		"lw t2, 3(zero)",
+	}
+
+	var jsonTrace bytes.Buffer
+	cpu := NewCPU(64)
+	if err := cpu.EnableTrace(&jsonTrace, TraceJSON); err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadInstructions(program)
+	cpu.RunProgram()
+	if err := cpu.DisableTrace(); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []TraceEntry
+	for _, line := range bytes.Split(bytes.TrimSpace(jsonTrace.Bytes()), []byte("\n")) {
+		var entry TraceEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("Trace length fail. actual %d", len(entries))
+	}
+	if entries[0].PC != 16 || entries[0].Instruction != "li t0, 5" || len(entries[0].Registers) != 1 || entries[0].Registers[0] != (RegisterWrite{Register: 5, Value: 5}) {
+		t.Errorf("Trace register fail. actual %+v", entries[0])
+	}
+	if len(entries[1].Memory) != 1 || entries[1].Memory[0] != (MemoryEffect{Write: true, Address: 32, Size: 4, Value: 5}) {
+		t.Errorf("Trace store fail. actual %+v", entries[1])
+	}
+	if len(entries[2].Memory) != 1 || entries[2].Memory[0].Write || entries[2].Registers[0].Value != 5 {
+		t.Errorf("Trace load fail. actual %+v", entries[2])
+	}
+	if entries[3].Trap != ExcLoadMisaligned.String() || entries[3].Step != 3 {
+		t.Errorf("Trace trap fail. actual %+v", entries[3])
+	}
+
+	var csvTrace, spikeTrace bytes.Buffer
+	cpu = NewCPU(64)
+	cpu.EnableTrace(&csvTrace, TraceCSV)
+	cpu.LoadInstructions(program[:2])
+	cpu.RunProgram()
+	expected := "hart,step,pc,instruction,registers,memory,trap\n0,0,0x00000010,\"li t0, 5\",t0=5,,\n0,1,0x00000014,\"sw t0, 32(zero)\",,w4@0x00000020=5,\n"
+	if csvTrace.String() != expected {
+		t.Errorf("CSV trace fail. actual %q", csvTrace.String())
+	}
+
+	cpu.EnableTrace(&spikeTrace, TraceSpike)
+	cpu.Restart()
+	cpu.RunProgram()
+	expected = "core   0: 3 0x00000010 (li t0, 5) x5  0x00000005\ncore   0: 3 0x00000014 (sw t0, 32(zero)) mem 0x00000020 0x00000005\n"
+	if spikeTrace.String() != expected {
+		t.Errorf("Spike trace fail. actual %q", spikeTrace.String())
+	}
+
+	if _, err := ParseTraceFormat("xml"); err == nil {
+		t.Error("Unknown trace format should fail")
+	}
+}
+
+func TestRunBudget(t *testing.T) {
+	loop := []string{"loop:", "addi x1, x1, 1", "j loop"}
+
+	cpu := NewCPU(64)
+	cpu.SetStepBudget(100)
+	cpu.LoadInstructions(loop)
+	if steps := cpu.RunContext(context.Background()); steps != 100 {
+		t.Errorf("Step budget fail. actual %d", steps)
+	}
+	if state := cpu.GetState(); state.Stop != StopStepLimit || state.Registers[1] != 50 || state.Halted {
+		t.Errorf("Step budget state fail. actual %+v", state)
+	}
+
+	// the next run carries on from where the budget ran out
+	cpu.RunProgram()
+	if cpu.Registers[1] != 100 {
+		t.Errorf("Step budget resume fail. actual %d", cpu.Registers[1])
+	}
+
+	sandboxed, _ := NewSandboxedCPU(SafeSandbox, 64)
+	sandboxed.SetStepBudget(SafeSandbox.MaxSteps + 1)
+	if sandboxed.StepLimit() != SafeSandbox.MaxSteps {
+		t.Errorf("Sandbox step limit fail. actual %d", sandboxed.StepLimit())
+	}
+
+	cpu = NewCPU(64)
+	cpu.LoadInstructions(loop)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan uint64)
+	go func() { done <- cpu.RunContext(ctx) }()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancel fail. run did not stop")
+	}
+	if cpu.Err() != ErrCanceled || cpu.GetState().Stop != StopCanceled {
+		t.Errorf("Cancel state fail. actual %v", cpu.Err())
+	}
+
+	harts := []*CPU{}
+	for range 2 {
+		hart := NewCPU(1024)
+		harts = append(harts, &hart)
+	}
+	machine := NewMachine(harts, &RoundRobin{})
+	machine.StepBudget = 10
+	machine.LoadInstructions(loop)
+	if steps := machine.RunContext(context.Background()); steps != 10 || machine.Harts[machine.LastHart].Err() != ErrStepLimit {
+		t.Errorf("Machine step budget fail. actual %d", steps)
+	}
+}
+
+func TestImmediates(t *testing.T) {
+	cpu := NewCPU(128)
+	cpu.LoadInstructions([]string{
+		"lui a2, %hi(target)",
+		"addi a2, a2, %lo(target)",
+		"lui a3, %hi(0x12345fff)",
+		"addi a3, a3, %lo(0x12345fff)",
+		"sw a3, %lo(64)(zero)",
+		"lw a4, %lo(64)(zero)",
+		"li t3, -1",
+		"li t4, 0xffffffff",
+		"addi t5, zero, -2048",
+		"target:",
+	})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 0 {
+		t.Fatalf("Relocation assemble fail. actual %v", diagnostics)
+	}
+	cpu.RunProgram()
+
+	if cpu.Registers[12] != 52 || cpu.Registers[13] != 0x12345fff || cpu.Registers[14] != 0x12345fff {
+		t.Errorf("Relocation fail. actual %d %x %x", cpu.Registers[12], cpu.Registers[13], cpu.Registers[14])
+	}
+
+	if cpu.Registers[28] != -1 || cpu.Registers[29] != -1 || cpu.Registers[30] != -2048 {
+		t.Errorf("Immediate parse fail. actual %d %d %d", cpu.Registers[28], cpu.Registers[29], cpu.Registers[30])
+	}
+
+	invalid := map[string]string{
+		"addi a0, zero, 2048":       "immediate 2048 out of range for addi, expected -2048 to 2047",
+		"slli a0, a0, 32":           "immediate 32 out of range for slli, expected 0 to 31",
+		"lui a0, 0x100000":          "immediate 0x100000 out of range for lui, expected 0 to 1048575",
+		"lw a0, 4096(sp)":           "immediate 4096 out of range for lw, expected -2048 to 2047",
+		"beq a0, a1, 3":             "offset 3 for beq must be even",
+		"lui a0, %lo(target)":       "%lo is not allowed in lui",
+		"addi a0, a0, %lo(missing)": "undefined symbol: missing",
+	}
+	for line, message := range invalid {
+		cpu := NewCPU(64)
+		cpu.LoadInstructions([]string{line})
+		if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Message != message {
+			t.Errorf("Immediate range fail for %q. actual %v", line, diagnostics)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	cpu := NewCPU(256)
+	cpu.LoadInstructions([]string{
+		"start: li t0, 3 # a label can share a line with an instruction",
+		"1: addi t1, t1, 1",
+		"addi t0, t0, -1",
+		"bnez t0, 1b",
+		"j 1f",
+		"li t2, 99",
+		"1:",
+		"li t5, 42",
+		"sw t5, %lo(table+4)(zero)",
+		"lui a1, %hi(table+4)",
+		"lw a0, %lo(table+4)(a1)",
+		"lw a2, table+4",
+		"beq zero, zero, skip+4",
+		"skip: li t3, 1",
+		"li t4, 2",
+		"table:",
+	})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 0 {
+		t.Fatalf("Label assemble fail. actual %v", diagnostics)
+	}
+	cpu.RunProgram()
+
+	if cpu.Labels["start"] != 16 || cpu.Labels["skip"] != 64 {
+		t.Errorf("Label address fail. actual %d %d", cpu.Labels["start"], cpu.Labels["skip"])
+	}
+
+	if cpu.Registers[6] != 3 || cpu.Registers[7] != 0 {
+		t.Errorf("Local label fail. actual %d %d", cpu.Registers[6], cpu.Registers[7])
+	}
+
+	if cpu.Registers[10] != 42 || cpu.Registers[12] != 42 {
+		t.Errorf("Label offset load fail. actual %d %d", cpu.Registers[10], cpu.Registers[12])
+	}
+
+	if cpu.Registers[28] != 0 || cpu.Registers[29] != 2 {
+		t.Errorf("Label offset branch fail. actual %d %d", cpu.Registers[28], cpu.Registers[29])
+	}
+
+	if stats := cpu.Stats(); stats.Instructions != 14 {
+		t.Errorf("Label line stats fail. actual %d", stats.Instructions)
+	}
+
+	invalid := map[string]string{
+		"bnez t0, 2b": "undefined local label: 2",
+		"j nowhere":   "undefined symbol: nowhere",
+	}
+	for line, message := range invalid {
+		cpu := NewCPU(64)
+		cpu.LoadInstructions([]string{line})
+		if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Message != message {
+			t.Errorf("Undefined label fail for %q. actual %v", line, diagnostics)
+		}
+	}
+}
+
+func TestRegisterHistory(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.KeepRegisterHistory(2)
+	cpu.LoadInstructions([]string{"li t0, 1", "addi t0, t0, 1", "addi t0, t0, 1"})
+	cpu.RunProgram()
+
+	history := cpu.RegisterHistory(5)
+	if len(history) != 2 || history[0] != (RegisterChange{PC: 24, Instruction: "addi t0, t0, 1", Old: 2, New: 3}) || history[1].PC != 20 {
+		t.Errorf("Register history fail. actual %+v", history)
+	}
+
+	var hooked []int
+	cpu.OnRegisterWrite(func(register int, old, new int32) { hooked = append(hooked, register) })
+	cpu.AddWatch("t1")
+	if err := cpu.SetRegister(6, 7); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers[6] != 7 || len(hooked) != 1 || len(cpu.WatchHits()) != 0 {
+		t.Errorf("SetRegister fail. actual %d %v %v", cpu.Registers[6], hooked, cpu.WatchHits())
+	}
+	if history := cpu.RegisterHistory(6); len(history) != 1 || history[0].Instruction != "" {
+		t.Errorf("SetRegister history fail. actual %+v", history)
+	}
+
+	cpu.SetRegister(0, 5)
+	if cpu.Registers[0] != 0 {
+		t.Error("SetRegister x0 fail")
+	}
+	if err := cpu.SetRegister(32, 1); err == nil {
+		t.Error("SetRegister should reject x32")
+	}
+	if err := cpu.WriteRegister(-1, 1); err == nil {
+		t.Error("WriteRegister should reject x-1")
+	}
+	if err := cpu.WriteRegister(32, 1); err == nil {
+		t.Error("WriteRegister should reject x32")
+	}
+}
+
+func TestDisplayFormats(t *testing.T) {
+	expected := map[format.Mode]string{
+		format.Decimal:  "-5",
+		format.Hex:      "0xfffffffb",
+		format.Binary:   "0b11111111111111111111111111111011",
+		format.Unsigned: "4294967291",
+	}
+	for mode, text := range expected {
+		if actual := format.Word(-5, mode); actual != text {
+			t.Errorf("Word %s fail. actual %s", mode, actual)
+		}
+		if parsed, err := format.ParseMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("ParseMode %s fail. actual %v %v", mode, parsed, err)
+		}
+	}
+	if format.Unsigned.Next() != format.Decimal {
+		t.Error("Next should wrap to decimal")
+	}
+
+	cpu := NewCPU(64)
+	binary.LittleEndian.PutUint32(cpu.Memory[0:], 0xfffffffb)
+	cpu.Memory[4] = 0x80
+
+	lines, err := cpu.Dump(0, 5, format.Decimal)
+	if err != nil || len(lines) != 1 || lines[0] != "0x0000:          -5 -128" {
+		t.Errorf("Dump decimal fail. actual %q %v", lines, err)
+	}
+	lines, _ = cpu.Dump(0, 8, format.Binary)
+	if len(lines) != 2 || lines[1] != "0x0004: 00000000000000000000000010000000" {
+		t.Errorf("Dump binary fail. actual %q", lines)
+	}
+	if hex, _ := cpu.HexDump(0, 8); hex[0] != "0x0000: fffffffb 00000080" {
+		t.Errorf("HexDump fail. actual %q", hex)
+	}
+}
+
+func TestRegisterInstruction(t *testing.T) {
+	// rd = rs1*3 + rs2
+	err := RegisterInstruction("madd3", RegisterOperands, func(cpu *CPU, operands Operands) {
+		cpu.WriteResult(operands.Rd, cpu.Registers[operands.Rs1]*3+cpu.Registers[operands.Rs2])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// skips the next instruction when rs1 is odd
+	err = RegisterInstruction("skipodd", ImmediateOperands, func(cpu *CPU, operands Operands) {
+		if cpu.Registers[operands.Rs1]&1 != 0 {
+			cpu.PC += 8
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterInstruction("madd3", RegisterOperands, func(*CPU, Operands) {}); err == nil {
+		t.Error("RegisterInstruction should reject a duplicate")
+	}
+	if err := RegisterInstruction("add", NoOperands, func(*CPU, Operands) {}); err == nil {
+		t.Error("RegisterInstruction should reject a built in mnemonic")
+	}
+
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{
+		"li a0, 5",
+		"li a1, 2",
+		"madd3 a2, a0, a1",
+		"skipodd zero, a0, 0",
+		"li a3, 1",
+		"li a4, 1",
+	})
+	cpu.RunProgram()
+	if cpu.Registers[12] != 17 || cpu.Registers[13] != 0 || cpu.Registers[14] != 1 {
+		t.Errorf("Custom instruction fail. actual %d %d %d", cpu.Registers[12], cpu.Registers[13], cpu.Registers[14])
+	}
+
+	cpu = NewCPU(64)
+	cpu.LoadInstructions([]string{"madd3 a2, a0", "skipodd a0, a1, 5000"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 2 {
+		t.Errorf("Custom instruction diagnostics fail. actual %v", diagnostics)
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	cpu := NewCPU(256)
+	cpu.LoadInstructions([]string{
+		"c.li a0, 5",
+		"addi a1, zero, 2",
+		"c.add a0, a1",
+		"loop:",
+		"c.addi a1, -1",
+		"c.bnez a1, loop",
+		"c.jal f",
+		"c.sw a0, 4(s0)",
+		"c.j end",
+		"f: c.jr ra",
+		"end:",
+	})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 0 {
+		t.Fatalf("Compressed diagnostics fail. actual %v", diagnostics)
+	}
+	if address := cpu.Labels["f"]; address != 0x22 {
+		t.Errorf("Compressed label fail. actual 0x%x", address)
+	}
+
+	cpu.KeepRegisterHistory(1)
+	cpu.RunProgram()
+	if cpu.Registers[10] != 7 || cpu.Registers[11] != 0 || binary.LittleEndian.Uint32(cpu.Memory[4:]) != 7 {
+		t.Errorf("Compressed run fail. actual %d %d", cpu.Registers[10], cpu.Registers[11])
+	}
+	// c.jal at 0x1c links to the next 2 byte instruction
+	if history := cpu.RegisterHistory(1); len(history) != 1 || history[0].New != 0x1e {
+		t.Errorf("Compressed link fail. actual %+v", history)
+	}
+
+	listing := cpu.Listing()
+	if len(listing) != 9 || listing[1] != (ListingEntry{Address: 0x12, Size: 4, Line: 2, Source: "addi a1, zero, 2"}) || listing[2].Address != 0x16 {
+		t.Errorf("Listing fail. actual %+v", listing)
+	}
+	if stats := cpu.Stats(); stats.CodeBytes != 20 {
+		t.Errorf("Compressed code size fail. actual %d", stats.CodeBytes)
+	}
+
+	cpu = NewCPU(256)
+	cpu.LoadInstructions([]string{"c.lw t0, 0(a0)", "c.addi16sp sp, 24", "c.li a0, 32", "c.jr zero"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 4 {
+		t.Errorf("Compressed limits fail. actual %v", diagnostics)
+	}
+
+	// landing in the middle of a 4 byte instruction
+	cpu = NewCPU(256)
+	cpu.LoadInstructions([]string{"c.j 6", "c.nop", "addi a0, zero, 1", "addi a0, zero, 2"})
+	cpu.RunProgram()
+	if trap, ok := cpu.Err().(*Trap); !ok || trap.Cause != ExcIllegalInstruction || trap.PC != 0x16 {
+		t.Errorf("Compressed misaligned fail. actual %v", cpu.Err())
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li a0, 1", "addi a0, a0, 1", "addi a0, a0, 1"})
+	if err := cpu.SetBreakpoint(18); err == nil {
+		t.Error("SetBreakpoint should reject an address without an instruction")
+	}
+	cpu.SetBreakpoint(16)
+	cpu.SetBreakpoint(20)
+
+	// stops before the first instruction, then before the second
+	if steps := cpu.RunContext(context.Background()); steps != 0 || !cpu.PausedAtBreakpoint() || cpu.GetState().Stop != StopBreakpoint {
+		t.Errorf("Breakpoint at start fail. actual %d %v", steps, cpu.GetState().Stop)
+	}
+	if steps := cpu.RunContext(context.Background()); steps != 1 || cpu.PC != 20 || cpu.Registers[10] != 1 {
+		t.Errorf("Breakpoint fail. actual %d %d %d", steps, cpu.PC, cpu.Registers[10])
+	}
+
+	cpu.ClearBreakpoint(16)
+	cpu.RunProgram()
+	if cpu.Registers[10] != 3 || cpu.PausedAtBreakpoint() || len(cpu.Breakpoints()) != 1 {
+		t.Errorf("Continue past breakpoint fail. actual %d %v", cpu.Registers[10], cpu.Breakpoints())
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	cpu := NewCPU(64)
+	cpu.LoadInstructions([]string{"li a0, 0", "li a1, 3", "loop:", "addi a0, a0, 1", "addi a1, a1, -1", "bnez a1, loop"})
+	if _, err := cpu.RunUntil(18); err == nil {
+		t.Error("RunUntil should reject an address without an instruction")
+	}
+
+	if steps, _ := cpu.RunUntil(24); steps != 2 || cpu.PC != 24 || !cpu.PausedAtBreakpoint() {
+		t.Errorf("RunUntil fail. actual %d %d", steps, cpu.PC)
+	}
+	// from the address itself it goes round the loop
+	if steps, _ := cpu.RunUntil(24); steps != 3 || cpu.Registers[10] != 1 {
+		t.Errorf("RunUntil again fail. actual %d %d", steps, cpu.Registers[10])
+	}
+	if len(cpu.Breakpoints()) != 0 {
+		t.Errorf("RunUntil breakpoint left fail. actual %v", cpu.Breakpoints())
+	}
+
+	// a breakpoint on the way still stops it
+	cpu.SetBreakpoint(28)
+	if cpu.RunUntil(32); cpu.PC != 28 {
+		t.Errorf("RunUntil breakpoint fail. actual %d", cpu.PC)
+	}
+	cpu.ClearBreakpoint(28)
+	cpu.RunProgram()
+	if cpu.Registers[10] != 3 {
+		t.Errorf("Run after RunUntil fail. actual %d", cpu.Registers[10])
+	}
+}
+
+func TestEntryPoint(t *testing.T) {
+	program := []string{
+		".globl start",
+		"double:",
+		"add a0, a0, a0",
+		"ret",
+		"start:",
+		"li a0, 3",
+		"mv s0, ra",
+		"call double",
+		"mv ra, s0",
+		"ret",
+		"li a0, -1",
+	}
+
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions(program)
+	if cpu.PC != 24 || cpu.EntryAddress() != 24 {
+		t.Errorf("Entry point fail. actual %d", cpu.PC)
+	}
+
+	// ret from the entry function ends the program before the li, and a0 is
+	// its exit code
+	cpu.RunProgram()
+	if cpu.Registers[10] != 6 || cpu.PC != exitAddress || cpu.Err() != nil || cpu.Termination() != TerminationReturn {
+		t.Errorf("Return from entry fail. actual %d %d %v %v", cpu.Registers[10], cpu.PC, cpu.Err(), cpu.Termination())
+	}
+	if code, ended := cpu.ExitCode(); code != 6 || !ended {
+		t.Errorf("Return exit code fail. actual %d %v", code, ended)
+	}
+
+	// the program stays ended until it is restarted
+	cpu.SetRegister(10, 0)
+	cpu.LoadInstructions(program)
+	if steps := cpu.RunContext(context.Background()); steps != 0 || cpu.Registers[10] != 0 || cpu.GetState().Stop != StopEnd {
+		t.Errorf("Ended rerun fail. actual %d steps, a0 %d", steps, cpu.Registers[10])
+	}
+
+	// a second run gets the exit address back in ra
+	cpu.SetRegister(1, 20)
+	cpu.Restart()
+	if _, ended := cpu.ExitCode(); ended || cpu.PC != 24 {
+		t.Errorf("Restart fail. actual %v %d", ended, cpu.PC)
+	}
+	cpu.RunProgram()
+	if cpu.Registers[10] != 6 {
+		t.Errorf("Rerun fail. actual %d", cpu.Registers[10])
+	}
+
+	// main without a .global, and the first instruction without either
+	cpu = NewCPU(1024)
+	cpu.LoadInstructions([]string{"li a0, 1", "main:", "li a1, 2"})
+	if cpu.PC != 20 {
+		t.Errorf("main entry fail. actual %d", cpu.PC)
+	}
+	cpu = NewCPU(1024)
+	cpu.LoadInstructions([]string{".global missing", "li a0, 1"})
+	if cpu.PC != 16 {
+		t.Errorf("Fallback entry fail. actual %d", cpu.PC)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	cpu := NewCPU(1024)
+	if err := cpu.SetArgs([]string{"prog", "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	program := []string{
+		"main:",
+		"lw t0, 4(a1)",
+		"lb t1, 1(t0)",
+		"lw t2, 8(a1)",
+		"ret",
+	}
+	cpu.LoadInstructions(program)
+	cpu.RunProgram()
+
+	if cpu.Registers[10] != 2 || cpu.Registers[6] != 'i' || cpu.Registers[7] != 0 {
+		t.Errorf("Args fail. actual argc %d, argv[1][1] %d, argv[2] %d", cpu.Registers[10], cpu.Registers[6], cpu.Registers[7])
+	}
+	if sp := cpu.Registers[2]; sp%16 != 0 || sp > cpu.Registers[11] {
+		t.Errorf("Args stack fail. actual sp %d, argv %d", sp, cpu.Registers[11])
+	}
+
+	// the next run lays the arguments out in the same place
+	sp := cpu.Registers[2]
+	cpu.SetRegister(10, 0)
+	cpu.Restart()
+	cpu.RunProgram()
+	if cpu.Registers[10] != 2 || cpu.Registers[2] != sp {
+		t.Errorf("Args rerun fail. actual argc %d, sp %d", cpu.Registers[10], cpu.Registers[2])
+	}
+
+	small := NewCPU(64)
+	if err := small.SetArgs([]string{"a long argument that can't fit in 64 bytes of stack"}); err == nil {
+		t.Error("SetArgs should reject arguments that don't fit on the stack")
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions([]string{
+		"li a0, 1",
+		"li t0, 3",
+		"loop:",
+		"slli a0, a0, 1",
+		"addi t0, t0, -1",
+		"bnez t0, loop",
+		"done:",
+		"sw a0, 0x100(zero)",
+		".assert a0 == 8",
+		".assert *0x100 >= 8",
+		".assert t0 == 0 at done",
+		".assert t0 > 0 at loop",
+		".assert a0 != 8",
+		".assert a0 ==",
+	})
+	if err := cpu.AddAssertion("a1 == 5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.AddAssertion("a1 5"); err == nil {
+		t.Error("AddAssertion should reject an assertion without an operator")
+	}
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Line != 14 {
+		t.Errorf("Assertion diagnostics fail. actual %v", diagnostics)
+	}
+
+	cpu.RunProgram()
+	var actual []string
+	for _, result := range cpu.AssertionResults() {
+		actual = append(actual, result.String())
+	}
+	expected := []string{
+		"a1 == 5: FAIL (a1 is 0)",
+		"line 9: a0 == 8: PASS",
+		"line 10: *0x100 >= 8: PASS",
+		"line 11: t0 == 0 at done: PASS",
+		"line 12: t0 > 0 at loop: PASS",
+		"line 13: a0 != 8: FAIL (a0 is 8)",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("Assertions fail. actual %q", actual)
+	}
+	if results := cpu.AssertionResults(); results[4].Checks != 3 {
+		t.Errorf("Checkpoint count fail. actual %d", results[4].Checks)
+	}
+}
+
+func TestSignExtension(t *testing.T) {
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions([]string{
+		"li t0, -32768",
+		"sh t0, 0x100(zero)",
+		"lh a0, 0x100(zero)",
+		"lhu a1, 0x100(zero)",
+		"lb a2, 0x101(zero)",
+		"lbu a3, 0x101(zero)",
+		"li t1, 36",
+		"li t2, 1",
+		"sll a4, t2, t1",
+		"sra a5, t0, t1",
+	})
+	cpu.RunProgram()
+
+	expected := []int32{-32768, 32768, -128, 128, 16, -2048}
+	if actual := cpu.Registers[10:16]; !slices.Equal(actual, expected) {
+		t.Errorf("Sign extension fail. actual %v", actual)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	cpu := NewCPU(1024)
+	cpu.SetStrict(true)
+	cpu.LoadInstructions([]string{
+		"main:",
+		"add a0, a0, t3",
+		"li t0, 5",
+		"sw t0, 0x200(zero)",
+		"lw a1, 0x200(zero)",
+		"lw a2, 0x204(zero)",
+		"sw t0, 16(zero)",
+		"add a3, t0, t0",
+	})
+	cpu.RunProgram()
+
+	var actual []string
+	for _, warning := range cpu.StrictWarnings() {
+		actual = append(actual, warning.String())
+	}
+	expected := []string{
+		"line 2: reads a0 before anything is written to it, registers don't start at 0 on hardware",
+		"line 2: reads t3 before anything is written to it, registers don't start at 0 on hardware",
+		"line 6: loads from 0x0204 before anything is stored there, memory doesn't start at 0 on hardware",
+		"line 7: accesses 0x0010 inside the program's code, which isn't kept in memory here",
+		"line 8: runs off the end of the program, hardware would carry on into whatever follows. Return from the entry function instead",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("Strict fail. actual %q", actual)
+	}
+
+	// the next run starts over, so registers from the last one don't count
+	cpu.RunProgram()
+	if warnings := cpu.StrictWarnings(); len(warnings) != 5 {
+		t.Errorf("Strict rerun fail. actual %v", warnings)
+	}
+
+	cpu.SetStrict(false)
+	cpu.RunProgram()
+	if cpu.Strict() || cpu.StrictWarnings() != nil {
+		t.Error("SetStrict(false) should stop warning")
+	}
+}
+
+func TestLoadUnchanged(t *testing.T) {
+	cpu := NewCPU(1024)
+	program := []string{"li t0, 300", "loop:", "sw t0, 0x100(zero)", "addi t0, t0, -1", "bnez t0, loop"}
+	cpu.LoadInstructions(program)
+	cpu.RunNextInstruction()
+
+	// loading the same source again keeps the decoded program and the pc
+	decoded := cpu.program[1]
+	cpu.LoadInstructions(slices.Clone(program))
+	if cpu.program[1] != decoded || cpu.PC != 20 {
+		t.Errorf("Reload fail. actual pc %d", cpu.PC)
+	}
+
+	program[2] = "sw t0, 0x104(zero)"
+	cpu.LoadInstructions(program)
+	if cpu.program[1] == decoded {
+		t.Error("Changed source should be re-decoded")
+	}
+
+	cpu.SetMemoryHistoryDepth(100)
+	cpu.RunProgram()
+	if history := cpu.MemoryHistory(MemOpFilter{}); len(history) != 100 || cpu.DescribeMemOp(history[0]) != "Stored word (1) to address 260" {
+		t.Errorf("Memory history fail. actual %v", history)
+	}
+}
+
+func TestMemoryMap(t *testing.T) {
+	cpu := NewCPU(4096)
+	if err := cpu.SetMemoryMap(MemoryMap{TextBase: 0x100, DataBase: 0x80, HeapBase: 0x800, StackTop: 4096, StackSize: 1024}); err == nil {
+		t.Error("SetMemoryMap should reject data below the text")
+	}
+	if err := cpu.SetMemoryMap(DefaultMemoryMap(4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	cpu.LoadInstructions([]string{
+		"main:",
+		"li a7, 214",
+		"li a0, 0",
+		"ecall",
+		"mv s0, a0",
+		"addi a0, a0, 16",
+		"ecall",
+		"li t0, 7",
+		"sw t0, 0(s0)",
+		"sw t0, 0x400(zero)",
+		"sw t0, -4(sp)",
+		"li a0, 0x1000",
+		"ecall",
+		"lw t1, 16(s0)",
+	})
+	if cpu.Labels["main"] != 0x100 || cpu.PC != 0x100 || cpu.Registers[2] != 4096 {
+		t.Fatalf("MemoryMap layout fail. actual main %d pc %d sp %d", cpu.Labels["main"], cpu.PC, cpu.Registers[2])
+	}
+
+	cpu.RunProgram()
+	trap, ok := cpu.Err().(*Trap)
+	if !ok || trap.Cause != ExcLoadAccessFault || trap.Value != 0x810 {
+		t.Fatalf("MemoryMap fault fail. actual %v", cpu.Err())
+	}
+	// a break past the guard is refused
+	if cpu.Registers[8] != 0x800 || cpu.Registers[10] != 0x810 || cpu.Memory[0x800] != 7 || cpu.Memory[0x400] != 7 {
+		t.Errorf("MemoryMap brk fail. actual s0 %d a0 %d", cpu.Registers[8], cpu.Registers[10])
+	}
+	if heap := cpu.MemoryRegions()[2]; heap.Name != "heap" || heap.Start != 0x800 || heap.End != 0x810 {
+		t.Errorf("MemoryMap regions fail. actual %v", cpu.MemoryRegions())
+	}
+
+	cpu.Restart()
+	if start, end, err := cpu.ResolveRange("heap"); err == nil {
+		t.Errorf("Restart should empty the heap. actual %d-%d", start, end)
+	}
+
+	if _, err := ParseMemoryMap("text=0x200,stack=0x100", 4096); err == nil {
+		t.Error("ParseMemoryMap should reject a stack below the heap")
+	}
+
+	first, second := NewCPU(4096), NewCPU(4096)
+	machine := NewMachine([]*CPU{&first, &second}, &RoundRobin{})
+	if err := machine.SetMemoryMap(DefaultMemoryMap(4096)); err == nil {
+		t.Error("Machine.SetMemoryMap should need room for every hart's stack")
+	}
+	layout := DefaultMemoryMap(4096)
+	layout.StackSize = 0x600
+	if err := machine.SetMemoryMap(layout); err != nil || second.Registers[2] != 4096-hartStackSize {
+		t.Errorf("Machine.SetMemoryMap fail. actual %v sp %d", err, second.Registers[2])
+	}
+}
+
+func TestRandomInit(t *testing.T) {
+	plain := NewCPUWithOptions(Options{})
+	if plain.MemorySize != DefaultMemorySize || slices.ContainsFunc(plain.Memory, func(b byte) bool { return b != 0 }) {
+		t.Error("Options{} should give zeroed memory")
+	}
+	if _, ok := plain.RandomSeed(); ok {
+		t.Error("Options{} should not be random")
+	}
+
+	first := NewCPUWithOptions(Options{MemorySize: 256, RandomInit: true, Seed: 42})
+	second := NewCPUWithOptions(Options{MemorySize: 256, RandomInit: true, Seed: 42})
+	if first.Registers != second.Registers || !slices.Equal(first.Memory, second.Memory) {
+		t.Error("RandomInit with the same seed should give the same state")
+	}
+	if first.Registers[0] != 0 || first.Registers[2] != 256 || first.Registers[10] == 0 {
+		t.Errorf("RandomInit registers fail. actual %v", first.Registers)
+	}
+	if seed, ok := first.RandomSeed(); !ok || seed != 42 {
+		t.Errorf("RandomSeed fail. actual %d %v", seed, ok)
+	}
+
+	picked := NewCPUWithOptions(Options{RandomInit: true})
+	if seed, ok := picked.RandomSeed(); !ok || seed == 0 {
+		t.Errorf("RandomInit should pick a seed. actual %d", seed)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	program := []string{"li t0, 0x12345678", "sw t0, 32(zero)", "lbu a0, 32(zero)", "lhu a1, 32(zero)", "lw a2, 32(zero)"}
+
+	little := NewCPUWithOptions(Options{MemorySize: 64})
+	little.LoadInstructions(program)
+	little.RunProgram()
+	if little.Memory[32] != 0x78 || little.Registers[10] != 0x78 || little.Registers[11] != 0x5678 {
+		t.Errorf("Little endian fail. actual %x %x", little.Memory[32:36], little.Registers[10:12])
+	}
+
+	big := NewCPUWithOptions(Options{MemorySize: 64, BigEndian: true})
+	big.LoadInstructions(program)
+	big.RunProgram()
+	if big.Memory[32] != 0x12 || big.Registers[10] != 0x12 || big.Registers[11] != 0x1234 || big.Registers[12] != 0x12345678 {
+		t.Errorf("Big endian fail. actual %x %x", big.Memory[32:36], big.Registers[10:13])
+	}
+	if big.ByteOrder() != binary.BigEndian {
+		t.Error("ByteOrder should be big endian")
+	}
+
+	if err := big.WriteMemory(40, []byte{0, 0, 0, 7}); err != nil || big.ByteOrder().Uint32(big.Memory[40:]) != 7 {
+		t.Errorf("Big endian WriteMemory fail. actual %v", err)
+	}
+}
+
+func TestAllowMisaligned(t *testing.T) {
+	program := []string{"li t0, 0x12345678", "sw t0, 33(zero)", "lw a0, 33(zero)", "lh a1, 35(zero)"}
+
+	strict := NewCPUWithOptions(Options{MemorySize: 64})
+	strict.LoadInstructions(program)
+	strict.RunProgram()
+	if trap, ok := strict.Err().(*Trap); !ok || trap.Cause != ExcStoreMisaligned || trap.Value != 33 {
+		t.Errorf("Misaligned store should fault by default. actual %v", strict.Err())
+	}
+
+	cpu := NewCPUWithOptions(Options{MemorySize: 64, AllowMisaligned: true})
+	cpu.LoadInstructions(program)
+	cpu.RunProgram()
+	if cpu.Err() != nil || cpu.Registers[10] != 0x12345678 || cpu.Registers[11] != 0x1234 {
+		t.Errorf("Misaligned access fail. actual %v %x", cpu.Err(), cpu.Registers[10:12])
+	}
+
+	atomic := NewCPUWithOptions(Options{MemorySize: 64, AllowMisaligned: true})
+	atomic.LoadInstructions([]string{"li a0, 34", "amoadd.w a1, zero, (a0)"})
+	atomic.RunProgram()
+	if trap, ok := atomic.Err().(*Trap); !ok || trap.Cause != ExcStoreMisaligned || trap.Value != 34 {
+		t.Errorf("Misaligned amo should still fault. actual %v", atomic.Err())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	program := []string{
+		"li a0, 3",
+		"loop:",
+		"addi a0, a0, -1",
+		"bnez a0, loop",
+		"beqz a0, done",
+		"li a1, 1",
+		"done:",
+		"li a2, 2",
+	}
+	cpu := NewCPU(256)
+	cpu.LoadInstructions(program)
+	if coverage := cpu.Coverage(); coverage.Instructions != 6 || coverage.Executed != 0 {
+		t.Errorf("Coverage before a run fail. actual %d of %d", coverage.Executed, coverage.Instructions)
+	}
+
+	cpu.RunProgram()
+	coverage := cpu.Coverage()
+	if coverage.Executed != 5 || coverage.Branches != 2 || coverage.BothWays != 1 {
+		t.Errorf("Coverage fail. actual %+v", coverage)
+	}
+	if loop := coverage.Covered[2]; loop.Count != 3 || loop.Taken != 2 || loop.NotTaken != 1 {
+		t.Errorf("Branch coverage fail. actual %+v", loop)
+	}
+
+	gaps := coverage.Gaps()
+	if len(gaps) != 2 || gaps[0].String() != "0x001c line 5: beqz a0, done, always taken" || gaps[1].Line != 6 {
+		t.Errorf("Coverage gaps fail. actual %v", gaps)
+	}
+	if lines := coverage.Lines(); !lines[3] || lines[6] || len(lines) != 6 {
+		t.Errorf("Coverage lines fail. actual %v", lines)
+	}
+
+	// runs add up until the program changes
+	cpu.Restart()
+	cpu.RunProgram()
+	if count := cpu.Coverage().Covered[0].Count; count != 2 {
+		t.Errorf("Coverage across runs fail. actual %d", count)
+	}
+
+	merged := MergeCoverage(cpu.Coverage(), cpu.Coverage())
+	if merged.Covered[0].Count != 4 || merged.Instructions != 6 || merged.Executed != 5 {
+		t.Errorf("MergeCoverage fail. actual %+v", merged)
+	}
+
+	var buffer bytes.Buffer
+	if err := merged.WriteJSON(&buffer); err != nil || !strings.Contains(buffer.String(), `"Executed": 5`) {
+		t.Errorf("Coverage JSON fail. actual %v %s", err, buffer.String())
+	}
+
+	cpu.ClearCoverage()
+	if cpu.Coverage().Executed != 0 {
+		t.Error("ClearCoverage fail")
+	}
+
+	cpu.RunProgram()
+	cpu.LoadInstructions(append(program, "li a3, 3"))
+	if coverage := cpu.Coverage(); coverage.Executed != 0 || coverage.Instructions != 7 {
+		t.Errorf("Coverage of a new program fail. actual %d of %d", coverage.Executed, coverage.Instructions)
+	}
+
+	// an instruction that traps still ran
+	cpu.LoadInstructions([]string{"li a0, 1", "lw a1, 1(zero)", "li a2, 2"})
+	cpu.RunProgram()
+	if coverage := cpu.Coverage(); coverage.Executed != 2 || coverage.Covered[1].Count != 1 || cpu.Err() == nil {
+		t.Errorf("Coverage of traps fail. actual %+v", coverage)
+	}
+}
+
+func TestDataSection(t *testing.T) {
+	cpu := NewCPU(256)
+	cpu.LoadInstructions([]string{
+		".data",
+		"counter: .word 5",
+		"table: .word 1, 2, 3, counter",
+		`msg: .string "hi # there"`,
+		"buf: .space 3, 0xff",
+		".align 2",
+		"half: .half -1",
+		".text",
+		"lw a0, counter",
+		"lw a1, table+4",
+		"addi a0, a0, 1",
+		"lui t0, %hi(counter)",
+		"sw a0, %lo(counter)(t0)",
+	})
+	if len(cpu.Diagnostics()) != 0 {
+		t.Fatalf("Data section diagnostics fail. actual %v", cpu.Diagnostics())
+	}
+
+	// the data goes after the five instructions at 16
+	if cpu.Labels["counter"] != 36 || cpu.Labels["table"] != 40 || cpu.Labels["msg"] != 56 || cpu.Labels["half"] != 72 {
+		t.Errorf("Data labels fail. actual %v", cpu.Labels)
+	}
+	if binary.LittleEndian.Uint32(cpu.Memory[52:]) != 36 || string(cpu.Memory[56:67]) != "hi # there\x00" || cpu.Memory[69] != 0xff {
+		t.Errorf("Data values fail. actual %v", cpu.Memory[36:74])
+	}
+	if binary.LittleEndian.Uint16(cpu.Memory[72:]) != 0xffff {
+		t.Errorf("Data alignment fail. actual %v", cpu.Memory[70:74])
+	}
+
+	var described []string
+	for _, symbol := range cpu.DataSymbols() {
+		described = append(described, symbol.Describe())
+	}
+	expected := []string{"counter: word", "table: 4 words", "msg: string (11 bytes)", "buf: space (5 bytes)", "half: half"}
+	if !slices.Equal(described, expected) {
+		t.Errorf("Data symbols fail. actual %v", described)
+	}
+	if symbol, ok := cpu.SymbolAt(47); !ok || symbol.Name != "table" {
+		t.Errorf("SymbolAt fail. actual %v %v", symbol, ok)
+	}
+	if _, ok := cpu.SymbolAt(74); ok {
+		t.Error("SymbolAt past the data should fail")
+	}
+	if start, end, err := cpu.ResolveRange("table"); err != nil || start != 40 || end != 56 {
+		t.Errorf("Data label range fail. actual %d-%d %v", start, end, err)
+	}
+
+	cpu.RunProgram()
+	if cpu.Registers[10] != 6 || cpu.Registers[11] != 2 || binary.LittleEndian.Uint32(cpu.Memory[36:]) != 6 {
+		t.Errorf("Data access fail. actual %d %d", cpu.Registers[10], cpu.Registers[11])
+	}
+
+	history := cpu.MemoryHistory(MemOpFilter{})
+	if history[0].Symbol != "counter" || cpu.DescribeMemOp(history[0]) != "Stored word (6) to counter (address 36)" {
+		t.Errorf("Data store description fail. actual %q", cpu.DescribeMemOp(history[0]))
+	}
+	if history[1].Symbol != "table+4" {
+		t.Errorf("Data load symbol fail. actual %q", history[1].Symbol)
+	}
+
+	lines, _ := cpu.Dump(32, 48, format.Hex)
+	if !strings.HasSuffix(lines[0], "  # counter: word, table: 4 words") {
+		t.Errorf("Data dump fail. actual %q", lines[0])
+	}
+
+	// a rerun starts from the initial values
+	cpu.Restart()
+	if binary.LittleEndian.Uint32(cpu.Memory[36:]) != 5 {
+		t.Errorf("Data restart fail. actual %d", binary.LittleEndian.Uint32(cpu.Memory[36:]))
+	}
+
+	cpu.LoadInstructions([]string{".data", "addi a0, a0, 1", ".byte 300", ".word missing"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 3 || diagnostics[0].Line != 2 || diagnostics[1].Line != 3 {
+		t.Errorf("Data diagnostics fail. actual %v", diagnostics)
+	}
+
+	// sizes past memory are rejected before anything is allocated for them
+	for _, size := range []string{"0xFFFFFFF0", "0x10000000", "0x101"} {
+		cpu.LoadInstructions([]string{".data", "a: .space " + size, "b: .word 5"})
+		diagnostics := cpu.Diagnostics()
+		if len(diagnostics) == 0 || diagnostics[0].Line != 2 || !strings.Contains(diagnostics[0].Message, "past the end of memory") {
+			t.Errorf("Data oversized space %s fail. actual %v", size, diagnostics)
+		}
+	}
+	cpu.LoadInstructions([]string{".data", ".space 200", ".space 200", ".balign 0x10000"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 2 || diagnostics[0].Line != 3 || diagnostics[1].Line != 4 {
+		t.Errorf("Data offset past memory fail. actual %v", diagnostics)
+	}
+}
+
+func TestMultiplyDivide(t *testing.T) {
+	cases := []struct {
+		instr    string
+		a, b     int32
+		expected int32
+	}{
+		{"mulh", -2, 3, -1},
+		{"mulh", 1 << 30, 8, 2},
+		{"mulhu", -1, -1, -2},
+		{"mulhsu", -1, -1, -1},
+		{"mulhsu", 2, -1, 1},
+		{"div", -7, 2, -3},
+		{"div", 7, 0, -1},
+		{"div", math.MinInt32, -1, math.MinInt32},
+		{"divu", -2, 2, math.MaxInt32},
+		{"divu", 7, 0, -1},
+		{"rem", -7, 2, -1},
+		{"rem", -7, 0, -7},
+		{"rem", math.MinInt32, -1, 0},
+		{"remu", -1, 10, 5},
+		{"remu", 7, 0, 7},
+	}
+	for _, c := range cases {
+		cpu := NewCPU(64)
+		cpu.Registers[5], cpu.Registers[6] = c.a, c.b
+		cpu.LoadInstructions([]string{c.instr + " x7, x5, x6"})
+		cpu.RunProgram()
+		if cpu.Err() != nil || cpu.Registers[7] != c.expected {
+			t.Errorf("%s %d, %d fail. actual %d %v", c.instr, c.a, c.b, cpu.Registers[7], cpu.Err())
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	cpu := NewCPU(256)
+	cpu.LoadInstructions([]string{
+		".global main",
+		"helper: addi a0, a0, 1",
+		"  ret",
+		"main:",
+		"  call helper # twice",
+		"1:",
+		"  call helper",
+		"  beqz a0, 1b",
+		"  la a1, end+4",
+		"end:",
+	})
+
+	expected := []Symbol{
+		{Name: "helper", Address: 16, Kind: SymbolText, Line: 2, References: []int{5, 7}},
+		{Name: "main", Address: 24, Kind: SymbolText, Line: 4, References: []int{1}},
+		{Name: "end", Address: 40, Kind: SymbolData, Line: 10, References: []int{9}},
+	}
+	symbols := cpu.Symbols()
+	if len(symbols) != len(expected) {
+		t.Fatalf("Symbols fail. actual %+v", symbols)
+	}
+	for i, symbol := range symbols {
+		if symbol.Name != expected[i].Name || symbol.Address != expected[i].Address || symbol.Kind != expected[i].Kind ||
+			symbol.Line != expected[i].Line || !slices.Equal(symbol.References, expected[i].References) {
+			t.Errorf("Symbols fail. actual %+v", symbol)
+		}
+	}
+
+	// labels of the previous program are forgotten
+	cpu.LoadInstructions([]string{"start: nop"})
+	if _, ok := cpu.Labels["helper"]; ok || len(cpu.Symbols()) != 1 {
+		t.Errorf("Stale labels fail. actual %v", cpu.Labels)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	program := []string{
+		".macro push reg",
+		"addi sp, sp, -4",
+		"sw \\reg, 0(sp)",
+		".endm",
+		".macro pop reg",
+		"lw \\reg, 0(sp)",
+		"addi sp, sp, 4",
+		".endm",
+		".macro inc reg, by=1",
+		"addi \\reg, \\reg, \\by",
+		".endm",
+		"li s0, 5",
+		"push s0",
+		"li s0, 0",
+		"start: pop s1",
+		".rept 3",
+		"inc s1",
+		".endr",
+		"inc s1, 10",
+	}
+
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions(program)
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 0 {
+		t.Fatalf("Macro diagnostics fail. actual %v", diagnostics)
+	}
+	cpu.RunProgram()
+	if cpu.Registers[9] != 18 || cpu.Registers[8] != 0 {
+		t.Errorf("Macro run fail. actual %d %d", cpu.Registers[9], cpu.Registers[8])
+	}
+
+	// the expanded instructions map back to the lines they came from
+	if line, _ := cpu.LineOfAddress(cpu.Labels["start"]); line != 15 {
+		t.Errorf("Macro label line fail. actual %d", line)
+	}
+	var lines []int
+	for _, entry := range cpu.Listing() {
+		lines = append(lines, entry.Line)
+	}
+	if expected := []int{12, 13, 13, 14, 15, 15, 17, 17, 17, 19}; !slices.Equal(lines, expected) {
+		t.Errorf("Macro listing lines fail. actual %v", lines)
+	}
+	if address, _ := cpu.AddressOfLine(13); address != cpu.Labels["start"]-12 {
+		t.Errorf("Macro address of line fail. actual %d", address)
+	}
+
+	cpu.LoadInstructions([]string{".macro two a, b", "add \\a, \\a, \\b", ".endm", "two t0", "addi t1, t1, 1", ".rept 2", "addi t1, t1, 1"})
+	var messages []string
+	for _, diagnostic := range cpu.Diagnostics() {
+		messages = append(messages, diagnostic.String())
+	}
+	if expected := []string{"line 4: macro two is missing its b argument", "line 6: .rept without .endr"}; !slices.Equal(messages, expected) {
+		t.Errorf("Macro errors fail. actual %q", messages)
+	}
+
+	cpu.LoadInstructions([]string{".macro again", "again", ".endm", "again"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Line != 4 {
+		t.Errorf("Recursive macro fail. actual %v", diagnostics)
+	}
+
+	// a bad line repeated by .rept is reported once
+	cpu.LoadInstructions([]string{".rept 1000", "frobnicate a0", ".endr"})
+	if diagnostics := cpu.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Line != 2 {
+		t.Errorf("Repeated diagnostic fail. actual %d diagnostics", len(diagnostics))
+	}
+
+	// the sandbox limits the expanded program, not just the source
+	sandbox := SafeSandbox
+	sandbox.MaxSourceLines = 100
+	sandboxed, err := NewSandboxedCPU(sandbox, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandboxed.LoadInstructions([]string{"li a0, 1", ".rept 1000", "addi a0, a0, 1", ".endr"})
+	if diagnostics := sandboxed.Diagnostics(); len(diagnostics) != 1 || diagnostics[0].Line != 3 || len(sandboxed.Listing()) > 100 {
+		t.Errorf("Sandbox expanded limit fail. actual %v, %d instructions", diagnostics, len(sandboxed.Listing()))
+	}
+}
+
+func TestStackReport(t *testing.T) {
+	cpu := NewCPU(1024)
+	cpu.LoadInstructions([]string{
+		"addi sp, sp, -16",
+		"sw s0, 12(sp)",
+		"sw s1, -4(sp)",
+		"addi sp, sp, 16",
+		"lw t0, -8(sp)",
+		"sw t0, 0x100(zero)",
+	})
+	cpu.RunProgram()
+
+	report := cpu.StackReport()
+	if report.Top != 1024 || report.Lowest != 1008 || report.MaxDepth() != 16 {
+		t.Errorf("Stack depth fail. actual %v", report)
+	}
+	var lines []int
+	for _, warning := range report.Warnings {
+		lines = append(lines, warning.Line)
+	}
+	if !slices.Equal(lines, []int{3, 5}) {
+		t.Errorf("Stack warnings fail. actual %v", report.Warnings)
+	}
+
+	cpu = NewCPU(4096)
+	cpu.SetMemoryMap(DefaultMemoryMap(4096))
+	cpu.LoadInstructions([]string{"li t0, 2048", "sub sp, sp, t0", "add sp, sp, t0"})
+	cpu.RunProgram()
+	report = cpu.StackReport()
+	if report.MaxDepth() != 2048 || len(report.Warnings) != 1 || report.Warnings[0].Line != 2 {
+		t.Errorf("Stack collision fail. actual %v %v", report, report.Warnings)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	cpu := NewCPU(1024)
+	cpu.SetMemoryHistoryDepth(4)
+	cpu.LoadInstructions([]string{
+		"li t0, 7",
+		"sw t0, 0x100(zero)",
+		"sb t0, 0x104(zero)",
+		"lw t1, 0x100(zero)",
+		"sh t0, 0x108(zero)",
+		"lbu t1, 0x104(zero)",
+	})
+	cpu.RunProgram()
+
+	// the first store has been pushed out
+	history := cpu.MemoryHistory(MemOpFilter{})
+	expected := []MemOp{
+		{Type: MemLoad, Addr: 0x104, Size: 1, Value: 7, PC: 36},
+		{Type: MemStore, Addr: 0x108, Size: 2, Value: 7, PC: 32},
+		{Type: MemLoad, Addr: 0x100, Size: 4, Value: 7, PC: 28},
+		{Type: MemStore, Addr: 0x104, Size: 1, Value: 7, PC: 24},
+	}
+	if !slices.Equal(history, expected) {
+		t.Errorf("Memory history fail. actual %v", history)
+	}
+	if dropped := cpu.MemoryHistoryDropped(); dropped != 1 {
+		t.Errorf("Memory history dropped fail. actual %d", dropped)
+	}
+
+	stores := cpu.MemoryHistory(MemOpFilter{Stores: true, Start: 0x104, End: 0x108})
+	if len(stores) != 1 || stores[0].Addr != 0x104 {
+		t.Errorf("Memory history filter fail. actual %v", stores)
+	}
+	if loads := cpu.MemoryHistory(MemOpFilter{Loads: true, Start: 0x102, End: 0x103}); len(loads) != 1 || loads[0].Addr != 0x100 {
+		t.Errorf("Memory history overlap fail. actual %v", loads)
+	}
+
+	var buffer bytes.Buffer
+	WriteMemOps(&buffer, stores)
+	if buffer.String() != "pc,type,address,size,value\n0x0018,store,0x0104,1,7\n" {
+		t.Errorf("Memory history export fail. actual %q", buffer.String())
+	}
+
+	cpu.SetMemoryHistoryDepth(2)
+	if history := cpu.MemoryHistory(MemOpFilter{}); !slices.Equal(history, expected[:2]) {
+		t.Errorf("Memory history depth fail. actual %v", history)
+	}
+	if dropped := cpu.MemoryHistoryDropped(); dropped != 3 {
+		t.Errorf("Memory history depth dropped fail. actual %d", dropped)
+	}
+	cpu.ClearMemoryHistory()
+	if dropped := cpu.MemoryHistoryDropped(); dropped != 0 {
+		t.Errorf("Memory history clear dropped fail. actual %d", dropped)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	source := "li t0, 100\nloop:\naddi t0, t0, -1\nbnez t0, loop"
+	result, err := Benchmark(context.Background(), source, BenchmarkConfig{Options: Options{MemorySize: 1024}, Iterations: 3})
+	if err != nil || result.Iterations != 3 || result.Instructions != 3*202 {
+		t.Errorf("Benchmark fail. actual %+v, %v", result, err)
+	}
+	if result.InstructionsPerSecond() <= 0 || !strings.HasPrefix(result.String(), "3 runs, 606 instructions in ") {
+		t.Errorf("Benchmark report fail. actual %q", result.String())
+	}
+
+	result, err = Benchmark(context.Background(), source, BenchmarkConfig{Options: Options{MemorySize: 1024}, Duration: 10 * time.Millisecond})
+	if err != nil || result.Iterations < 2 {
+		t.Errorf("Benchmark duration fail. actual %+v, %v", result, err)
+	}
+
+	if _, err := Benchmark(context.Background(), "frobnicate a0", BenchmarkConfig{Options: Options{MemorySize: 1024}}); err == nil {
+		t.Errorf("Benchmark assembly error fail. actual %v", err)
+	}
+
+	_, err = Benchmark(context.Background(), "loop:\nj loop", BenchmarkConfig{Options: Options{MemorySize: 1024}, MaxSteps: 100})
+	if !errors.Is(err, ErrStepLimit) {
+		t.Errorf("Benchmark step limit fail. actual %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Benchmark(ctx, source, BenchmarkConfig{Options: Options{MemorySize: 1024}}); err != context.Canceled {
+		t.Errorf("Benchmark cancel fail. actual %v", err)
+	}
+}
+
+func BenchmarkRunLoop(b *testing.B) {
+	program := []string{"li t0, 10000", "loop:", "sw t0, 0x100(zero)", "lw t1, 0x100(zero)", "addi t0, t0, -1", "bnez t0, loop"}
+	b.ReportAllocs()
+	var steps uint64
+	for range b.N {
+		cpu := NewCPU(1024)
+		cpu.LoadInstructions(program)
+		steps += cpu.RunContext(context.Background())
+	}
+	b.ReportMetric(float64(steps)/b.Elapsed().Seconds(), "instrs/s")
+}
+
+func BenchmarkDecode(b *testing.B) {
+	var program []string
+	for i := range 20 {
+		program = append(program, "li t0, 10000", fmt.Sprintf("loop%d:", i), "sw t0, 0x100(zero)", "lw t1, 0x100(zero)", "addi t0, t0, -1", fmt.Sprintf("bnez t0, loop%d", i))
+	}
+	b.ReportAllocs()
+	for range b.N {
+		cpu := NewCPU(4096)
+		cpu.LoadInstructions(program)
+	}
+}
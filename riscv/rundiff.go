@@ -0,0 +1,226 @@
+package riscv
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// how many differing registers or words String lists before summing up the
+// rest
+const diffListLimit = 32
+
+// a copy of everything a run can change, so two runs can be compared with
+// DiffStates
+type CPUState struct {
+	State
+	Memory        []byte
+	ByteOrder     binary.ByteOrder // of the words in Memory
+	RegisterNames []string
+	// every instruction the run executed, when it came from RecordRun
+	Trace []TraceEntry
+	// whether the run went on past the maxRecordedTrace instructions kept
+	TraceTruncated bool
+}
+
+func (cpu *CPU) CaptureState() CPUState {
+	return CPUState{
+		State:         cpu.GetState(),
+		Memory:        slices.Clone(cpu.Memory),
+		ByteOrder:     cpu.byteOrder,
+		RegisterNames: cpu.Arch.RegisterNames(),
+	}
+}
+
+// puts the registers, CSRs, pc and memory back as they were captured. The
+// trace is ignored.
+func (cpu *CPU) RestoreState(state CPUState) error {
+	if len(state.Memory) != len(cpu.Memory) {
+		return fmt.Errorf("the state has %d bytes of memory, the cpu has %d", len(state.Memory), len(cpu.Memory))
+	}
+	if err := cpu.SetState(state.State); err != nil {
+		return err
+	}
+	copy(cpu.Memory, state.Memory)
+	return nil
+}
+
+// runs the loaded program from its entry point until it stops, as RunContext
+// does, and returns the state it ended in along with every instruction it
+// executed. A trace enabled with EnableTrace is still written. Registers and
+// memory carry on from where they were, so restore the same CPUState before
+// each of two runs that are to be compared.
+func (cpu *CPU) RecordRun(ctx context.Context) CPUState {
+	trace, truncated := cpu.recordTrace(func() {
+		cpu.Restart()
+		cpu.RunContext(ctx)
+	})
+
+	state := cpu.CaptureState()
+	state.Trace = trace
+	state.TraceTruncated = truncated
+	return state
+}
+
+type RegisterDiff struct {
+	Register      int
+	Name          string
+	Before, After int32
+}
+
+// a word of memory that differs
+type MemoryDiff struct {
+	Address       uint32
+	Before, After int32
+}
+
+// how two runs ended up differently
+type StateDiff struct {
+	BeforePC, AfterPC     uint32
+	BeforeStop, AfterStop StopReason
+	Registers             []RegisterDiff
+	Memory                []MemoryDiff
+	// the index into both traces of the first instruction that ran or did
+	// something differently, -1 when the traces are the same. BeforeEntry or
+	// AfterEntry is nil when that trace ended first.
+	Divergence              int
+	BeforeEntry, AfterEntry *TraceEntry
+	RegisterNames           []string
+}
+
+// compares the final registers and memory of two runs, and their traces
+// instruction by instruction. Memory is compared up to the smaller of the
+// two.
+func DiffStates(before, after CPUState) StateDiff {
+	diff := StateDiff{
+		BeforePC:      before.PC,
+		AfterPC:       after.PC,
+		BeforeStop:    before.Stop,
+		AfterStop:     after.Stop,
+		Divergence:    -1,
+		RegisterNames: after.RegisterNames,
+	}
+
+	for register := range before.Registers {
+		if before.Registers[register] == after.Registers[register] {
+			continue
+		}
+		name := fmt.Sprintf("x%d", register)
+		if register < len(after.RegisterNames) {
+			name = after.RegisterNames[register]
+		}
+		diff.Registers = append(diff.Registers, RegisterDiff{Register: register, Name: name, Before: before.Registers[register], After: after.Registers[register]})
+	}
+
+	order := after.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	size := min(len(before.Memory), len(after.Memory))
+	for address := 0; address+4 <= size; address += 4 {
+		beforeWord := int32(order.Uint32(before.Memory[address:]))
+		afterWord := int32(order.Uint32(after.Memory[address:]))
+		if beforeWord != afterWord {
+			diff.Memory = append(diff.Memory, MemoryDiff{Address: uint32(address), Before: beforeWord, After: afterWord})
+		}
+	}
+
+	for i := 0; i < max(len(before.Trace), len(after.Trace)); i++ {
+		if i < len(before.Trace) && i < len(after.Trace) && sameEffects(before.Trace[i], after.Trace[i]) {
+			continue
+		}
+		diff.Divergence = i
+		if i < len(before.Trace) {
+			diff.BeforeEntry = &before.Trace[i]
+		}
+		if i < len(after.Trace) {
+			diff.AfterEntry = &after.Trace[i]
+		}
+		break
+	}
+
+	return diff
+}
+
+// whether two trace entries ran the same instruction with the same results.
+// The step and hart are left out.
+func sameEffects(a, b TraceEntry) bool {
+	return a.PC == b.PC && a.Instruction == b.Instruction && a.Trap == b.Trap &&
+		slices.Equal(a.Registers, b.Registers) && slices.Equal(a.Memory, b.Memory)
+}
+
+// whether the runs ended the same way
+func (diff StateDiff) Same() bool {
+	return diff.BeforePC == diff.AfterPC && diff.BeforeStop == diff.AfterStop &&
+		len(diff.Registers) == 0 && len(diff.Memory) == 0 && diff.Divergence < 0
+}
+
+func (diff StateDiff) String() string {
+	if diff.Same() {
+		return "the runs are the same\n"
+	}
+
+	var builder strings.Builder
+	if diff.BeforePC != diff.AfterPC || diff.BeforeStop != diff.AfterStop {
+		fmt.Fprintf(&builder, "stopped at 0x%04x (%s), now 0x%04x (%s)\n", diff.BeforePC, diff.BeforeStop, diff.AfterPC, diff.AfterStop)
+	}
+
+	if diff.Divergence >= 0 {
+		fmt.Fprintf(&builder, "first difference at instruction %d:\n", diff.Divergence+1)
+		fmt.Fprintf(&builder, "  before: %s\n", diff.describeEntry(diff.BeforeEntry))
+		fmt.Fprintf(&builder, "  after:  %s\n", diff.describeEntry(diff.AfterEntry))
+	}
+
+	if len(diff.Registers) > 0 {
+		builder.WriteString("registers:\n")
+	}
+	for i, register := range diff.Registers {
+		if i == diffListLimit {
+			fmt.Fprintf(&builder, "  and %d more\n", len(diff.Registers)-i)
+			break
+		}
+		fmt.Fprintf(&builder, "  %-4s %d -> %d\n", register.Name, register.Before, register.After)
+	}
+
+	if len(diff.Memory) > 0 {
+		builder.WriteString("memory:\n")
+	}
+	for i, word := range diff.Memory {
+		if i == diffListLimit {
+			fmt.Fprintf(&builder, "  and %d more words\n", len(diff.Memory)-i)
+			break
+		}
+		fmt.Fprintf(&builder, "  0x%04x %d -> %d\n", word.Address, word.Before, word.After)
+	}
+
+	return builder.String()
+}
+
+// e.g. "0x0018 addi a0, a0, 1 (a0=10)"
+func (diff StateDiff) describeEntry(entry *TraceEntry) string {
+	if entry == nil {
+		return "(the run had ended)"
+	}
+
+	var effects []string
+	for _, write := range entry.Registers {
+		name := fmt.Sprintf("x%d", write.Register)
+		if write.Register < len(diff.RegisterNames) {
+			name = diff.RegisterNames[write.Register]
+		}
+		effects = append(effects, fmt.Sprintf("%s=%d", name, write.Value))
+	}
+	for _, effect := range entry.Memory {
+		effects = append(effects, effect.String())
+	}
+	if entry.Trap != "" {
+		effects = append(effects, "trap "+entry.Trap)
+	}
+
+	if len(effects) == 0 {
+		return fmt.Sprintf("0x%04x %s", entry.PC, entry.Instruction)
+	}
+	return fmt.Sprintf("0x%04x %s (%s)", entry.PC, entry.Instruction, strings.Join(effects, " "))
+}
@@ -0,0 +1,125 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// limits for running untrusted programs, e.g. student submissions on a
+// shared grading server. the core never execs processes or opens network
+// connections, and every CPU owns all of its state, so one CPU per session
+// is enough to isolate sessions from each other. the only host access left
+// is reading files for `.check file`, which the sandbox turns off
+type Sandbox struct {
+	MaxMemory      uint32 // largest memory a sandboxed CPU can be created with
+	MaxSteps       uint64 // instructions per run, 0 for no limit
+	MaxSourceLines int    // 0 for no limit
+	AllowHostFiles bool
+}
+
+// preset for classroom server deployments
+var SafeSandbox = Sandbox{
+	MaxMemory:      1 << 20,
+	MaxSteps:       10_000_000,
+	MaxSourceLines: 10_000,
+}
+
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// set by RunContext when its context is done before the program stops
+var ErrCanceled = errors.New("run canceled")
+
+// how many instructions run between checks for cancellation
+const cancelCheckInterval = 1024
+
+// limits every run to steps instructions, 0 for no limit. A sandbox's
+// MaxSteps still applies when it is smaller.
+func (cpu *CPU) SetStepBudget(steps uint64) {
+	cpu.stepBudget = steps
+}
+
+// the most instructions a run may execute, 0 for no limit
+func (cpu *CPU) StepLimit() uint64 {
+	limit := cpu.stepBudget
+	if cpu.sandbox != nil && cpu.sandbox.MaxSteps != 0 && (limit == 0 || cpu.sandbox.MaxSteps < limit) {
+		limit = cpu.sandbox.MaxSteps
+	}
+	return limit
+}
+
+func NewSandboxedCPU(sandbox Sandbox, memorySize uint32) (CPU, error) {
+	if sandbox.MaxMemory != 0 && memorySize > sandbox.MaxMemory {
+		return CPU{}, fmt.Errorf("memory size %d exceeds sandbox limit %d", memorySize, sandbox.MaxMemory)
+	}
+
+	cpu := NewCPU(memorySize)
+	cpu.sandbox = &sandbox
+	return cpu, nil
+}
+
+// a sandboxed cpu set up the way NewCPUWithOptions sets one up
+func NewSandboxedCPUWithOptions(sandbox Sandbox, options Options) (CPU, error) {
+	if options.MemorySize == 0 {
+		options.MemorySize = DefaultMemorySize
+	}
+	if sandbox.MaxMemory != 0 && options.MemorySize > sandbox.MaxMemory {
+		return CPU{}, fmt.Errorf("memory size %d exceeds sandbox limit %d", options.MemorySize, sandbox.MaxMemory)
+	}
+
+	cpu := NewCPUWithOptions(options)
+	cpu.sandbox = &sandbox
+	return cpu, nil
+}
+
+// nil when the CPU is not sandboxed
+func (cpu *CPU) Sandbox() *Sandbox {
+	return cpu.sandbox
+}
+
+// why the last run stopped early, if it did
+func (cpu *CPU) Err() error {
+	return cpu.err
+}
+
+// trims the source and drops directives the sandbox doesn't allow, returning
+// diagnostics for everything removed
+func (cpu *CPU) sandboxSource(instrs []string) ([]string, []Diagnostic) {
+	if cpu.sandbox == nil {
+		return instrs, nil
+	}
+
+	var diagnostics []Diagnostic
+
+	if limit := cpu.sandbox.MaxSourceLines; limit != 0 && len(instrs) > limit {
+		diagnostics = append(diagnostics, Diagnostic{Line: limit + 1, Message: fmt.Sprintf("source exceeds sandbox limit of %d lines", limit)})
+		instrs = instrs[:limit]
+	}
+
+	if !cpu.sandbox.AllowHostFiles {
+		for i, instr := range instrs {
+			if checker, ok := parseCheckDirective(instr); ok {
+				if _, isFile := checker.checker.(EqualsFile); isFile {
+					diagnostics = append(diagnostics, Diagnostic{Line: i + 1, Message: "host file access is disabled in the sandbox"})
+				}
+			}
+		}
+	}
+
+	return instrs, diagnostics
+}
+
+// trims a program that macros and .rept expanded past the sandbox's line
+// limit, along with the source line each expanded line came from
+func (cpu *CPU) sandboxExpanded(instrs []string, origins []int) ([]string, []int, []Diagnostic) {
+	if cpu.sandbox == nil || cpu.sandbox.MaxSourceLines == 0 || len(instrs) <= cpu.sandbox.MaxSourceLines {
+		return instrs, origins, nil
+	}
+
+	limit := cpu.sandbox.MaxSourceLines
+	line := limit + 1
+	if origins != nil {
+		line = origins[limit] + 1
+		origins = origins[:limit]
+	}
+	return instrs[:limit], origins, []Diagnostic{{Line: line, Message: fmt.Sprintf("macros expand the source past the sandbox limit of %d lines", limit)}}
+}
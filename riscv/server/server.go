@@ -0,0 +1,363 @@
+// Package server drives a riscv.Machine over JSON-RPC 2.0, one call per HTTP
+// POST, so a browser or editor front end can run programs on the same core
+// as the interface. The methods are:
+//
+//	load      {"source": "..."}             assemble a program
+//	step      {"count": n}                  run n instructions, default 1
+//	run       {}                            run to the end or the next stop
+//	restart   {}                            go back to the entry point
+//	registers {"hart": n}                   the pc and registers of a hart
+//	memory    {"address": a, "length": n}   bytes of memory
+//	setRegister {"hart": n, "register": "a0", "value": v}
+//	                                        change a register
+//	writeMemory {"address": a, "bytes": [...]}
+//	                                        change bytes of memory
+//
+// load, step, run and restart reply with where the harts stopped and the
+// console output since the last call.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// the most memory one memory call returns
+const maxMemoryRead = 64 * 1024
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeCallFailed     = -32000
+)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+func invalidParams(format string, args ...any) *Error {
+	return &Error{Code: codeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// where a hart is
+type HartState struct {
+	Hart   int    `json:"hart"`
+	PC     uint32 `json:"pc"`
+	Line   int    `json:"line,omitempty"` // 1-based source line of the next instruction
+	Halted bool   `json:"halted"`
+	Stop   string `json:"stop"`
+	Error  string `json:"error,omitempty"`
+	// set once the program has ended, with how it ended
+	ExitCode    *int32 `json:"exitCode,omitempty"`
+	Termination string `json:"termination,omitempty"`
+}
+
+type Diagnostic struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type RunResult struct {
+	Steps       uint64       `json:"steps"`
+	Harts       []HartState  `json:"harts"`
+	Console     string       `json:"console"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"` // only from load
+}
+
+type Registers struct {
+	PC        uint32    `json:"pc"`
+	Registers [32]int32 `json:"registers"`
+	Names     []string  `json:"names"`
+}
+
+type Memory struct {
+	Address uint32 `json:"address"`
+	Bytes   []int  `json:"bytes"` // numbers rather than base64, for plain JavaScript
+}
+
+// serves calls to one machine, one at a time
+type Server struct {
+	Machine *riscv.Machine
+	// sent as Access-Control-Allow-Origin so a page served from elsewhere
+	// can make calls, nothing when empty
+	AllowOrigin string
+
+	mu      sync.Mutex
+	console bytes.Buffer
+}
+
+// the console of the first hart is collected for the replies, so it should
+// be the one the machine's UART writes to
+func New(machine *riscv.Machine) *Server {
+	server := &Server{Machine: machine}
+	machine.Harts[0].AttachSink(riscv.StreamConsole, &server.console)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if server.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", server.AllowOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "JSON-RPC calls are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var call request
+	reply := response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+		reply.Error = &Error{Code: codeParseError, Message: err.Error()}
+	} else if call.JSONRPC != "2.0" || call.Method == "" {
+		reply.Error = &Error{Code: codeInvalidRequest, Message: `expected a "2.0" request with a method`}
+	} else {
+		if call.ID != nil {
+			reply.ID = call.ID
+		}
+		result, err := server.Call(r.Context(), call.Method, call.Params)
+		if err != nil {
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: codeCallFailed, Message: err.Error()}
+			}
+			reply.Error = rpcErr
+		} else {
+			reply.Result = result
+		}
+
+		// notifications get no reply
+		if call.ID == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// runs a method with its JSON params, ctx bounds run
+func (server *Server) Call(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	switch method {
+	case "load":
+		var args struct {
+			Source *string `json:"source"`
+		}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Source == nil {
+			return nil, invalidParams("load needs the source")
+		}
+		return server.load(*args.Source), nil
+	case "step":
+		args := struct {
+			Count int `json:"count"`
+		}{Count: 1}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Count < 1 {
+			return nil, invalidParams("count must be at least 1")
+		}
+		return server.step(ctx, args.Count), nil
+	case "run":
+		return server.run(ctx), nil
+	case "restart":
+		for _, hart := range server.Machine.Harts {
+			hart.Restart()
+		}
+		return server.result(0), nil
+	case "registers":
+		var args struct {
+			Hart int `json:"hart"`
+		}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Hart < 0 || args.Hart >= len(server.Machine.Harts) {
+			return nil, invalidParams("no hart %d", args.Hart)
+		}
+		cpu := server.Machine.Harts[args.Hart]
+		state := cpu.GetState()
+		return Registers{PC: state.PC, Registers: state.Registers, Names: cpu.Arch.RegisterNames()}, nil
+	case "memory":
+		var args struct {
+			Address uint32 `json:"address"`
+			Length  uint32 `json:"length"`
+		}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		return server.memory(args.Address, args.Length)
+	case "setRegister":
+		var args struct {
+			Hart     int    `json:"hart"`
+			Register string `json:"register"`
+			Value    int32  `json:"value"`
+		}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		if args.Hart < 0 || args.Hart >= len(server.Machine.Harts) {
+			return nil, invalidParams("no hart %d", args.Hart)
+		}
+		cpu := server.Machine.Harts[args.Hart]
+		register, ok := cpu.Arch.RegisterNumber(args.Register)
+		if !ok {
+			return nil, invalidParams("no register named %s", args.Register)
+		}
+		cpu.SetRegister(register, args.Value)
+		state := cpu.GetState()
+		return Registers{PC: state.PC, Registers: state.Registers, Names: cpu.Arch.RegisterNames()}, nil
+	case "writeMemory":
+		var args struct {
+			Address uint32 `json:"address"`
+			Bytes   []int  `json:"bytes"`
+		}
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		return server.writeMemory(args.Address, args.Bytes)
+	}
+	return nil, &Error{Code: codeMethodNotFound, Message: fmt.Sprintf("no method %s", method)}
+}
+
+// params may be left out, otherwise they have to be an object
+func decodeParams(params json.RawMessage, args any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, args); err != nil {
+		return invalidParams("%s", err)
+	}
+	return nil
+}
+
+func (server *Server) load(source string) RunResult {
+	machine := server.Machine
+	machine.LoadInstructions(strings.Split(source, "\n"))
+
+	result := server.result(0)
+	for _, diagnostic := range machine.Harts[0].Diagnostics() {
+		result.Diagnostics = append(result.Diagnostics, Diagnostic{Line: diagnostic.Line, Message: diagnostic.Message})
+	}
+	return result
+}
+
+// runs count instructions, held to the step limit and ctx like run is
+func (server *Server) step(ctx context.Context, count int) RunResult {
+	steps := uint64(0)
+	for steps < uint64(count) && server.Machine.CanStep(ctx, steps) {
+		i := server.Machine.Step()
+		if i < 0 {
+			break
+		}
+		steps++
+
+		state := server.Machine.Harts[i].GetState()
+		if state.Halted || state.Stop != riscv.StopNone {
+			break
+		}
+	}
+	return server.result(steps)
+}
+
+func (server *Server) run(ctx context.Context) RunResult {
+	machine := server.Machine
+	var steps uint64
+	if len(machine.Harts) == 1 {
+		// a lone hart keeps the cpu's own run semantics, sandbox limits included
+		steps = machine.Harts[0].RunContext(ctx)
+	} else {
+		steps = machine.RunContext(ctx)
+	}
+	return server.result(steps)
+}
+
+func (server *Server) result(steps uint64) RunResult {
+	result := RunResult{Steps: steps, Console: server.console.String()}
+	server.console.Reset()
+
+	for i, hart := range server.Machine.Harts {
+		state := hart.GetState()
+		hartState := HartState{Hart: i, PC: state.PC, Halted: state.Halted, Stop: state.Stop.String()}
+		hartState.Line, _ = hart.CurrentLine()
+		if state.Err != nil {
+			hartState.Error = state.Err.Error()
+		}
+		if code, ended := hart.ExitCode(); ended {
+			hartState.ExitCode, hartState.Termination = &code, hart.Termination().String()
+		}
+		result.Harts = append(result.Harts, hartState)
+	}
+	return result
+}
+
+func (server *Server) memory(address, length uint32) (Memory, error) {
+	memory := server.Machine.Harts[0].Memory
+	if length > maxMemoryRead {
+		return Memory{}, invalidParams("at most %d bytes can be read at once", maxMemoryRead)
+	}
+	if uint64(address)+uint64(length) > uint64(len(memory)) {
+		return Memory{}, invalidParams("0x%x-0x%x is outside memory", address, uint64(address)+uint64(length))
+	}
+
+	data := make([]int, length)
+	for i := range data {
+		data[i] = int(memory[address+uint32(i)])
+	}
+	return Memory{Address: address, Bytes: data}, nil
+}
+
+func (server *Server) writeMemory(address uint32, values []int) (Memory, error) {
+	data := make([]byte, len(values))
+	for i, value := range values {
+		if value < 0 || value > 255 {
+			return Memory{}, invalidParams("%d is not a byte", value)
+		}
+		data[i] = byte(value)
+	}
+	if err := server.Machine.Harts[0].WriteMemory(address, data); err != nil {
+		return Memory{}, invalidParams("%s", err)
+	}
+	return Memory{Address: address, Bytes: values}, nil
+}
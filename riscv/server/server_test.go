@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+func call(t *testing.T, url string, body string) response {
+	t.Helper()
+	reply, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Body.Close()
+
+	var decoded response
+	if err := json.NewDecoder(reply.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestServer(t *testing.T) {
+	cpu := riscv.NewCPU(1024)
+	machine := riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})
+	if _, _, err := machine.MapStandardDevices(); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(New(machine))
+	defer httpServer.Close()
+
+	reply := call(t, httpServer.URL, `{"jsonrpc":"2.0","id":1,"method":"load","params":{"source":"li a0, 72\nli t0, 0x10000000\nsb a0, 0(t0)\nsw a0, 0x100(zero)"}}`)
+	if reply.Error != nil || string(reply.ID) != "1" {
+		t.Fatalf("load fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":2,"method":"step","params":{"count":2}}`)
+	result := reply.Result.(map[string]any)
+	if harts := result["harts"].([]any); result["steps"] != 2.0 || harts[0].(map[string]any)["line"] != 3.0 {
+		t.Errorf("step fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":3,"method":"run"}`)
+	if result := reply.Result.(map[string]any); result["console"] != "H" {
+		t.Errorf("run fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":4,"method":"registers"}`)
+	if registers := reply.Result.(map[string]any)["registers"].([]any); registers[10] != 72.0 {
+		t.Errorf("registers fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":5,"method":"memory","params":{"address":256,"length":2}}`)
+	if data := reply.Result.(map[string]any)["bytes"].([]any); len(data) != 2 || data[0] != 72.0 {
+		t.Errorf("memory fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":10,"method":"setRegister","params":{"register":"a1","value":-5}}`)
+	if registers := reply.Result.(map[string]any)["registers"].([]any); registers[11] != -5.0 {
+		t.Errorf("setRegister fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":11,"method":"writeMemory","params":{"address":257,"bytes":[1,2]}}`)
+	if reply.Error != nil || cpu.Memory[256] != 72 || cpu.Memory[257] != 1 || cpu.Memory[258] != 2 {
+		t.Errorf("writeMemory fail. actual %+v", reply)
+	}
+
+	reply = call(t, httpServer.URL, `{"jsonrpc":"2.0","id":12,"method":"writeMemory","params":{"address":1023,"bytes":[1,256]}}`)
+	if reply.Error == nil || reply.Error.Code != codeInvalidParams || cpu.Memory[1023] != 0 {
+		t.Errorf("writeMemory of a bad byte fail. actual %+v", reply)
+	}
+
+	for body, code := range map[string]int{
+		`{"jsonrpc":"2.0","id":6,"method":"frobnicate"}`:                                  codeMethodNotFound,
+		`{"jsonrpc":"2.0","id":7,"method":"memory","params":{"address":1020,"length":8}}`: codeInvalidParams,
+		`{"jsonrpc":"2.0","id":8,"method":"step","params":{"count":0}}`:                   codeInvalidParams,
+		`{"id":9,"method":"run"}`:                                                         codeInvalidRequest,
+		`{`:                                                                               codeParseError,
+	} {
+		if reply := call(t, httpServer.URL, body); reply.Error == nil || reply.Error.Code != code {
+			t.Errorf("%s fail. actual %+v", body, reply)
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	cpu, err := riscv.NewSandboxedCPU(riscv.Sandbox{MaxSteps: 5}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(New(riscv.NewMachine([]*riscv.CPU{&cpu}, &riscv.RoundRobin{})))
+	defer httpServer.Close()
+
+	call(t, httpServer.URL, `{"jsonrpc":"2.0","id":1,"method":"load","params":{"source":"loop:\naddi a0, a0, 1\nj loop"}}`)
+	reply := call(t, httpServer.URL, `{"jsonrpc":"2.0","id":2,"method":"step","params":{"count":1000000}}`)
+	result := reply.Result.(map[string]any)
+	if hart := result["harts"].([]any)[0].(map[string]any); result["steps"] != 5.0 || hart["error"] != riscv.ErrStepLimit.Error() {
+		t.Errorf("step limit fail. actual %+v", reply)
+	}
+}
@@ -0,0 +1,109 @@
+package riscv
+
+import (
+	"bytes"
+	"io"
+	"slices"
+)
+
+// kinds of output a CPU produces. Each stream can have any number of sinks
+// attached, and nothing is formatted for a stream with no sinks.
+type Stream int
+
+const (
+	// bytes the program writes to the UART
+	StreamConsole Stream = iota
+	// one line per load or store, as DescribeMemOp puts it
+	StreamMemory
+	// one line per executed instruction with its pc and source
+	StreamTrace
+	// bytes the program writes to file descriptor 2. Writes to 1 go to the
+	// console, along with the UART's.
+	StreamStderr
+)
+
+func (stream Stream) String() string {
+	switch stream {
+	case StreamConsole:
+		return "console"
+	case StreamMemory:
+		return "memory"
+	case StreamTrace:
+		return "trace"
+	case StreamStderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// adds w to the writers receiving stream. Sinks should be attached before
+// the program runs, and a slow sink slows the CPU down with it.
+func (cpu *CPU) AttachSink(stream Stream, w io.Writer) {
+	if cpu.sinks == nil {
+		cpu.sinks = make(map[Stream][]io.Writer)
+	}
+	cpu.sinks[stream] = append(cpu.sinks[stream], w)
+}
+
+func (cpu *CPU) DetachSink(stream Stream, w io.Writer) {
+	cpu.sinks[stream] = slices.DeleteFunc(cpu.sinks[stream], func(sink io.Writer) bool {
+		return sink == w
+	})
+}
+
+// a writer that passes everything on to the sinks attached to stream at the
+// time of the write
+func (cpu *CPU) Output(stream Stream) io.Writer {
+	return streamWriter{cpu: cpu, stream: stream}
+}
+
+func (cpu *CPU) hasSinks(stream Stream) bool {
+	return len(cpu.sinks[stream]) > 0
+}
+
+// write errors are ignored so a broken sink can't stop the program
+func (cpu *CPU) emit(stream Stream, data []byte) {
+	for _, sink := range cpu.sinks[stream] {
+		sink.Write(data)
+	}
+}
+
+func (cpu *CPU) emitLine(stream Stream, line string) {
+	if cpu.hasSinks(stream) {
+		cpu.emit(stream, []byte(line+"\n"))
+	}
+}
+
+type streamWriter struct {
+	cpu    *CPU
+	stream Stream
+}
+
+func (writer streamWriter) Write(data []byte) (int, error) {
+	writer.cpu.emit(writer.stream, data)
+	return len(data), nil
+}
+
+// a sink sending each complete line, without its newline, to ch. Sends
+// block, so the channel needs a reader or enough buffer for the output.
+func ChannelSink(ch chan<- string) io.Writer {
+	return &channelSink{ch: ch}
+}
+
+type channelSink struct {
+	ch      chan<- string
+	pending []byte
+}
+
+func (sink *channelSink) Write(data []byte) (int, error) {
+	sink.pending = append(sink.pending, data...)
+	for {
+		i := bytes.IndexByte(sink.pending, '\n')
+		if i < 0 {
+			break
+		}
+		sink.ch <- string(sink.pending[:i])
+		sink.pending = sink.pending[i+1:]
+	}
+	return len(data), nil
+}
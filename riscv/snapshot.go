@@ -0,0 +1,135 @@
+package riscv
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// serialized form of a CPU, unexported fields included
+type cpuSnapshot struct {
+	Arch            string
+	PC              uint32
+	Registers       [32]int32
+	Memory          []byte
+	MemorySize      uint32
+	Instructions    []string
+	Source          []string `json:",omitempty"` // as passed to LoadInstructions
+	Done            bool
+	Labels          map[string]uint32
+	MemoryHistory   []MemOp `json:",omitempty"` // newest first
+	EntryPoint      string
+	Bookmarks       []Bookmark
+	CallStack       []StackFrame
+	CSRs            map[uint16]int32
+	Instret         uint64
+	MemoryMap       *MemoryMap  `json:",omitempty"`
+	Brk             uint32      `json:",omitempty"`
+	LineOrigins     []int       `json:",omitempty"`
+	Termination     Termination `json:",omitempty"`
+	ExitCode        int32       `json:",omitempty"`
+	BigEndian       bool        `json:",omitempty"`
+	AllowMisaligned bool        `json:",omitempty"`
+}
+
+func (cpu *CPU) Snapshot() ([]byte, error) {
+	snapshot := cpuSnapshot{
+		Arch:            cpu.Arch.Name(),
+		PC:              cpu.PC,
+		Registers:       cpu.Registers,
+		Memory:          cpu.Memory,
+		MemorySize:      cpu.MemorySize,
+		Instructions:    cpu.instructions,
+		Source:          cpu.loadedSource,
+		Done:            cpu.Done,
+		Labels:          cpu.Labels,
+		MemoryHistory:   cpu.MemoryHistory(MemOpFilter{}),
+		EntryPoint:      cpu.entryPoint,
+		Bookmarks:       cpu.Bookmarks(),
+		CallStack:       cpu.callStack,
+		CSRs:            cpu.csrs,
+		Instret:         cpu.instret,
+		LineOrigins:     cpu.lineOrigins,
+		Termination:     cpu.termination,
+		ExitCode:        cpu.exitCode,
+		BigEndian:       cpu.byteOrder == binary.BigEndian,
+		AllowMisaligned: cpu.allowMisaligned,
+	}
+	if cpu.memoryMap != nil {
+		snapshot.MemoryMap = &cpu.memoryMap.MemoryMap
+		snapshot.Brk = cpu.memoryMap.brk
+	}
+
+	return json.Marshal(snapshot)
+}
+
+// rebuilds a CPU from a Snapshot. The sandbox isn't part of a snapshot, since
+// a snapshot file shouldn't pick its own limits, so the restored CPU is not
+// sandboxed.
+func Restore(data []byte) (*CPU, error) {
+	var snapshot cpuSnapshot
+
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(snapshot.Memory)) != snapshot.MemorySize {
+		return nil, errors.New("snapshot memory does not match memory size")
+	}
+
+	if snapshot.LineOrigins != nil && len(snapshot.LineOrigins) != len(snapshot.Instructions) {
+		return nil, errors.New("snapshot line origins do not match its instructions")
+	}
+
+	arch, err := lookupArch(snapshot.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	cpu := NewCPUForArch(arch, snapshot.MemorySize)
+	cpu.PC = snapshot.PC
+	for register, value := range snapshot.Registers {
+		cpu.SetRegister(register, value)
+	}
+	copy(cpu.Memory, snapshot.Memory)
+	cpu.instructions = snapshot.Instructions
+	// loading the same program again carries on from the snapshot rather than
+	// reassembling it over the restored memory
+	cpu.loadedSource = snapshot.Source
+	cpu.lineOrigins = snapshot.LineOrigins
+	cpu.Done = snapshot.Done
+	cpu.termination, cpu.exitCode = snapshot.Termination, snapshot.ExitCode
+	if snapshot.BigEndian {
+		cpu.byteOrder = binary.BigEndian
+	}
+	cpu.allowMisaligned = snapshot.AllowMisaligned
+	for i := len(snapshot.MemoryHistory) - 1; i >= 0; i-- {
+		cpu.memoryHistory.add(snapshot.MemoryHistory[i])
+	}
+	cpu.entryPoint = snapshot.EntryPoint
+	cpu.callStack = snapshot.CallStack
+	cpu.instret = snapshot.Instret
+	cpu.started = true
+	if snapshot.MemoryMap != nil {
+		cpu.memoryMap = &memoryLayout{MemoryMap: *snapshot.MemoryMap, brk: snapshot.Brk}
+	}
+	for address, value := range snapshot.CSRs {
+		cpu.csrs[address] = value
+	}
+
+	for label, address := range snapshot.Labels {
+		cpu.Labels[label] = address
+	}
+
+	lines, _, section := layoutSource(cpu.instructions, cpu.textBase(), cpu.dataBase(), cpu.MemorySize)
+	cpu.assemble(lines, cpu.Labels)
+	cpu.assembleData(section, cpu.Labels)
+
+	for _, bookmark := range snapshot.Bookmarks {
+		if err := cpu.AddBookmark(bookmark.Name, bookmark.Start, bookmark.End, bookmark.Color); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cpu, nil
+}
@@ -0,0 +1,95 @@
+package riscv
+
+import "fmt"
+
+// with flat memory there is no stack region, so accesses up to this far
+// below sp count as the stack
+const stackWarnWindow = 256
+
+// how a run used the stack
+type StackReport struct {
+	Top      uint32 // sp when the run started
+	Lowest   uint32 // the lowest sp went
+	Warnings []Diagnostic
+}
+
+// the most bytes the stack held at once
+func (report StackReport) MaxDepth() uint32 {
+	return report.Top - report.Lowest
+}
+
+func (report StackReport) String() string {
+	return fmt.Sprintf("max stack depth %d bytes (sp 0x%04x to 0x%04x)", report.MaxDepth(), report.Top, report.Lowest)
+}
+
+// the stack since the current or last run started, zero before any run
+func (cpu *CPU) StackReport() StackReport {
+	report := cpu.stack
+	report.Warnings = append([]Diagnostic(nil), cpu.stack.Warnings...)
+	return report
+}
+
+func (cpu *CPU) resetStack() {
+	sp := uint32(cpu.Registers[cpu.Arch.StackPointer()])
+	cpu.stack = StackReport{Top: sp, Lowest: sp}
+}
+
+// a warning for the instruction at the pc, once per line and message
+func (cpu *CPU) stackWarning(message string) {
+	line, _ := cpu.LineOfAddress(cpu.PC)
+	warning := Diagnostic{Line: line, Message: message}
+	for _, existing := range cpu.stack.Warnings {
+		if existing == warning {
+			return
+		}
+	}
+	cpu.stack.Warnings = append(cpu.stack.Warnings, warning)
+}
+
+// called when an instruction writes sp. With a memory map, warns when sp
+// leaves the stack for the guard, heap or data below it.
+func (cpu *CPU) stackPointerMoved(sp uint32) {
+	if sp < cpu.stack.Lowest {
+		cpu.stack.Lowest = sp
+	}
+
+	layout := cpu.memoryMap
+	if layout == nil || sp >= layout.stackBottom() {
+		return
+	}
+	where := "unmapped memory"
+	if region, ok := cpu.regionAt(sp); ok {
+		where = "the " + region.Name
+	} else if sp >= layout.DataBase && sp < layout.heapLimit() {
+		where = "the heap's room to grow"
+	}
+	cpu.stackWarning(fmt.Sprintf("moves sp to 0x%04x, below the stack at 0x%04x into %s", sp, layout.stackBottom(), where))
+}
+
+// called for every load and store. Anything below sp can be overwritten by
+// the next call or interrupt, so it's warned about when it's in the stack.
+func (cpu *CPU) stackAccess(effect MemoryEffect) {
+	if _, ok := cpu.deviceAt(effect.Address); ok {
+		return
+	}
+	sp := uint32(cpu.Registers[cpu.Arch.StackPointer()])
+	if effect.Address >= sp {
+		return
+	}
+
+	bottom := uint32(0)
+	if cpu.memoryMap != nil {
+		bottom = cpu.memoryMap.stackBottom()
+	} else if sp > stackWarnWindow {
+		bottom = sp - stackWarnWindow
+	}
+	if effect.Address < bottom {
+		return
+	}
+
+	if effect.Write {
+		cpu.stackWarning(fmt.Sprintf("stores to 0x%04x, %d bytes below sp, where the next call can overwrite it", effect.Address, sp-effect.Address))
+	} else {
+		cpu.stackWarning(fmt.Sprintf("loads from 0x%04x, %d bytes below sp, which isn't on the stack", effect.Address, sp-effect.Address))
+	}
+}
@@ -0,0 +1,114 @@
+package riscv
+
+import "fmt"
+
+// why the cpu stopped running
+type StopReason int
+
+const (
+	StopNone       StopReason = iota
+	StopEnd                   // the program ended, see CPU.Termination
+	StopTrap                  // an exception with no handler, see State.Err
+	StopStepLimit             // the step budget or sandbox limit ran out
+	StopBreakpoint            // paused after an ebreak or before a breakpoint
+	StopWatch                 // paused by a watch hit
+	StopCanceled              // the run's context was done
+)
+
+var stopReasonNames = [...]string{"none", "end", "trap", "step limit", "breakpoint", "watch", "canceled"}
+
+func (reason StopReason) String() string {
+	if reason >= 0 && int(reason) < len(stopReasonNames) {
+		return stopReasonNames[reason]
+	}
+	return fmt.Sprintf("stop reason %d", int(reason))
+}
+
+// the architectural state of a CPU as a plain value. embedders should use
+// this over the exported fields, whose representation may change
+type State struct {
+	PC        uint32
+	Registers [32]int32
+	CSRs      map[uint16]int32 // every CSR in CSRList
+	Halted    bool
+	Stop      StopReason
+	Err       error
+}
+
+func (cpu *CPU) GetState() State {
+	state := State{
+		PC:        cpu.PC,
+		Registers: cpu.Registers,
+		CSRs:      make(map[uint16]int32, len(CSRList)),
+		Halted:    cpu.Done,
+		Err:       cpu.err,
+	}
+
+	for _, csr := range CSRList {
+		state.CSRs[csr.Address] = cpu.ReadCSR(csr.Address)
+	}
+
+	switch {
+	case cpu.err == ErrStepLimit:
+		state.Stop = StopStepLimit
+	case cpu.err == ErrCanceled:
+		state.Stop = StopCanceled
+	case cpu.err != nil:
+		state.Stop = StopTrap
+	case cpu.breakpoint, cpu.pausedAtBreakpoint:
+		state.Stop = StopBreakpoint
+	case len(cpu.watchHits) > 0:
+		state.Stop = StopWatch
+	case cpu.Done:
+		state.Stop = StopEnd
+	}
+
+	return state
+}
+
+// sets the pc, registers and any CSRs in the state, leaving CSRs missing from
+// the map alone. Halted, Stop and Err are ignored: the cpu resumes from the
+// new pc. nothing is changed if the state is invalid
+func (cpu *CPU) SetState(state State) error {
+	if state.PC%cpu.instrAlign() != 0 {
+		return fmt.Errorf("pc %d is not aligned", state.PC)
+	}
+
+	if state.Registers[0] != 0 {
+		return fmt.Errorf("x0 must be 0, got %d", state.Registers[0])
+	}
+
+	for address := range state.CSRs {
+		if _, ok := csrName(address); !ok {
+			return fmt.Errorf("unknown csr 0x%03x", address)
+		}
+	}
+
+	// only values that differ from before are written, since the counters
+	// alias each other
+	before := cpu.GetState().CSRs
+
+	cpu.PC = state.PC
+	for register, value := range state.Registers {
+		if value != cpu.Registers[register] {
+			cpu.SetRegister(register, value)
+		}
+	}
+	for _, csr := range CSRList {
+		if value, ok := state.CSRs[csr.Address]; ok && value != before[csr.Address] {
+			cpu.SetCSR(csr.Address, value)
+		}
+	}
+
+	cpu.err = nil
+	cpu.breakpoint = false
+	cpu.pausedAtBreakpoint = false
+	cpu.watchHits = nil
+	cpu.termination, cpu.exitCode = TerminationNone, 0
+	// the caller has put the cpu where it wants it
+	cpu.started = true
+	_, inProgram := cpu.CurrentLine()
+	cpu.Done = !inProgram
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package riscv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var instrFormats = []string{"R", "I", "S", "B", "U", "J"}
+
+type ProgramStats struct {
+	Instructions int
+	CodeBytes    int
+	ByFormat     map[string]int
+}
+
+func (stats ProgramStats) String() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%d instructions, %d bytes", stats.Instructions, stats.CodeBytes))
+	for _, format := range instrFormats {
+		builder.WriteString(fmt.Sprintf(" %s:%d", format, stats.ByFormat[format]))
+	}
+	return builder.String()
+}
+
+var mnemonicRe = regexp.MustCompile(`^\s*([\w.]+)`)
+
+// machine instruction formats a decoded source line expands to
+func lineFormats(line string, instr Instr) []string {
+	if _, ok := instr.(*NoOp); ok {
+		return nil
+	}
+
+	mnemonic := mnemonicRe.FindStringSubmatch(line)
+	if len(mnemonic) != 2 {
+		return nil
+	}
+
+	if loadImm, ok := instr.(*LoadImmInstr); ok && mnemonic[1] == "li" {
+		// li only needs a lui when the value doesn't fit in addi's 12 bits
+		if loadImm.imm < -2048 || loadImm.imm > 2047 {
+			return []string{"U", "I"}
+		}
+		return []string{"I"}
+	}
+
+	if spec, ok := lookupSpec(atomicMnemonic(mnemonic[1])); ok {
+		return []string{spec.Format}
+	}
+	return nil
+}
+
+// size and format breakdown of the currently loaded program
+func (cpu *CPU) Stats() ProgramStats {
+	stats := ProgramStats{ByFormat: make(map[string]int)}
+
+	for instr_num, instr := range cpu.program {
+		_, line := splitLabels(stripComment(cpu.instructions[cpu.sourceLines[instr_num]]))
+		for _, format := range lineFormats(line, instr) {
+			stats.Instructions++
+			stats.CodeBytes += int(instrSize(instr))
+			stats.ByFormat[format]++
+		}
+	}
+
+	return stats
+}
+
+// an instruction's place in the program
+type ListingEntry struct {
+	Address uint32
+	Size    uint32 // 2 for compressed instructions, otherwise 4
+	Line    int    // 1-based source line
+	Source  string
+}
+
+// every instruction of the program in address order
+func (cpu *CPU) Listing() []ListingEntry {
+	listing := make([]ListingEntry, len(cpu.program))
+	for instr_num, instr := range cpu.program {
+		listing[instr_num] = ListingEntry{
+			Address: cpu.addresses[instr_num],
+			Size:    instrSize(instr),
+			Line:    cpu.sourceLine(cpu.sourceLines[instr_num]),
+			Source:  cpu.sourceText(instr_num),
+		}
+	}
+	return listing
+}
@@ -0,0 +1,76 @@
+package riscv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// returned by Step once the program has ended
+var ErrHalted = errors.New("the program has ended")
+
+// what one Step did
+type StepResult struct {
+	PC          uint32 // of the instruction that ran
+	Line        int    // its 1-based source line
+	Instruction string // its source, empty when nothing ran
+	Registers   []RegisterWrite
+	Memory      []MemoryEffect
+	// the exception the instruction raised, if a handler took it or it was
+	// an ebreak that paused the run. One that halts the program is the error
+	// instead.
+	Trap *Trap
+	// the pc went to mtvec for an interrupt instead of running an
+	// instruction
+	Interrupted bool
+	NextPC      uint32
+	Stop        StopReason
+}
+
+// runs the next instruction and says what it did. The error is ErrHalted when
+// the program had already ended, the trap that halted it when an exception had
+// no handler, and an internal error, which also halts the program, if the
+// interpreter itself went wrong. Step doesn't panic and doesn't stop for
+// breakpoints.
+func (cpu *CPU) Step() (result StepResult, err error) {
+	if cpu.Done {
+		return StepResult{PC: cpu.PC, NextPC: cpu.PC, Stop: cpu.GetState().Stop}, ErrHalted
+	}
+
+	// a run that ran out of steps or was canceled carries on
+	if cpu.err == ErrStepLimit || cpu.err == ErrCanceled {
+		cpu.err = nil
+	}
+
+	result.PC = cpu.PC
+	result.Line, _ = cpu.LineOfAddress(cpu.PC)
+	cpu.lastTrap = nil
+	defer func() {
+		if r := recover(); r != nil {
+			cpu.err = fmt.Errorf("internal error at pc 0x%x: %v", result.PC, r)
+			cpu.Done = true
+			result.NextPC, result.Stop = cpu.PC, StopTrap
+			err = cpu.err
+		}
+	}()
+
+	trace, _ := cpu.recordTrace(cpu.RunNextInstruction)
+	// end the program now rather than on a Step that runs nothing
+	if !cpu.Done && cpu.err == nil && (cpu.PC < cpu.textBase() || cpu.PC >= cpu.programEnd()) {
+		cpu.endProgram()
+	}
+	if len(trace) > 0 {
+		entry := trace[len(trace)-1]
+		result.Instruction = entry.Instruction
+		result.Registers = entry.Registers
+		result.Memory = entry.Memory
+	}
+
+	state := cpu.GetState()
+	result.NextPC, result.Stop = state.PC, state.Stop
+	if state.Err != nil {
+		return result, state.Err
+	}
+	result.Trap = cpu.lastTrap
+	result.Interrupted = len(trace) == 0 && cpu.lastTrap == nil && !cpu.Done
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package riscv
+
+import "fmt"
+
+// what strict mode has seen written since the run started
+type strictState struct {
+	registers [32]bool
+	memory    []bool // per byte
+	warnings  []Diagnostic
+}
+
+// in strict mode runs warn when a program relies on something the
+// interpreter does differently from hardware: registers and memory starting
+// out as zero, code being kept out of memory, and running off the end of the
+// program halting it. The program still runs as usual.
+func (cpu *CPU) SetStrict(strict bool) {
+	if !strict {
+		cpu.strict = nil
+		return
+	}
+	if cpu.strict == nil {
+		cpu.strict = &strictState{}
+		cpu.resetStrict()
+	}
+}
+
+func (cpu *CPU) Strict() bool {
+	return cpu.strict != nil
+}
+
+// warnings from the current run, one per line and problem
+func (cpu *CPU) StrictWarnings() []Diagnostic {
+	if cpu.strict == nil {
+		return nil
+	}
+	return cpu.strict.warnings
+}
+
+// forgets what was written, keeping what the start of a run sets up
+func (cpu *CPU) resetStrict() {
+	strict := cpu.strict
+	strict.warnings = nil
+	strict.registers = [32]bool{}
+	for _, register := range []int{0, cpu.Arch.StackPointer(), cpu.Arch.ReturnAddress()} {
+		strict.registers[register] = true
+	}
+	strict.memory = make([]bool, len(cpu.Memory))
+
+	if cpu.hasArgs {
+		strict.registers[abiToRegister["a0"]] = true
+		strict.registers[abiToRegister["a1"]] = true
+		for address := uint32(cpu.Registers[cpu.Arch.StackPointer()]); address < cpu.argsTop; address++ {
+			strict.memory[address] = true
+		}
+	}
+}
+
+// a warning for the instruction at address
+func (cpu *CPU) strictWarning(address uint32, message string) {
+	line, _ := cpu.LineOfAddress(address)
+	warning := Diagnostic{Line: line, Message: message}
+	for _, existing := range cpu.strict.warnings {
+		if existing == warning {
+			return
+		}
+	}
+	cpu.strict.warnings = append(cpu.strict.warnings, warning)
+}
+
+// before an instruction runs, checks the registers it reads
+func (cpu *CPU) strictInstruction(instr Instr) {
+	_, sources := instrRegisters(instr)
+	names := cpu.Arch.RegisterNames()
+	for _, register := range sources {
+		if !cpu.strict.registers[register] {
+			cpu.strictWarning(cpu.PC, fmt.Sprintf("reads %s before anything is written to it, registers don't start at 0 on hardware", names[register]))
+		}
+	}
+}
+
+func (cpu *CPU) strictRegisterWritten(register int8) {
+	cpu.strict.registers[register] = true
+}
+
+func (cpu *CPU) strictMemory(effect MemoryEffect) {
+	if _, ok := cpu.deviceAt(effect.Address); ok {
+		return
+	}
+
+	if effect.Address < cpu.programEnd() && effect.Address+effect.Size > cpu.textBase() {
+		cpu.strictWarning(cpu.PC, fmt.Sprintf("accesses 0x%04x inside the program's code, which isn't kept in memory here", effect.Address))
+	}
+
+	end := min(effect.Address+effect.Size, uint32(len(cpu.strict.memory)))
+	for address := effect.Address; address < end; address++ {
+		if effect.Write {
+			cpu.strict.memory[address] = true
+		} else if !cpu.strict.memory[address] {
+			cpu.strictWarning(cpu.PC, fmt.Sprintf("loads from 0x%04x before anything is stored there, memory doesn't start at 0 on hardware", effect.Address))
+			return
+		}
+	}
+}
+
+// called as the cpu halts
+func (cpu *CPU) strictHalt() {
+	if len(cpu.addresses) == 0 || cpu.PC != cpu.programEnd() {
+		return
+	}
+	cpu.strictWarning(cpu.addresses[len(cpu.addresses)-1], "runs off the end of the program, hardware would carry on into whatever follows. Return from the entry function instead")
+}
@@ -0,0 +1,113 @@
+package riscv
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type SymbolKind int
+
+const (
+	SymbolText SymbolKind = iota // labels an instruction
+	SymbolData                   // labels anything else, e.g. the end of the program
+)
+
+func (kind SymbolKind) String() string {
+	if kind == SymbolText {
+		return "text"
+	}
+	return "data"
+}
+
+// a label of the loaded program
+type Symbol struct {
+	Name       string
+	Address    uint32
+	Kind       SymbolKind
+	Line       int   // 1-based line it is defined on
+	References []int // 1-based lines that use it, in order
+	// for labels in the data section, what follows the label and how many
+	// bytes there are up to the next one
+	Type DataType `json:",omitempty"`
+	Size uint32   `json:",omitempty"`
+}
+
+// e.g. "counter: word", "table: 4 words" or "message: string (6 bytes)"
+func (symbol Symbol) Describe() string {
+	switch {
+	case symbol.Type == DataNone:
+		return fmt.Sprintf("%s: %s", symbol.Name, symbol.Kind)
+	case symbol.Type == DataString || symbol.Type == DataSpace:
+		return fmt.Sprintf("%s: %s (%d bytes)", symbol.Name, symbol.Type, symbol.Size)
+	}
+
+	count := symbol.Size / symbol.Type.elementSize()
+	if count == 1 {
+		return fmt.Sprintf("%s: %s", symbol.Name, symbol.Type)
+	}
+	plural := symbol.Type.String() + "s"
+	if symbol.Type == DataHalf {
+		plural = "halves"
+	}
+	return fmt.Sprintf("%s: %d %s", symbol.Name, count, plural)
+}
+
+// a word that could name a label, numbers are told apart afterwards
+var symbolTokenRe = regexp.MustCompile(`[\w.$]+`)
+
+// the labels of the loaded program ordered by address then name. Numeric
+// local labels like 1: are left out.
+func (cpu *CPU) Symbols() []Symbol {
+	definitions := make(map[string]int)
+	references := make(map[string][]int)
+	for i, instr := range cpu.instructions {
+		defined, line := splitLabels(stripComment(instr))
+		for _, label := range defined {
+			if !numericLabelRe.MatchString(label) {
+				definitions[label] = cpu.sourceLine(i)
+			}
+		}
+
+		// the first word is the mnemonic or directive
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, token := range symbolTokenRe.FindAllString(strings.Join(fields[1:], " "), -1) {
+			if _, ok := cpu.Labels[token]; ok && !slices.Contains(references[token], cpu.sourceLine(i)) {
+				references[token] = append(references[token], cpu.sourceLine(i))
+			}
+		}
+	}
+
+	symbols := make([]Symbol, 0, len(definitions))
+	for name, line := range definitions {
+		address := cpu.Labels[name]
+		kind := SymbolData
+		if _, ok := cpu.instrIndex(address); ok {
+			kind = SymbolText
+		}
+		symbol := Symbol{Name: name, Address: address, Kind: kind, Line: line, References: references[name]}
+		if index := slices.IndexFunc(cpu.dataSymbols, func(data Symbol) bool { return data.Name == name }); index >= 0 {
+			symbol.Type, symbol.Size = cpu.dataSymbols[index].Type, cpu.dataSymbols[index].Size
+		}
+		symbols = append(symbols, symbol)
+	}
+
+	slices.SortFunc(symbols, func(a, b Symbol) int {
+		return cmp.Or(cmp.Compare(a.Address, b.Address), strings.Compare(a.Name, b.Name))
+	})
+	return symbols
+}
+
+func (cpu *CPU) Symbol(name string) (Symbol, bool) {
+	for _, symbol := range cpu.Symbols() {
+		if symbol.Name == name {
+			return symbol, true
+		}
+	}
+	return Symbol{}, false
+}
@@ -0,0 +1,90 @@
+package riscv
+
+import "io"
+
+// a7 numbers of the system calls ecall makes when no trap handler is
+// installed, the same as Linux's
+const (
+	SyscallRead  = 63
+	SyscallWrite = 64
+	SyscallExit  = 93
+	SyscallBrk   = 214
+)
+
+// Linux's errno values, whatever the host's are
+const (
+	errnoIO    = 5
+	errnoBADF  = 9
+	errnoFAULT = 14
+)
+
+// makes the system call in a7 with its arguments in a0 and up, leaving the
+// result in a0. Like Linux, a failed call returns -errno.
+func (cpu *CPU) syscall() {
+	a0 := int8(abiToRegister["a0"])
+	a1 := cpu.Registers[abiToRegister["a1"]]
+	a2 := cpu.Registers[abiToRegister["a2"]]
+	number := cpu.Registers[abiToRegister["a7"]]
+
+	switch number {
+	case SyscallRead:
+		cpu.setRegister(a0, cpu.readSyscall(cpu.Registers[a0], uint32(a1), a2))
+	case SyscallWrite:
+		cpu.setRegister(a0, cpu.writeSyscall(cpu.Registers[a0], uint32(a1), a2))
+	case SyscallExit:
+		cpu.terminate(TerminationExit, cpu.Registers[a0])
+	case SyscallBrk:
+		// sbrk(n) is brk(0) for the current break then brk(break+n)
+		cpu.setRegister(a0, int32(cpu.brk(uint32(cpu.Registers[a0]))))
+	default:
+		cpu.raise(ExcEnvironmentCall, uint32(number))
+	}
+}
+
+// read(0, buf, count) reads up to count bytes from the reader SetStdin gave,
+// returning 0 at the end of it or when there is none, and -EFAULT when the
+// count bytes at buf aren't all memory the program can write
+func (cpu *CPU) readSyscall(fd int32, buf uint32, count int32) int32 {
+	if fd != 0 {
+		return -errnoBADF
+	}
+	if count <= 0 || cpu.stdin == nil {
+		return 0
+	}
+	// a bad buffer fails before anything is read, so no input is lost
+	if !cpu.canStoreBlock(buf, uint32(count)) {
+		return -errnoFAULT
+	}
+
+	data := make([]byte, count)
+	n, err := cpu.stdin.Read(data)
+	if n == 0 && err != nil && err != io.EOF {
+		return -errnoIO
+	}
+	cpu.storeBlock(buf, data[:n])
+	return int32(n)
+}
+
+// write(1 or 2, buf, count) sends count bytes to the console or stderr streams
+func (cpu *CPU) writeSyscall(fd int32, buf uint32, count int32) int32 {
+	stream := StreamConsole
+	switch fd {
+	case 1:
+	case 2:
+		stream = StreamStderr
+	default:
+		return -errnoBADF
+	}
+
+	data := make([]byte, min(max(count, 0), int32(len(cpu.Memory))))
+	for i := range data {
+		data[i] = cpu.loadByte(buf + uint32(i))
+	}
+	cpu.emit(stream, data)
+	return int32(len(data))
+}
+
+// where the read system call reads standard input from, nil for none
+func (cpu *CPU) SetStdin(r io.Reader) {
+	cpu.stdin = r
+}
@@ -0,0 +1,50 @@
+package riscv
+
+import "fmt"
+
+// how a program ended
+type Termination int
+
+const (
+	TerminationNone   Termination = iota // still running, or stopped some other way
+	TerminationEnd                       // ran past its last instruction
+	TerminationReturn                    // the entry function returned
+	TerminationExit                      // made the exit system call
+)
+
+var terminationNames = [...]string{"not ended", "ran off the end", "returned from the entry function", "called exit"}
+
+func (termination Termination) String() string {
+	if termination >= 0 && int(termination) < len(terminationNames) {
+		return terminationNames[termination]
+	}
+	return fmt.Sprintf("termination %d", int(termination))
+}
+
+// how the program ended, TerminationNone while it hasn't or when a trap
+// stopped it. The final state stays as it was until Restart.
+func (cpu *CPU) Termination() Termination {
+	return cpu.termination
+}
+
+// the program's exit status once it has ended: what it passed to exit, a0
+// when the entry function returned, like main returning to the C runtime, and
+// 0 when it ran off the end. false until it ends.
+func (cpu *CPU) ExitCode() (int32, bool) {
+	return cpu.exitCode, cpu.termination != TerminationNone
+}
+
+func (cpu *CPU) terminate(termination Termination, code int32) {
+	cpu.termination, cpu.exitCode = termination, code
+	cpu.halt()
+}
+
+// ends the program now that the pc has left it: through the exit address the
+// entry function returns to, or off the end
+func (cpu *CPU) endProgram() {
+	if cpu.PC == exitAddress && cpu.started {
+		cpu.terminate(TerminationReturn, cpu.Registers[abiToRegister["a0"]])
+		return
+	}
+	cpu.terminate(TerminationEnd, 0)
+}
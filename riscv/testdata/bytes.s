@@ -0,0 +1,9 @@
+// byte and half-word stores and loads
+        li      t0, 127
+        sb      t0, 64(zero)
+        li      t1, 1000
+        sh      t1, 66(zero)
+        lbu     a0, 64(zero)
+        lhu     a1, 66(zero)
+        slti    a2, a1, 1001
+        sltiu   a3, a1, 5
@@ -0,0 +1,14 @@
+// add, ported from riscv-arch-test rv32i_m/I/add-01
+.bookmark signature 0x1000 0x1010
+        li      s0, 0x1000
+        li      t0, 0x7fffffff
+        li      t1, 1
+        add     t2, t0, t1
+        sw      t2, 0(s0)
+        li      t0, -1
+        add     t2, t0, t0
+        sw      t2, 4(s0)
+        add     t2, zero, zero
+        sw      t2, 8(s0)
+        add     zero, t0, t1
+        sw      zero, 12(s0)
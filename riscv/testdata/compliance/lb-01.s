@@ -0,0 +1,18 @@
+// lb and lbu, ported from riscv-arch-test rv32i_m/I/lb-align-01
+.bookmark signature 0x1000 0x1010
+        li      s0, 0x1000
+        li      s1, 0x1100
+        li      t0, 0x80
+        sb      t0, 0(s1)
+        li      t0, 0x7f
+        sb      t0, 1(s1)
+        li      t0, -1
+        sb      t0, 2(s1)
+        lb      a0, 0(s1)
+        lb      a1, 1(s1)
+        lbu     a2, 0(s1)
+        lb      a3, 2(s1)
+        sw      a0, 0(s0)
+        sw      a1, 4(s0)
+        sw      a2, 8(s0)
+        sw      a3, 12(s0)
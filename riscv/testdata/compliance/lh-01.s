@@ -0,0 +1,18 @@
+// lh and lhu, ported from riscv-arch-test rv32i_m/I/lh-align-01
+.bookmark signature 0x1000 0x1010
+        li      s0, 0x1000
+        li      s1, 0x1100
+        li      t0, -32768
+        sh      t0, 0(s1)
+        li      t0, 0x1234
+        sh      t0, 2(s1)
+        li      t0, -1
+        sh      t0, 4(s1)
+        lh      a0, 0(s1)
+        lh      a1, 2(s1)
+        lhu     a2, 0(s1)
+        lh      a3, 4(s1)
+        sw      a0, 0(s0)
+        sw      a1, 4(s0)
+        sw      a2, 8(s0)
+        sw      a3, 12(s0)
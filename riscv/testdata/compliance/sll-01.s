@@ -0,0 +1,20 @@
+// sll, srl and sra use the low 5 bits of rs2, ported from riscv-arch-test
+// rv32i_m/I/sll-01, srl-01 and sra-01
+.bookmark signature 0x1000 0x1014
+        li      s0, 0x1000
+        li      t0, 1
+        li      t1, 33
+        sll     a0, t0, t1
+        li      t1, 31
+        sll     a1, t0, t1
+        srl     a2, a1, t1
+        li      t1, 32
+        sll     a3, t0, t1
+        li      t0, -16
+        li      t1, 33
+        sra     a4, t0, t1
+        sw      a0, 0(s0)
+        sw      a1, 4(s0)
+        sw      a2, 8(s0)
+        sw      a3, 12(s0)
+        sw      a4, 16(s0)
@@ -0,0 +1,13 @@
+// sltu, slt and sltiu, ported from riscv-arch-test rv32i_m/I/sltu-01
+.bookmark signature 0x1000 0x1010
+        li      s0, 0x1000
+        li      t0, -1
+        li      t1, 1
+        sltu    a0, t0, t1
+        sltu    a1, t1, t0
+        slt     a2, t0, t1
+        sltiu   a3, zero, 1
+        sw      a0, 0(s0)
+        sw      a1, 4(s0)
+        sw      a2, 8(s0)
+        sw      a3, 12(s0)
@@ -0,0 +1,11 @@
+# sums 1..10 into a0 and stores the running totals into an array at 0x100
+        li      a0, 0
+        li      t0, 1
+        li      t1, 11
+        li      t2, 256
+loop:
+        add     a0, a0, t0
+        sw      a0, 0(t2)
+        addi    t2, t2, 4
+        addi    t0, t0, 1
+        blt     t0, t1, loop
@@ -0,0 +1,249 @@
+package riscv
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type TraceFormat int
+
+const (
+	// one JSON object per line
+	TraceJSON TraceFormat = iota
+	// a header row, then one row per instruction
+	TraceCSV
+	// a text log in the style of spike's commit log
+	TraceSpike
+)
+
+func ParseTraceFormat(format string) (TraceFormat, error) {
+	switch strings.ToLower(format) {
+	case "json":
+		return TraceJSON, nil
+	case "csv":
+		return TraceCSV, nil
+	case "spike", "text":
+		return TraceSpike, nil
+	}
+	return 0, fmt.Errorf("unknown trace format: %s", format)
+}
+
+func (format TraceFormat) String() string {
+	switch format {
+	case TraceCSV:
+		return "csv"
+	case TraceSpike:
+		return "spike"
+	}
+	return "json"
+}
+
+type RegisterWrite struct {
+	Register int
+	Value    int32
+}
+
+type MemoryEffect struct {
+	Write   bool
+	Address uint32
+	Size    uint32
+	Value   int32
+}
+
+// everything one instruction did. Instruction is the source with comments
+// and extra spaces removed, and Trap is set when the instruction faulted
+// instead of retiring.
+type TraceEntry struct {
+	Hart        int
+	Step        uint64
+	PC          uint32
+	Instruction string
+	Registers   []RegisterWrite `json:",omitempty"`
+	Memory      []MemoryEffect  `json:",omitempty"`
+	Trap        string          `json:",omitempty"`
+}
+
+// the most instructions recordTrace keeps, so a long run can't use up memory
+const maxRecordedTrace = 1 << 20
+
+type tracer struct {
+	format  TraceFormat
+	w       io.Writer // nil when only recording
+	csv     *csv.Writer
+	current *TraceEntry
+	err     error
+	// entries kept for recordTrace, up to maxRecordedTrace
+	record    bool
+	entries   []TraceEntry
+	truncated bool
+}
+
+// writes every instruction executed from now on to w. Only the first write
+// error is kept, and it is returned by DisableTrace.
+func (cpu *CPU) EnableTrace(w io.Writer, format TraceFormat) error {
+	return cpu.enableTrace(w, format, true)
+}
+
+func (cpu *CPU) enableTrace(w io.Writer, format TraceFormat, header bool) error {
+	if format < TraceJSON || format > TraceSpike {
+		return fmt.Errorf("unknown trace format: %d", format)
+	}
+
+	trace := &tracer{format: format, w: w}
+	if format == TraceCSV {
+		trace.csv = csv.NewWriter(w)
+	}
+	if format == TraceCSV && header {
+		trace.csv.Write([]string{"hart", "step", "pc", "instruction", "registers", "memory", "trap"})
+		trace.csv.Flush()
+		trace.err = trace.csv.Error()
+	}
+	cpu.tracer = trace
+	return nil
+}
+
+func (cpu *CPU) DisableTrace() error {
+	if cpu.tracer == nil {
+		return nil
+	}
+	err := cpu.tracer.err
+	cpu.tracer = nil
+	return err
+}
+
+// calls run, keeping every instruction it executes. A trace enabled with
+// EnableTrace is still written.
+func (cpu *CPU) recordTrace(run func()) ([]TraceEntry, bool) {
+	saved := cpu.tracer
+	recorder := &tracer{record: true}
+	if saved != nil {
+		recorder = &tracer{format: saved.format, w: saved.w, csv: saved.csv, err: saved.err, record: true}
+	}
+
+	cpu.tracer = recorder
+	defer func() {
+		cpu.tracer = saved
+		if saved != nil {
+			saved.err = recorder.err
+		}
+	}()
+	run()
+	return recorder.entries, recorder.truncated
+}
+
+func (cpu *CPU) traceStart(instr_num int) {
+	if cpu.tracer == nil {
+		return
+	}
+	cpu.tracer.current = &TraceEntry{
+		Hart:        int(cpu.ReadCSR(CSRMhartid)),
+		Step:        cpu.instret,
+		PC:          cpu.PC,
+		Instruction: cpu.sourceText(instr_num),
+	}
+}
+
+func (cpu *CPU) traceRegister(register int8, value int32) {
+	if cpu.tracer == nil || cpu.tracer.current == nil {
+		return
+	}
+	entry := cpu.tracer.current
+	entry.Registers = append(entry.Registers, RegisterWrite{Register: int(register), Value: value})
+}
+
+func (cpu *CPU) traceMemory(effect MemoryEffect) {
+	if cpu.tracer == nil || cpu.tracer.current == nil {
+		return
+	}
+	entry := cpu.tracer.current
+	entry.Memory = append(entry.Memory, effect)
+}
+
+func (cpu *CPU) traceEnd(trap *Trap) {
+	if cpu.tracer == nil || cpu.tracer.current == nil {
+		return
+	}
+	entry := cpu.tracer.current
+	cpu.tracer.current = nil
+	if trap != nil {
+		entry.Trap = trap.Cause.String()
+	}
+
+	if cpu.tracer.record {
+		if len(cpu.tracer.entries) < maxRecordedTrace {
+			cpu.tracer.entries = append(cpu.tracer.entries, *entry)
+		} else {
+			cpu.tracer.truncated = true
+		}
+	}
+	if cpu.tracer.w == nil {
+		return
+	}
+
+	if err := cpu.tracer.write(entry, cpu.Arch.RegisterNames()); err != nil && cpu.tracer.err == nil {
+		cpu.tracer.err = err
+	}
+}
+
+func (trace *tracer) write(entry *TraceEntry, names []string) error {
+	switch trace.format {
+	case TraceCSV:
+		var registers, memory []string
+		for _, write := range entry.Registers {
+			registers = append(registers, fmt.Sprintf("%s=%d", names[write.Register], write.Value))
+		}
+		for _, effect := range entry.Memory {
+			memory = append(memory, effect.String())
+		}
+		trace.csv.Write([]string{
+			strconv.Itoa(entry.Hart),
+			strconv.FormatUint(entry.Step, 10),
+			fmt.Sprintf("0x%08x", entry.PC),
+			entry.Instruction,
+			strings.Join(registers, " "),
+			strings.Join(memory, " "),
+			entry.Trap,
+		})
+		trace.csv.Flush()
+		return trace.csv.Error()
+	case TraceSpike:
+		var builder strings.Builder
+		fmt.Fprintf(&builder, "core %3d: 3 0x%08x (%s)", entry.Hart, entry.PC, entry.Instruction)
+		for _, write := range entry.Registers {
+			fmt.Fprintf(&builder, " x%-2d 0x%08x", write.Register, uint32(write.Value))
+		}
+		for _, effect := range entry.Memory {
+			if effect.Write {
+				fmt.Fprintf(&builder, " mem 0x%08x 0x%0*x", effect.Address, effect.Size*2, uint32(effect.Value)&sizeMask(effect.Size))
+			} else {
+				fmt.Fprintf(&builder, " mem 0x%08x", effect.Address)
+			}
+		}
+		if entry.Trap != "" {
+			fmt.Fprintf(&builder, " trap %s", entry.Trap)
+		}
+		builder.WriteString("\n")
+		_, err := io.WriteString(trace.w, builder.String())
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = trace.w.Write(append(data, '\n'))
+	return err
+}
+
+// e.g. "w4@0x00000020=10" for a word stored to 0x20
+func (effect MemoryEffect) String() string {
+	kind := "r"
+	if effect.Write {
+		kind = "w"
+	}
+	return fmt.Sprintf("%s%d@0x%08x=%d", kind, effect.Size, effect.Address, effect.Value)
+}
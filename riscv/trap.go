@@ -0,0 +1,114 @@
+package riscv
+
+import "fmt"
+
+// mcause exception codes
+type Exception int32
+
+const (
+	ExcInstrMisaligned    Exception = 0
+	ExcIllegalInstruction Exception = 2
+	ExcBreakpoint         Exception = 3
+	ExcLoadMisaligned     Exception = 4
+	ExcLoadAccessFault    Exception = 5
+	ExcStoreMisaligned    Exception = 6
+	ExcStoreAccessFault   Exception = 7
+	ExcEnvironmentCall    Exception = 11 // from machine mode
+)
+
+var exceptionNames = map[Exception]string{
+	ExcInstrMisaligned:    "instruction address misaligned",
+	ExcIllegalInstruction: "illegal instruction",
+	ExcBreakpoint:         "breakpoint",
+	ExcLoadMisaligned:     "load address misaligned",
+	ExcLoadAccessFault:    "load access fault",
+	ExcStoreMisaligned:    "store address misaligned",
+	ExcStoreAccessFault:   "store access fault",
+	ExcEnvironmentCall:    "environment call",
+}
+
+func (exc Exception) String() string {
+	if name, ok := exceptionNames[exc]; ok {
+		return name
+	}
+	return fmt.Sprintf("exception %d", int32(exc))
+}
+
+// an exception raised by an instruction, Value is what ends up in mtval
+type Trap struct {
+	Cause Exception
+	PC    uint32
+	Value uint32
+	Line  int // 1-based source line of the instruction, 0 if unknown
+}
+
+func (trap *Trap) Error() string {
+	message := trap.Cause.String()
+	switch trap.Cause {
+	case ExcInstrMisaligned, ExcLoadMisaligned, ExcLoadAccessFault, ExcStoreMisaligned, ExcStoreAccessFault:
+		message = fmt.Sprintf("%s at address %d", message, trap.Value)
+	case ExcEnvironmentCall:
+		message = fmt.Sprintf("unknown system call %d", trap.Value)
+	}
+
+	if trap.Line != 0 {
+		return fmt.Sprintf("line %d: %s", trap.Line, message)
+	}
+	return fmt.Sprintf("pc %d: %s", trap.PC, message)
+}
+
+// aborts the current instruction, RunNextInstruction recovers the trap
+func (cpu *CPU) raise(cause Exception, value uint32) {
+	panic(&Trap{Cause: cause, PC: cpu.PC, Value: value})
+}
+
+func (cpu *CPU) checkJumpTarget(target uint32) {
+	if target%cpu.instrAlign() != 0 {
+		cpu.raise(ExcInstrMisaligned, target)
+	}
+}
+
+// runs an instruction, returning the trap it raised if any
+func (cpu *CPU) execute(instr Instr) (trap *Trap) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if trap, ok = r.(*Trap); !ok {
+				panic(r)
+			}
+		}
+	}()
+
+	cpu.Arch.Execute(cpu, instr)
+	return nil
+}
+
+// vectors to mtvec when a handler is installed, otherwise a breakpoint
+// pauses the run and anything else halts with the trap as the error
+func (cpu *CPU) takeTrap(trap *Trap) {
+	trap.Line, _ = cpu.LineOfAddress(trap.PC)
+	cpu.lastTrap = trap
+
+	if vector := uint32(cpu.csrs[CSRMtvec]); vector != 0 {
+		cpu.csrs[CSRMepc] = int32(trap.PC)
+		cpu.csrs[CSRMcause] = int32(trap.Cause)
+		cpu.csrs[CSRMtval] = int32(trap.Value)
+		cpu.enterTrap()
+		cpu.PC = vector &^ 3
+		return
+	}
+
+	if trap.Cause == ExcBreakpoint {
+		cpu.PC = cpu.nextPC()
+		cpu.breakpoint = true
+		return
+	}
+
+	cpu.err = trap
+	cpu.halt()
+}
+
+// whether the last instruction was an ebreak with no trap handler installed
+func (cpu *CPU) AtBreakpoint() bool {
+	return cpu.breakpoint
+}
@@ -0,0 +1,95 @@
+package riscv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// breaks execution when a register changes or memory in [Start, End) is written
+type Watch struct {
+	ID         int
+	Expression string
+	IsRegister bool
+	Register   int8
+	Start      uint32
+	End        uint32
+}
+
+type WatchHit struct {
+	Watch   Watch
+	PC      uint32
+	Address uint32
+	Old     int32
+	New     int32
+}
+
+func (hit WatchHit) String() string {
+	if hit.Watch.IsRegister {
+		return fmt.Sprintf("watch %d: %s changed %d -> %d at pc %d", hit.Watch.ID, hit.Watch.Expression, hit.Old, hit.New, hit.PC)
+	}
+	return fmt.Sprintf("watch %d: %s written with %d at address %d, pc %d", hit.Watch.ID, hit.Watch.Expression, hit.New, hit.Address, hit.PC)
+}
+
+// expression is a register name, a bookmark name, an address or a "start-end"
+// address range. Returns the id of the new watch.
+func (cpu *CPU) AddWatch(expression string) (int, error) {
+	expression = strings.TrimSpace(expression)
+	watch := Watch{Expression: expression}
+
+	if register, ok := cpu.Arch.RegisterNumber(expression); ok {
+		watch.IsRegister = true
+		watch.Register = int8(register)
+	} else {
+		start, end, err := cpu.ResolveRange(expression)
+		if err != nil {
+			return 0, err
+		}
+		watch.Start = start
+		watch.End = end
+	}
+
+	cpu.nextWatchID++
+	watch.ID = cpu.nextWatchID
+	cpu.watches = append(cpu.watches, watch)
+
+	return watch.ID, nil
+}
+
+func (cpu *CPU) RemoveWatch(id int) error {
+	for i, watch := range cpu.watches {
+		if watch.ID == id {
+			cpu.watches = append(cpu.watches[:i], cpu.watches[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no watch with id %d", id)
+}
+
+func (cpu *CPU) Watches() []Watch {
+	return cpu.watches
+}
+
+// watches triggered by the last instruction
+func (cpu *CPU) WatchHits() []WatchHit {
+	return cpu.watchHits
+}
+
+func (cpu *CPU) checkRegisterWatches(register int8, old, new int32) {
+	if old == new {
+		return
+	}
+
+	for _, watch := range cpu.watches {
+		if watch.IsRegister && watch.Register == register {
+			cpu.watchHits = append(cpu.watchHits, WatchHit{Watch: watch, PC: cpu.PC, Old: old, New: new})
+		}
+	}
+}
+
+func (cpu *CPU) checkMemoryWatches(address uint32, size uint32, value int32) {
+	for _, watch := range cpu.watches {
+		if !watch.IsRegister && address < watch.End && address+size > watch.Start {
+			cpu.watchHits = append(cpu.watchHits, WatchHit{Watch: watch, PC: cpu.PC, Address: address, New: value})
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+)
+
+// the run "diff" compares the next one with
+type runDiff struct {
+	start *riscv.CPUState // the registers and memory both runs start from
+	base  *riscv.CPUState
+}
+
+// "diff base" runs the program and keeps the run, and "diff" runs it again
+// from the same registers and memory, after an edit or with other input, and
+// compares the two. Only the first hart runs. Returns the report to show.
+func parseDiffCommand(cpu *riscv.CPU, instrs []string, command string, runs *runDiff) (string, bool) {
+	switch strings.TrimSpace(command) {
+	case "diff base":
+		cpu.LoadInstructions(instrs)
+		start := cpu.CaptureState()
+		base := cpu.RecordRun(context.Background())
+		runs.start, runs.base = &start, &base
+		return fmt.Sprintf("recorded a run of %d instructions. Edit the program or its input, then enter diff to run it again and compare\n", len(base.Trace)), true
+	case "diff":
+		if runs.base == nil {
+			return "enter diff base first to record the run to compare with\n", true
+		}
+		cpu.LoadInstructions(instrs)
+		if err := cpu.RestoreState(*runs.start); err != nil {
+			return err.Error(), true
+		}
+		after := cpu.RecordRun(context.Background())
+		report := riscv.DiffStates(*runs.base, after).String()
+		if runs.base.TraceTruncated || after.TraceTruncated {
+			report += "the traces were too long to keep whole, so a later difference in them may be missed\n"
+		}
+		return report, true
+	}
+	return "", false
+}
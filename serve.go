@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+	"github.com/ckashino/riscv_interpreter/riscv/server"
+)
+
+// serves the JSON-RPC API at /rpc on localhost until the process is stopped,
+// with file loaded if there is one
+func runServe(machine *riscv.Machine, file string, port int, allowOrigin string) error {
+	if _, _, err := machine.MapStandardDevices(); err != nil {
+		return err
+	}
+
+	handler := server.New(machine)
+	handler.AllowOrigin = allowOrigin
+	if file != "" {
+		source, err := loadSource(file)
+		if err != nil {
+			return err
+		}
+		machine.LoadInstructions(strings.Split(source, "\n"))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", handler)
+
+	address := fmt.Sprintf("localhost:%d", port)
+	fmt.Fprintf(os.Stderr, "serving JSON-RPC at http://%s/rpc\n", address)
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ckashino/riscv_interpreter/riscv"
+	"github.com/ckashino/riscv_interpreter/riscv/debug"
+)
+
+// writes what the debugger recorded to path, for --record
+func saveSession(debugger *debug.Debugger, path string) error {
+	session := debugger.StopRecording()
+	if session == nil {
+		return nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := session.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replays the session in path without the interface and writes it to out as
+// an annotated transcript. Returns whether every command showed what it did
+// when it was recorded.
+func runReplay(machine *riscv.Machine, path string, out, console, stderr io.Writer) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	session, err := debug.ReadSession(file)
+	file.Close()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+
+	uart, _, err := machine.MapStandardDevices()
+	if err != nil {
+		return false, err
+	}
+	attachProgramOutput(machine, console, stderr)
+
+	debugger := debug.New(machine)
+	debugger.UART = uart
+	replayed := debugger.Replay(context.Background(), session)
+	if err := debug.WriteTranscript(out, replayed); err != nil {
+		return false, err
+	}
+
+	same := true
+	for _, action := range replayed {
+		same = same && !action.Diverged()
+	}
+	return same, nil
+}